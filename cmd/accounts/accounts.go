@@ -0,0 +1,105 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	dryRun bool
+
+	accountsCmd = &cobra.Command{
+		Use:   "accounts",
+		Short: "Manage user accounts",
+		Long:  `Manage user accounts`,
+	}
+
+	pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove unverified accounts",
+		Long:  `Send reminders to and delete accounts that never verified their email address`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return prune()
+		},
+	}
+)
+
+func init() {
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report accounts that would be reminded or deleted")
+	pruneCmd.Flags().Int("max-age", 0, "delete unverified accounts older than this many days")
+	viper.BindPFlag("accounts.unverified_max_age", pruneCmd.Flags().Lookup("max-age"))
+	pruneCmd.Flags().Int("reminder-age", 0, "send reminder to unverified accounts older than this many days")
+	viper.BindPFlag("accounts.unverified_reminder_age", pruneCmd.Flags().Lookup("reminder-age"))
+
+	accountsCmd.AddCommand(pruneCmd)
+	cmd.Root.AddCommand(accountsCmd)
+}
+
+func prune() error {
+	if viper.GetInt("accounts.unverified_max_age") <= 0 {
+		return errors.New("Please set max age for unverified accounts")
+	}
+
+	if viper.GetInt("accounts.unverified_reminder_age") > 0 && viper.GetString("email.base_url") == "" {
+		return errors.New("Please set email.base_url to send reminder emails")
+	}
+
+	client, err := server.NewAdminClient()
+	if err != nil {
+		return err
+	}
+
+	storage := server.NewStorage()
+	if storage == nil {
+		return errors.New("Failed to open mokey storage database")
+	}
+	defer storage.Close()
+
+	if !server.PersistentStorage(storage) {
+		return server.ErrPruneStorage
+	}
+
+	emailer, err := server.NewEmailer(storage)
+	if err != nil {
+		return err
+	}
+
+	auditLog, err := server.NewAuditLogger()
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	webhooks, flush, err := cmd.StartWebhooks()
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	pruner := server.NewAccountPruner(client, emailer, storage, auditLog, webhooks)
+	pruner.DryRun = dryRun
+
+	result, err := pruner.Run()
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "[dry-run] "
+	}
+
+	for _, username := range result.Reminded {
+		fmt.Printf("%sreminded: %s\n", prefix, username)
+	}
+	for _, username := range result.Deleted {
+		fmt.Printf("%sdeleted: %s\n", prefix, username)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Manage the audit log",
+		Long:  `Manage the audit log`,
+	}
+
+	verifyCmd = &cobra.Command{
+		Use:   "verify [file...]",
+		Short: "Verify the audit log hash chain",
+		Long:  `Verify the hash chain of the audit log to detect deleted or modified events. Files are checked in the order given, oldest first. With no files the configured audit.file and its rotated backups are checked`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return verify(args)
+		},
+	}
+)
+
+func init() {
+	auditCmd.AddCommand(verifyCmd)
+	cmd.Root.AddCommand(auditCmd)
+}
+
+func verify(files []string) error {
+	if len(files) == 0 {
+		path := viper.GetString("audit.file")
+		if path == "" {
+			return errors.New("Please set audit.file or provide the audit log files to verify")
+		}
+		files = server.AuditLogFiles(path)
+	}
+
+	key, err := server.AuditKey()
+	if err != nil {
+		return err
+	}
+
+	res, err := server.VerifyAuditLog(files, key)
+	if err != nil {
+		return fmt.Errorf("Audit log verification failed after %d events: %w", res.Events, err)
+	}
+
+	if res.Events == 0 {
+		fmt.Println("No audit events found")
+		return nil
+	}
+
+	fmt.Printf("OK %d events verified (seq %d-%d)\n", res.Events, res.FirstSeq, res.LastSeq)
+	return nil
+}
@@ -0,0 +1,218 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	all  bool
+	dead bool
+
+	mailCmd = &cobra.Command{
+		Use:     "mail",
+		Aliases: []string{"email"},
+		Short:   "Manage outbound email",
+		Long:    `Manage outbound email`,
+	}
+
+	queueCmd = &cobra.Command{
+		Use:   "queue",
+		Short: "Manage the email queue",
+		Long:  `Inspect, retry, and purge emails in the outbound email queue`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return list()
+		},
+	}
+
+	listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List queued and dead letter emails",
+		Long:  `List emails waiting to be delivered and emails in the dead letter list`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return list()
+		},
+	}
+
+	retryCmd = &cobra.Command{
+		Use:   "retry [id...]",
+		Short: "Retry dead letter emails",
+		Long:  `Move emails from the dead letter list back to the queue`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return retry(args)
+		},
+	}
+
+	purgeCmd = &cobra.Command{
+		Use:   "purge [id...]",
+		Short: "Delete queued emails",
+		Long:  `Delete emails from the queue or dead letter list`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return purge(args)
+		},
+	}
+)
+
+func init() {
+	retryCmd.Flags().BoolVar(&all, "all", false, "retry all dead letter emails")
+	purgeCmd.Flags().BoolVar(&dead, "dead", false, "purge all dead letter emails")
+	purgeCmd.Flags().BoolVar(&all, "all", false, "purge all queued and dead letter emails")
+
+	queueCmd.AddCommand(listCmd)
+	queueCmd.AddCommand(retryCmd)
+	queueCmd.AddCommand(purgeCmd)
+	mailCmd.AddCommand(queueCmd)
+	cmd.Root.AddCommand(mailCmd)
+}
+
+func newQueue() (*server.MailQueue, func(), error) {
+	storage := server.NewStorage()
+	if storage == nil {
+		return nil, nil, errors.New("Failed to open mokey storage database")
+	}
+
+	if !server.PersistentStorage(storage) {
+		storage.Close()
+		return nil, nil, server.ErrMailQueueStorage
+	}
+
+	transport, err := server.NewMailTransport()
+	if err != nil {
+		storage.Close()
+		return nil, nil, err
+	}
+
+	return server.NewMailQueue(transport, storage), func() { storage.Close() }, nil
+}
+
+func subject(m *server.QueuedMail) string {
+	msg, err := mail.ReadMessage(strings.NewReader(string(m.Data)))
+	if err != nil {
+		return ""
+	}
+
+	return msg.Header.Get("Subject")
+}
+
+func list() error {
+	queue, done, err := newQueue()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	pending, err := queue.Pending()
+	if err != nil {
+		return err
+	}
+
+	deadLetters, err := queue.Dead()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued: %d\n", len(pending))
+	for _, m := range pending {
+		next := "now"
+		if time.Now().Before(m.NextAttempt) {
+			next = humanize.Time(m.NextAttempt)
+		}
+		fmt.Printf("  %s  %s  %q  attempts=%d next=%s\n", m.ID, strings.Join(m.To, ","), subject(m), m.Attempts, next)
+		if m.LastError != "" {
+			fmt.Printf("      error: %s\n", m.LastError)
+		}
+	}
+
+	fmt.Printf("Dead: %d\n", len(deadLetters))
+	for _, m := range deadLetters {
+		fmt.Printf("  %s  %s  %q  attempts=%d created=%s\n", m.ID, strings.Join(m.To, ","), subject(m), m.Attempts, humanize.Time(m.CreatedAt))
+		if m.LastError != "" {
+			fmt.Printf("      error: %s\n", m.LastError)
+		}
+	}
+
+	return nil
+}
+
+func retry(ids []string) error {
+	if len(ids) == 0 && !all {
+		return errors.New("Please provide email ids or --all")
+	}
+
+	queue, done, err := newQueue()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if all {
+		deadLetters, err := queue.Dead()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range deadLetters {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	for _, id := range ids {
+		if err := queue.Retry(id); err != nil {
+			return fmt.Errorf("Failed to retry %s: %w", id, err)
+		}
+		fmt.Printf("retrying: %s\n", id)
+	}
+
+	return nil
+}
+
+func purge(ids []string) error {
+	if len(ids) == 0 && !all && !dead {
+		return errors.New("Please provide email ids, --dead, or --all")
+	}
+
+	queue, done, err := newQueue()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if all {
+		pending, err := queue.Pending()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range pending {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	if all || dead {
+		deadLetters, err := queue.Dead()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range deadLetters {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	for _, id := range ids {
+		if err := queue.Purge(id); err != nil {
+			return fmt.Errorf("Failed to purge %s: %w", id, err)
+		}
+		fmt.Printf("purged: %s\n", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	format string
+	output string
+	lang   string
+	to     string
+
+	previewCmd = &cobra.Command{
+		Use:   "preview [template]",
+		Short: "Preview an email template",
+		Long:  `Render an email template with sample data. Templates in site.templates_dir/email override the built-in templates. With no template the available templates are listed`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			return preview(args)
+		},
+	}
+
+	testCmd = &cobra.Command{
+		Use:   "test [template...]",
+		Short: "Send test emails",
+		Long:  `Send email templates rendered with sample data through the configured transport. Sends all templates if none are given`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return test(args)
+		},
+	}
+)
+
+func init() {
+	previewCmd.Flags().StringVarP(&format, "format", "f", server.EmailFormatHTML, "format to render (html or txt)")
+	previewCmd.Flags().StringVarP(&output, "output", "o", "", "write to file instead of stdout")
+	previewCmd.Flags().StringVar(&lang, "lang", "", "language to render the template in")
+	testCmd.Flags().StringVar(&to, "to", "", "email address to send test emails to")
+	testCmd.Flags().StringVar(&lang, "lang", "", "language to render the templates in")
+	testCmd.MarkFlagRequired("to")
+
+	mailCmd.AddCommand(previewCmd)
+	mailCmd.AddCommand(testCmd)
+}
+
+func preview(args []string) error {
+	emailer, err := server.NewEmailer(nil)
+	if err != nil {
+		return fmt.Errorf("Failed to load email templates: %w", err)
+	}
+
+	if len(args) == 0 {
+		for _, name := range emailer.TemplateNames() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	out, err := emailer.RenderPreview(args[0], format, lang)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	return os.WriteFile(output, out, 0644)
+}
+
+func test(args []string) error {
+	emailer, err := server.NewEmailer(nil)
+	if err != nil {
+		return fmt.Errorf("Failed to load email templates: %w", err)
+	}
+
+	templates := args
+	if len(templates) == 0 {
+		templates = emailer.TemplateNames()
+	}
+
+	failed := 0
+	for _, name := range templates {
+		if err := emailer.SendTestEmail(name, to, lang); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", name, err)
+			continue
+		}
+		fmt.Printf("ok    %s\n", name)
+	}
+
+	if failed > 0 {
+		return errors.New("Failed to send one or more test emails")
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	dryRun bool
+
+	notifyCmd = &cobra.Command{
+		Use:   "notify",
+		Short: "Send notification emails",
+		Long:  `Send notification emails`,
+	}
+
+	passwordExpiryCmd = &cobra.Command{
+		Use:   "password-expiry",
+		Short: "Email users whose password will expire soon",
+		Long:  `Email users whose password expires within the configured thresholds. Each threshold is emailed once`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return passwordExpiry()
+		},
+	}
+)
+
+func init() {
+	passwordExpiryCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report users that would be emailed")
+	passwordExpiryCmd.Flags().IntSlice("thresholds", []int{14, 7, 1}, "email users whose password expires within these many days")
+	viper.BindPFlag("accounts.password_expiry_thresholds", passwordExpiryCmd.Flags().Lookup("thresholds"))
+
+	notifyCmd.AddCommand(passwordExpiryCmd)
+	cmd.Root.AddCommand(notifyCmd)
+}
+
+func passwordExpiry() error {
+	if viper.GetString("email.base_url") == "" {
+		return errors.New("Please set email.base_url to send password expiring emails")
+	}
+
+	client, err := server.NewAdminClient()
+	if err != nil {
+		return err
+	}
+
+	storage := server.NewStorage()
+	if storage == nil {
+		return errors.New("Failed to open mokey storage database")
+	}
+	defer storage.Close()
+
+	if !server.PersistentStorage(storage) {
+		return server.ErrPasswordExpiryStorage
+	}
+
+	emailer, err := server.NewEmailer(storage)
+	if err != nil {
+		return err
+	}
+
+	notifier := server.NewPasswordExpiryNotifier(client, emailer, storage)
+	notifier.DryRun = dryRun
+
+	if len(notifier.Thresholds) == 0 {
+		return errors.New("Please set at least one password expiry threshold")
+	}
+
+	result, err := notifier.Run()
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "[dry-run] "
+	}
+
+	for _, username := range result.Notified {
+		fmt.Printf("%snotified: %s\n", prefix, username)
+	}
+
+	return nil
+}
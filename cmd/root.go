@@ -6,6 +6,7 @@ import (
 	golog "log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -13,6 +14,9 @@ import (
 	"github.com/ubccr/mokey/server"
 )
 
+// Time to wait for webhook deliveries before a command exits
+const webhookFlushTimeout = time.Minute
+
 var (
 	cfgFile     string
 	cfgFileUsed string
@@ -43,6 +47,31 @@ func init() {
 	}
 }
 
+// StartWebhooks starts delivering webhook events emitted by a command. The
+// returned function waits for pending deliveries and must be called before
+// the command exits.
+func StartWebhooks() (*server.Webhooks, func(), error) {
+	webhooks, err := server.NewWebhooks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if webhooks == nil {
+		return nil, func() {}, nil
+	}
+
+	stop := make(chan struct{})
+	webhooks.Start(stop)
+
+	return webhooks, func() {
+		if !webhooks.Flush(webhookFlushTimeout) {
+			logrus.Warn("Timed out waiting for webhook deliveries")
+		}
+		close(stop)
+		webhooks.Wait()
+	}, nil
+}
+
 func SetupLogging() error {
 	switch logLevel {
 	case "trace":
@@ -0,0 +1,138 @@
+package sshca
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/cobra"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	krlFile string
+	serials []uint
+	keyIDs  []string
+	user    string
+
+	sshcaCmd = &cobra.Command{
+		Use:   "sshca",
+		Short: "Manage the ssh certificate authority",
+		Long:  `Manage the ssh certificate authority`,
+	}
+
+	krlCmd = &cobra.Command{
+		Use:   "krl",
+		Short: "Export the ssh Key Revocation List",
+		Long:  `Export revoked ssh certificates as an OpenSSH Key Revocation List for use with RevokedKeys in sshd_config`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return exportKRL()
+		},
+	}
+
+	revokeCmd = &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke ssh certificates",
+		Long:  `Revoke ssh certificates by serial, key ID, or all unexpired certificates issued to a user`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return revoke()
+		},
+	}
+)
+
+func init() {
+	krlCmd.Flags().StringVarP(&krlFile, "output", "o", "", "write KRL to file (default stdout)")
+	revokeCmd.Flags().UintSliceVar(&serials, "serial", nil, "certificate serial to revoke")
+	revokeCmd.Flags().StringSliceVar(&keyIDs, "key-id", nil, "certificate key ID to revoke")
+	revokeCmd.Flags().StringVar(&user, "user", "", "revoke all unexpired certificates issued to user")
+
+	sshcaCmd.AddCommand(krlCmd)
+	sshcaCmd.AddCommand(revokeCmd)
+	cmd.Root.AddCommand(sshcaCmd)
+}
+
+func newCA() (fiber.Storage, *server.SSHCA, error) {
+	storage := server.NewStorage()
+	if storage == nil {
+		return nil, nil, errors.New("Failed to open mokey storage database")
+	}
+
+	if !server.PersistentStorage(storage) {
+		storage.Close()
+		return nil, nil, server.ErrSSHCAStorage
+	}
+
+	ca, err := server.NewSSHCA(storage)
+	if err != nil {
+		storage.Close()
+		return nil, nil, err
+	}
+
+	return storage, ca, nil
+}
+
+func exportKRL() error {
+	storage, ca, err := newCA()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	krl, err := ca.KRL()
+	if err != nil {
+		return err
+	}
+
+	if krlFile == "" {
+		_, err = os.Stdout.Write(krl)
+		return err
+	}
+
+	return os.WriteFile(krlFile, krl, 0644)
+}
+
+func revoke() error {
+	if len(serials) == 0 && len(keyIDs) == 0 && user == "" {
+		return errors.New("Please provide --serial, --key-id, or --user")
+	}
+
+	storage, ca, err := newCA()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	if user != "" {
+		revoked, err := ca.RevokeUser(user)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range revoked {
+			fmt.Printf("revoked serial: %d\n", s)
+		}
+	}
+
+	if len(serials) > 0 || len(keyIDs) > 0 {
+		revoked := make([]uint64, len(serials))
+		for i, s := range serials {
+			revoked[i] = uint64(s)
+		}
+
+		if err := ca.Revoke(revoked, keyIDs); err != nil {
+			return err
+		}
+
+		for _, s := range serials {
+			fmt.Printf("revoked serial: %d\n", s)
+		}
+
+		for _, id := range keyIDs {
+			fmt.Printf("revoked key id: %s\n", id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package sshkeys
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ubccr/mokey/cmd"
+	"github.com/ubccr/mokey/server"
+)
+
+var (
+	dryRun bool
+
+	sshkeysCmd = &cobra.Command{
+		Use:   "sshkeys",
+		Short: "Manage user ssh keys",
+		Long:  `Manage user ssh keys`,
+	}
+
+	expireCmd = &cobra.Command{
+		Use:   "expire",
+		Short: "Remove expired ssh keys",
+		Long:  `Remove expired ssh keys from FreeIPA and email users whose ssh keys will expire soon`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return expire()
+		},
+	}
+)
+
+func init() {
+	expireCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report keys that would be removed or users that would be emailed")
+	expireCmd.Flags().Int("notify-days", 7, "email users whose ssh keys expire within this many days")
+	viper.BindPFlag("sshkeys.expiry_notify_days", expireCmd.Flags().Lookup("notify-days"))
+
+	sshkeysCmd.AddCommand(expireCmd)
+	cmd.Root.AddCommand(sshkeysCmd)
+}
+
+func expire() error {
+	if viper.GetInt("sshkeys.expiry_notify_days") > 0 && viper.GetString("email.base_url") == "" {
+		return errors.New("Please set email.base_url to send ssh key expiring emails")
+	}
+
+	client, err := server.NewAdminClient()
+	if err != nil {
+		return err
+	}
+
+	storage := server.NewStorage()
+	if storage == nil {
+		return errors.New("Failed to open mokey storage database")
+	}
+	defer storage.Close()
+
+	if !server.PersistentStorage(storage) {
+		return server.ErrSSHKeyExpiryStorage
+	}
+
+	emailer, err := server.NewEmailer(storage)
+	if err != nil {
+		return err
+	}
+
+	// Key removed notices are encrypted to the users OpenPGP key
+	if rpc, err := server.NewIPARPC(client); err == nil {
+		emailer.UseIPARPC(rpc)
+	}
+
+	auditLog, err := server.NewAuditLogger()
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	webhooks, flush, err := cmd.StartWebhooks()
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	expirer := server.NewSSHKeyExpirer(client, emailer, storage, auditLog, webhooks)
+	expirer.DryRun = dryRun
+
+	result, err := expirer.Run()
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "[dry-run] "
+	}
+
+	for _, key := range result.Notified {
+		fmt.Printf("%snotified: %s\n", prefix, key)
+	}
+
+	for _, key := range result.Removed {
+		fmt.Printf("%sremoved: %s\n", prefix, key)
+	}
+
+	return nil
+}
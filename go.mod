@@ -1,16 +1,19 @@
 module github.com/ubccr/mokey
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/asaskevich/govalidator v0.0.0-20230301143203-a9d515a09cc2
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/dchest/captcha v1.0.0
 	github.com/dustin/go-humanize v1.0.1
+	github.com/emersion/go-msgauth v0.7.0
 	github.com/essentialkaos/branca/v2 v2.0.5
 	github.com/gofiber/fiber/v2 v2.52.5
 	github.com/gofiber/storage/memory/v2 v2.0.1
 	github.com/gofiber/storage/redis/v3 v3.1.2
 	github.com/gofiber/storage/sqlite3/v2 v2.1.1
 	github.com/gorilla/mux v1.8.1
+	github.com/jcmturner/gokrb5/v8 v8.4.4
 	github.com/mileusna/useragent v1.3.5
 	github.com/ory/hydra-client-go v1.10.6
 	github.com/pkg/errors v0.9.1
@@ -23,8 +26,10 @@ require (
 	github.com/ubccr/goipa v0.0.7
 	github.com/urfave/negroni v1.0.0
 	github.com/valyala/fasthttp v1.56.0
+	golang.org/x/crypto v0.31.0
 	golang.org/x/net v0.29.0
 	golang.org/x/oauth2 v0.18.0
+	golang.org/x/text v0.21.0
 )
 
 require (
@@ -32,6 +37,7 @@ require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/boombuler/barcode v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
@@ -57,7 +63,6 @@ require (
 	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
 	github.com/jcmturner/gofork v1.7.6 // indirect
 	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
-	github.com/jcmturner/gokrb5/v8 v8.4.4 // indirect
 	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
@@ -97,11 +102,9 @@ require (
 	go.opentelemetry.io/otel/metric v1.26.0 // indirect
 	go.opentelemetry.io/otel/trace v1.26.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
-	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.19.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
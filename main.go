@@ -6,7 +6,13 @@ package main
 
 import (
 	"github.com/ubccr/mokey/cmd"
+	_ "github.com/ubccr/mokey/cmd/accounts"
+	_ "github.com/ubccr/mokey/cmd/audit"
+	_ "github.com/ubccr/mokey/cmd/mail"
+	_ "github.com/ubccr/mokey/cmd/notify"
 	_ "github.com/ubccr/mokey/cmd/serve"
+	_ "github.com/ubccr/mokey/cmd/sshca"
+	_ "github.com/ubccr/mokey/cmd/sshkeys"
 )
 
 func main() {
@@ -18,8 +18,10 @@ func (r *Router) AccountSettings(c *fiber.Ctx) error {
 	user := r.user(c)
 
 	vars := fiber.Map{
-		"user": user,
+		"user":              user,
+		"preferredLanguage": r.preferredLanguage(c),
 	}
+	r.pgpKeyVars(user, vars)
 
 	if c.Method() == fiber.MethodGet {
 		return c.Render("account.html", vars)
@@ -30,12 +32,12 @@ func (r *Router) AccountSettings(c *fiber.Ctx) error {
 	user.Mobile = strings.TrimSpace(c.FormValue("phone"))
 
 	if user.First == "" || user.Last == "" {
-		vars["message"] = "Please provide a first and last name"
+		vars["message"] = tr(c, "Please provide a first and last name")
 		return c.Render("account.html", vars)
 	}
 
 	if len(user.First) > 150 || len(user.Last) > 150 {
-		vars["message"] = "First or Last name is too long. Maximum of 150 chars allowed"
+		vars["message"] = tr(c, "First or Last name is too long. Maximum of %d chars allowed", 150)
 		return c.Render("account.html", vars)
 	}
 
@@ -47,18 +49,37 @@ func (r *Router) AccountSettings(c *fiber.Ctx) error {
 				"message":  ierr.Message,
 				"code":     ierr.Code,
 			}).Error("Failed to update account settings")
-			vars["message"] = "Failed to save account settings"
+			vars["message"] = tr(c, "Failed to save account settings")
 		} else {
 			log.WithFields(log.Fields{
 				"username": user.Username,
 				"error":    err.Error(),
 			}).Error("Failed to update account settings")
-			vars["message"] = "Fatal system error"
+			vars["message"] = tr(c, "Fatal system error")
 		}
-	} else {
-		vars["user"] = userUpdated
-		vars["success"] = true
+		return c.Render("account.html", vars)
 	}
+
+	vars["user"] = userUpdated
+
+	if lang := c.FormValue("language"); lang != vars["preferredLanguage"] {
+		if err := r.setPreferredLanguage(c, user.Username, lang); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"language": lang,
+				"err":      err,
+			}).Error("Failed to update preferred language")
+			vars["message"] = tr(c, "Failed to save language preference")
+			return c.Render("account.html", vars)
+		}
+
+		vars["preferredLanguage"] = lang
+
+		// Reload the page so the navigation is rendered in the new language
+		c.Set("HX-Refresh", "true")
+	}
+
+	vars["success"] = true
 	return c.Render("account.html", vars)
 }
 
@@ -67,6 +88,7 @@ func (r *Router) AccountCreate(c *fiber.Ctx) error {
 		vars := fiber.Map{
 			"captchaID":         captcha.New(),
 			"usernameFromEmail": viper.GetBool("accounts.username_from_email"),
+			"policy":            r.pwpolicy.Get(""),
 		}
 
 		return c.Render("signup.html", vars)
@@ -84,8 +106,17 @@ func (r *Router) AccountCreate(c *fiber.Ctx) error {
 
 	err := r.accountCreate(user, password, passwordConfirm, captchaID, captchaSol)
 	if err != nil {
+		r.audit(c, &AuditEvent{
+			Action:  AuditAccountCreate,
+			Outcome: AuditFailure,
+			Target:  user.Username,
+			Reason:  err.Error(),
+			Data: map[string]interface{}{
+				"email": user.Email,
+			},
+		})
 		c.Append("HX-Trigger", "{\"reloadCaptcha\":\""+captcha.New()+"\"}")
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	log.WithFields(log.Fields{
@@ -93,6 +124,16 @@ func (r *Router) AccountCreate(c *fiber.Ctx) error {
 		"email":    user.Email,
 	}).Info("AUDIT user account created successfully")
 	r.metrics.totalSignups.Inc()
+	r.audit(c, &AuditEvent{
+		Action: AuditAccountCreate,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"email": user.Email,
+		},
+	})
+	r.webhooks.Emit(EventAccountCreated, user.Username, RemoteIP(c), map[string]interface{}{
+		"email": user.Email,
+	})
 
 	// Send user an email to verify their account
 	err = r.emailer.SendAccountVerifyEmail(user, c)
@@ -116,12 +157,108 @@ func (r *Router) AccountCreate(c *fiber.Ctx) error {
 	return c.Render("signup-success.html", vars)
 }
 
+// UsernameCheck reports whether the requested username is valid and available
+// and offers alternative suggestions when it is not
+func (r *Router) UsernameCheck(c *fiber.Ctx) error {
+	user := &ipa.User{}
+	user.Username = strings.TrimSpace(c.Query("username"))
+	user.Email = strings.TrimSpace(c.Query("email"))
+	user.First = strings.TrimSpace(c.Query("first"))
+	user.Last = strings.TrimSpace(c.Query("last"))
+
+	vars := fiber.Map{}
+
+	// Usernames generated from email have collisions resolved automatically
+	if viper.GetBool("accounts.username_from_email") {
+		if user.Email == "" {
+			return c.Render("signup-username-check.html", vars)
+		}
+
+		if err := validateUsername(user); err != nil {
+			vars["message"] = tr(c, err.Error())
+			return c.Render("signup-username-check.html", vars)
+		}
+
+		username, err := uniqueUsername(user.Username, r.usernameExists)
+		if err != nil {
+			vars["message"] = tr(c, err.Error())
+			return c.Render("signup-username-check.html", vars)
+		}
+
+		vars["username"] = username
+		vars["available"] = true
+		vars["generated"] = true
+		return c.Render("signup-username-check.html", vars)
+	}
+
+	if user.Username == "" {
+		return c.Render("signup-username-check.html", vars)
+	}
+
+	if err := checkUsername(user.Username); err != nil {
+		vars["message"] = tr(c, err.Error())
+		vars["suggestions"] = suggestUsernames(user, r.usernameExists, 3)
+		return c.Render("signup-username-check.html", vars)
+	}
+
+	user.Username = strings.ToLower(user.Username)
+	vars["username"] = user.Username
+
+	if r.usernameExists(user.Username) {
+		vars["message"] = tr(c, "Username already exists: %s", user.Username)
+		vars["suggestions"] = suggestUsernames(user, r.usernameExists, 3)
+		return c.Render("signup-username-check.html", vars)
+	}
+
+	vars["available"] = true
+
+	return c.Render("signup-username-check.html", vars)
+}
+
+// usernameExists returns true if username exists in FreeIPA. Lookup errors
+// other than not found are treated as existing so we never suggest a username
+// we could not verify.
+func (r *Router) usernameExists(username string) bool {
+	_, err := r.adminClient.UserShow(username)
+	if err == nil {
+		return true
+	}
+
+	if ierr, ok := err.(*ipa.IpaError); ok && ierr.Code == 4001 {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"username": username,
+		"err":      err,
+	}).Error("Failed to check if username exists in FreeIPA")
+
+	return true
+}
+
 // accountCreate does the work of validation and creating the account in FreeIPA
 func (r *Router) accountCreate(user *ipa.User, password, passwordConfirm, captchaID, captchaSol string) error {
 	if err := validateUsername(user); err != nil {
 		return err
 	}
 
+	if reason, err := r.emailFilter.Check(user.Email); err != nil {
+		log.WithFields(log.Fields{
+			"email":  user.Email,
+			"reason": reason,
+		}).Warn("AUDIT Signup rejected for email domain")
+		r.metrics.totalSignupEmailsRejected.WithLabelValues(reason).Inc()
+		return err
+	}
+
+	if viper.GetBool("accounts.username_from_email") {
+		username, err := uniqueUsername(user.Username, r.usernameExists)
+		if err != nil {
+			return err
+		}
+		user.Username = username
+	}
+
 	if user.First == "" || user.Last == "" {
 		return errors.New("Please provide your first and last name")
 	}
@@ -134,7 +271,11 @@ func (r *Router) accountCreate(user *ipa.User, password, passwordConfirm, captch
 		return errors.New("Last name is too long. Maximum of 150 chars allowed")
 	}
 
-	if err := validatePassword(password, passwordConfirm); err != nil {
+	if err := validatePassword(password, passwordConfirm, r.pwpolicy.Get("")); err != nil {
+		return err
+	}
+
+	if err := r.checkNewPassword(user, password); err != nil {
 		return err
 	}
 
@@ -212,7 +353,7 @@ func (r *Router) AccountVerify(c *fiber.Ctx) error {
 			"email":    claims.Email,
 			"err":      err,
 		}).Error("Verifying account failed while fetching user from FreeIPA")
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to verify account please contact administrator")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to verify account please contact administrator"))
 	}
 
 	if user.Locked && !viper.GetBool("accounts.require_admin_verify") {
@@ -223,7 +364,7 @@ func (r *Router) AccountVerify(c *fiber.Ctx) error {
 				"email":    claims.Email,
 				"error":    err,
 			}).Error("Verify account failed to enable user in FreeIPA")
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to verify account please contact administrator")
+			return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to verify account please contact administrator"))
 		}
 	}
 
@@ -238,11 +379,11 @@ func (r *Router) AccountVerify(c *fiber.Ctx) error {
 				"email":    claims.Email,
 				"error":    err,
 			}).Error("Verify account failed to modify user category in FreeIPA")
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to verify account please contact administrator")
+			return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to verify account please contact administrator"))
 		}
 	}
 
-	r.storage.Set(TokenAccountVerify+TokenUsedPrefix+token, []byte("true"), time.Until(claims.Timestamp.Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second)))
+	MarkTokenUsed(token, claims, r.storage)
 
 	err = r.emailer.SendWelcomeEmail(user, c)
 	if err != nil {
@@ -258,6 +399,16 @@ func (r *Router) AccountVerify(c *fiber.Ctx) error {
 		"email":    user.Email,
 	}).Info("AUDIT user account verified successfully")
 	r.metrics.totalAccountVerifications.Inc()
+	r.audit(c, &AuditEvent{
+		Action: AuditAccountVerify,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"email": user.Email,
+		},
+	})
+	r.webhooks.Emit(EventAccountVerified, user.Username, RemoteIP(c), map[string]interface{}{
+		"email": user.Email,
+	})
 
 	return c.Render("verify-success.html", vars)
 }
@@ -274,7 +425,7 @@ func (r *Router) AccountVerifyResend(c *fiber.Ctx) error {
 	err := r.verifyCaptcha(c.FormValue("captcha_id"), c.FormValue("captcha_sol"))
 	if err != nil {
 		c.Append("HX-Trigger", "{\"reloadCaptcha\":\""+captcha.New()+"\"}")
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	username := c.FormValue("username")
@@ -327,3 +478,277 @@ func (r *Router) AccountVerifyResend(c *fiber.Ctx) error {
 
 	return c.Render("account-verify-forgot-success.html", fiber.Map{})
 }
+
+func (r *Router) AccountEmailModal(c *fiber.Ctx) error {
+	vars := fiber.Map{
+		"user": r.user(c),
+	}
+	return c.Render("account-email-new.html", vars)
+}
+
+// AccountEmailChange starts the email change flow. A confirmation link is
+// sent to the new address and the old address is notified with a link to
+// cancel. The email address is only updated once confirmed.
+func (r *Router) AccountEmailChange(c *fiber.Ctx) error {
+	user := r.user(c)
+	email := strings.TrimSpace(c.FormValue("email"))
+
+	if email == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide a new email address"))
+	}
+
+	if strings.EqualFold(email, user.Email) {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "New email address is the same as your current email address"))
+	}
+
+	if err := validateEmail(&ipa.User{Email: email}, viper.GetStringMapString("accounts.allowed_domains")); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	if reason, err := r.emailFilter.Check(email); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"email":    email,
+			"reason":   reason,
+		}).Warn("AUDIT Email change rejected for email domain")
+		r.audit(c, &AuditEvent{
+			Action:  AuditEmailChangeRequest,
+			Outcome: AuditFailure,
+			Target:  user.Username,
+			Reason:  err.Error(),
+			Data: map[string]interface{}{
+				"new_email": email,
+			},
+		})
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	inUse, err := r.emailInUse(email, user.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"username":  user.Username,
+			"new_email": email,
+		}).Error("Failed to check if email address is in use")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to send confirmation email. Please contact system administrator"))
+	}
+	if inUse {
+		log.WithFields(log.Fields{
+			"username":  user.Username,
+			"new_email": email,
+		}).Warn("AUDIT Email change rejected, address belongs to another account")
+		r.audit(c, &AuditEvent{
+			Action:  AuditEmailChangeRequest,
+			Outcome: AuditFailure,
+			Target:  user.Username,
+			Reason:  "email in use",
+			Data: map[string]interface{}{
+				"new_email": email,
+			},
+		})
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "This email address is already in use by another account"))
+	}
+
+	err = r.emailer.SendEmailChangeConfirmEmail(user, email, c)
+	if err != nil {
+		if errors.Is(err, ErrTokenAlreadyIssued) {
+			return c.Status(fiber.StatusBadRequest).SendString(tr(c, "An email change is already pending. Please check your email or try again later"))
+		}
+
+		log.WithFields(log.Fields{
+			"err":       err,
+			"username":  user.Username,
+			"new_email": email,
+		}).Error("Failed to send email change confirmation email")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Failed to send confirmation email. Please contact system administrator"))
+	}
+
+	r.storage.Set(StoragePrefixEmailChange+user.Username, []byte(email), time.Duration(viper.GetInt("email.token_max_age"))*time.Second)
+
+	err = r.emailer.SendEmailChangeNotifyEmail(user, email, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": user.Username,
+			"email":    user.Email,
+		}).Error("Failed to send email change notification to current email address")
+	}
+
+	log.WithFields(log.Fields{
+		"username":  user.Username,
+		"email":     user.Email,
+		"new_email": email,
+		"ip":        RemoteIP(c),
+	}).Info("AUDIT User requested email address change")
+	r.audit(c, &AuditEvent{
+		Action: AuditEmailChangeRequest,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"email":     user.Email,
+			"new_email": email,
+		},
+	})
+
+	return r.accountPage(c, fiber.Map{"emailPending": email})
+}
+
+// AccountEmailConfirm updates the users email address after the new address
+// has been confirmed
+func (r *Router) AccountEmailConfirm(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	claims, err := ParseToken(token, TokenEmailChange, r.storage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Debug("Invalid email change token")
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	pending, err := r.storage.Get(StoragePrefixEmailChange + claims.Username)
+	if err != nil || string(pending) != claims.Email {
+		log.WithFields(log.Fields{
+			"username":  claims.Username,
+			"new_email": claims.Email,
+		}).Warn("Email change confirm attempt for cancelled or unknown request")
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	vars := fiber.Map{
+		"claims": claims,
+	}
+
+	if c.Method() == fiber.MethodGet {
+		return c.Render("email-change-confirm.html", vars)
+	}
+
+	user, err := r.adminClient.UserShow(claims.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": claims.Username,
+			"err":      err,
+		}).Error("Email change failed while fetching user from FreeIPA")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to change email address please contact administrator"))
+	}
+
+	// The address may have been taken since the change was requested
+	inUse, err := r.emailInUse(claims.Email, claims.Username)
+	if err != nil || inUse {
+		log.WithFields(log.Fields{
+			"username":  claims.Username,
+			"new_email": claims.Email,
+			"err":       err,
+		}).Warn("Email change failed, address is in use or could not be checked")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "This email address is already in use by another account"))
+	}
+
+	oldUser := *user
+	user.Email = claims.Email
+
+	_, err = r.adminClient.UserMod(user)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username":  claims.Username,
+			"new_email": claims.Email,
+			"err":       err,
+		}).Error("Email change failed to modify user in FreeIPA")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to change email address please contact administrator"))
+	}
+
+	MarkTokenUsed(token, claims, r.storage)
+	r.clearEmailChange(claims.Username)
+
+	err = r.emailer.SendEmailChangedEmail(&oldUser, claims.Email, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": oldUser.Username,
+			"email":    oldUser.Email,
+		}).Error("Failed to send email changed email")
+	}
+
+	log.WithFields(log.Fields{
+		"username":  user.Username,
+		"old_email": oldUser.Email,
+		"new_email": user.Email,
+	}).Info("AUDIT User email address changed successfully")
+	r.audit(c, &AuditEvent{
+		Action: AuditEmailChange,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"old_email": oldUser.Email,
+			"new_email": user.Email,
+		},
+	})
+	r.webhooks.Emit(EventEmailChanged, user.Username, RemoteIP(c), map[string]interface{}{
+		"old_email": oldUser.Email,
+		"new_email": user.Email,
+	})
+
+	return c.Render("email-change-success.html", vars)
+}
+
+// AccountEmailCancel cancels a pending email change from the link sent to
+// the current email address
+func (r *Router) AccountEmailCancel(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	claims, err := ParseToken(token, TokenEmailCancel, r.storage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Debug("Invalid email change cancel token")
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	vars := fiber.Map{
+		"claims": claims,
+		"cancel": true,
+	}
+
+	if c.Method() == fiber.MethodGet {
+		return c.Render("email-change-confirm.html", vars)
+	}
+
+	MarkTokenUsed(token, claims, r.storage)
+	r.clearEmailChange(claims.Username)
+
+	log.WithFields(log.Fields{
+		"username": claims.Username,
+		"email":    claims.Email,
+		"ip":       RemoteIP(c),
+	}).Info("AUDIT User cancelled email address change")
+	r.audit(c, &AuditEvent{
+		Action: AuditEmailChangeCancel,
+		Target: claims.Username,
+		Data: map[string]interface{}{
+			"new_email": claims.Email,
+		},
+	})
+
+	return c.Render("email-change-success.html", vars)
+}
+
+// emailInUse returns true if email belongs to an account other than username
+func (r *Router) emailInUse(email, username string) (bool, error) {
+	users, err := r.adminClient.UserFind(ipa.Options{"mail": email})
+	if err != nil {
+		return false, err
+	}
+
+	for _, u := range users {
+		if u.Username != username {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// clearEmailChange removes a pending email change so the user may start a new
+// one right away
+func (r *Router) clearEmailChange(username string) {
+	r.storage.Delete(StoragePrefixEmailChange + username)
+	r.storage.Delete(TokenEmailChange + TokenIssuedPrefix + username)
+	r.storage.Delete(TokenEmailCancel + TokenIssuedPrefix + username)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+// newTestEmailChangeApp returns an app serving the email change routes backed
+// by a fake FreeIPA where taken lists addresses owned by other accounts
+func newTestEmailChangeApp(t *testing.T, taken map[string]bool) (*fiber.App, *Router, *testIPAServer) {
+	emailer, _ := newTestEmailer(t)
+
+	var mu sync.Mutex
+	email := "jdoe@example.com"
+	client, fake := newTestIPAClient(t, func(method string, params []interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch method {
+		case "user_find":
+			opts, _ := params[1].(map[string]interface{})
+			mail, _ := opts["mail"].(string)
+			if taken[mail] {
+				return map[string]interface{}{
+					"count":  1,
+					"result": []interface{}{map[string]interface{}{"uid": []string{"other"}, "mail": []string{mail}}},
+				}
+			}
+			return map[string]interface{}{"count": 0, "result": []interface{}{}}
+		case "user_mod":
+			opts, _ := params[1].(map[string]interface{})
+			if mail, ok := opts["mail"].(string); ok {
+				email = mail
+			}
+		}
+
+		return map[string]interface{}{
+			"result": map[string]interface{}{"uid": []string{"jdoe"}, "mail": []string{email}},
+		}
+	})
+
+	r := &Router{
+		storage:     emailer.storage,
+		emailer:     emailer,
+		adminClient: client,
+		emailFilter: NewEmailDomainFilter("", false, 0),
+	}
+
+	views, err := NewTemplateRenderer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{Views: views, PassLocalsToViews: true})
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(ContextKeyUser, &ipa.User{Username: "jdoe", Email: "jdoe@example.com"})
+		c.Locals(ContextKeyUsername, "jdoe")
+		return c.Next()
+	})
+	app.Post("/account/email", r.AccountEmailChange)
+	app.Get("/auth/email/cancel/:token", r.AccountEmailCancel)
+	app.Post("/auth/email/cancel/:token", r.AccountEmailCancel)
+	app.Get("/auth/email/:token", r.AccountEmailConfirm)
+	app.Post("/auth/email/:token", r.AccountEmailConfirm)
+
+	return app, r, fake
+}
+
+// newTestEmailChange records a pending email change and returns the confirm
+// and cancel tokens
+func newTestEmailChange(t *testing.T, r *Router, newEmail string) (string, string) {
+	confirm, err := NewToken("jdoe", newEmail, TokenEmailChange, r.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := NewToken("jdoe", "jdoe@example.com", TokenEmailCancel, r.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.storage.Set(StoragePrefixEmailChange+"jdoe", []byte(newEmail), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return confirm, cancel
+}
+
+func testRequest(t *testing.T, app *fiber.App, method, path string, form url.Values) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func countCalls(calls []string, method string) int {
+	n := 0
+	for _, c := range calls {
+		if c == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAccountEmailConfirm(t *testing.T) {
+	assert := assert.New(t)
+	app, r, fake := newTestEmailChangeApp(t, nil)
+
+	confirm, cancel := newTestEmailChange(t, r, "john@example.com")
+
+	// Tokens are not interchangeable
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodPost, "/auth/email/"+cancel, nil))
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodPost, "/auth/email/cancel/"+confirm, nil))
+
+	assert.Equal(fiber.StatusOK, testRequest(t, app, fiber.MethodGet, "/auth/email/"+confirm, nil))
+	assert.Equal(0, countCalls(fake.Calls(), "user_mod"))
+
+	assert.Equal(fiber.StatusOK, testRequest(t, app, fiber.MethodPost, "/auth/email/"+confirm, nil))
+	assert.Equal(1, countCalls(fake.Calls(), "user_mod"))
+
+	pending, err := r.storage.Get(StoragePrefixEmailChange + "jdoe")
+	assert.NoError(err)
+	assert.Nil(pending)
+
+	// Tokens may only be used once
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodPost, "/auth/email/"+confirm, nil))
+	assert.Equal(1, countCalls(fake.Calls(), "user_mod"))
+}
+
+func TestAccountEmailCancel(t *testing.T) {
+	assert := assert.New(t)
+	app, r, fake := newTestEmailChangeApp(t, nil)
+
+	confirm, cancel := newTestEmailChange(t, r, "john@example.com")
+
+	assert.Equal(fiber.StatusOK, testRequest(t, app, fiber.MethodGet, "/auth/email/cancel/"+cancel, nil))
+	assert.Equal(fiber.StatusOK, testRequest(t, app, fiber.MethodPost, "/auth/email/cancel/"+cancel, nil))
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodPost, "/auth/email/cancel/"+cancel, nil))
+
+	// The confirm link no longer works once cancelled
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodGet, "/auth/email/"+confirm, nil))
+	assert.Equal(fiber.StatusNotFound, testRequest(t, app, fiber.MethodPost, "/auth/email/"+confirm, nil))
+	assert.Equal(0, countCalls(fake.Calls(), "user_mod"))
+
+	// A new change may be started right away
+	_, _ = newTestEmailChange(t, r, "jd@example.com")
+}
+
+func TestAccountEmailInUse(t *testing.T) {
+	assert := assert.New(t)
+	taken := map[string]bool{}
+	app, r, fake := newTestEmailChangeApp(t, taken)
+
+	taken["other@example.com"] = true
+	assert.Equal(fiber.StatusBadRequest, testRequest(t, app, fiber.MethodPost, "/account/email", url.Values{"email": {"other@example.com"}}))
+
+	pending, err := r.storage.Get(StoragePrefixEmailChange + "jdoe")
+	assert.NoError(err)
+	assert.Nil(pending)
+
+	// The address was taken after the change was requested
+	confirm, _ := newTestEmailChange(t, r, "john@example.com")
+	taken["john@example.com"] = true
+	assert.Equal(fiber.StatusBadRequest, testRequest(t, app, fiber.MethodPost, "/auth/email/"+confirm, nil))
+	assert.Equal(0, countCalls(fake.Calls(), "user_mod"))
+}
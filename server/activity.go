@@ -0,0 +1,445 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mileusna/useragent"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	StoragePrefixActivity = "activity-"
+)
+
+// activityDescriptions are the audit actions shown to users in the Activity
+// tab
+var activityDescriptions = map[string]string{
+	AuditLogin:              "Signed in",
+	AuditLoginMagicLink:     "Signed in with an email link",
+	AuditLoginOAuth2:        "Signed in to an application",
+	AuditPasswordChange:     "Password changed",
+	AuditPasswordReset:      "Password reset",
+	AuditEmailChangeRequest: "Email address change requested",
+	AuditEmailChange:        "Email address changed",
+	AuditMFAEnable:          "Two-Factor authentication enabled",
+	AuditMFADisable:         "Two-Factor authentication disabled",
+	AuditOTPTokenAdd:        "OTP token added",
+	AuditOTPTokenRemove:     "OTP token removed",
+	AuditSSHKeyAdd:          "SSH key added",
+	AuditSSHKeyRemove:       "SSH key removed",
+	AuditSSHCertIssue:       "SSH certificate issued",
+	AuditPGPKeyAdd:          "Encryption key added",
+	AuditPGPKeyRemove:       "Encryption key removed",
+	AuditAccountLockdown:    "Account locked down",
+}
+
+// activityMu serializes updates to the per user activity lists
+var activityMu sync.Mutex
+
+// ActivityRecord is an event on a users account shown in the Activity tab
+type ActivityRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// Description returns the message id describing the event
+func (a *ActivityRecord) Description() string {
+	if desc, ok := activityDescriptions[a.Action]; ok {
+		return desc
+	}
+
+	return a.Action
+}
+
+// Device returns the browser and operating system of the event
+func (a *ActivityRecord) Device() string {
+	if a.UserAgent == "" {
+		return ""
+	}
+
+	ua := useragent.Parse(a.UserAgent)
+	switch {
+	case ua.Name != "" && ua.OS != "":
+		return ua.Name + " on " + ua.OS
+	case ua.Name != "":
+		return ua.Name
+	}
+
+	return ua.OS
+}
+
+func activityKey(username string) string {
+	return StoragePrefixActivity + username
+}
+
+func activityRetention() time.Duration {
+	return time.Duration(viper.GetInt("accounts.activity_retention")) * 24 * time.Hour
+}
+
+// ActivityEnabled returns true if account activity is recorded
+func ActivityEnabled() bool {
+	return activityRetention() > 0
+}
+
+// GetActivity returns the recorded events for username, newest first
+func GetActivity(storage fiber.Storage, username string) ([]*ActivityRecord, error) {
+	data, err := storage.Get(activityKey(username))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var records []*ActivityRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-activityRetention())
+	for i, rec := range records {
+		if rec.Time.Before(cutoff) {
+			return records[:i], nil
+		}
+	}
+
+	return records, nil
+}
+
+// AddActivity records rec for username. Events older than
+// accounts.activity_retention days are removed and at most
+// accounts.activity_max_events are kept.
+func AddActivity(storage fiber.Storage, username string, rec *ActivityRecord) error {
+	if !ActivityEnabled() {
+		return nil
+	}
+
+	activityMu.Lock()
+	defer activityMu.Unlock()
+
+	records, err := GetActivity(storage, username)
+	if err != nil {
+		return err
+	}
+
+	records = append([]*ActivityRecord{rec}, records...)
+	if max := viper.GetInt("accounts.activity_max_events"); max > 0 && len(records) > max {
+		records = records[:max]
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	return storage.Set(activityKey(username), data, activityRetention())
+}
+
+// recordActivity adds successful audit events on a users account to their
+// activity list
+func (r *Router) recordActivity(ev *AuditEvent) {
+	if ev.Target == "" || (ev.Outcome != "" && ev.Outcome != AuditSuccess) {
+		return
+	}
+
+	if _, ok := activityDescriptions[ev.Action]; !ok {
+		return
+	}
+
+	rec := &ActivityRecord{
+		Time:      ev.Time,
+		Action:    ev.Action,
+		IP:        ev.IP,
+		UserAgent: ev.UserAgent,
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	switch {
+	case ev.HydraClient != "":
+		rec.Detail = ev.HydraClient
+	case ev.Data["fingerprint"] != nil:
+		rec.Detail, _ = ev.Data["fingerprint"].(string)
+	case ev.Data["new_email"] != nil:
+		rec.Detail, _ = ev.Data["new_email"].(string)
+	case ev.Data["uuid"] != nil:
+		rec.Detail, _ = ev.Data["uuid"].(string)
+	}
+
+	if err := AddActivity(r.storage, ev.Target, rec); err != nil {
+		log.WithFields(log.Fields{
+			"username": ev.Target,
+			"action":   ev.Action,
+			"err":      err,
+		}).Error("Failed to record account activity")
+	}
+}
+
+func lockdownWindow() time.Duration {
+	return time.Duration(viper.GetInt("accounts.lockdown_window")) * 24 * time.Hour
+}
+
+// recentActivity returns the details of action events in records that
+// occurred after since
+func recentActivity(records []*ActivityRecord, action string, since time.Time) []string {
+	details := make([]string, 0)
+	for _, rec := range records {
+		if rec.Action == action && rec.Time.After(since) {
+			details = append(details, rec.Detail)
+		}
+	}
+
+	return details
+}
+
+// recentSSHKeys returns the fingerprints of the users ssh keys that were
+// added after since
+func recentSSHKeys(storage fiber.Storage, user *ipa.User, records []*ActivityRecord, since time.Time) []string {
+	added := make(map[string]bool)
+	for _, fp := range recentActivity(records, AuditSSHKeyAdd, since) {
+		added[fp] = true
+	}
+	for fp, rec := range sshKeyRecords(storage, user) {
+		if rec.AddedAt.After(since) {
+			added[fp] = true
+		}
+	}
+
+	fingerprints := make([]string, 0)
+	for _, key := range user.SSHAuthKeys {
+		if added[key.Fingerprint] {
+			fingerprints = append(fingerprints, key.Fingerprint)
+		}
+	}
+
+	return fingerprints
+}
+
+// lockdownSSHKeys removes ssh keys added to the users account during the
+// lockdown window
+func (r *Router) lockdownSSHKeys(user *ipa.User, records []*ActivityRecord, since time.Time) []string {
+	removed := recentSSHKeys(r.storage, user, records, since)
+	if len(removed) == 0 {
+		return removed
+	}
+
+	for _, fp := range removed {
+		user.RemoveSSHAuthorizedKey(fp)
+	}
+
+	if _, err := r.adminClient.UserMod(user); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Lockdown failed to remove recently added ssh keys")
+		return []string{}
+	}
+
+	for _, fp := range removed {
+		DeleteSSHKeyRecord(r.storage, user.Username, fp)
+	}
+
+	return removed
+}
+
+// lockdownOTPTokens removes OTP tokens added to the users account during the
+// lockdown window. Two-Factor authentication is disabled if no tokens would
+// remain.
+func (r *Router) lockdownOTPTokens(user *ipa.User, records []*ActivityRecord, since time.Time) ([]string, bool) {
+	removed := make([]string, 0)
+	added := make(map[string]bool)
+	for _, uuid := range recentActivity(records, AuditOTPTokenAdd, since) {
+		added[uuid] = true
+	}
+	if len(added) == 0 {
+		return removed, false
+	}
+
+	tokens, err := r.adminClient.FetchOTPTokens(user.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Lockdown failed to fetch otp tokens")
+		return removed, false
+	}
+
+	remaining := 0
+	for _, t := range tokens {
+		if !added[t.UUID] {
+			remaining++
+		}
+	}
+
+	mfaDisabled := false
+	if remaining == 0 && user.OTPOnly() {
+		if err := r.adminClient.SetAuthTypes(user.Username, nil); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Lockdown failed to disable two-factor authentication")
+			return removed, false
+		}
+		mfaDisabled = true
+	}
+
+	for _, t := range tokens {
+		if !added[t.UUID] {
+			continue
+		}
+
+		if err := r.adminClient.RemoveOTPToken(t.UUID); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"uuid":     t.UUID,
+				"err":      err,
+			}).Error("Lockdown failed to remove otp token")
+			continue
+		}
+		removed = append(removed, t.UUID)
+	}
+
+	return removed, mfaDisabled
+}
+
+// ActivityLockdown secures the account of a user reporting activity they do
+// not recognize. The password is reset to a random value, all of the users
+// sessions and ssh certificates are revoked, and ssh keys, OTP tokens and
+// encryption keys added within accounts.lockdown_window days are removed.
+// The user is then emailed a password reset link. The account is disabled
+// instead if accounts.lockdown_disable_account is set or the email address
+// was changed within the window, as the link would go to the new address.
+func (r *Router) ActivityLockdown(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	if _, err := r.adminClient.ResetPassword(user.Username); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Lockdown failed to reset password")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Failed to lock down your account. Please contact the system administrator"))
+	}
+
+	data := map[string]interface{}{
+		"password_reset": true,
+	}
+
+	if err := RevokeSessions(r.storage, user.Username); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Lockdown failed to revoke sessions")
+	}
+	data["sessions_revoked"] = true
+
+	if viper.IsSet("hydra.admin_url") {
+		if err := r.revokeHydraConsentSessions(user.Username); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Lockdown failed to revoke hydra consent sessions")
+		}
+	}
+
+	if r.sshca != nil {
+		serials, err := r.sshca.RevokeUser(user.Username)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Lockdown failed to revoke ssh certificates")
+		}
+		data["revoked_certs"] = len(serials)
+	}
+
+	records, err := GetActivity(r.storage, user.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Lockdown failed to fetch account activity")
+	}
+	since := time.Now().Add(-lockdownWindow())
+
+	data["removed_ssh_keys"] = r.lockdownSSHKeys(user, records, since)
+	data["removed_otp_tokens"], data["mfa_disabled"] = r.lockdownOTPTokens(user, records, since)
+
+	if r.emailer.pgpKeys != nil && len(recentActivity(records, AuditPGPKeyAdd, since)) > 0 {
+		rec, err := r.emailer.pgpKeys.Get(user.Username)
+		if err == nil && rec != nil {
+			err = r.emailer.pgpKeys.Delete(user.Username)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Lockdown failed to remove recently added encryption key")
+		} else if rec != nil {
+			data["removed_pgp_key"] = rec.Fingerprint
+		}
+	}
+
+	emailChanged := len(recentActivity(records, AuditEmailChange, since)) > 0
+	data["email_changed"] = emailChanged
+
+	disable := viper.GetBool("accounts.lockdown_disable_account") || emailChanged
+	if disable {
+		if err := r.adminClient.UserDisable(user.Username); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Lockdown failed to disable account")
+			disable = false
+		}
+	}
+	data["disabled"] = disable
+
+	log.WithFields(log.Fields{
+		"username":      user.Username,
+		"ip":            RemoteIP(c),
+		"disabled":      disable,
+		"email_changed": emailChanged,
+	}).Warn("AUDIT User reported unrecognized activity, account locked down")
+	r.audit(c, &AuditEvent{
+		Action: AuditAccountLockdown,
+		Target: user.Username,
+		Data:   data,
+	})
+	r.webhooks.Emit(EventAccountLockdown, user.Username, RemoteIP(c), data)
+
+	// Never send the reset link to an address that was changed recently
+	if !disable && !emailChanged {
+		err := r.emailer.SendPasswordResetEmail(user, c)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":      err,
+				"username": user.Username,
+				"email":    user.Email,
+			}).Error("Lockdown failed to send reset password email")
+		}
+	}
+
+	r.logout(c)
+
+	if disable {
+		c.Set("HX-Redirect", "/auth/lockdown?disabled=1")
+	} else {
+		c.Set("HX-Redirect", "/auth/lockdown")
+	}
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+func (r *Router) LockdownSuccess(c *fiber.Ctx) error {
+	vars := fiber.Map{
+		"disabled": c.Query("disabled") == "1",
+	}
+
+	return c.Render("lockdown-success.html", vars)
+}
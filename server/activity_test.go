@@ -0,0 +1,162 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestActivityStore(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+	viper.Set("accounts.activity_max_events", 3)
+	defer viper.Set("accounts.activity_max_events", 200)
+
+	storage := memory.New()
+
+	records, err := GetActivity(storage, "jdoe")
+	assert.NoError(err)
+	assert.Empty(records)
+
+	now := time.Now()
+	assert.NoError(AddActivity(storage, "jdoe", &ActivityRecord{Time: now.Add(-100 * 24 * time.Hour), Action: AuditLogin}))
+	for i := 0; i < 4; i++ {
+		assert.NoError(AddActivity(storage, "jdoe", &ActivityRecord{Time: now.Add(time.Duration(i) * time.Minute), Action: AuditSSHKeyAdd, Detail: string(rune('a' + i))}))
+	}
+
+	records, err = GetActivity(storage, "jdoe")
+	if assert.NoError(err) && assert.Len(records, 3) {
+		// Newest first
+		assert.Equal("d", records[0].Detail)
+		assert.Equal("b", records[2].Detail)
+	}
+
+	// Events past the retention period are not returned
+	assert.NoError(AddActivity(storage, "mjones", &ActivityRecord{Time: now.Add(-100 * 24 * time.Hour), Action: AuditLogin}))
+	records, err = GetActivity(storage, "mjones")
+	assert.NoError(err)
+	assert.Empty(records)
+
+	records, err = GetActivity(storage, "other")
+	assert.NoError(err)
+	assert.Empty(records)
+}
+
+func TestActivityDisabled(t *testing.T) {
+	SetDefaults()
+	viper.Set("accounts.activity_retention", 0)
+	defer viper.Set("accounts.activity_retention", 90)
+
+	storage := memory.New()
+	assert.False(t, ActivityEnabled())
+	assert.NoError(t, AddActivity(storage, "jdoe", &ActivityRecord{Time: time.Now(), Action: AuditLogin}))
+
+	data, err := storage.Get(activityKey("jdoe"))
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestRecordActivity(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+
+	r := &Router{storage: memory.New()}
+
+	r.recordActivity(&AuditEvent{Action: AuditLogin, Outcome: AuditFailure, Target: "jdoe"})
+	r.recordActivity(&AuditEvent{Action: AuditPasswordResetRequest, Target: "jdoe"})
+	r.recordActivity(&AuditEvent{Action: AuditLogin, Target: ""})
+	r.recordActivity(&AuditEvent{
+		Action:    AuditSSHKeyAdd,
+		Outcome:   AuditSuccess,
+		Target:    "jdoe",
+		IP:        "10.0.0.1",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+		Data: map[string]interface{}{
+			"fingerprint": "SHA256:abc",
+		},
+	})
+	r.recordActivity(&AuditEvent{Action: AuditLoginOAuth2, Target: "jdoe", HydraClient: "jupyterhub"})
+
+	records, err := GetActivity(r.storage, "jdoe")
+	if assert.NoError(err) && assert.Len(records, 2) {
+		assert.Equal(AuditLoginOAuth2, records[0].Action)
+		assert.Equal("jupyterhub", records[0].Detail)
+		assert.Equal("Signed in to an application", records[0].Description())
+		assert.False(records[0].Time.IsZero())
+		assert.Equal("", records[0].Device())
+
+		assert.Equal("SHA256:abc", records[1].Detail)
+		assert.Equal("10.0.0.1", records[1].IP)
+		assert.Equal("Firefox on Linux", records[1].Device())
+	}
+}
+
+func TestLockdownRecentChanges(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+
+	storage := memory.New()
+	now := time.Now()
+	since := now.Add(-lockdownWindow())
+
+	records := []*ActivityRecord{
+		{Time: now.Add(-time.Hour), Action: AuditOTPTokenAdd, Detail: "uuid-new"},
+		{Time: now.Add(-2 * time.Hour), Action: AuditSSHKeyAdd, Detail: "SHA256:new"},
+		{Time: now.Add(-3 * time.Hour), Action: AuditSSHKeyAdd, Detail: "SHA256:removed"},
+		{Time: now.Add(-30 * 24 * time.Hour), Action: AuditOTPTokenAdd, Detail: "uuid-old"},
+		{Time: now.Add(-30 * 24 * time.Hour), Action: AuditSSHKeyAdd, Detail: "SHA256:old"},
+	}
+
+	assert.Equal([]string{"uuid-new"}, recentActivity(records, AuditOTPTokenAdd, since))
+	assert.Empty(recentActivity(records, AuditEmailChange, since))
+
+	// Keys added without an activity record are found by their key record
+	assert.NoError(SaveSSHKeyRecord(storage, "jdoe", "SHA256:imported", &SSHKeyRecord{AddedAt: now.Add(-time.Hour)}))
+	assert.NoError(SaveSSHKeyRecord(storage, "jdoe", "SHA256:old", &SSHKeyRecord{AddedAt: now.Add(-30 * 24 * time.Hour)}))
+
+	user := &ipa.User{
+		Username: "jdoe",
+		SSHAuthKeys: []*ipa.SSHAuthorizedKey{
+			{Fingerprint: "SHA256:old"},
+			{Fingerprint: "SHA256:new"},
+			{Fingerprint: "SHA256:imported"},
+		},
+	}
+
+	assert.Equal([]string{"SHA256:new", "SHA256:imported"}, recentSSHKeys(storage, user, records, since))
+}
+
+func TestRevokeSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	storage := memory.New()
+	loginAt := time.Now().UnixNano()
+
+	revoked, err := sessionRevoked(storage, "jdoe", loginAt)
+	assert.NoError(err)
+	assert.False(revoked)
+
+	assert.NoError(RevokeSessions(storage, "jdoe"))
+
+	revoked, err = sessionRevoked(storage, "jdoe", loginAt)
+	assert.NoError(err)
+	assert.True(revoked)
+
+	// Sessions without a login time predate revocation support
+	revoked, err = sessionRevoked(storage, "jdoe", 0)
+	assert.NoError(err)
+	assert.True(revoked)
+
+	// New logins are not affected
+	revoked, err = sessionRevoked(storage, "jdoe", time.Now().UnixNano())
+	assert.NoError(err)
+	assert.False(revoked)
+
+	revoked, err = sessionRevoked(storage, "mjones", loginAt)
+	assert.NoError(err)
+	assert.False(revoked)
+}
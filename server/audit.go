@@ -0,0 +1,721 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Audit sinks
+const (
+	AuditSinkFile   = "file"
+	AuditSinkSyslog = "syslog"
+	AuditSinkStdout = "stdout"
+)
+
+// Audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Audit event actions
+const (
+	AuditAccountCreate        = "account.create"
+	AuditAccountVerify        = "account.verify"
+	AuditAccountDelete        = "account.delete"
+	AuditEmailChangeRequest   = "email.change_request"
+	AuditEmailChange          = "email.change"
+	AuditEmailChangeCancel    = "email.change_cancel"
+	AuditLogin                = "login"
+	AuditLoginMagicLink       = "login.magic_link"
+	AuditLoginOAuth2          = "login.oauth2"
+	AuditMagicLinkRequest     = "magic_link.request"
+	AuditPasswordChange       = "password.change"
+	AuditPasswordChangeForced = "password.change_required"
+	AuditPasswordResetRequest = "password.reset_request"
+	AuditPasswordReset        = "password.reset"
+	AuditMFAEnable            = "mfa.enable"
+	AuditMFADisable           = "mfa.disable"
+	AuditOTPTokenAdd          = "otptoken.add"
+	AuditOTPTokenRemove       = "otptoken.remove"
+	AuditSSHKeyAdd            = "sshkey.add"
+	AuditSSHKeyRemove         = "sshkey.remove"
+	AuditSSHKeyExpire         = "sshkey.expire"
+	AuditSSHCertIssue         = "sshcert.issue"
+	AuditPGPKeyAdd            = "pgpkey.add"
+	AuditPGPKeyRemove         = "pgpkey.remove"
+	AuditAccountLockdown      = "account.lockdown"
+)
+
+// auditHashField is appended to each JSON encoded event. The hash covers the
+// encoded event up to this field.
+const auditHashField = `,"hash":"`
+
+// AuditEvent is a security relevant action. Actor is the user performing the
+// action, if known, and Target is the account the action applies to. Events
+// are chained by including the hash of the previous event so deleted or
+// modified events can be detected.
+type AuditEvent struct {
+	Seq         uint64                 `json:"seq"`
+	Time        time.Time              `json:"time"`
+	Action      string                 `json:"action"`
+	Outcome     string                 `json:"outcome"`
+	Actor       string                 `json:"actor,omitempty"`
+	Target      string                 `json:"target,omitempty"`
+	IP          string                 `json:"ip,omitempty"`
+	UserAgent   string                 `json:"user_agent,omitempty"`
+	HydraClient string                 `json:"hydra_client,omitempty"`
+	Reason      string                 `json:"reason,omitempty"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+	PrevHash    string                 `json:"prev_hash"`
+	Hash        string                 `json:"hash"`
+}
+
+// AuditSink writes JSON encoded audit events
+type AuditSink interface {
+	Write(ev *AuditEvent, line []byte) error
+	Close() error
+}
+
+// AuditLogger writes audit events to the configured sinks. A nil
+// *AuditLogger discards all events.
+type AuditLogger struct {
+	mu    sync.Mutex
+	sinks []AuditSink
+	file  *auditFileSink
+	key   []byte
+	seq   uint64
+	hash  string
+}
+
+// NewAuditLogger returns an audit logger for the sinks listed in audit.sinks.
+// Returns nil if no sinks are configured. When logging to a file the hash
+// chain is resumed from the last event in the file.
+func NewAuditLogger() (*AuditLogger, error) {
+	sinks := viper.GetStringSlice("audit.sinks")
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	key, err := AuditKey()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AuditLogger{key: key}
+	for _, name := range sinks {
+		switch strings.ToLower(name) {
+		case AuditSinkFile:
+			path := viper.GetString("audit.file")
+			if path == "" {
+				return nil, errors.New("Please set audit.file to log audit events to a file")
+			}
+
+			if err := a.resume(path); err != nil {
+				return nil, err
+			}
+
+			sink, err := newAuditFileSink(path, int64(viper.GetInt("audit.max_size"))*1024*1024, viper.GetInt("audit.max_backups"))
+			if err != nil {
+				return nil, err
+			}
+			a.file = sink
+			a.sinks = append(a.sinks, sink)
+		case AuditSinkSyslog:
+			sink, err := newAuditSyslogSink(
+				viper.GetString("audit.syslog_network"),
+				viper.GetString("audit.syslog_address"),
+				viper.GetString("audit.syslog_facility"),
+				viper.GetString("audit.syslog_tag"))
+			if err != nil {
+				return nil, err
+			}
+			a.sinks = append(a.sinks, sink)
+		case AuditSinkStdout:
+			a.sinks = append(a.sinks, &auditWriterSink{w: os.Stdout})
+		default:
+			return nil, fmt.Errorf("Invalid audit sink: %s", name)
+		}
+	}
+
+	return a, nil
+}
+
+// AuditKey returns the audit.hmac_key used to chain events. Events are
+// chained with plain SHA-256 if no key is set.
+func AuditKey() ([]byte, error) {
+	key, err := configSecret("audit.hmac_key")
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+
+	return []byte(key), nil
+}
+
+func auditHash(key, data []byte) string {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encode returns the JSON encoded event with its hash
+func (a *AuditLogger) encode(ev *AuditEvent) ([]byte, error) {
+	ev.Hash = ""
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the empty hash field, hash the rest and add the hash back
+	i := bytes.LastIndex(data, []byte(auditHashField))
+	if i < 0 {
+		return nil, errors.New("invalid audit event encoding")
+	}
+	data = data[:i]
+
+	ev.Hash = auditHash(a.key, data)
+	data = append(data, auditHashField...)
+	data = append(data, ev.Hash...)
+	data = append(data, `"}`...)
+
+	return data, nil
+}
+
+// Log assigns ev the next sequence number in the hash chain and writes it to
+// all sinks
+func (a *AuditLogger) Log(ev *AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Time = ev.Time.UTC()
+
+	if ev.Outcome == "" {
+		ev.Outcome = AuditSuccess
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The server and mokey commands may append to the same audit log so the
+	// chain is continued from the file while holding its lock
+	if a.file != nil {
+		unlock, err := a.file.lock()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"action": ev.Action,
+				"err":    err,
+			}).Error("Failed to lock audit log")
+		} else {
+			defer unlock()
+			if err := a.resume(a.file.path); err != nil {
+				log.WithFields(log.Fields{
+					"action": ev.Action,
+					"err":    err,
+				}).Error("Failed to resume audit hash chain")
+			}
+		}
+	}
+
+	ev.Seq = a.seq + 1
+	ev.PrevHash = a.hash
+
+	line, err := a.encode(ev)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": ev.Action,
+			"err":    err,
+		}).Error("Failed to encode audit event")
+		return
+	}
+
+	a.seq = ev.Seq
+	a.hash = ev.Hash
+
+	for _, sink := range a.sinks {
+		if err := sink.Write(ev, line); err != nil {
+			log.WithFields(log.Fields{
+				"action": ev.Action,
+				"seq":    ev.Seq,
+				"err":    err,
+			}).Error("Failed to write audit event")
+		}
+	}
+}
+
+// Close closes all sinks
+func (a *AuditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var errs []error
+	for _, sink := range a.sinks {
+		errs = append(errs, sink.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// resume continues the hash chain from the last event in the audit log at
+// path, or its most recent backup if the log is empty
+func (a *AuditLogger) resume(path string) error {
+	for _, p := range []string{path, path + ".1"} {
+		line, err := lastLine(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read audit log %s: %w", p, err)
+		}
+		if line == nil {
+			continue
+		}
+
+		var ev AuditEvent
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Hash == "" {
+			log.WithFields(log.Fields{
+				"file": p,
+			}).Warn("Last audit event is corrupt, starting a new hash chain")
+			return nil
+		}
+
+		a.seq = ev.Seq
+		a.hash = ev.Hash
+		return nil
+	}
+
+	return nil
+}
+
+// lastLine returns the last non empty line of the file at path
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Audit events are small, only the tail of the file needs reading
+	offset := fi.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+
+	data := make([]byte, fi.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+
+	return data, nil
+}
+
+// AuditVerifyResult summarizes a verified audit log
+type AuditVerifyResult struct {
+	Events   int
+	FirstSeq uint64
+	LastSeq  uint64
+}
+
+// VerifyAuditLog checks the hash chain of the audit log files, oldest first.
+// The first event may continue a chain from a file that is no longer
+// present. Returns an error describing the first event that was modified,
+// deleted or inserted.
+func VerifyAuditLog(files []string, key []byte) (*AuditVerifyResult, error) {
+	res := &AuditVerifyResult{}
+	prevHash := ""
+
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return res, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		lineno := 0
+		for scanner.Scan() {
+			lineno++
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			var ev AuditEvent
+			if err := json.Unmarshal(line, &ev); err != nil {
+				f.Close()
+				return res, fmt.Errorf("%s:%d: invalid audit event: %w", path, lineno, err)
+			}
+
+			suffix := auditHashField + ev.Hash + `"}`
+			if ev.Hash == "" || !bytes.HasSuffix(line, []byte(suffix)) {
+				f.Close()
+				return res, fmt.Errorf("%s:%d: audit event %d has no hash", path, lineno, ev.Seq)
+			}
+
+			if !hmac.Equal([]byte(auditHash(key, line[:len(line)-len(suffix)])), []byte(ev.Hash)) {
+				f.Close()
+				return res, fmt.Errorf("%s:%d: audit event %d was modified", path, lineno, ev.Seq)
+			}
+
+			if res.Events > 0 {
+				if ev.Seq != res.LastSeq+1 {
+					f.Close()
+					return res, fmt.Errorf("%s:%d: expected audit event %d found %d, events were deleted or reordered", path, lineno, res.LastSeq+1, ev.Seq)
+				}
+				if ev.PrevHash != prevHash {
+					f.Close()
+					return res, fmt.Errorf("%s:%d: audit event %d does not chain to event %d", path, lineno, ev.Seq, res.LastSeq)
+				}
+			} else {
+				res.FirstSeq = ev.Seq
+			}
+
+			res.Events++
+			res.LastSeq = ev.Seq
+			prevHash = ev.Hash
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return res, nil
+}
+
+// AuditLogFiles returns the audit log at path and its backups, oldest first
+func AuditLogFiles(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		backup := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		files = append([]string{backup}, files...)
+	}
+
+	return append(files, path)
+}
+
+// auditFileSink writes events as JSON lines to a file that is rotated when it
+// reaches maxSize bytes. Rotated files are named path.1, path.2, ... with
+// path.1 the most recent.
+type auditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	lockFile   *os.File
+	size       int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxBackups int) (*auditFileSink, error) {
+	s := &auditFileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if s.maxBackups < 1 {
+		s.maxBackups = 1
+	}
+
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log lock: %w", err)
+	}
+	s.lockFile = lockFile
+
+	if err := s.open(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lock takes an exclusive lock on the audit log shared with other mokey
+// processes. The file is reopened if another process rotated it.
+func (s *auditFileSink) lock() (func(), error) {
+	fd := int(s.lockFile.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	unlock := func() { syscall.Flock(fd, syscall.LOCK_UN) }
+
+	current, err := s.file.Stat()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	fi, err := os.Stat(s.path)
+	if err == nil && os.SameFile(current, fi) {
+		s.size = fi.Size()
+		return unlock, nil
+	}
+
+	s.file.Close()
+	if err := s.open(); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return unlock, nil
+}
+
+func (s *auditFileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *auditFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *auditFileSink) Write(ev *AuditEvent, line []byte) error {
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("Failed to rotate audit log: %w", err)
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+func (s *auditFileSink) Close() error {
+	s.lockFile.Close()
+	return s.file.Close()
+}
+
+// auditWriterSink writes events as JSON lines to w
+type auditWriterSink struct {
+	w io.Writer
+}
+
+func (s *auditWriterSink) Write(ev *AuditEvent, line []byte) error {
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *auditWriterSink) Close() error {
+	return nil
+}
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"authpriv": 10,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog severities
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+)
+
+// auditSyslogSink sends events to a syslog server formatted as RFC 5424
+// messages. Messages sent over tcp are framed using octet counting (RFC 6587).
+type auditSyslogSink struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+func newAuditSyslogSink(network, address, facility, tag string) (*auditSyslogSink, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid audit.syslog_facility: %s", facility)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	if tag == "" {
+		tag = "mokey"
+	}
+
+	s := &auditSyslogSink{
+		network:  network,
+		address:  address,
+		facility: code,
+		tag:      tag,
+		hostname: hostname,
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, fmt.Errorf("Failed to connect to syslog: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *auditSyslogSink) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	return nil
+}
+
+// format returns ev as an RFC 5424 syslog message
+func (s *auditSyslogSink) format(ev *AuditEvent, line []byte) []byte {
+	severity := syslogNotice
+	if ev.Outcome != AuditSuccess {
+		severity = syslogWarning
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d audit - %s",
+		s.facility*8+severity,
+		ev.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.tag,
+		os.Getpid(),
+		line)
+
+	if strings.HasPrefix(s.network, "tcp") {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	return []byte(msg)
+}
+
+func (s *auditSyslogSink) Write(ev *AuditEvent, line []byte) error {
+	msg := s.format(ev, line)
+
+	if s.conn != nil {
+		if _, err := s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	// Reconnect once, the syslog server may have been restarted
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func (s *auditSyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
+// audit records ev with the remote address and user agent of the request c in
+// the audit log and the activity list of the target user. The actor defaults
+// to the logged in user.
+func (r *Router) audit(c *fiber.Ctx, ev *AuditEvent) {
+	ev.IP = RemoteIP(c)
+	ev.UserAgent = c.Get(fiber.HeaderUserAgent)
+	if ev.Actor == "" {
+		ev.Actor, _ = c.Locals(ContextKeyUsername).(string)
+	}
+
+	r.auditLog.Log(ev)
+	r.recordActivity(ev)
+}
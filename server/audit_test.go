@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuditLogger(t *testing.T, path string) *AuditLogger {
+	SetDefaults()
+	viper.Set("audit.sinks", []string{AuditSinkFile})
+	viper.Set("audit.file", path)
+	t.Cleanup(func() {
+		viper.Set("audit.sinks", nil)
+		viper.Set("audit.file", "")
+		viper.Set("audit.hmac_key", "")
+		viper.Set("audit.max_size", 100)
+	})
+
+	a, err := NewAuditLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	return a
+}
+
+func logTestAuditEvents(a *AuditLogger, n int) {
+	for i := 0; i < n; i++ {
+		a.Log(&AuditEvent{
+			Action:    AuditLogin,
+			Actor:     "jdoe",
+			Target:    "jdoe",
+			IP:        "10.0.0.1",
+			UserAgent: "Mozilla/5.0",
+			Data: map[string]interface{}{
+				"attempt": i,
+			},
+		})
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	a := newTestAuditLogger(t, path)
+	logTestAuditEvents(a, 5)
+
+	res, err := VerifyAuditLog([]string{path}, nil)
+	if assert.NoError(err) {
+		assert.Equal(5, res.Events)
+		assert.Equal(uint64(1), res.FirstSeq)
+		assert.Equal(uint64(5), res.LastSeq)
+	}
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(err) {
+		return
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+
+	var ev AuditEvent
+	if assert.NoError(json.Unmarshal(lines[0], &ev)) {
+		assert.Equal(AuditLogin, ev.Action)
+		assert.Equal(AuditSuccess, ev.Outcome)
+		assert.Equal("", ev.PrevHash)
+		assert.Len(ev.Hash, 64)
+	}
+
+	// Modified event
+	tampered := bytes.Replace(data, []byte("10.0.0.1"), []byte("10.0.0.2"), 1)
+	assert.NoError(os.WriteFile(path, tampered, 0600))
+	_, err = VerifyAuditLog([]string{path}, nil)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "audit event 1 was modified")
+	}
+
+	// Deleted event
+	deleted := bytes.Join(append(lines[:2:2], lines[3:]...), []byte("\n"))
+	assert.NoError(os.WriteFile(path, deleted, 0600))
+	_, err = VerifyAuditLog([]string{path}, nil)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "expected audit event 3 found 4")
+	}
+
+	// Truncated from the start is allowed, older events may have been rotated
+	assert.NoError(os.WriteFile(path, bytes.Join(lines[2:], []byte("\n")), 0600))
+	res, err = VerifyAuditLog([]string{path}, nil)
+	if assert.NoError(err) {
+		assert.Equal(uint64(3), res.FirstSeq)
+	}
+}
+
+func TestAuditLogHMAC(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	viper.Set("audit.hmac_key", "s3cret")
+	a := newTestAuditLogger(t, path)
+	logTestAuditEvents(a, 2)
+
+	_, err := VerifyAuditLog([]string{path}, []byte("s3cret"))
+	assert.NoError(err)
+
+	_, err = VerifyAuditLog([]string{path}, nil)
+	assert.Error(err)
+}
+
+func TestAuditLogResumeAndRotate(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	a := newTestAuditLogger(t, path)
+	logTestAuditEvents(a, 3)
+	assert.NoError(a.Close())
+
+	// Restart continues the chain
+	a = newTestAuditLogger(t, path)
+	logTestAuditEvents(a, 2)
+
+	// Force rotation on every write
+	a.sinks[0].(*auditFileSink).maxSize = 1
+	a.sinks[0].(*auditFileSink).maxBackups = 2
+	logTestAuditEvents(a, 3)
+
+	files := AuditLogFiles(path)
+	assert.Equal([]string{path + ".2", path + ".1", path}, files)
+
+	res, err := VerifyAuditLog(files, nil)
+	if assert.NoError(err) {
+		assert.Equal(3, res.Events)
+		assert.Equal(uint64(6), res.FirstSeq)
+		assert.Equal(uint64(8), res.LastSeq)
+	}
+
+	// Out of order files break the chain
+	_, err = VerifyAuditLog([]string{path + ".1", path + ".2", path}, nil)
+	assert.Error(err)
+}
+
+func TestAuditLogShared(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// The server and a mokey command writing to the same log
+	server := newTestAuditLogger(t, path)
+	command := newTestAuditLogger(t, path)
+
+	logTestAuditEvents(server, 2)
+	logTestAuditEvents(command, 2)
+	logTestAuditEvents(server, 1)
+
+	res, err := VerifyAuditLog([]string{path}, nil)
+	if assert.NoError(err) {
+		assert.Equal(5, res.Events)
+		assert.Equal(uint64(5), res.LastSeq)
+	}
+
+	// Rotation by one process is followed by the other
+	command.file.maxSize = 1
+	logTestAuditEvents(command, 1)
+	logTestAuditEvents(server, 1)
+
+	files := AuditLogFiles(path)
+	res, err = VerifyAuditLog(files, nil)
+	if assert.NoError(err) {
+		assert.Equal(uint64(7), res.LastSeq)
+	}
+
+	data, err := os.ReadFile(path)
+	if assert.NoError(err) {
+		assert.Equal(2, bytes.Count(data, []byte("\n")))
+	}
+}
+
+func TestAuditLogSyslog(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	sink, err := newAuditSyslogSink("udp", conn.LocalAddr().String(), "authpriv", "mokey")
+	if !assert.NoError(err) {
+		return
+	}
+
+	a := &AuditLogger{sinks: []AuditSink{sink}}
+	defer a.Close()
+	a.Log(&AuditEvent{Action: AuditLogin, Outcome: AuditFailure, Target: "jdoe"})
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if !assert.NoError(err) {
+		return
+	}
+
+	msg := string(buf[:n])
+	// authpriv (10) * 8 + warning (4)
+	assert.True(strings.HasPrefix(msg, "<84>1 "), msg)
+	assert.Contains(msg, " mokey ")
+	assert.Contains(msg, ` audit - {"seq":1,`)
+	assert.Contains(msg, `"outcome":"failure"`)
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var a *AuditLogger
+	assert.NotPanics(t, func() {
+		a.Log(&AuditEvent{Action: AuditLogin})
+	})
+	assert.NoError(t, a.Close())
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -11,6 +12,34 @@ import (
 	ipa "github.com/ubccr/goipa"
 )
 
+const (
+	StoragePrefixSessionsRevoked = "sessions-revoked-"
+)
+
+// RevokeSessions invalidates all of the users existing sessions. Sessions
+// record when the user logged in and are rejected by isLoggedIn if they
+// were created before the most recent revocation.
+func RevokeSessions(storage fiber.Storage, username string) error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return storage.Set(StoragePrefixSessionsRevoked+username, []byte(now), 0)
+}
+
+// sessionRevoked returns true if a session for username created at loginAt
+// has been revoked
+func sessionRevoked(storage fiber.Storage, username string, loginAt int64) (bool, error) {
+	data, err := storage.Get(StoragePrefixSessionsRevoked + username)
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	revokedAt, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	return loginAt < revokedAt, nil
+}
+
 func isBlocked(username string) bool {
 	blockUsers := viper.GetStringSlice("accounts.block_users")
 	for _, u := range blockUsers {
@@ -31,7 +60,8 @@ func (r *Router) isLoggedIn(c *fiber.Ctx) (bool, error) {
 	username := sess.Get(SessionKeyUsername)
 	sid := sess.Get(SessionKeySID)
 	authenticated := sess.Get(SessionKeyAuthenticated)
-	if sid == nil || username == nil || authenticated == nil {
+	magicLink, _ := sess.Get(SessionKeyMagicLink).(bool)
+	if (sid == nil && !magicLink) || username == nil || authenticated == nil {
 		return false, errors.New("Invalid session")
 	}
 
@@ -39,23 +69,47 @@ func (r *Router) isLoggedIn(c *fiber.Ctx) (bool, error) {
 		return false, errors.New("Invalid user in session")
 	}
 
-	if _, ok := sid.(string); !ok {
-		return false, errors.New("Invalid sid in session")
-	}
-
 	if isAuthed, ok := authenticated.(bool); !ok || !isAuthed {
 		return false, errors.New("User is not authenticated in session")
 	}
 
-	client := ipa.NewDefaultClientWithSession(sid.(string))
-	user, err := client.UserShow(username.(string))
-	if err != nil {
-		return false, fmt.Errorf("Failed to refresh FreeIPA user session: %w", err)
+	loginAt, _ := sess.Get(SessionKeyLoginAt).(int64)
+	if revoked, err := sessionRevoked(r.storage, username.(string), loginAt); err != nil {
+		return false, fmt.Errorf("Failed to check session revocation: %w", err)
+	} else if revoked {
+		return false, errors.New("Session has been revoked")
 	}
 
-	c.Locals(ContextKeyUsername, username)
-	c.Locals(ContextKeyUser, user)
-	c.Locals(ContextKeyIPAClient, client)
+	if magicLink {
+		// Magic link sessions have no FreeIPA session so the user is
+		// re-checked on every request
+		user, err := r.adminClient.UserShow(username.(string))
+		if err != nil {
+			return false, fmt.Errorf("Failed to fetch magic link user: %w", err)
+		}
+
+		if !magicLinkAllowed(user) {
+			return false, errors.New("User is no longer allowed to login with magic links")
+		}
+
+		c.Locals(ContextKeyUsername, username)
+		c.Locals(ContextKeyUser, user)
+		c.Locals(ContextKeyMagicLink, true)
+	} else {
+		if _, ok := sid.(string); !ok {
+			return false, errors.New("Invalid sid in session")
+		}
+
+		client := ipa.NewDefaultClientWithSession(sid.(string))
+		user, err := client.UserShow(username.(string))
+		if err != nil {
+			return false, fmt.Errorf("Failed to refresh FreeIPA user session: %w", err)
+		}
+
+		c.Locals(ContextKeyUsername, username)
+		c.Locals(ContextKeyUser, user)
+		c.Locals(ContextKeyIPAClient, client)
+	}
 
 	// Update session expiry time
 	sess.SetExpiry(time.Duration(viper.GetInt("server.session_idle_timeout")) * time.Second)
@@ -154,17 +208,37 @@ func (r *Router) RequireMFA(c *fiber.Ctx) error {
 
 	user := r.user(c)
 	if !user.OTPOnly() {
-		return c.Status(fiber.StatusUnauthorized).SendString("You must enable Two-Factor Authentication first!")
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "You must enable Two-Factor Authentication first!"))
 	}
 
 	return c.Next()
 }
 
+// RequirePassword rejects sessions that were started with a magic link.
+// Sensitive actions require the user to login with their password.
+func (r *Router) RequirePassword(c *fiber.Ctx) error {
+	if magicLink, _ := c.Locals(ContextKeyMagicLink).(bool); !magicLink {
+		return c.Next()
+	}
+
+	log.WithFields(log.Fields{
+		"username": c.Locals(ContextKeyUsername),
+		"path":     c.Path(),
+		"ip":       RemoteIP(c),
+	}).Info("Password login required for magic link session")
+
+	if c.Get("HX-Request", "false") == "true" {
+		return c.Status(fiber.StatusForbidden).SendString(tr(c, "Please sign in with your password to make this change"))
+	}
+
+	return c.Redirect("/account")
+}
+
 func (r *Router) CheckUser(c *fiber.Ctx) error {
 	username := c.FormValue("username")
 
 	if username == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please provide a username")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide a username"))
 	}
 
 	if isBlocked(username) {
@@ -172,7 +246,13 @@ func (r *Router) CheckUser(c *fiber.Ctx) error {
 			"username": username,
 		}).Warn("AUDIT User account is blocked from logging in")
 		r.metrics.totalFailedLogins.Inc()
-		return c.Status(fiber.StatusUnauthorized).SendString("Invalid username")
+		r.audit(c, &AuditEvent{
+			Action:  AuditLogin,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "blocked",
+		})
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid username"))
 	}
 
 	userRec, err := r.adminClient.UserShow(username)
@@ -185,7 +265,7 @@ func (r *Router) CheckUser(c *fiber.Ctx) error {
 
 			if !viper.GetBool("accounts.hide_invalid_username_error") {
 				r.metrics.totalFailedLogins.Inc()
-				return c.Status(fiber.StatusUnauthorized).SendString("Invalid username")
+				return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid username"))
 			}
 			userRec = new(ipa.User)
 			userRec.Username = username
@@ -195,7 +275,7 @@ func (r *Router) CheckUser(c *fiber.Ctx) error {
 				"username": username,
 			}).Error("Failed to fetch user info from FreeIPA")
 			r.metrics.totalFailedLogins.Inc()
-			return c.Status(fiber.StatusInternalServerError).SendString("Fatal system error")
+			return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Fatal system error"))
 		}
 	}
 
@@ -204,7 +284,13 @@ func (r *Router) CheckUser(c *fiber.Ctx) error {
 			"username": username,
 		}).Warn("AUDIT User account is locked in FreeIPA")
 		r.metrics.totalFailedLogins.Inc()
-		return c.Status(fiber.StatusUnauthorized).SendString("User account is locked")
+		r.audit(c, &AuditEvent{
+			Action:  AuditLogin,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "locked",
+		})
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "User account is locked"))
 	}
 
 	log.WithFields(log.Fields{
@@ -227,11 +313,11 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 	otp := c.FormValue("otp")
 
 	if username == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please provide a username")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide a username"))
 	}
 
 	if password == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please provide a password")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide a password"))
 	}
 
 	if isBlocked(username) {
@@ -239,7 +325,13 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 			"username": username,
 		}).Warn("AUDIT User account is blocked from logging in")
 		r.metrics.totalFailedLogins.Inc()
-		return c.Status(fiber.StatusUnauthorized).SendString("Invalid credentials")
+		r.audit(c, &AuditEvent{
+			Action:  AuditLogin,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "blocked",
+		})
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
 	}
 
 	client := ipa.NewDefaultClient()
@@ -252,33 +344,7 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 				"err":      err,
 			}).Info("Password expired, forcing change")
 
-			sess, err := r.session(c)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).SendString("")
-			}
-
-			err = sess.Regenerate()
-			if err != nil {
-				return err
-			}
-
-			sess.Set(SessionKeyAuthenticated, false)
-			sess.Set(SessionKeyUsername, username)
-
-			if err := r.sessionSave(c, sess); err != nil {
-				return c.Status(fiber.StatusInternalServerError).SendString("")
-			}
-
-			userRec, err := r.adminClient.UserShow(username)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).SendString("")
-			}
-
-			vars := fiber.Map{
-				"username": username,
-				"user":     userRec,
-			}
-			return c.Render("login-password-expired.html", vars)
+			return r.passwordChangeForm(c, username, false)
 		default:
 			log.WithFields(log.Fields{
 				"username": username,
@@ -286,7 +352,13 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 				"err":      err,
 			}).Error("AUDIT Failed login attempt")
 			r.metrics.totalFailedLogins.Inc()
-			return c.Status(fiber.StatusUnauthorized).SendString("Invalid credentials")
+			r.audit(c, &AuditEvent{
+				Action:  AuditLogin,
+				Outcome: AuditFailure,
+				Target:  username,
+				Reason:  "invalid credentials",
+			})
+			return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
 		}
 	}
 
@@ -297,7 +369,32 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 			"err":      err,
 		}).Error("Failed to ping FreeIPA")
 		r.metrics.totalFailedLogins.Inc()
-		return c.Status(fiber.StatusUnauthorized).SendString("Invalid credentials")
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
+	}
+
+	if viper.GetBool("accounts.force_password_change") {
+		userRec, err := r.adminClient.UserShow(username)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": username,
+				"err":      err,
+			}).Error("Failed to fetch user info from FreeIPA")
+			return c.Status(fiber.StatusInternalServerError).SendString("")
+		}
+
+		if passwordChangeRequired(userRec, time.Now()) {
+			log.WithFields(log.Fields{
+				"username":  username,
+				"ip":        RemoteIP(c),
+				"expire_at": userRec.PasswdExpire,
+			}).Info("AUDIT Password flagged for change by FreeIPA, forcing change")
+			r.audit(c, &AuditEvent{
+				Action: AuditPasswordChangeForced,
+				Actor:  username,
+				Target: username,
+			})
+			return r.passwordChangeForm(c, username, true)
+		}
 	}
 
 	sess, err := r.session(c)
@@ -313,11 +410,19 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 	sess.Set(SessionKeyAuthenticated, true)
 	sess.Set(SessionKeyUsername, username)
 	sess.Set(SessionKeySID, client.SessionID())
+	sess.Set(SessionKeyLanguage, r.sessionLanguage(username))
+	sess.Set(SessionKeyLoginAt, time.Now().UnixNano())
 
 	if err := r.sessionSave(c, sess); err != nil {
 		return err
 	}
 
+	r.audit(c, &AuditEvent{
+		Action: AuditLogin,
+		Actor:  username,
+		Target: username,
+	})
+
 	if viper.IsSet("hydra.admin_url") && challenge != "" {
 		return r.LoginOAuthPost(username, challenge, c)
 	}
@@ -327,7 +432,45 @@ func (r *Router) Authenticate(c *fiber.Ctx) error {
 		"ip":       RemoteIP(c),
 	}).Info("AUDIT User logged in successfully")
 	r.metrics.totalLogins.Inc()
+	r.webhooks.Emit(EventLogin, username, RemoteIP(c), map[string]interface{}{
+		"method": "password",
+	})
 
 	c.Set("HX-Redirect", "/")
 	return c.Status(fiber.StatusNoContent).SendString("")
 }
+
+// passwordChangeForm starts an unauthenticated session for username and
+// renders the expired password form. The user is logged in once the password
+// is changed.
+func (r *Router) passwordChangeForm(c *fiber.Ctx, username string, forced bool) error {
+	sess, err := r.session(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("")
+	}
+
+	err = sess.Regenerate()
+	if err != nil {
+		return err
+	}
+
+	sess.Set(SessionKeyAuthenticated, false)
+	sess.Set(SessionKeyUsername, username)
+
+	if err := r.sessionSave(c, sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("")
+	}
+
+	userRec, err := r.adminClient.UserShow(username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("")
+	}
+
+	vars := fiber.Map{
+		"username": username,
+		"user":     userRec,
+		"policy":   r.pwpolicy.Get(username),
+		"forced":   forced,
+	}
+	return c.Render("login-password-expired.html", vars)
+}
@@ -3,16 +3,26 @@ package server
 var Version = "dev"
 
 const (
-	SessionKeyAuthenticated = "authenticated"
-	SessionKeySID           = "sid"
-	SessionKeyUsername      = "user"
-	SessionKeyCSRF          = "csrf"
-	ContextKeyUser          = "user"
-	ContextKeyUsername      = "username"
-	ContextKeyIPAClient     = "ipa"
-	UserCategoryUnverified  = "mokey-user-unverified"
-	TokenAccountVerify      = "verify"
-	TokenPasswordReset      = "reset"
-	TokenUsedPrefix         = "used-"
-	TokenIssuedPrefix       = "issued-"
+	SessionKeyAuthenticated  = "authenticated"
+	SessionKeySID            = "sid"
+	SessionKeyUsername       = "user"
+	SessionKeyCSRF           = "csrf"
+	SessionKeyExpiryDismiss  = "pw-expiry-dismissed"
+	SessionKeyMagicLink      = "magic-link"
+	SessionKeyLanguage       = "lang"
+	SessionKeyLoginAt        = "login-at"
+	ContextKeyUser           = "user"
+	ContextKeyUsername       = "username"
+	ContextKeyIPAClient      = "ipa"
+	ContextKeyMagicLink      = "magicLink"
+	ContextKeyLanguage       = "lang"
+	UserCategoryUnverified   = "mokey-user-unverified"
+	TokenAccountVerify       = "verify"
+	TokenPasswordReset       = "reset"
+	TokenEmailChange         = "email"
+	TokenEmailCancel         = "email-cancel"
+	TokenMagicLink           = "magic"
+	TokenUsedPrefix          = "used-"
+	TokenIssuedPrefix        = "issued-"
+	StoragePrefixEmailChange = "email-change-"
 )
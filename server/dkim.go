@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/spf13/viper"
+)
+
+// NewDKIMSignOptions returns the DKIM signing options from the email.dkim_*
+// config. Returns nil if email.dkim_private_key is not set.
+func NewDKIMSignOptions() (*dkim.SignOptions, error) {
+	keyFile := viper.GetString("email.dkim_private_key")
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	domain := viper.GetString("email.dkim_domain")
+	if domain == "" {
+		from, err := ParseFromAddress()
+		if err != nil {
+			return nil, err
+		}
+		domain = addressDomain(from.Address)
+	}
+
+	selector := viper.GetString("email.dkim_selector")
+	if domain == "" || selector == "" {
+		return nil, errors.New("Please set email.dkim_domain and email.dkim_selector to enable DKIM signing")
+	}
+
+	headers := viper.GetStringSlice("email.dkim_headers")
+	hasFrom := false
+	for _, h := range headers {
+		if strings.EqualFold(h, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		return nil, errors.New("email.dkim_headers must include the From header")
+	}
+
+	signer, err := LoadDKIMPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 signer,
+		Hash:                   crypto.SHA256,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             headers,
+	}, nil
+}
+
+// LoadDKIMPrivateKey reads a PEM encoded RSA or Ed25519 private key in PKCS1
+// or PKCS8 format
+func LoadDKIMPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Invalid DKIM private key %s: no PEM data found", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+
+		return nil, fmt.Errorf("Unsupported DKIM private key type %T, must be RSA or Ed25519", key)
+	}
+
+	return nil, fmt.Errorf("Unsupported DKIM private key PEM type: %s", block.Type)
+}
+
+// dkimSign returns msg with a DKIM-Signature header prepended
+func dkimSign(msg []byte, opts *dkim.SignOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := dkim.Sign(&buf, bytes.NewReader(msg), opts); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -6,19 +6,23 @@ package server
 
 import (
 	"bytes"
-	"crypto/tls"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
-	"net"
-	"net/smtp"
+	"net/mail"
 	"net/textproto"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/dustin/go-humanize"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mileusna/useragent"
 	log "github.com/sirupsen/logrus"
@@ -26,16 +30,32 @@ import (
 	"github.com/ubccr/goipa"
 )
 
-const crlf = "\r\n"
+const (
+	crlf = "\r\n"
+
+	// Max length of a header line before it is folded (RFC 5322 2.1.1)
+	maxHeaderLineLength = 78
+)
 
 type Emailer struct {
 	templates *template.Template
 	storage   fiber.Storage
+	transport MailTransport
+	dkim      *dkim.SignOptions
+
+	// Optional lookup of the preferred language of a user
+	language func(username string) (string, error)
+
+	// OpenPGP keys of users. nil if keys are not supported.
+	pgpKeys PGPKeyStore
 }
 
+// BaseURL returns the base URL used for links in emails. ctx may be nil when
+// sending emails outside of an http request in which case email.base_url must
+// be set.
 func BaseURL(ctx *fiber.Ctx) string {
 	baseURL := viper.GetString("email.base_url")
-	if baseURL == "" {
+	if baseURL == "" && ctx != nil {
 		baseURL = ctx.BaseURL()
 	}
 
@@ -66,7 +86,130 @@ func NewEmailer(storage fiber.Storage) (*Emailer, error) {
 		}
 	}
 
-	return &Emailer{storage: storage, templates: tmpl}, nil
+	if _, err := ParseFromAddress(); err != nil {
+		return nil, err
+	}
+
+	if err := LoadTranslations(); err != nil {
+		return nil, err
+	}
+
+	transport, err := NewMailTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	dkimOpts, err := NewDKIMSignOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Emailer{
+		storage:   storage,
+		templates: tmpl,
+		transport: transport,
+		dkim:      dkimOpts,
+		pgpKeys:   NewPGPKeyStore(storage, nil),
+	}, nil
+}
+
+// UseIPARPC looks up the preferred language and OpenPGP key of users in
+// FreeIPA using rpc
+func (e *Emailer) UseIPARPC(rpc *IPARPC) {
+	e.language = rpc.PreferredLanguage
+	e.pgpKeys = NewPGPKeyStore(e.storage, rpc)
+}
+
+// Language returns the language emails to user are rendered in. The users
+// preferredLanguage is used if set, otherwise the language of the current
+// request or the default language.
+func (e *Emailer) Language(user *ipa.User, ctx *fiber.Ctx) string {
+	prefs := make([]string, 0, 2)
+
+	if e.language != nil && user.Username != "" {
+		lang, err := e.language(user.Username)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Warn("Failed to fetch preferred language for email")
+		} else if lang != "" {
+			prefs = append(prefs, lang)
+		}
+	}
+
+	if ctx != nil {
+		if lang, ok := ctx.Locals(ContextKeyLanguage).(string); ok && lang != "" {
+			prefs = append(prefs, lang)
+		}
+	}
+
+	return MatchLanguage(prefs...)
+}
+
+// ParseFromAddress parses the email.from address which may include a display
+// name, for example "HPC Support <support@example.com>"
+func ParseFromAddress() (*mail.Address, error) {
+	from, err := mail.ParseAddress(viper.GetString("email.from"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config value for email.from: %w", err)
+	}
+
+	return from, nil
+}
+
+// formatAddress returns addr formatted for use in a header. Non-ASCII display
+// names are encoded per RFC 2047.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+
+	return addr.String()
+}
+
+func addressDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		return addr[i+1:]
+	}
+
+	return ""
+}
+
+// newMessageID returns a unique Message-ID for domain
+func newMessageID(domain string) (string, error) {
+	rnd := make([]byte, 16)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
+
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(rnd), domain), nil
+}
+
+// foldHeader returns the header field name: value folded at whitespace so no
+// line exceeds maxHeaderLineLength
+func foldHeader(name, value string) string {
+	if strings.Contains(value, crlf) {
+		return name + ": " + value
+	}
+
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLen := len(name) + 1
+	for _, word := range strings.Split(value, " ") {
+		if lineLen > 0 && lineLen+1+len(word) > maxHeaderLineLength {
+			b.WriteString(crlf)
+			lineLen = 0
+		}
+		b.WriteString(" " + word)
+		lineLen += 1 + len(word)
+	}
+
+	return b.String()
 }
 
 func (e *Emailer) SendPasswordResetEmail(user *ipa.User, ctx *fiber.Ctx) error {
@@ -83,6 +226,20 @@ func (e *Emailer) SendPasswordResetEmail(user *ipa.User, ctx *fiber.Ctx) error {
 	return e.sendEmail(user, ctx, "Please reset your password", "password-reset", vars)
 }
 
+func (e *Emailer) SendMagicLinkEmail(user *ipa.User, ctx *fiber.Ctx) error {
+	token, err := NewToken(user.Username, user.Email, TokenMagicLink, e.storage)
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]interface{}{
+		"link":         fmt.Sprintf("%s/auth/magic/%s", BaseURL(ctx), token),
+		"link_expires": strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(time.Duration(viper.GetInt("accounts.magic_link_max_age"))*time.Second), "", "")),
+	}
+
+	return e.sendEmail(user, ctx, "Your sign-in link", "magic-link", vars)
+}
+
 func (e *Emailer) SendAccountVerifyEmail(user *ipa.User, ctx *fiber.Ctx) error {
 	token, err := NewToken(user.Username, user.Email, TokenAccountVerify, e.storage)
 	if err != nil {
@@ -97,22 +254,95 @@ func (e *Emailer) SendAccountVerifyEmail(user *ipa.User, ctx *fiber.Ctx) error {
 	return e.sendEmail(user, ctx, "Verify your email", "account-verify", vars)
 }
 
+func (e *Emailer) SendAccountVerifyReminderEmail(user *ipa.User, deleteAt time.Time, ctx *fiber.Ctx) error {
+	token, err := NewToken(user.Username, user.Email, TokenAccountVerify, e.storage)
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]interface{}{
+		"link":         fmt.Sprintf("%s/auth/verify/%s", BaseURL(ctx), token),
+		"link_expires": strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second), "", "")),
+		"delete_at":    deleteAt,
+		"delete_in":    strings.TrimSpace(humanize.RelTime(time.Now(), deleteAt, "", "")),
+	}
+
+	return e.sendEmail(user, ctx, "Reminder: verify your email", "account-verify-reminder", vars)
+}
+
+func (e *Emailer) SendPasswordExpiringEmail(user *ipa.User, ctx *fiber.Ctx) error {
+	vars := map[string]interface{}{
+		"link":      fmt.Sprintf("%s/password", BaseURL(ctx)),
+		"expire_at": user.PasswdExpire,
+		"expire_in": strings.TrimSpace(humanize.RelTime(time.Now(), user.PasswdExpire, "", "")),
+	}
+
+	return e.sendEmail(user, ctx, "Your password will expire soon", "password-expiring", vars)
+}
+
+func (e *Emailer) SendEmailChangeConfirmEmail(user *ipa.User, newEmail string, ctx *fiber.Ctx) error {
+	token, err := NewToken(user.Username, newEmail, TokenEmailChange, e.storage)
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]interface{}{
+		"link":         fmt.Sprintf("%s/auth/email/%s", BaseURL(ctx), token),
+		"link_expires": strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second), "", "")),
+		"old_email":    user.Email,
+		"new_email":    newEmail,
+	}
+
+	// Confirmation is sent to the new address
+	recipient := *user
+	recipient.Email = newEmail
+
+	return e.sendEmail(&recipient, ctx, "Confirm your new email address", "email-change-confirm", vars)
+}
+
+func (e *Emailer) SendEmailChangeNotifyEmail(user *ipa.User, newEmail string, ctx *fiber.Ctx) error {
+	token, err := NewToken(user.Username, user.Email, TokenEmailCancel, e.storage)
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]interface{}{
+		"link":         fmt.Sprintf("%s/auth/email/cancel/%s", BaseURL(ctx), token),
+		"link_expires": strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second), "", "")),
+		"old_email":    user.Email,
+		"new_email":    newEmail,
+	}
+
+	return e.sendEmail(user, ctx, "Email address change requested", "email-change-notify", vars)
+}
+
+func (e *Emailer) SendEmailChangedEmail(user *ipa.User, newEmail string, ctx *fiber.Ctx) error {
+	lang := e.Language(user, ctx)
+	vars := map[string]interface{}{
+		"lang":  lang,
+		"event": T(lang, "Email address changed to %s", newEmail),
+	}
+
+	return e.sendEmail(user, ctx, "Your email address has been changed", "account-updated", vars)
+}
+
 func (e *Emailer) SendWelcomeEmail(user *ipa.User, ctx *fiber.Ctx) error {
 	vars := map[string]interface{}{
 		"getting_started_url": viper.GetString("site.getting_started_url"),
 	}
 
-	subject := "Welcome to " + viper.GetString("site.name")
+	lang := e.Language(user, ctx)
+	vars["lang"] = lang
+	subject := T(lang, "Welcome to %s", viper.GetString("site.name"))
 
 	return e.sendEmail(user, ctx, subject, "welcome", vars)
 }
 
 func (e *Emailer) SendMFAChangedEmail(enabled bool, user *ipa.User, ctx *fiber.Ctx) error {
-	verb := "Disabled"
+	event := "Two-Factor Authentication Disabled"
 	if enabled {
-		verb = "Enabled"
+		event = "Two-Factor Authentication Enabled"
 	}
-	event := "Two-Factor Authentication " + verb
 
 	vars := map[string]interface{}{
 		"event": event,
@@ -122,11 +352,10 @@ func (e *Emailer) SendMFAChangedEmail(enabled bool, user *ipa.User, ctx *fiber.C
 }
 
 func (e *Emailer) SendSSHKeyUpdatedEmail(added bool, user *ipa.User, ctx *fiber.Ctx) error {
-	verb := "removed"
+	event := "SSH key removed"
 	if added {
-		verb = "added"
+		event = "SSH key added"
 	}
-	event := "SSH key " + verb
 
 	vars := map[string]interface{}{
 		"event": event,
@@ -135,12 +364,49 @@ func (e *Emailer) SendSSHKeyUpdatedEmail(added bool, user *ipa.User, ctx *fiber.
 	return e.sendEmail(user, ctx, event, "account-updated", vars)
 }
 
+// SendSSHKeysImportedEmail sends a single notification listing all keys
+// imported from an authorized_keys file
+func (e *Emailer) SendSSHKeysImportedEmail(user *ipa.User, keys []*ipa.SSHAuthorizedKey, ctx *fiber.Ctx) error {
+	lang := e.Language(user, ctx)
+	event := T(lang, "SSH key added")
+	if len(keys) > 1 {
+		event = T(lang, "%d SSH keys added", len(keys))
+	}
+
+	details := make([]string, len(keys))
+	for i, k := range keys {
+		details[i] = k.Fingerprint
+		if k.Comment != "" {
+			details[i] = k.Comment + " (" + k.Fingerprint + ")"
+		}
+	}
+
+	vars := map[string]interface{}{
+		"lang":    lang,
+		"event":   event,
+		"details": details,
+	}
+
+	return e.sendEmail(user, ctx, event, "account-updated", vars)
+}
+
+func (e *Emailer) SendSSHKeyExpiringEmail(user *ipa.User, key *ipa.SSHAuthorizedKey, rec *SSHKeyRecord, ctx *fiber.Ctx) error {
+	vars := map[string]interface{}{
+		"link":        fmt.Sprintf("%s/sshkey", BaseURL(ctx)),
+		"title":       key.Comment,
+		"fingerprint": key.Fingerprint,
+		"expire_at":   rec.ExpiresAt,
+		"expire_in":   strings.TrimSpace(humanize.RelTime(time.Now(), rec.ExpiresAt, "", "")),
+	}
+
+	return e.sendEmail(user, ctx, "Your SSH key will expire soon", "sshkey-expiring", vars)
+}
+
 func (e *Emailer) SendOTPTokenUpdatedEmail(added bool, user *ipa.User, ctx *fiber.Ctx) error {
-	verb := "removed"
+	event := "OTP token removed"
 	if added {
-		verb = "added"
+		event = "OTP token added"
 	}
-	event := "OTP token " + verb
 
 	vars := map[string]interface{}{
 		"event": event,
@@ -157,6 +423,37 @@ func (e *Emailer) SendPasswordChangedEmail(user *ipa.User, ctx *fiber.Ctx) error
 	return e.sendEmail(user, ctx, "Your password has been changed", "account-updated", vars)
 }
 
+// SendPGPKeyUpdatedEmail notifies user their OpenPGP key was changed. The
+// notice is never encrypted to the new key so the owner can read it if
+// someone else added the key. It's encrypted to previous, the key being
+// replaced or removed, if set.
+func (e *Emailer) SendPGPKeyUpdatedEmail(added bool, user *ipa.User, previous *PGPKeyRecord, ctx *fiber.Ctx) error {
+	event := "Encryption key removed"
+	if added {
+		event = "Encryption key added"
+	}
+
+	vars := map[string]interface{}{
+		"event": event,
+	}
+
+	var keys openpgp.EntityList
+	if previous != nil {
+		var err error
+		keys, err = previous.EntityList()
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, err := e.renderMessage(user, ctx, event, "account-updated", vars, keys)
+	if err != nil {
+		return err
+	}
+
+	return e.send(user, msg)
+}
+
 func (e *Emailer) quotedBody(body []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	w := quotedprintable.NewWriter(&buf)
@@ -179,51 +476,119 @@ func (e *Emailer) sendEmail(user *ipa.User, ctx *fiber.Ctx, subject, tmpl string
 		"username": user.Username,
 	}).Debug("Sending email to user")
 
+	msg, err := e.buildMessage(user, ctx, subject, tmpl, data)
+	if err != nil {
+		return err
+	}
+
+	return e.send(user, msg)
+}
+
+func (e *Emailer) send(user *ipa.User, msg []byte) error {
+	from, err := ParseFromAddress()
+	if err != nil {
+		return err
+	}
+
+	return e.transport.Send(from.Address, []string{user.Email}, msg)
+}
+
+// templateData returns data with the variables common to all email templates
+// set
+func (e *Emailer) templateData(user *ipa.User, ctx *fiber.Ctx, from *mail.Address, data map[string]interface{}) map[string]interface{} {
 	if data == nil {
 		data = make(map[string]interface{})
 	}
 
-	ua := useragent.Parse(ctx.Get(fiber.HeaderUserAgent))
+	if ctx != nil {
+		ua := useragent.Parse(ctx.Get(fiber.HeaderUserAgent))
+		data["os"] = ua.OS
+		data["browser"] = ua.Name
+	}
+
+	if lang, ok := data["lang"].(string); !ok || lang == "" {
+		data["lang"] = e.Language(user, ctx)
+	}
 
-	data["os"] = ua.OS
-	data["browser"] = ua.Name
 	data["user"] = user
 	data["date"] = time.Now()
-	data["contact"] = viper.GetString("email.from")
+	data["contact"] = from.Address
 	data["sig"] = viper.GetString("email.signature")
 	data["site_name"] = viper.GetString("site.name")
 	data["help_url"] = viper.GetString("site.help_url")
 	data["homepage"] = viper.GetString("site.homepage")
 	data["base_url"] = BaseURL(ctx)
 
+	return data
+}
+
+// buildMessage renders the text and html templates and returns the complete
+// MIME message, encrypted to the users OpenPGP key if tmpl is one of the
+// email.pgp_templates and DKIM signed if enabled
+func (e *Emailer) buildMessage(user *ipa.User, ctx *fiber.Ctx, subject, tmpl string, data map[string]interface{}) ([]byte, error) {
+	pgpKeys, err := e.encryptionKeys(user, tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.renderMessage(user, ctx, subject, tmpl, data, pgpKeys)
+}
+
+// renderMessage renders the text and html templates and returns the complete
+// MIME message, encrypted to pgpKeys if not nil
+func (e *Emailer) renderMessage(user *ipa.User, ctx *fiber.Ctx, subject, tmpl string, data map[string]interface{}, pgpKeys openpgp.EntityList) ([]byte, error) {
+	from, err := ParseFromAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	data = e.templateData(user, ctx, from, data)
+	lang := data["lang"].(string)
+
 	var text bytes.Buffer
-	err := e.templates.ExecuteTemplate(&text, tmpl+".txt", data)
+	err = e.templates.ExecuteTemplate(&text, tmpl+".txt", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	txtBody, err := e.quotedBody(text.Bytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var html bytes.Buffer
 	err = e.templates.ExecuteTemplate(&html, tmpl+".html", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlBody, err := e.quotedBody(html.Bytes())
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	to := &mail.Address{
+		Name:    strings.TrimSpace(user.First + " " + user.Last),
+		Address: user.Email,
+	}
+
+	domain := addressDomain(from.Address)
+	if e.dkim != nil {
+		domain = e.dkim.Domain
+	}
+
+	messageID, err := newMessageID(domain)
+	if err != nil {
+		return nil, err
 	}
 
 	header := make(textproto.MIMEHeader)
 	header.Set("Mime-Version", "1.0")
 	header.Set("Date", time.Now().Format(time.RFC1123Z))
-	header.Set("To", user.Email)
-	header.Set("Subject", fmt.Sprintf("[%s] %s", viper.GetString("site.name"), subject))
-	header.Set("From", viper.GetString("email.from"))
+	header.Set("Message-ID", messageID)
+	header.Set("To", formatAddress(to))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", fmt.Sprintf("[%s] %s", viper.GetString("site.name"), T(lang, subject))))
+	header.Set("From", formatAddress(from))
 
 	var multipartBody bytes.Buffer
 	mp := multipart.NewWriter(&multipartBody)
@@ -235,12 +600,12 @@ func (e *Emailer) sendEmail(user *ipa.User, ctx *fiber.Ctx, subject, tmpl string
 			"Content-Transfer-Encoding": []string{"quoted-printable"},
 		}))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = txtPart.Write(txtBody)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlPart, err := mp.CreatePart(textproto.MIMEHeader(
@@ -249,91 +614,49 @@ func (e *Emailer) sendEmail(user *ipa.User, ctx *fiber.Ctx, subject, tmpl string
 			"Content-Transfer-Encoding": []string{"quoted-printable"},
 		}))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = htmlPart.Write(htmlBody)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = mp.Close()
 	if err != nil {
-		return err
-	}
-
-	smtpHostPort := fmt.Sprintf("%s:%d", viper.GetString("email.smtp_host"), viper.GetInt("email.smtp_port"))
-	var conn net.Conn
-	tlsMode := viper.GetString("email.smtp_tls")
-
-	switch tlsMode {
-	case "on":
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         viper.GetString("email.smtp_host"),
-		}
-		conn, err = tls.Dial("tcp", smtpHostPort, tlsConfig)
-	case "off", "starttls":
-		conn, err = net.Dial("tcp", smtpHostPort)
-	default:
-		return fmt.Errorf("invalid config value for smtp_tls: %s", tlsMode)
-	}
-
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c, err := smtp.NewClient(conn, viper.GetString("email.smtp_host"))
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+	body := multipartBody.Bytes()
 
-	if tlsMode == "starttls" {
-		err := c.StartTLS(&tls.Config{
-			ServerName: viper.GetString("email.smtp_host"),
-		})
+	if pgpKeys != nil {
+		contentType, encrypted, err := pgpMIME(header.Get("Content-Type"), body, pgpKeys)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	}
 
-	if viper.IsSet("email.smtp_username") && viper.IsSet("email.smtp_password") {
-		auth := smtp.PlainAuth("", viper.GetString("email.smtp_username"), viper.GetString("email.smtp_password"), viper.GetString("email.smtp_host"))
-		if err = c.Auth(auth); err != nil {
-			log.Error(err)
-			return err
-		}
-	}
-	if err = c.Mail(viper.GetString("email.from")); err != nil {
-		log.Error(err)
-		return err
-	}
-	if err = c.Rcpt(user.Email); err != nil {
-		log.Error(err)
-		return err
+		header.Set("Content-Type", contentType)
+		body = encrypted
 	}
 
-	wc, err := c.Data()
-	if err != nil {
-		return err
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
 	}
-	defer wc.Close()
+	sort.Strings(keys)
 
-	var buf bytes.Buffer
-	for k, vv := range header {
-		for _, v := range vv {
-			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(&buf, "%s\r\n", foldHeader(k, v))
 		}
 	}
 	fmt.Fprintf(&buf, "\r\n")
+	buf.Write(body)
 
-	if _, err = buf.WriteTo(wc); err != nil {
-		return err
-	}
-	if _, err = wc.Write(multipartBody.Bytes()); err != nil {
-		return err
+	if e.dkim == nil {
+		return buf.Bytes(), nil
 	}
 
-	return nil
+	return dkimSign(buf.Bytes(), e.dkim)
 }
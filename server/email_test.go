@@ -0,0 +1,462 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+type testMessage struct {
+	header mail.Header
+	text   string
+	html   string
+}
+
+func newTestEmailer(t *testing.T) (*Emailer, *MemoryTransport) {
+	SetDefaults()
+	secret, _ := GenerateSecret(32)
+	viper.Set("email.token_secret", secret)
+	viper.Set("email.token_max_age", 3600)
+	viper.Set("email.transport", "memory")
+	viper.Set("email.base_url", "https://mokey.example.com")
+	viper.Set("site.name", "Example HPC")
+	t.Cleanup(func() {
+		viper.Set("email.transport", "smtp")
+		viper.Set("email.base_url", "")
+	})
+
+	emailer, err := NewEmailer(memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return emailer, emailer.transport.(*MemoryTransport)
+}
+
+func parseTestMessage(t *testing.T, data []byte) *testMessage {
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type: %s", mediaType)
+	}
+
+	m := &testMessage{header: msg.Header}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if part.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+			t.Fatalf("unexpected transfer encoding: %s", part.Header.Get("Content-Transfer-Encoding"))
+		}
+
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch part.Header.Get("Content-Type") {
+		case "text/plain; charset=utf-8":
+			m.text = string(body)
+		case "text/html; charset=utf-8":
+			m.html = string(body)
+		default:
+			t.Fatalf("unexpected part content type: %s", part.Header.Get("Content-Type"))
+		}
+	}
+
+	return m
+}
+
+func TestEmailMessages(t *testing.T) {
+	emailer, transport := newTestEmailer(t)
+
+	user := &ipa.User{
+		Username:     "jdoe",
+		First:        "John",
+		Last:         "Doe",
+		Email:        "jdoe@example.com",
+		PasswdExpire: time.Now().Add(72 * time.Hour),
+	}
+	key := parseTestKey(t, testKeyED25519)
+	key.Comment = "laptop"
+
+	tests := []struct {
+		name     string
+		send     func() error
+		to       string
+		subject  string
+		contains []string
+	}{
+		{"PasswordReset", func() error { return emailer.SendPasswordResetEmail(user, nil) },
+			user.Email, "Please reset your password", []string{"https://mokey.example.com/auth/resetpw/"}},
+		{"MagicLink", func() error { return emailer.SendMagicLinkEmail(user, nil) },
+			user.Email, "Your sign-in link", []string{"https://mokey.example.com/auth/magic/"}},
+		{"AccountVerify", func() error { return emailer.SendAccountVerifyEmail(user, nil) },
+			user.Email, "Verify your email", []string{"https://mokey.example.com/auth/verify/"}},
+		{"AccountVerifyReminder", func() error {
+			emailer.storage.Delete(TokenAccountVerify + TokenIssuedPrefix + user.Username)
+			return emailer.SendAccountVerifyReminderEmail(user, time.Now().Add(48*time.Hour), nil)
+		}, user.Email, "Reminder: verify your email", []string{"https://mokey.example.com/auth/verify/"}},
+		{"PasswordExpiring", func() error { return emailer.SendPasswordExpiringEmail(user, nil) },
+			user.Email, "Your password will expire soon", []string{"https://mokey.example.com/password"}},
+		{"EmailChangeConfirm", func() error { return emailer.SendEmailChangeConfirmEmail(user, "john@example.org", nil) },
+			"john@example.org", "Confirm your new email address", []string{"https://mokey.example.com/auth/email/", "john@example.org"}},
+		{"EmailChangeNotify", func() error { return emailer.SendEmailChangeNotifyEmail(user, "john@example.org", nil) },
+			user.Email, "Email address change requested", []string{"https://mokey.example.com/auth/email/cancel/", "john@example.org"}},
+		{"EmailChanged", func() error { return emailer.SendEmailChangedEmail(user, "john@example.org", nil) },
+			user.Email, "Your email address has been changed", []string{"Email address changed to john@example.org"}},
+		{"Welcome", func() error { return emailer.SendWelcomeEmail(user, nil) },
+			user.Email, "Welcome to Example HPC", []string{"jdoe"}},
+		{"MFAEnabled", func() error { return emailer.SendMFAChangedEmail(true, user, nil) },
+			user.Email, "Two-Factor Authentication Enabled", []string{"Two-Factor Authentication Enabled"}},
+		{"MFADisabled", func() error { return emailer.SendMFAChangedEmail(false, user, nil) },
+			user.Email, "Two-Factor Authentication Disabled", []string{"Two-Factor Authentication Disabled"}},
+		{"SSHKeyAdded", func() error { return emailer.SendSSHKeyUpdatedEmail(true, user, nil) },
+			user.Email, "SSH key added", []string{"SSH key added"}},
+		{"SSHKeyRemoved", func() error { return emailer.SendSSHKeyUpdatedEmail(false, user, nil) },
+			user.Email, "SSH key removed", []string{"SSH key removed"}},
+		{"SSHKeysImported", func() error {
+			return emailer.SendSSHKeysImportedEmail(user, []*ipa.SSHAuthorizedKey{key, parseTestKey(t, testKeyECDSA)}, nil)
+		}, user.Email, "2 SSH keys added", []string{"laptop (" + key.Fingerprint + ")"}},
+		{"SSHKeyExpiring", func() error {
+			return emailer.SendSSHKeyExpiringEmail(user, key, &SSHKeyRecord{ExpiresAt: time.Now().Add(72 * time.Hour)}, nil)
+		}, user.Email, "Your SSH key will expire soon", []string{"https://mokey.example.com/sshkey", key.Fingerprint}},
+		{"OTPTokenAdded", func() error { return emailer.SendOTPTokenUpdatedEmail(true, user, nil) },
+			user.Email, "OTP token added", []string{"OTP token added"}},
+		{"OTPTokenRemoved", func() error { return emailer.SendOTPTokenUpdatedEmail(false, user, nil) },
+			user.Email, "OTP token removed", []string{"OTP token removed"}},
+		{"PasswordChanged", func() error { return emailer.SendPasswordChangedEmail(user, nil) },
+			user.Email, "Your password has been changed", []string{"Password changed"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			transport.Reset()
+
+			if !assert.NoError(tt.send()) {
+				return
+			}
+
+			messages := transport.Messages()
+			if !assert.Len(messages, 1) {
+				return
+			}
+
+			assert.Equal("support@example.com", messages[0].From)
+			assert.Equal([]string{tt.to}, messages[0].To)
+
+			msg := parseTestMessage(t, messages[0].Data)
+			assert.Equal("1.0", msg.header.Get("Mime-Version"))
+			to, err := mail.ParseAddress(msg.header.Get("To"))
+			if assert.NoError(err) {
+				assert.Equal(tt.to, to.Address)
+				assert.Equal("John Doe", to.Name)
+			}
+			assert.Regexp(`^<[0-9a-f.]+@example\.com>$`, msg.header.Get("Message-Id"))
+			assert.Equal("support@example.com", msg.header.Get("From"))
+			assert.Equal("[Example HPC] "+tt.subject, msg.header.Get("Subject"))
+			_, err = msg.header.Date()
+			assert.NoError(err)
+
+			assert.Contains(msg.text, "John")
+			assert.True(strings.Contains(msg.html, "John"))
+			for _, s := range tt.contains {
+				assert.Contains(msg.text, s)
+			}
+		})
+	}
+}
+
+func TestEmailHeaderEncoding(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestEmailer(t)
+	viper.Set("email.from", "Équipe HPC <support@example.com>")
+	viper.Set("site.name", "Calcul Québec et compagnie pour la recherche scientifique avancée")
+	t.Cleanup(func() {
+		viper.Set("email.from", "support@example.com")
+	})
+
+	user := &ipa.User{
+		Username: "jdoe",
+		First:    "Jérôme",
+		Last:     "Doe",
+		Email:    "jdoe@example.com",
+	}
+
+	if !assert.NoError(emailer.SendPasswordChangedEmail(user, nil)) {
+		return
+	}
+
+	messages := transport.Messages()
+	if !assert.Len(messages, 1) {
+		return
+	}
+	assert.Equal("support@example.com", messages[0].From)
+
+	data := string(messages[0].Data)
+	headers, _, _ := strings.Cut(data, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		assert.LessOrEqual(len(line), maxHeaderLineLength)
+		for _, r := range line {
+			assert.Less(r, rune(128), "non-ASCII header: %s", line)
+		}
+	}
+
+	msg := parseTestMessage(t, messages[0].Data)
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.header.Get("Subject"))
+	if assert.NoError(err) {
+		assert.Equal("[Calcul Québec et compagnie pour la recherche scientifique avancée] Your password has been changed", subject)
+	}
+
+	to, err := mail.ParseAddress(msg.header.Get("To"))
+	if assert.NoError(err) {
+		assert.Equal("Jérôme Doe", to.Name)
+		assert.Equal("jdoe@example.com", to.Address)
+	}
+
+	from, err := mail.ParseAddress(msg.header.Get("From"))
+	if assert.NoError(err) {
+		assert.Equal("Équipe HPC", from.Name)
+		assert.Equal("support@example.com", from.Address)
+	}
+}
+
+func TestEmailDKIM(t *testing.T) {
+	_, rsaKey, _ := generateTestDKIMKey(t, "rsa")
+	_, edKey, _ := generateTestDKIMKey(t, "ed25519")
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"RSA", rsaKey},
+		{"Ed25519", edKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			viper.Set("email.dkim_private_key", tt.key)
+			viper.Set("email.dkim_selector", "mokey")
+			t.Cleanup(func() {
+				viper.Set("email.dkim_private_key", "")
+				viper.Set("email.dkim_selector", "")
+			})
+
+			emailer, transport := newTestEmailer(t)
+			if !assert.NotNil(emailer.dkim) {
+				return
+			}
+			assert.Equal("example.com", emailer.dkim.Domain)
+
+			user := &ipa.User{Username: "jdoe", First: "John", Last: "Doe", Email: "jdoe@example.com"}
+			if !assert.NoError(emailer.SendPasswordChangedEmail(user, nil)) {
+				return
+			}
+
+			messages := transport.Messages()
+			if !assert.Len(messages, 1) {
+				return
+			}
+
+			record := dkimTestRecord(t, emailer.dkim.Signer)
+			verifications, err := dkim.VerifyWithOptions(strings.NewReader(string(messages[0].Data)), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					assert.Equal("mokey._domainkey.example.com", domain)
+					return []string{record}, nil
+				},
+			})
+			if assert.NoError(err) && assert.Len(verifications, 1) {
+				assert.NoError(verifications[0].Err)
+				assert.Equal("example.com", verifications[0].Domain)
+				assert.Contains(verifications[0].HeaderKeys, "Message-ID")
+			}
+
+			// Tampering with the subject must break the signature
+			tampered := strings.Replace(string(messages[0].Data), "Your password has been changed", "Your password has been reset", 1)
+			verifications, err = dkim.VerifyWithOptions(strings.NewReader(tampered), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return []string{record}, nil
+				},
+			})
+			if assert.NoError(err) && assert.Len(verifications, 1) {
+				assert.Error(verifications[0].Err)
+			}
+		})
+	}
+}
+
+func TestLoadDKIMPrivateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	pkcs1, _, _ := generateTestDKIMKey(t, "rsa")
+	signer, err := LoadDKIMPrivateKey(pkcs1)
+	if assert.NoError(err) {
+		assert.IsType(&rsa.PrivateKey{}, signer)
+	}
+
+	_, _, ecdsaKey := generateTestDKIMKey(t, "ecdsa")
+	_, err = LoadDKIMPrivateKey(ecdsaKey)
+	assert.Error(err)
+
+	bogus := filepath.Join(t.TempDir(), "bogus.key")
+	os.WriteFile(bogus, []byte("not a key"), 0600)
+	_, err = LoadDKIMPrivateKey(bogus)
+	assert.Error(err)
+
+	viper.Set("email.dkim_private_key", pkcs1)
+	viper.Set("email.dkim_selector", "")
+	t.Cleanup(func() { viper.Set("email.dkim_private_key", "") })
+	_, err = NewDKIMSignOptions()
+	assert.Error(err)
+}
+
+// generateTestDKIMKey writes a PKCS1 RSA key or a PKCS8 Ed25519/RSA/ECDSA key
+// depending on kind and returns the paths as (pkcs1, pkcs8, pkcs8 ecdsa)
+func generateTestDKIMKey(t *testing.T, kind string) (string, string, string) {
+	dir := t.TempDir()
+	write := func(name, pemType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	var key interface{}
+	var err error
+	switch kind {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pkcs1Path string
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		pkcs1Path = write("pkcs1.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	}
+
+	path := write("pkcs8.key", "PRIVATE KEY", pkcs8)
+	if kind == "ecdsa" {
+		return "", "", path
+	}
+
+	return pkcs1Path, path, ""
+}
+
+// dkimTestRecord returns the DNS TXT record for the public key of signer
+func dkimTestRecord(t *testing.T, signer crypto.Signer) string {
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+
+	t.Fatalf("unsupported key type %T", signer.Public())
+	return ""
+}
+
+func TestFileTransport(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	transport := &FileTransport{Dir: dir}
+	assert.NoError(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("Subject: test\r\n\r\nhello\r\n")))
+	assert.NoError(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("Subject: test\r\n\r\nagain\r\n")))
+
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if assert.NoError(err) && assert.Len(files, 2) {
+		data, err := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+		assert.NoError(err)
+		assert.Contains(string(data), "Subject: test")
+	}
+
+	files, err = os.ReadDir(filepath.Join(dir, "tmp"))
+	if assert.NoError(err) {
+		assert.Len(files, 0)
+	}
+}
+
+func TestSendmailTransport(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "sendmail")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+".args\ncat > "+out+"\n"), 0700)
+	if !assert.NoError(err) {
+		return
+	}
+
+	transport := &SendmailTransport{Path: script}
+	if !assert.NoError(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("Subject: test\r\n\r\nhello\r\n"))) {
+		return
+	}
+
+	args, err := os.ReadFile(out + ".args")
+	if assert.NoError(err) {
+		assert.Equal("-i -f support@example.com -- jdoe@example.com\n", string(args))
+	}
+
+	data, err := os.ReadFile(out)
+	if assert.NoError(err) {
+		assert.Equal("Subject: test\r\n\r\nhello\r\n", string(data))
+	}
+
+	transport = &SendmailTransport{Path: filepath.Join(dir, "missing")}
+	assert.Error(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello")))
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EmailRejectDenylist = "denylist"
+	EmailRejectNoMX     = "no_mx"
+)
+
+var (
+	ErrDomainBlocked    = errors.New("Email domain is blocked")
+	ErrDomainNoMailHost = errors.New("Email domain does not accept mail")
+)
+
+// MXResolver looks up the DNS records used to decide if an email domain can
+// receive mail. *net.Resolver satisfies this interface.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// EmailDomainFilter rejects email addresses from denied domains and
+// optionally domains that can not receive mail. The denylist file is
+// re-read whenever its modification time changes.
+type EmailDomainFilter struct {
+	path      string
+	checkMX   bool
+	mxTimeout time.Duration
+	resolver  MXResolver
+	mu        sync.RWMutex
+	modTime   time.Time
+	domains   map[string]bool
+	patterns  []string
+}
+
+func NewEmailDomainFilter(path string, checkMX bool, mxTimeout time.Duration) *EmailDomainFilter {
+	return &EmailDomainFilter{
+		path:      path,
+		checkMX:   checkMX,
+		mxTimeout: mxTimeout,
+		resolver:  net.DefaultResolver,
+		domains:   make(map[string]bool),
+	}
+}
+
+// SetResolver overrides the DNS resolver used for MX checks
+func (f *EmailDomainFilter) SetResolver(resolver MXResolver) {
+	f.resolver = resolver
+}
+
+// Load reads the denylist file. Each line is either a domain name, which
+// also matches all of its subdomains, or a shell pattern such as
+// "*.example.com" or "mail?.example.net". Blank lines and lines starting with
+// # are ignored.
+func (f *EmailDomainFilter) Load() error {
+	if f.path == "" {
+		return nil
+	}
+
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	domains := make(map[string]bool)
+	patterns := make([]string, 0)
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "@")
+
+		if strings.ContainsAny(line, "*?[") {
+			if _, err := path.Match(line, ""); err != nil {
+				return fmt.Errorf("invalid domain pattern %q: %w", line, err)
+			}
+			patterns = append(patterns, line)
+			continue
+		}
+
+		domains[strings.TrimSuffix(line, ".")] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.domains = domains
+	f.patterns = patterns
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"path":     f.path,
+		"domains":  len(domains),
+		"patterns": len(patterns),
+	}).Info("Loaded email domain denylist")
+
+	return nil
+}
+
+// reload re-reads the denylist file if it has changed on disk
+func (f *EmailDomainFilter) reload() {
+	if f.path == "" {
+		return
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": f.path,
+			"err":  err,
+		}).Warn("Failed to stat email domain denylist")
+		return
+	}
+
+	f.mu.RLock()
+	changed := !info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := f.Load(); err != nil {
+		log.WithFields(log.Fields{
+			"path": f.path,
+			"err":  err,
+		}).Error("Failed to reload email domain denylist. Keeping previous list")
+	}
+}
+
+// Denied returns true if domain matches an entry in the denylist
+func (f *EmailDomainFilter) Denied(domain string) bool {
+	f.reload()
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for d := domain; d != ""; {
+		if f.domains[d] {
+			return true
+		}
+
+		dot := strings.Index(d, ".")
+		if dot == -1 {
+			break
+		}
+		d = d[dot+1:]
+	}
+
+	for _, p := range f.patterns {
+		if ok, _ := path.Match(p, domain); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AcceptsMail returns true if domain has MX records or, when no MX records
+// exist, an address record to use as an implicit MX (RFC 5321). Temporary DNS
+// failures are treated as success so signups are not rejected when DNS is
+// flaky.
+func (f *EmailDomainFilter) AcceptsMail(domain string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), f.mxTimeout)
+	defer cancel()
+
+	mxs, err := f.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		// Null MX (RFC 7505) explicitly states the domain accepts no mail
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return false
+		}
+		return true
+	}
+
+	if err != nil && !isNotFound(err) {
+		log.WithFields(log.Fields{
+			"domain": domain,
+			"err":    err,
+		}).Warn("Failed to lookup MX records for email domain")
+		return true
+	}
+
+	addrs, err := f.resolver.LookupHost(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return false
+		}
+
+		log.WithFields(log.Fields{
+			"domain": domain,
+			"err":    err,
+		}).Warn("Failed to lookup address records for email domain")
+		return true
+	}
+
+	return len(addrs) > 0
+}
+
+// Check returns an error if the domain of email is denied or, when enabled,
+// can not receive mail. The returned reason is used for metrics.
+func (f *EmailDomainFilter) Check(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return "", nil
+	}
+
+	domain := strings.ToLower(email[at+1:])
+
+	if f.Denied(domain) {
+		return EmailRejectDenylist, fmt.Errorf("%w: %s", ErrDomainBlocked, domain)
+	}
+
+	if f.checkMX && !f.AcceptsMail(domain) {
+		return EmailRejectNoMX, fmt.Errorf("%w: %s", ErrDomainNoMailHost, domain)
+	}
+
+	return "", nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+
+	return false
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+
+	if host == "timeout.example.org" {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestEmailDomainDenylist(t *testing.T) {
+	assert := assert.New(t)
+
+	denylist := filepath.Join(t.TempDir(), "denylist.txt")
+	err := os.WriteFile(denylist, []byte("# Disposable domains\nmailinator.com\n\n*.trash-mail.*\n@throwaway.email\n"), 0644)
+	if !assert.NoError(err) {
+		return
+	}
+
+	filter := NewEmailDomainFilter(denylist, false, time.Second)
+	if !assert.NoError(filter.Load()) {
+		return
+	}
+
+	badTests := []string{
+		"user@mailinator.com",
+		"user@MAILINATOR.com",
+		"user@sub.mailinator.com",
+		"user@x.trash-mail.net",
+		"user@throwaway.email",
+	}
+
+	for _, email := range badTests {
+		reason, err := filter.Check(email)
+		if assert.Error(err, email) {
+			assert.True(errors.Is(err, ErrDomainBlocked))
+			assert.Equal(EmailRejectDenylist, reason)
+		}
+	}
+
+	goodTests := []string{
+		"user@example.edu",
+		"user@notmailinator.com",
+		"user@trash-mail.net",
+	}
+
+	for _, email := range goodTests {
+		_, err := filter.Check(email)
+		assert.NoError(err, email)
+	}
+
+	// Denylist is reloaded when the file changes
+	err = os.WriteFile(denylist, []byte("example.edu\n"), 0644)
+	if !assert.NoError(err) {
+		return
+	}
+	future := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(denylist, future, future))
+
+	_, err = filter.Check("user@example.edu")
+	assert.Error(err)
+	_, err = filter.Check("user@mailinator.com")
+	assert.NoError(err)
+}
+
+func TestEmailDomainMX(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := NewEmailDomainFilter("", true, time.Second)
+	filter.SetResolver(&fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.edu":  {{Host: "mx.example.edu.", Pref: 10}},
+			"nullmx.com":   {{Host: ".", Pref: 0}},
+			"implicit.com": {},
+		},
+		hosts: map[string][]string{
+			"implicit.com": {"192.0.2.1"},
+		},
+	})
+
+	_, err := filter.Check("user@example.edu")
+	assert.NoError(err)
+
+	// Implicit MX using address record
+	_, err = filter.Check("user@implicit.com")
+	assert.NoError(err)
+
+	// Temporary DNS failures should not reject signups
+	_, err = filter.Check("user@timeout.example.org")
+	assert.NoError(err)
+
+	for _, email := range []string{"user@nullmx.com", "user@doesnotexist.invalid"} {
+		reason, err := filter.Check(email)
+		if assert.Error(err, email) {
+			assert.True(errors.Is(err, ErrDomainNoMailHost))
+			assert.Equal(EmailRejectNoMX, reason)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/viper"
+	"github.com/ubccr/goipa"
+)
+
+const (
+	EmailFormatText = "txt"
+	EmailFormatHTML = "html"
+)
+
+// emailSample is the subject and sample template variables used to preview an
+// email template
+type emailSample struct {
+	subject string
+	vars    func(baseURL string) map[string]interface{}
+}
+
+func sampleLinkVars(link string) map[string]interface{} {
+	return map[string]interface{}{
+		"link":         link,
+		"link_expires": strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second), "", "")),
+	}
+}
+
+var emailSamples = map[string]emailSample{
+	"password-reset": {"Please reset your password", func(baseURL string) map[string]interface{} {
+		return sampleLinkVars(baseURL + "/auth/resetpw/sample-token")
+	}},
+	"magic-link": {"Your sign-in link", func(baseURL string) map[string]interface{} {
+		return sampleLinkVars(baseURL + "/auth/magic/sample-token")
+	}},
+	"account-verify": {"Verify your email", func(baseURL string) map[string]interface{} {
+		return sampleLinkVars(baseURL + "/auth/verify/sample-token")
+	}},
+	"account-verify-reminder": {"Reminder: verify your email", func(baseURL string) map[string]interface{} {
+		vars := sampleLinkVars(baseURL + "/auth/verify/sample-token")
+		deleteAt := time.Now().Add(72 * time.Hour)
+		vars["delete_at"] = deleteAt
+		vars["delete_in"] = strings.TrimSpace(humanize.RelTime(time.Now(), deleteAt, "", ""))
+		return vars
+	}},
+	"password-expiring": {"Your password will expire soon", func(baseURL string) map[string]interface{} {
+		expireAt := time.Now().Add(7 * 24 * time.Hour)
+		return map[string]interface{}{
+			"link":      baseURL + "/password",
+			"expire_at": expireAt,
+			"expire_in": strings.TrimSpace(humanize.RelTime(time.Now(), expireAt, "", "")),
+		}
+	}},
+	"email-change-confirm": {"Confirm your new email address", func(baseURL string) map[string]interface{} {
+		vars := sampleLinkVars(baseURL + "/auth/email/sample-token")
+		vars["old_email"] = "jdoe@example.com"
+		vars["new_email"] = "john.doe@example.org"
+		return vars
+	}},
+	"email-change-notify": {"Email address change requested", func(baseURL string) map[string]interface{} {
+		vars := sampleLinkVars(baseURL + "/auth/email/cancel/sample-token")
+		vars["old_email"] = "jdoe@example.com"
+		vars["new_email"] = "john.doe@example.org"
+		return vars
+	}},
+	"account-updated": {"SSH key added", func(baseURL string) map[string]interface{} {
+		return map[string]interface{}{
+			"event":   "SSH key added",
+			"details": []string{"laptop (SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8)"},
+		}
+	}},
+	"sshkey-expiring": {"Your SSH key will expire soon", func(baseURL string) map[string]interface{} {
+		expireAt := time.Now().Add(7 * 24 * time.Hour)
+		return map[string]interface{}{
+			"link":        baseURL + "/sshkey",
+			"title":       "laptop",
+			"fingerprint": "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8",
+			"expire_at":   expireAt,
+			"expire_in":   strings.TrimSpace(humanize.RelTime(time.Now(), expireAt, "", "")),
+		}
+	}},
+	"welcome": {"Welcome to %s", func(baseURL string) map[string]interface{} {
+		return map[string]interface{}{
+			"getting_started_url": viper.GetString("site.getting_started_url"),
+		}
+	}},
+}
+
+// sampleUser returns the user emails are previewed for
+func sampleUser(email string) *ipa.User {
+	if email == "" {
+		email = "jdoe@example.com"
+	}
+
+	return &ipa.User{
+		Username:     "jdoe",
+		First:        "John",
+		Last:         "Doe",
+		Email:        email,
+		PasswdExpire: time.Now().Add(7 * 24 * time.Hour),
+	}
+}
+
+// TemplateNames returns the names of all email templates including any added
+// in site.templates_dir/email. Templates must have both a txt and html
+// version.
+func (e *Emailer) TemplateNames() []string {
+	found := make(map[string]int)
+	for _, t := range e.templates.Templates() {
+		for _, ext := range []string{"." + EmailFormatText, "." + EmailFormatHTML} {
+			if name := strings.TrimSuffix(t.Name(), ext); name != t.Name() {
+				found[name]++
+			}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name, count := range found {
+		if count == 2 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// sampleData returns the subject and template variables for previewing tmpl
+// sent to user
+func (e *Emailer) sampleData(tmpl, lang string, user *ipa.User) (string, map[string]interface{}, error) {
+	from, err := ParseFromAddress()
+	if err != nil {
+		return "", nil, err
+	}
+
+	baseURL := BaseURL(nil)
+	if baseURL == "" {
+		baseURL = "https://mokey.example.com"
+	}
+
+	subject := tmpl
+	vars := make(map[string]interface{})
+	if sample, ok := emailSamples[tmpl]; ok {
+		subject = sample.subject
+		vars = sample.vars(baseURL)
+	}
+
+	vars["lang"] = MatchLanguage(lang)
+	if strings.Contains(subject, "%s") {
+		subject = T(vars["lang"], subject, viper.GetString("site.name"))
+	}
+	vars["os"] = "Linux"
+	vars["browser"] = "Firefox"
+
+	data := e.templateData(user, nil, from, vars)
+	data["base_url"] = baseURL
+
+	return subject, data, nil
+}
+
+// render executes the template failing on any variables missing from data
+func (e *Emailer) render(name string, data map[string]interface{}) ([]byte, error) {
+	if e.templates.Lookup(name) == nil {
+		return nil, fmt.Errorf("Email template not found: %s", name)
+	}
+
+	tmpl, err := e.templates.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Option("missingkey=error")
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// RenderPreview renders the email template tmpl in format txt or html with
+// sample data. An error is returned if the template references variables
+// missing from the sample data.
+func (e *Emailer) RenderPreview(tmpl, format, lang string) ([]byte, error) {
+	if format != EmailFormatText && format != EmailFormatHTML {
+		return nil, fmt.Errorf("Invalid email format %s, must be txt or html", format)
+	}
+
+	_, data, err := e.sampleData(tmpl, lang, sampleUser(""))
+	if err != nil {
+		return nil, err
+	}
+
+	return e.render(tmpl+"."+format, data)
+}
+
+// SendTestEmail sends the email template tmpl rendered with sample data to
+// the address to using the configured transport
+func (e *Emailer) SendTestEmail(tmpl, to, lang string) error {
+	user := sampleUser(to)
+	subject, data, err := e.sampleData(tmpl, lang, user)
+	if err != nil {
+		return err
+	}
+
+	// Check both versions render before sending
+	for _, format := range []string{EmailFormatText, EmailFormatHTML} {
+		if _, err := e.render(tmpl+"."+format, data); err != nil {
+			return err
+		}
+	}
+
+	msg, err := e.buildMessage(user, nil, subject, tmpl, data)
+	if err != nil {
+		return err
+	}
+
+	from, err := ParseFromAddress()
+	if err != nil {
+		return err
+	}
+
+	return e.transport.Send(from.Address, []string{to}, msg)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailPreview(t *testing.T) {
+	assert := assert.New(t)
+	emailer, _ := newTestEmailer(t)
+
+	names := emailer.TemplateNames()
+	assert.Contains(names, "password-reset")
+	assert.Contains(names, "welcome")
+
+	for _, name := range names {
+		for _, format := range []string{EmailFormatText, EmailFormatHTML} {
+			out, err := emailer.RenderPreview(name, format, "")
+			if assert.NoError(err, "%s.%s", name, format) {
+				assert.Contains(string(out), "John", "%s.%s", name, format)
+				assert.NotContains(string(out), "<no value>", "%s.%s", name, format)
+			}
+		}
+	}
+
+	out, err := emailer.RenderPreview("password-reset", EmailFormatText, "fr")
+	if assert.NoError(err) {
+		assert.Contains(string(out), "Bonjour John,")
+		assert.Contains(string(out), "https://mokey.example.com/auth/resetpw/")
+	}
+
+	_, err = emailer.RenderPreview("password-reset", "pdf", "")
+	assert.Error(err)
+
+	_, err = emailer.RenderPreview("does-not-exist", EmailFormatHTML, "")
+	assert.Error(err)
+}
+
+func TestEmailPreviewMissingVariable(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "email"), 0755)
+	os.WriteFile(filepath.Join(dir, "email", "password-reset.txt"), []byte("Hi {{ $.user.First }} {{ $.bogus }}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "email", "custom.txt"), []byte("Hi {{ $.user.First }}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "email", "custom.html"), []byte("<p>Hi {{ $.user.First }}</p>\n"), 0644)
+	viper.Set("site.templates_dir", dir)
+	t.Cleanup(func() { viper.Set("site.templates_dir", "") })
+
+	emailer, transport := newTestEmailer(t)
+	assert.Contains(emailer.TemplateNames(), "custom")
+
+	_, err := emailer.RenderPreview("password-reset", EmailFormatText, "")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "bogus")
+	}
+
+	_, err = emailer.RenderPreview("password-reset", EmailFormatHTML, "")
+	assert.NoError(err)
+
+	assert.Error(emailer.SendTestEmail("password-reset", "admin@example.com", ""))
+	assert.Len(transport.Messages(), 0)
+
+	out, err := emailer.RenderPreview("custom", EmailFormatText, "")
+	if assert.NoError(err) {
+		assert.Equal("Hi John\n", string(out))
+	}
+}
+
+func TestSendTestEmail(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestEmailer(t)
+
+	if !assert.NoError(emailer.SendTestEmail("welcome", "admin@example.com", "fr")) {
+		return
+	}
+
+	messages := transport.Messages()
+	if assert.Len(messages, 1) {
+		assert.Equal([]string{"admin@example.com"}, messages[0].To)
+		msg := parseTestMessage(t, messages[0].Data)
+		assert.Equal("[Example HPC] Bienvenue sur Example HPC", msg.header.Get("Subject"))
+		assert.Contains(msg.text, "Bienvenue, John !")
+	}
+}
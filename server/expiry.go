@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	StoragePrefixPasswordExpiry = "pw-expiry-notified-"
+)
+
+// ErrPasswordExpiryStorage is returned when password expiry emails are sent
+// without persistent storage. Sent thresholds would be forgotten and users
+// emailed again on every run.
+var ErrPasswordExpiryStorage = errors.New("Password expiry emails require a persistent storage driver. Please set storage.driver to sqlite3 or redis")
+
+// PasswordExpiryNotifier emails users whose password will expire within one
+// of the configured thresholds. Each threshold is only emailed once per
+// password.
+type PasswordExpiryNotifier struct {
+	Thresholds []int
+	DryRun     bool
+
+	client  *ipa.Client
+	emailer *Emailer
+	storage fiber.Storage
+}
+
+// NotifyResult lists the usernames emailed by a notify run
+type NotifyResult struct {
+	Notified []string
+}
+
+func NewPasswordExpiryNotifier(client *ipa.Client, emailer *Emailer, storage fiber.Storage) *PasswordExpiryNotifier {
+	return &PasswordExpiryNotifier{
+		Thresholds: viper.GetIntSlice("accounts.password_expiry_thresholds"),
+		client:     client,
+		emailer:    emailer,
+		storage:    storage,
+	}
+}
+
+// threshold returns the smallest threshold in days that remaining falls
+// within or 0 if none
+func (n *PasswordExpiryNotifier) threshold(remaining time.Duration) int {
+	thresholds := append([]int{}, n.Thresholds...)
+	sort.Ints(thresholds)
+
+	for _, days := range thresholds {
+		if days > 0 && remaining <= time.Duration(days)*24*time.Hour {
+			return days
+		}
+	}
+
+	return 0
+}
+
+// Run emails users with passwords expiring within the thresholds
+func (n *PasswordExpiryNotifier) Run() (*NotifyResult, error) {
+	users, err := n.client.UserFind(ipa.Options{"nsaccountlock": false, "sizelimit": 0})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NotifyResult{}
+	now := time.Now()
+
+	for _, user := range users {
+		if user.Locked || user.Email == "" || user.PasswdExpire.IsZero() || user.Category == UserCategoryUnverified {
+			continue
+		}
+
+		remaining := user.PasswdExpire.Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+
+		days := n.threshold(remaining)
+		if days == 0 {
+			continue
+		}
+
+		sent, err := n.notify(user, days)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"email":    user.Email,
+				"err":      err,
+			}).Error("Failed to send password expiring email")
+			continue
+		}
+
+		if sent {
+			result.Notified = append(result.Notified, user.Username)
+		}
+	}
+
+	return result, nil
+}
+
+func (n *PasswordExpiryNotifier) notify(user *ipa.User, days int) (bool, error) {
+	// Keyed on the expiration time so changing the password resets reminders
+	key := fmt.Sprintf("%s%s-%d-%d", StoragePrefixPasswordExpiry, user.Username, user.PasswdExpire.Unix(), days)
+
+	notified, err := n.storage.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	if notified != nil {
+		return false, nil
+	}
+
+	if !n.DryRun {
+		if err := n.emailer.SendPasswordExpiringEmail(user, nil); err != nil {
+			return false, err
+		}
+
+		n.storage.Set(key, []byte("true"), time.Until(user.PasswdExpire.Add(24*time.Hour)))
+	}
+
+	log.WithFields(log.Fields{
+		"username":  user.Username,
+		"email":     user.Email,
+		"expire_at": user.PasswdExpire,
+		"threshold": days,
+		"dry_run":   n.DryRun,
+	}).Info("Sent password expiring email")
+
+	return true, nil
+}
+
+// Schedule runs the notifier every interval until stop is closed
+func (n *PasswordExpiryNotifier) Schedule(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			result, err := n.Run()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("Failed to send password expiring emails")
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"notified": len(result.Notified),
+			}).Info("Sent password expiring emails")
+		}
+	}
+}
+
+// passwordExpiresSoon returns true if the users password expires within
+// accounts.password_expiry_warn_days of now
+func passwordExpiresSoon(user *ipa.User, now time.Time) bool {
+	days := viper.GetInt("accounts.password_expiry_warn_days")
+	if days <= 0 || user.PasswdExpire.IsZero() {
+		return false
+	}
+
+	remaining := user.PasswdExpire.Sub(now)
+
+	return remaining > 0 && remaining <= time.Duration(days)*24*time.Hour
+}
+
+// passwordChangeRequired returns true if FreeIPA has flagged the users
+// password to be changed. When an admin sets or resets a password FreeIPA
+// expires it at the same time it was changed.
+func passwordChangeRequired(user *ipa.User, now time.Time) bool {
+	if user.PasswdExpire.IsZero() {
+		return false
+	}
+
+	if !user.PasswdExpire.After(now) {
+		return true
+	}
+
+	return !user.LastPasswdChange.IsZero() && !user.PasswdExpire.After(user.LastPasswdChange)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestPasswordExpiryThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	n := &PasswordExpiryNotifier{Thresholds: []int{7, 14, 1}}
+	day := 24 * time.Hour
+
+	assert.Equal(0, n.threshold(30*day))
+	assert.Equal(14, n.threshold(14*day))
+	assert.Equal(14, n.threshold(8*day))
+	assert.Equal(7, n.threshold(7*day))
+	assert.Equal(7, n.threshold(2*day))
+	assert.Equal(1, n.threshold(day))
+	assert.Equal(1, n.threshold(time.Hour))
+}
+
+func TestPasswordExpiresSoon(t *testing.T) {
+	viper.Set("accounts.password_expiry_warn_days", 14)
+
+	assert := assert.New(t)
+	now := time.Now()
+
+	user := &ipa.User{}
+	assert.False(passwordExpiresSoon(user, now))
+
+	user.PasswdExpire = now.Add(10 * 24 * time.Hour)
+	assert.True(passwordExpiresSoon(user, now))
+
+	user.PasswdExpire = now.Add(30 * 24 * time.Hour)
+	assert.False(passwordExpiresSoon(user, now))
+
+	// Already expired passwords are handled at login
+	user.PasswdExpire = now.Add(-time.Hour)
+	assert.False(passwordExpiresSoon(user, now))
+
+	viper.Set("accounts.password_expiry_warn_days", 0)
+	user.PasswdExpire = now.Add(24 * time.Hour)
+	assert.False(passwordExpiresSoon(user, now))
+}
+
+func TestPasswordChangeRequired(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	user := &ipa.User{}
+	assert.False(passwordChangeRequired(user, now))
+
+	user.LastPasswdChange = now.Add(-24 * time.Hour)
+	user.PasswdExpire = now.Add(90 * 24 * time.Hour)
+	assert.False(passwordChangeRequired(user, now))
+
+	// Admin reset
+	user.PasswdExpire = user.LastPasswdChange
+	assert.True(passwordChangeRequired(user, now))
+
+	user.PasswdExpire = now.Add(-time.Minute)
+	assert.True(passwordChangeRequired(user, now))
+}
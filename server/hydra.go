@@ -91,6 +91,24 @@ func (r *Router) ConsentGet(c *fiber.Ctx) error {
 	}).Info("AUDIT User logged in via Hydra OAuth2 successfully")
 	r.metrics.totalHydraLogins.Inc()
 
+	clientID := ""
+	if consent.Client != nil {
+		clientID = consent.Client.ClientID
+	}
+	r.webhooks.Emit(EventLogin, user.Username, RemoteIP(c), map[string]interface{}{
+		"method":    "oauth2",
+		"client_id": clientID,
+	})
+	r.audit(c, &AuditEvent{
+		Action:      AuditLoginOAuth2,
+		Actor:       user.Username,
+		Target:      user.Username,
+		HydraClient: clientID,
+		Data: map[string]interface{}{
+			"scopes": consent.RequestedScope,
+		},
+	})
+
 	c.Set("HX-Redirect", *response.Payload.RedirectTo)
 	return c.Redirect(*response.Payload.RedirectTo)
 }
@@ -163,7 +181,8 @@ func (r *Router) LoginOAuthGet(c *fiber.Ctx) error {
 		return c.Redirect(*completedResponse.Payload.RedirectTo)
 	}
 
-	if ok, _ := r.isLoggedIn(c); ok {
+	// Magic link sessions are not used for OAuth logins
+	if ok, _ := r.isLoggedIn(c); ok && c.Locals(ContextKeyMagicLink) == nil {
 		return r.LoginOAuthPost(r.username(c), challenge, c)
 	}
 
@@ -234,3 +253,21 @@ func (r *Router) revokeHydraAuthenticationSession(username string, c *fiber.Ctx)
 
 	return nil
 }
+
+func (r *Router) revokeHydraConsentSessions(username string) error {
+	params := admin.NewRevokeConsentSessionsParams()
+	params.SetSubject(username)
+	all := true
+	params.SetAll(&all)
+	params.SetHTTPClient(r.hydraAdminHTTPClient)
+	_, err := r.hydraClient.Admin.RevokeConsentSessions(params)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"user": username,
+	}).Info("Successfully revoked hydra consent sessions")
+
+	return nil
+}
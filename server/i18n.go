@@ -0,0 +1,358 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+//go:embed locales
+var localeFiles embed.FS
+
+// Language is a supported language shown in the language picker
+type Language struct {
+	Tag  string
+	Name string
+}
+
+// Catalog holds the translated messages for each supported language. Messages
+// are keyed by the English source string so untranslated messages fall back
+// to English.
+type Catalog struct {
+	defaultLang string
+	messages    map[string]map[string]string
+	tags        []language.Tag
+	matcher     language.Matcher
+}
+
+var (
+	catalogMu sync.RWMutex
+	catalog   = &Catalog{defaultLang: "en", messages: map[string]map[string]string{}}
+)
+
+// LoadTranslations loads the message catalogs embedded in mokey and any
+// catalogs found in site.templates_dir/locales. Catalogs are JSON files named
+// after the language tag, for example fr.json. Site catalogs are merged over
+// the embedded catalogs so sites can override or add translations.
+func LoadTranslations() error {
+	c, err := NewCatalog(viper.GetString("site.default_language"), viper.GetStringSlice("site.languages"))
+	if err != nil {
+		return err
+	}
+
+	catalogMu.Lock()
+	catalog = c
+	catalogMu.Unlock()
+
+	return nil
+}
+
+// NewCatalog loads all message catalogs. If enabled is not empty only those
+// languages are supported.
+func NewCatalog(defaultLang string, enabled []string) (*Catalog, error) {
+	if defaultLang == "" {
+		defaultLang = "en"
+	}
+
+	c := &Catalog{
+		defaultLang: defaultLang,
+		messages:    make(map[string]map[string]string),
+	}
+
+	if err := c.loadDir(localeFiles, "locales"); err != nil {
+		return nil, err
+	}
+
+	if dir := viper.GetString("site.templates_dir"); dir != "" {
+		localDir := filepath.Join(dir, "locales")
+		if _, err := os.Stat(localDir); err == nil {
+			if err := c.loadDir(os.DirFS(localDir), "."); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The default language is always supported even without a catalog
+	if _, ok := c.messages[defaultLang]; !ok {
+		c.messages[defaultLang] = make(map[string]string)
+	}
+
+	langs := make([]string, 0, len(c.messages))
+	for lang := range c.messages {
+		if lang != defaultLang && len(enabled) > 0 && !containsString(enabled, lang) {
+			continue
+		}
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	// The first tag is used by the matcher when there is no match
+	c.tags = []language.Tag{language.Make(defaultLang)}
+	for _, lang := range langs {
+		if lang != defaultLang {
+			c.tags = append(c.tags, language.Make(lang))
+		}
+	}
+	c.matcher = language.NewMatcher(c.tags)
+
+	log.WithFields(log.Fields{
+		"languages": langs,
+		"default":   defaultLang,
+	}).Debug("Loaded translations")
+
+	return c, nil
+}
+
+func (c *Catalog) loadDir(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("Invalid translation catalog %s: %w", file, err)
+		}
+
+		tag, err := language.Parse(strings.TrimSuffix(path.Base(file), ".json"))
+		if err != nil {
+			return fmt.Errorf("Invalid language for translation catalog %s: %w", file, err)
+		}
+
+		lang := tag.String()
+		if _, ok := c.messages[lang]; !ok {
+			c.messages[lang] = make(map[string]string)
+		}
+
+		for k, v := range messages {
+			c.messages[lang][k] = v
+		}
+	}
+
+	return nil
+}
+
+// Match returns the best supported language for a list of language
+// preferences in Accept-Language format. The default language is returned if
+// there is no match.
+func (c *Catalog) Match(prefs ...string) string {
+	if c.matcher == nil {
+		return c.defaultLang
+	}
+
+	_, index := language.MatchStrings(c.matcher, prefs...)
+	return c.tags[index].String()
+}
+
+// Translate returns msg translated to lang and formatted with args
+func (c *Catalog) Translate(lang, msg string, args ...interface{}) string {
+	translated := msg
+	if messages, ok := c.messages[lang]; ok && messages[msg] != "" {
+		translated = messages[msg]
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(translated, args...)
+	}
+
+	return translated
+}
+
+// Languages returns the supported languages with their names in their own
+// language
+func (c *Catalog) Languages() []Language {
+	langs := make([]Language, 0, len(c.tags))
+	for _, tag := range c.tags {
+		name := display.Self.Name(tag)
+		if name == "" {
+			name = tag.String()
+		}
+		langs = append(langs, Language{Tag: tag.String(), Name: name})
+	}
+
+	return langs
+}
+
+func currentCatalog() *Catalog {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return catalog
+}
+
+// T translates msg to lang. Used in templates as {{ T $.lang "message" }}.
+// lang may be nil in which case the default language is used.
+func T(lang interface{}, msg string, args ...interface{}) string {
+	l, _ := lang.(string)
+	return currentCatalog().Translate(l, msg, args...)
+}
+
+// Languages returns the supported languages. Used in templates
+func Languages() []Language {
+	return currentCatalog().Languages()
+}
+
+// MatchLanguage returns the best supported language for the Accept-Language
+// style preferences
+func MatchLanguage(prefs ...string) string {
+	return currentCatalog().Match(prefs...)
+}
+
+// Localize sets the language for the request. The language saved in the
+// session from the users preferredLanguage takes precedence over the
+// Accept-Language header.
+func (r *Router) Localize(c *fiber.Ctx) error {
+	prefs := make([]string, 0, 2)
+
+	if sess, err := r.sessionStore.Get(c); err == nil {
+		if lang, ok := sess.Get(SessionKeyLanguage).(string); ok && lang != "" {
+			prefs = append(prefs, lang)
+		}
+	}
+
+	if accept := c.Get(fiber.HeaderAcceptLanguage); accept != "" {
+		prefs = append(prefs, accept)
+	}
+
+	c.Locals(ContextKeyLanguage, MatchLanguage(prefs...))
+
+	return c.Next()
+}
+
+// tr translates msg to the language of the request
+func tr(c *fiber.Ctx, msg string, args ...interface{}) string {
+	return T(c.Locals(ContextKeyLanguage), msg, args...)
+}
+
+// sessionLanguage returns the users preferredLanguage from FreeIPA to store in
+// the session at login
+func (r *Router) sessionLanguage(username string) string {
+	if r.ipaRPC == nil {
+		return ""
+	}
+
+	lang, err := r.ipaRPC.PreferredLanguage(username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"err":      err,
+		}).Warn("Failed to fetch preferred language from FreeIPA")
+		return ""
+	}
+
+	return lang
+}
+
+// preferredLanguage returns the supported language matching the users
+// preferredLanguage saved in the session or an empty string if not set
+func (r *Router) preferredLanguage(c *fiber.Ctx) string {
+	sess, err := r.session(c)
+	if err != nil {
+		return ""
+	}
+
+	lang, _ := sess.Get(SessionKeyLanguage).(string)
+	if lang == "" {
+		return ""
+	}
+
+	return MatchLanguage(lang)
+}
+
+// setPreferredLanguage saves the users preferredLanguage in FreeIPA and the
+// session. An empty lang removes the preference.
+func (r *Router) setPreferredLanguage(c *fiber.Ctx, username, lang string) error {
+	if lang != "" && MatchLanguage(lang) != lang {
+		return fmt.Errorf("Unsupported language: %s", lang)
+	}
+
+	if r.ipaRPC == nil {
+		return errors.New("FreeIPA JSON-RPC client is not available")
+	}
+
+	if err := r.ipaRPC.SetPreferredLanguage(username, lang); err != nil {
+		return err
+	}
+
+	sess, err := r.session(c)
+	if err != nil {
+		return err
+	}
+
+	sess.Set(SessionKeyLanguage, lang)
+	if err := r.sessionSave(c, sess); err != nil {
+		return err
+	}
+
+	if lang == "" {
+		lang = MatchLanguage(c.Get(fiber.HeaderAcceptLanguage))
+	}
+	c.Locals(ContextKeyLanguage, lang)
+
+	log.WithFields(log.Fields{
+		"username": username,
+		"language": lang,
+	}).Info("User updated preferred language")
+
+	return nil
+}
+
+// PreferredLanguage returns the preferredLanguage attribute for username.
+// goipa does not expose this attribute so it's fetched using user_show.
+func (c *IPARPC) PreferredLanguage(username string) (string, error) {
+	res, err := c.Call("user_show", []string{username}, ipa.Options{"all": true})
+	if err != nil {
+		return "", err
+	}
+
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(res.Data, &attrs); err != nil {
+		return "", err
+	}
+
+	return ipaAttrString(attrs, "preferredlanguage"), nil
+}
+
+// SetPreferredLanguage sets the preferredLanguage attribute for username. An
+// empty lang removes the attribute.
+func (c *IPARPC) SetPreferredLanguage(username, lang string) error {
+	_, err := c.Call("user_mod", []string{username}, ipa.Options{
+		"setattr": []string{"preferredlanguage=" + lang},
+	})
+	if ierr, ok := err.(*ipa.IpaError); ok && ierr.Code == 4202 {
+		// no modifications to be performed
+		return nil
+	}
+
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
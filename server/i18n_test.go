@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestCatalogMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCatalog("en", nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("en", c.Match())
+	assert.Equal("en", c.Match("de-DE,de;q=0.9"))
+	assert.Equal("fr", c.Match("fr-CA,fr;q=0.9,en;q=0.8"))
+	assert.Equal("fr", c.Match("de", "fr"))
+	assert.Equal("en", c.Match("en-US,en;q=0.9,fr;q=0.8"))
+	assert.Equal("fr", c.Match("fr", "en-US"))
+
+	langs := c.Languages()
+	if assert.Len(langs, 2) {
+		assert.Equal("en", langs[0].Tag)
+		assert.Equal("fr", langs[1].Tag)
+		assert.Equal("français", langs[1].Name)
+	}
+
+	// Only enabled languages are supported
+	c, err = NewCatalog("en", []string{"de"})
+	if assert.NoError(err) {
+		assert.Equal("en", c.Match("fr"))
+		assert.Len(c.Languages(), 1)
+	}
+
+	c, err = NewCatalog("fr", nil)
+	if assert.NoError(err) {
+		assert.Equal("fr", c.Match("de"))
+	}
+}
+
+func TestCatalogTranslate(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCatalog("en", nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("Account", c.Translate("en", "Account"))
+	assert.Equal("Compte", c.Translate("fr", "Account"))
+	assert.Equal("Bonjour Jean,", c.Translate("fr", "Hi %s,", "Jean"))
+	assert.Equal("Hi Jean,", c.Translate("de", "Hi %s,", "Jean"))
+
+	// Untranslated messages fall back to the source string
+	assert.Equal("Some new message", c.Translate("fr", "Some new message"))
+
+	// Messages without args are not formatted
+	assert.Equal("100% done", c.Translate("fr", "100% done"))
+}
+
+func TestCatalogSiteOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "locales"), 0755)
+	os.WriteFile(filepath.Join(dir, "locales", "fr.json"), []byte(`{"Account": "Mon compte"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "locales", "de.json"), []byte(`{"Account": "Konto"}`), 0644)
+
+	viper.Set("site.templates_dir", dir)
+	t.Cleanup(func() { viper.Set("site.templates_dir", "") })
+
+	c, err := NewCatalog("en", nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("Mon compte", c.Translate("fr", "Account"))
+	assert.Equal("Sécurité", c.Translate("fr", "Security"))
+	assert.Equal("Konto", c.Translate("de", "Account"))
+	assert.Equal("de", c.Match("de-AT"))
+
+	os.WriteFile(filepath.Join(dir, "locales", "es.json"), []byte(`not json`), 0644)
+	_, err = NewCatalog("en", nil)
+	assert.Error(err)
+}
+
+// Every message used in the templates should have a French translation
+func TestCatalogComplete(t *testing.T) {
+	data, err := localeFiles.ReadFile("locales/fr.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatal(err)
+	}
+
+	re := regexp.MustCompile(`\bT \$\.lang "((?:[^"\\]|\\.)*)"`)
+	for _, pattern := range []string{"templates/*.html", "templates/email/*.html", "templates/email/*.txt"} {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			tmpl, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, m := range re.FindAllStringSubmatch(string(tmpl), -1) {
+				msg := strings.ReplaceAll(m[1], `\"`, `"`)
+				assert.NotEmpty(t, messages[msg], "%s: missing translation for %q", file, msg)
+			}
+		}
+	}
+}
+
+// Pages are rendered in the request language
+func TestTemplateLanguage(t *testing.T) {
+	assert := assert.New(t)
+
+	views, err := NewTemplateRenderer()
+	if !assert.NoError(err) {
+		return
+	}
+
+	var buf bytes.Buffer
+	policy := &PasswordPolicy{MinLength: 12}
+	if assert.NoError(views.Render(&buf, "signup.html", map[string]interface{}{"lang": "fr", "policy": policy})) {
+		assert.Contains(buf.String(), "Inscription")
+		assert.Contains(buf.String(), "Confirmer le mot de passe")
+		assert.Contains(buf.String(), "Au moins 12 caractères")
+	}
+
+	buf.Reset()
+	strength := &PasswordStrength{Score: 1, Warning: "This is a very common password"}
+	if assert.NoError(views.Render(&buf, "password-strength.html", map[string]interface{}{"lang": "fr", "strength": strength})) {
+		assert.Contains(buf.String(), "Faible")
+		assert.Contains(buf.String(), "Ce mot de passe est très courant")
+	}
+
+	buf.Reset()
+	if assert.NoError(views.Render(&buf, "404-partial.html", map[string]interface{}{})) {
+		assert.Contains(buf.String(), "Sorry the page you requested is not found")
+	}
+}
+
+func TestEmailLanguage(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestEmailer(t)
+
+	user := &ipa.User{
+		Username:     "jdoe",
+		First:        "Jean",
+		Last:         "Dupont",
+		Email:        "jdoe@example.com",
+		PasswdExpire: time.Now().Add(72 * time.Hour),
+	}
+
+	preferred := map[string]string{"jdoe": "fr-FR"}
+	emailer.language = func(username string) (string, error) {
+		return preferred[username], nil
+	}
+
+	assert.Equal("fr", emailer.Language(user, nil))
+
+	if !assert.NoError(emailer.SendPasswordResetEmail(user, nil)) {
+		return
+	}
+
+	messages := transport.Messages()
+	if !assert.Len(messages, 1) {
+		return
+	}
+
+	msg := parseTestMessage(t, messages[0].Data)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.header.Get("Subject"))
+	if assert.NoError(err) {
+		assert.Equal("[Example HPC] Veuillez réinitialiser votre mot de passe", subject)
+	}
+	assert.Contains(msg.text, "Bonjour Jean,")
+	assert.Contains(msg.text, "L'équipe [Example HPC]")
+	assert.Contains(msg.html, "Réinitialiser votre mot de passe")
+
+	// Users without a preferred language get the default language
+	transport.Reset()
+	delete(preferred, "jdoe")
+	assert.Equal("en", emailer.Language(user, nil))
+	if assert.NoError(emailer.SendMFAChangedEmail(true, user, nil)) {
+		msg := parseTestMessage(t, transport.Messages()[0].Data)
+		assert.Equal("[Example HPC] Two-Factor Authentication Enabled", msg.header.Get("Subject"))
+		assert.Contains(msg.text, "Hi Jean,")
+	}
+}
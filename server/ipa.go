@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const ipaCACertFile = "/etc/ipa/ca.crt"
+
+// IPARPC makes FreeIPA JSON-RPC calls that are not provided by goipa. Calls
+// are authenticated with the mokey keytab using SPNEGO.
+type IPARPC struct {
+	host       string
+	httpClient *http.Client
+	krbClient  *client.Client
+}
+
+// NewIPARPC returns an IPARPC client for the same FreeIPA server and realm as
+// the admin client
+func NewIPARPC(adminClient *ipa.Client) (*IPARPC, error) {
+	cfg, err := config.Load(ipa.DefaultKerbConf)
+	if err != nil {
+		return nil, err
+	}
+
+	kt, err := keytab.Load(viper.GetString("site.keytab"))
+	if err != nil {
+		return nil, err
+	}
+
+	cl := client.NewWithKeytab(viper.GetString("site.ktuser"), adminClient.Realm(), kt, cfg)
+	if err := cl.Login(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if pem, err := os.ReadFile(ipaCACertFile); err == nil {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pem) {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	return &IPARPC{
+		host:      adminClient.Host(),
+		krbClient: cl,
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Call runs the FreeIPA method with params and options and returns the result
+func (c *IPARPC) Call(method string, params []string, options ipa.Options) (*ipa.Result, error) {
+	if options == nil {
+		options = ipa.Options{}
+	}
+	options["version"] = ipa.IpaClientVersion
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":     0,
+		"method": method,
+		"params": []interface{}{params, options},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/ipa/json", c.host), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Referer", fmt.Sprintf("https://%s/ipa/xml", c.host))
+
+	if err := spnego.SetSPNEGOHeader(c.krbClient, req, ""); err != nil {
+		return nil, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("IPA RPC call %s failed with HTTP status code: %d", method, res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipaRes ipa.Response
+	if err := json.Unmarshal(body, &ipaRes); err != nil {
+		return nil, err
+	}
+
+	if ipaRes.Error != nil {
+		return nil, ipaRes.Error
+	}
+
+	if ipaRes.Result == nil {
+		return nil, fmt.Errorf("IPA RPC call %s returned no result", method)
+	}
+
+	return ipaRes.Result, nil
+}
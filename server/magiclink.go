@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dchest/captcha"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+// magicLinkAllowed returns true if user can login using a magic link sent to
+// their email address. Users with Two-Factor authentication enabled must
+// always login with their password and OTP.
+func magicLinkAllowed(user *ipa.User) bool {
+	if !viper.GetBool("accounts.magic_link_login") {
+		return false
+	}
+
+	if isBlocked(user.Username) || user.Locked || user.Email == "" || user.Category == UserCategoryUnverified {
+		return false
+	}
+
+	if user.OTPOnly() {
+		return false
+	}
+
+	groups := viper.GetStringSlice("accounts.magic_link_groups")
+	if len(groups) == 0 {
+		return true
+	}
+
+	for _, g := range groups {
+		if user.HasGroup(g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Router) MagicLinkRequest(c *fiber.Ctx) error {
+	if !viper.GetBool("accounts.magic_link_login") {
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	if c.Method() == fiber.MethodGet {
+		vars := fiber.Map{
+			"captchaID": captcha.New(),
+		}
+
+		return c.Render("login-magic.html", vars)
+	}
+
+	err := r.verifyCaptcha(c.FormValue("captcha_id"), c.FormValue("captcha_sol"))
+	if err != nil {
+		c.Append("HX-Trigger", "{\"reloadCaptcha\":\""+captcha.New()+"\"}")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	username := c.FormValue("username")
+
+	user, err := r.adminClient.UserShow(username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"err":      err,
+		}).Warn("AUDIT Magic link request for unknown username")
+		r.audit(c, &AuditEvent{
+			Action:  AuditMagicLinkRequest,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "unknown username",
+		})
+		return c.Render("login-magic-success.html", fiber.Map{})
+	}
+
+	if !magicLinkAllowed(user) {
+		log.WithFields(log.Fields{
+			"username": username,
+		}).Warn("AUDIT Magic link request for user not allowed to use magic links")
+		r.audit(c, &AuditEvent{
+			Action:  AuditMagicLinkRequest,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "not allowed",
+		})
+		return c.Render("login-magic-success.html", fiber.Map{})
+	}
+
+	err = r.emailer.SendMagicLinkEmail(user, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": user.Username,
+			"email":    user.Email,
+		}).Error("Failed to send magic link email")
+	} else {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"email":    user.Email,
+		}).Info("Magic link email sent successfully")
+		r.audit(c, &AuditEvent{
+			Action: AuditMagicLinkRequest,
+			Target: user.Username,
+		})
+	}
+
+	return c.Render("login-magic-success.html", fiber.Map{})
+}
+
+func (r *Router) MagicLinkLogin(c *fiber.Ctx) error {
+	if !viper.GetBool("accounts.magic_link_login") {
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	token := c.Params("token")
+
+	claims, err := ParseToken(token, TokenMagicLink, r.storage)
+	if err == nil && time.Since(claims.Timestamp) > time.Duration(viper.GetInt("accounts.magic_link_max_age"))*time.Second {
+		err = errors.New("Token expired")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Debug("Invalid magic link token")
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	user, err := r.adminClient.UserShow(claims.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": claims.Username,
+			"err":      err,
+		}).Warn("Magic link login attempt for unknown username")
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	// Links are only valid for the email address they were sent to
+	if !magicLinkAllowed(user) || user.Email != claims.Email {
+		log.WithFields(log.Fields{
+			"username": claims.Username,
+			"email":    claims.Email,
+		}).Warn("AUDIT Magic link login attempt for user not allowed to use magic links")
+		r.audit(c, &AuditEvent{
+			Action:  AuditLoginMagicLink,
+			Outcome: AuditFailure,
+			Target:  claims.Username,
+			Reason:  "not allowed",
+		})
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	// Require a POST so email link scanners do not use up the token
+	if c.Method() == fiber.MethodGet {
+		vars := fiber.Map{
+			"claims": claims,
+		}
+
+		return c.Render("login-magic-confirm.html", vars)
+	}
+
+	MarkTokenUsed(token, claims, r.storage)
+	r.storage.Delete(TokenMagicLink + TokenIssuedPrefix + user.Username)
+
+	sess, err := r.session(c)
+	if err != nil {
+		return err
+	}
+
+	err = sess.Regenerate()
+	if err != nil {
+		return err
+	}
+
+	sess.Set(SessionKeyAuthenticated, true)
+	sess.Set(SessionKeyUsername, user.Username)
+	sess.Set(SessionKeyMagicLink, true)
+	sess.Set(SessionKeyLanguage, r.sessionLanguage(user.Username))
+	sess.Set(SessionKeyLoginAt, time.Now().UnixNano())
+
+	if err := r.sessionSave(c, sess); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"username": user.Username,
+		"ip":       RemoteIP(c),
+	}).Info("AUDIT User logged in successfully with magic link")
+	r.metrics.totalMagicLinkLogins.Inc()
+	r.webhooks.Emit(EventLogin, user.Username, RemoteIP(c), map[string]interface{}{
+		"method": "magic_link",
+	})
+	r.audit(c, &AuditEvent{
+		Action: AuditLoginMagicLink,
+		Actor:  user.Username,
+		Target: user.Username,
+	})
+
+	c.Set("HX-Redirect", "/")
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestMagicLinkAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	user := &ipa.User{Username: "jdoe", Email: "jdoe@example.com", Groups: []string{"ipausers", "students"}}
+
+	viper.Set("accounts.magic_link_login", false)
+	assert.False(magicLinkAllowed(user))
+
+	viper.Set("accounts.magic_link_login", true)
+	assert.True(magicLinkAllowed(user))
+
+	viper.Set("accounts.magic_link_groups", []string{"staff", "students"})
+	assert.True(magicLinkAllowed(user))
+
+	viper.Set("accounts.magic_link_groups", []string{"staff"})
+	assert.False(magicLinkAllowed(user))
+	viper.Set("accounts.magic_link_groups", []string{})
+
+	// Two-Factor users must login with their password and OTP
+	user.AuthTypes = []string{"otp"}
+	assert.False(magicLinkAllowed(user))
+	user.AuthTypes = nil
+
+	user.Locked = true
+	assert.False(magicLinkAllowed(user))
+	user.Locked = false
+
+	user.Email = ""
+	assert.False(magicLinkAllowed(user))
+
+	viper.Set("accounts.magic_link_login", false)
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	StoragePrefixMailQueue   = "mailq-"
+	storageKeyMailIndex      = StoragePrefixMailQueue + "index"
+	storageKeyMailLock       = StoragePrefixMailQueue + "lock"
+	storagePrefixMailMessage = StoragePrefixMailQueue + "msg-"
+
+	// Max time to hold the queue lock and wait to acquire it
+	mailQueueLockTTL  = 30 * time.Second
+	mailQueueLockWait = 10 * time.Second
+
+	// Time a message is reserved for delivery by a worker. Messages still
+	// being sent after this are handed out again.
+	mailQueueLease = 10 * time.Minute
+)
+
+// Queued mail states
+const (
+	MailStatePending = "pending"
+	MailStateSending = "sending"
+	MailStateDead    = "dead"
+)
+
+var (
+	ErrMailNotFound     = errors.New("mail not found in queue")
+	ErrMailQueueStorage = errors.New("The email queue requires a persistent storage driver. Please set storage.driver to sqlite3 or redis")
+)
+
+// QueuedMail is a message waiting to be delivered or that failed delivery
+type QueuedMail struct {
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Data        []byte    `json:"data"`
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LeaseUntil  time.Time `json:"lease_until,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// MailQueue is a persistent outbound mail queue. Each message is stored in
+// mokey storage with its delivery state and delivered by worker goroutines
+// using the underlying transport. Failed deliveries are retried with
+// exponential backoff and marked dead after MaxAttempts. Changes to the queue
+// are made holding a storage lock so the queue can be shared by multiple
+// mokey servers and the mail queue command.
+type MailQueue struct {
+	Workers       int
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	transport MailTransport
+	storage   fiber.Storage
+	metrics   *Metrics
+	wake      chan struct{}
+}
+
+func NewMailQueue(transport MailTransport, storage fiber.Storage) *MailQueue {
+	return &MailQueue{
+		Workers:       viper.GetInt("email.queue_workers"),
+		MaxAttempts:   viper.GetInt("email.queue_max_attempts"),
+		RetryDelay:    time.Duration(viper.GetInt("email.queue_retry_delay")) * time.Second,
+		MaxRetryDelay: time.Duration(viper.GetInt("email.queue_max_retry_delay")) * time.Second,
+		transport:     transport,
+		storage:       storage,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+func (q *MailQueue) lock() (func(), error) {
+	return LockStorage(q.storage, storageKeyMailLock, mailQueueLockTTL, mailQueueLockWait)
+}
+
+// Send adds a message to the queue. Implements MailTransport.
+func (q *MailQueue) Send(from string, to []string, msg []byte) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	mail := &QueuedMail{
+		ID:          hex.EncodeToString(id),
+		State:       MailStatePending,
+		From:        from,
+		To:          to,
+		Data:        msg,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+
+	if err := q.save(mail); err != nil {
+		return err
+	}
+
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	err = q.addIndex(mail.ID)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	q.updateMetrics()
+
+	log.WithFields(log.Fields{
+		"id": mail.ID,
+		"to": to,
+	}).Debug("Queued email")
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Start runs the queue workers until stop is closed
+func (q *MailQueue) Start(stop <-chan struct{}) {
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *QueuedMail)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for mail := range jobs {
+				q.deliver(mail)
+			}
+		}()
+	}
+
+	q.updateMetrics()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer close(jobs)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+
+		for _, mail := range q.due(time.Now()) {
+			select {
+			case <-stop:
+				return
+			case jobs <- mail:
+			}
+		}
+	}
+}
+
+// due returns the queued messages ready to be delivered and leases them to
+// the caller so they are not handed out again by this or another process
+func (q *MailQueue) due(now time.Time) []*QueuedMail {
+	unlock, err := q.lock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to lock mail queue")
+		return nil
+	}
+	defer unlock()
+
+	ids, err := q.index()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to read mail queue")
+		return nil
+	}
+
+	due := make([]*QueuedMail, 0)
+	for _, id := range ids {
+		mail, err := q.Get(id)
+		if errors.Is(err, ErrMailNotFound) {
+			q.removeIndex(id)
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Error("Failed to read queued mail")
+			continue
+		}
+
+		switch {
+		case mail.State == MailStateDead:
+			continue
+		case mail.State == MailStateSending && now.Before(mail.LeaseUntil):
+			continue
+		case now.Before(mail.NextAttempt):
+			continue
+		}
+
+		mail.State = MailStateSending
+		mail.LeaseUntil = now.Add(mailQueueLease)
+		if err := q.save(mail); err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Error("Failed to lease queued mail")
+			continue
+		}
+
+		due = append(due, mail)
+	}
+
+	return due
+}
+
+func (q *MailQueue) deliver(mail *QueuedMail) {
+	err := q.transport.Send(mail.From, mail.To, mail.Data)
+
+	defer q.updateMetrics()
+
+	unlock, lerr := q.lock()
+	if lerr != nil {
+		log.WithFields(log.Fields{
+			"id":  mail.ID,
+			"err": lerr,
+		}).Error("Failed to lock mail queue to record delivery")
+		return
+	}
+	defer unlock()
+
+	if err == nil {
+		q.removeIndex(mail.ID)
+		q.storage.Delete(storagePrefixMailMessage + mail.ID)
+		log.WithFields(log.Fields{
+			"id":       mail.ID,
+			"to":       mail.To,
+			"attempts": mail.Attempts + 1,
+		}).Info("Delivered queued email")
+		return
+	}
+
+	if q.metrics != nil {
+		q.metrics.totalMailFailures.Inc()
+	}
+
+	// Message may have been purged while it was being sent
+	if _, gerr := q.Get(mail.ID); gerr != nil {
+		return
+	}
+
+	mail.Attempts++
+	mail.State = MailStatePending
+	mail.LeaseUntil = time.Time{}
+	mail.LastError = err.Error()
+	mail.NextAttempt = time.Now().Add(q.backoff(mail.Attempts))
+
+	if q.MaxAttempts > 0 && mail.Attempts >= q.MaxAttempts {
+		mail.State = MailStateDead
+		q.save(mail)
+		log.WithFields(log.Fields{
+			"id":       mail.ID,
+			"to":       mail.To,
+			"attempts": mail.Attempts,
+			"err":      err,
+		}).Error("Failed to deliver email, moved to dead letter list")
+		return
+	}
+
+	q.save(mail)
+	log.WithFields(log.Fields{
+		"id":           mail.ID,
+		"to":           mail.To,
+		"attempts":     mail.Attempts,
+		"next_attempt": mail.NextAttempt,
+		"err":          err,
+	}).Warn("Failed to deliver email, will retry")
+}
+
+// backoff returns the delay before the next delivery attempt
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	delay := q.RetryDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if q.MaxRetryDelay > 0 && delay >= q.MaxRetryDelay {
+			return q.MaxRetryDelay
+		}
+	}
+
+	return delay
+}
+
+// Get returns the queued message with id
+func (q *MailQueue) Get(id string) (*QueuedMail, error) {
+	data, err := q.storage.Get(storagePrefixMailMessage + id)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, ErrMailNotFound
+	}
+
+	var mail QueuedMail
+	if err := json.Unmarshal(data, &mail); err != nil {
+		return nil, err
+	}
+
+	return &mail, nil
+}
+
+// Pending returns messages waiting to be delivered
+func (q *MailQueue) Pending() ([]*QueuedMail, error) {
+	return q.list(func(m *QueuedMail) bool { return m.State != MailStateDead })
+}
+
+// Dead returns messages that failed delivery
+func (q *MailQueue) Dead() ([]*QueuedMail, error) {
+	return q.list(func(m *QueuedMail) bool { return m.State == MailStateDead })
+}
+
+// Retry moves a message from the dead letter list back to the queue and
+// resets its attempts
+func (q *MailQueue) Retry(id string) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer q.updateMetrics()
+
+	mail, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if mail.State == MailStateSending && time.Now().Before(mail.LeaseUntil) {
+		return errors.New("mail is being delivered")
+	}
+
+	mail.State = MailStatePending
+	mail.Attempts = 0
+	mail.NextAttempt = time.Now()
+	mail.LeaseUntil = time.Time{}
+	if err := q.save(mail); err != nil {
+		return err
+	}
+
+	return q.addIndex(id)
+}
+
+// Purge deletes a message from the queue or dead letter list
+func (q *MailQueue) Purge(id string) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer q.updateMetrics()
+
+	if _, err := q.Get(id); err != nil {
+		return err
+	}
+
+	if err := q.storage.Delete(storagePrefixMailMessage + id); err != nil {
+		return err
+	}
+
+	return q.removeIndex(id)
+}
+
+func (q *MailQueue) list(match func(*QueuedMail) bool) ([]*QueuedMail, error) {
+	ids, err := q.index()
+	if err != nil {
+		return nil, err
+	}
+
+	mails := make([]*QueuedMail, 0, len(ids))
+	for _, id := range ids {
+		mail, err := q.Get(id)
+		if errors.Is(err, ErrMailNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if match(mail) {
+			mails = append(mails, mail)
+		}
+	}
+
+	sort.SliceStable(mails, func(i, j int) bool { return mails[i].CreatedAt.Before(mails[j].CreatedAt) })
+
+	return mails, nil
+}
+
+func (q *MailQueue) save(mail *QueuedMail) error {
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+
+	return q.storage.Set(storagePrefixMailMessage+mail.ID, data, 0)
+}
+
+// index returns the ids of all messages in the queue. The index must only be
+// modified holding the queue lock.
+func (q *MailQueue) index() ([]string, error) {
+	data, err := q.storage.Get(storageKeyMailIndex)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("Invalid mail queue index: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (q *MailQueue) addIndex(id string) error {
+	ids, err := q.index()
+	if err != nil {
+		return err
+	}
+
+	for _, i := range ids {
+		if i == id {
+			return nil
+		}
+	}
+
+	return q.saveIndex(append(ids, id))
+}
+
+func (q *MailQueue) removeIndex(id string) error {
+	ids, err := q.index()
+	if err != nil {
+		return err
+	}
+
+	keep := make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			keep = append(keep, i)
+		}
+	}
+
+	return q.saveIndex(keep)
+}
+
+func (q *MailQueue) saveIndex(ids []string) error {
+	if len(ids) == 0 {
+		return q.storage.Delete(storageKeyMailIndex)
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return q.storage.Set(storageKeyMailIndex, data, 0)
+}
+
+func (q *MailQueue) updateMetrics() {
+	if q.metrics == nil {
+		return
+	}
+
+	if mails, err := q.Pending(); err == nil {
+		q.metrics.mailQueueDepth.Set(float64(len(mails)))
+	}
+
+	if mails, err := q.Dead(); err == nil {
+		q.metrics.mailQueueDead.Set(float64(len(mails)))
+	}
+}
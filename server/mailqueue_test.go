@@ -0,0 +1,268 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/gofiber/storage/sqlite3/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingTransport struct {
+	mu    sync.Mutex
+	fail  bool
+	sends int
+}
+
+func (t *failingTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sends++
+	if t.fail {
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+func newTestMailQueue(transport MailTransport) *MailQueue {
+	q := NewMailQueue(transport, memory.New())
+	q.MaxAttempts = 3
+	q.RetryDelay = time.Minute
+	q.MaxRetryDelay = 10 * time.Minute
+	return q
+}
+
+func TestMailQueueBackoff(t *testing.T) {
+	assert := assert.New(t)
+	q := newTestMailQueue(&MemoryTransport{})
+
+	assert.Equal(time.Minute, q.backoff(1))
+	assert.Equal(2*time.Minute, q.backoff(2))
+	assert.Equal(8*time.Minute, q.backoff(4))
+	assert.Equal(10*time.Minute, q.backoff(5))
+	assert.Equal(10*time.Minute, q.backoff(50))
+}
+
+func TestMailQueueDeliver(t *testing.T) {
+	assert := assert.New(t)
+	transport := &MemoryTransport{}
+	q := newTestMailQueue(transport)
+
+	assert.NoError(q.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello")))
+
+	pending, err := q.Pending()
+	if assert.NoError(err) && assert.Len(pending, 1) {
+		assert.Equal([]string{"jdoe@example.com"}, pending[0].To)
+	}
+
+	// Nothing is delivered until the workers run
+	assert.Len(transport.Messages(), 0)
+
+	due := q.due(time.Now())
+	if !assert.Len(due, 1) {
+		return
+	}
+
+	// Messages in flight are not handed out twice
+	assert.Len(q.due(time.Now()), 0)
+
+	q.deliver(due[0])
+	if assert.Len(transport.Messages(), 1) {
+		assert.Equal([]byte("hello"), transport.Messages()[0].Data)
+	}
+
+	pending, err = q.Pending()
+	assert.NoError(err)
+	assert.Len(pending, 0)
+
+	_, err = q.Get(due[0].ID)
+	assert.ErrorIs(err, ErrMailNotFound)
+}
+
+func TestMailQueueRetry(t *testing.T) {
+	assert := assert.New(t)
+	transport := &failingTransport{fail: true}
+	q := newTestMailQueue(transport)
+
+	assert.NoError(q.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello")))
+
+	now := time.Now()
+	for i := 1; i <= q.MaxAttempts; i++ {
+		due := q.due(now)
+		if !assert.Len(due, 1) {
+			return
+		}
+		q.deliver(due[0])
+
+		mail, err := q.Get(due[0].ID)
+		if assert.NoError(err) {
+			assert.Equal(i, mail.Attempts)
+			assert.Equal("connection refused", mail.LastError)
+			now = mail.NextAttempt
+		}
+
+		// Not retried before the backoff delay
+		assert.Len(q.due(now.Add(-time.Second)), 0)
+	}
+
+	assert.Equal(q.MaxAttempts, transport.sends)
+
+	pending, err := q.Pending()
+	assert.NoError(err)
+	assert.Len(pending, 0)
+
+	dead, err := q.Dead()
+	if !assert.NoError(err) || !assert.Len(dead, 1) {
+		return
+	}
+
+	assert.Len(q.due(now.Add(time.Hour)), 0)
+
+	transport.fail = false
+	assert.NoError(q.Retry(dead[0].ID))
+
+	due := q.due(time.Now())
+	if assert.Len(due, 1) {
+		assert.Equal(0, due[0].Attempts)
+		q.deliver(due[0])
+	}
+
+	dead, err = q.Dead()
+	assert.NoError(err)
+	assert.Len(dead, 0)
+	assert.Equal(q.MaxAttempts+1, transport.sends)
+}
+
+func TestMailQueuePurge(t *testing.T) {
+	assert := assert.New(t)
+	q := newTestMailQueue(&MemoryTransport{})
+
+	assert.NoError(q.Send("support@example.com", []string{"jdoe@example.com"}, []byte("one")))
+	assert.NoError(q.Send("support@example.com", []string{"jdoe@example.com"}, []byte("two")))
+
+	pending, err := q.Pending()
+	if !assert.NoError(err) || !assert.Len(pending, 2) {
+		return
+	}
+
+	assert.NoError(q.Purge(pending[0].ID))
+	assert.ErrorIs(q.Purge(pending[0].ID), ErrMailNotFound)
+
+	pending, err = q.Pending()
+	if assert.NoError(err) && assert.Len(pending, 1) {
+		assert.Equal([]byte("two"), pending[0].Data)
+	}
+}
+
+func TestMailQueueStart(t *testing.T) {
+	assert := assert.New(t)
+	transport := &MemoryTransport{}
+	q := newTestMailQueue(transport)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Start(stop)
+
+	assert.NoError(q.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello")))
+
+	assert.Eventually(func() bool {
+		return len(transport.Messages()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMailQueueShared(t *testing.T) {
+	assert := assert.New(t)
+	storage := sqlite3.New(sqlite3.Config{
+		Database: filepath.Join(t.TempDir(), "mokey.db"),
+		Table:    storageTable,
+	})
+	defer storage.Close()
+
+	// Two servers, or a server and the mail queue command, sharing storage
+	transport := &failingTransport{}
+	q1 := NewMailQueue(transport, storage)
+	q2 := NewMailQueue(transport, storage)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(q1.Send("support@example.com", []string{"jdoe@example.com"}, []byte("one")))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(q2.Send("support@example.com", []string{"jdoe@example.com"}, []byte("two")))
+		}()
+	}
+	wg.Wait()
+
+	pending, err := q2.Pending()
+	if !assert.NoError(err) || !assert.Len(pending, 20) {
+		return
+	}
+
+	// Leased messages are not handed out by the other queue
+	now := time.Now()
+	due := q1.due(now)
+	assert.Len(due, 20)
+	assert.Len(q2.due(now), 0)
+
+	// Unless the lease expired
+	assert.Len(q2.due(now.Add(mailQueueLease+time.Second)), 20)
+
+	// Messages purged while being sent are not requeued
+	assert.NoError(q2.Purge(due[0].ID))
+	transport.fail = true
+	q1.deliver(due[0])
+	_, err = q1.Get(due[0].ID)
+	assert.ErrorIs(err, ErrMailNotFound)
+
+	transport.fail = false
+	for _, m := range due[1:] {
+		q1.deliver(m)
+	}
+
+	pending, err = q2.Pending()
+	assert.NoError(err)
+	assert.Len(pending, 0)
+	assert.Equal(20, transport.sends)
+}
+
+func TestStorageLock(t *testing.T) {
+	assert := assert.New(t)
+	storage := sqlite3.New(sqlite3.Config{
+		Database: filepath.Join(t.TempDir(), "mokey.db"),
+		Table:    storageTable,
+	})
+	defer storage.Close()
+
+	unlock, err := LockStorage(storage, "test-lock", time.Minute, 0)
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = LockStorage(storage, "test-lock", time.Minute, 50*time.Millisecond)
+	assert.ErrorIs(err, ErrStorageLockTimeout)
+
+	unlock()
+	unlock2, err := LockStorage(storage, "test-lock", time.Minute, 0)
+	if assert.NoError(err) {
+		unlock2()
+	}
+
+	// Expired locks are taken over
+	_, err = LockStorage(storage, "expired-lock", -time.Minute, 0)
+	assert.NoError(err)
+	_, err = LockStorage(storage, "expired-lock", time.Minute, 0)
+	assert.NoError(err)
+
+	assert.False(PersistentStorage(memory.New()))
+	assert.True(PersistentStorage(storage))
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// MailTransport delivers a fully rendered email message
+type MailTransport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// NewMailTransport returns the mail transport set in email.transport. Supported
+// transports are smtp, sendmail, file, and memory.
+func NewMailTransport() (MailTransport, error) {
+	switch viper.GetString("email.transport") {
+	case "", "smtp":
+		return NewSMTPTransport()
+	case "sendmail":
+		return &SendmailTransport{
+			Path: viper.GetString("email.sendmail_path"),
+		}, nil
+	case "file":
+		if viper.GetString("email.file_dir") == "" {
+			return nil, fmt.Errorf("Please set email.file_dir to use the file mail transport")
+		}
+		return &FileTransport{
+			Dir: viper.GetString("email.file_dir"),
+		}, nil
+	case "memory":
+		return &MemoryTransport{}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid config value for email.transport: %s", viper.GetString("email.transport"))
+}
+
+// SMTPTransport delivers mail to an SMTP server. Auth is one of none, plain,
+// login, cram-md5, or xoauth2. TokenSource provides the access token for
+// xoauth2.
+type SMTPTransport struct {
+	Host        string
+	Port        int
+	TLS         string
+	Auth        string
+	Username    string
+	Password    string
+	TokenSource oauth2.TokenSource
+}
+
+func NewSMTPTransport() (*SMTPTransport, error) {
+	t := &SMTPTransport{
+		Host: viper.GetString("email.smtp_host"),
+		Port: viper.GetInt("email.smtp_port"),
+		TLS:  viper.GetString("email.smtp_tls"),
+	}
+
+	if err := configureSMTPAuth(t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *SMTPTransport) Send(from string, to []string, msg []byte) error {
+	smtpHostPort := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	var conn net.Conn
+	var err error
+
+	switch t.TLS {
+	case "on":
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: false,
+			ServerName:         t.Host,
+		}
+		conn, err = tls.Dial("tcp", smtpHostPort, tlsConfig)
+	case "off", "starttls":
+		conn, err = net.Dial("tcp", smtpHostPort)
+	default:
+		return fmt.Errorf("invalid config value for smtp_tls: %s", t.TLS)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if t.TLS == "starttls" {
+		err := c.StartTLS(&tls.Config{
+			ServerName: t.Host,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	auth, err := t.smtpAuth()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = wc.Write(msg); err != nil {
+		wc.Close()
+		return err
+	}
+
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// SendmailTransport delivers mail by piping it to a sendmail compatible
+// binary
+type SendmailTransport struct {
+	Path string
+}
+
+func (t *SendmailTransport) Send(from string, to []string, msg []byte) error {
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(t.Path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sendmail failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return nil
+}
+
+// FileTransport writes each message to a maildir. Useful for development and
+// testing where no mail server is available.
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(from string, to []string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	name, err := maildirName()
+	if err != nil {
+		return err
+	}
+
+	// Messages are written to tmp and moved to new so readers never see a
+	// partially written message
+	tmpPath := filepath.Join(t.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, msg, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(t.Dir, "new", name))
+}
+
+func maildirName() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hex.EncodeToString(rnd), hostname), nil
+}
+
+// MailMessage is a message captured by the MemoryTransport
+type MailMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryTransport keeps all messages in memory. Used for unit tests.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []*MailMessage
+}
+
+func (t *MemoryTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, &MailMessage{
+		From: from,
+		To:   append([]string{}, to...),
+		Data: append([]byte{}, msg...),
+	})
+
+	return nil
+}
+
+// Messages returns all messages sent
+func (t *MemoryTransport) Messages() []*MailMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*MailMessage{}, t.messages...)
+}
+
+// Reset removes all messages
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
@@ -20,6 +20,14 @@ type Metrics struct {
 	totalPasswordResetsSent       prometheus.Counter
 	totalAccountVerifications     prometheus.Counter
 	totalAccountVerificationsSent prometheus.Counter
+	totalSignupEmailsRejected     *prometheus.CounterVec
+	totalBreachedPasswords        prometheus.Counter
+	totalMagicLinkLogins          prometheus.Counter
+	totalSSHCertsIssued           prometheus.Counter
+	totalMailFailures             prometheus.Counter
+	mailQueueDepth                prometheus.Gauge
+	mailQueueDead                 prometheus.Gauge
+	totalWebhookFailures          prometheus.Counter
 }
 
 func NewMetrics() *Metrics {
@@ -60,6 +68,38 @@ func NewMetrics() *Metrics {
 			Name: "mokey_account_verification_sent_total",
 			Help: "The total number of account verification emails sent",
 		}),
+		totalSignupEmailsRejected: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "mokey_signup_email_rejected_total",
+			Help: "The total number of signups rejected due to the email domain",
+		}, []string{"reason"}),
+		totalBreachedPasswords: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mokey_password_breached_total",
+			Help: "The total number of new passwords rejected for appearing in a breach corpus",
+		}),
+		totalMagicLinkLogins: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mokey_magic_link_logins_total",
+			Help: "The total number of successful logins using magic links",
+		}),
+		totalSSHCertsIssued: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mokey_sshcert_issued_total",
+			Help: "The total number of ssh user certificates issued",
+		}),
+		totalMailFailures: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mokey_mail_failures_total",
+			Help: "The total number of failed email delivery attempts",
+		}),
+		mailQueueDepth: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "mokey_mail_queue_depth",
+			Help: "The number of emails waiting to be delivered",
+		}),
+		mailQueueDead: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "mokey_mail_queue_dead",
+			Help: "The number of emails in the dead letter list",
+		}),
+		totalWebhookFailures: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mokey_webhook_failures_total",
+			Help: "The total number of failed or dropped webhook deliveries",
+		}),
 	}
 
 	m.handler = fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
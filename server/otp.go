@@ -62,11 +62,22 @@ func (r *Router) OTPTokenRemove(c *fiber.Ctx) error {
 		}).Error("Failed to remove OTP token")
 
 		if ierr, ok := err.(*ipa.IpaError); ok && ierr.Code == 4203 {
-			vars["message"] = "You can't remove your last active token while Two-Factor auth is enabled"
+			vars["message"] = tr(c, "You can't remove your last active token while Two-Factor auth is enabled")
 		} else {
-			vars["message"] = "Failed to remove token"
+			vars["message"] = tr(c, "Failed to remove token")
 		}
 	} else {
+		r.audit(c, &AuditEvent{
+			Action: AuditOTPTokenRemove,
+			Target: user.Username,
+			Data: map[string]interface{}{
+				"uuid": uuid,
+			},
+		})
+		r.webhooks.Emit(EventOTPTokenRemoved, user.Username, RemoteIP(c), map[string]interface{}{
+			"uuid": uuid,
+		})
+
 		err = r.emailer.SendOTPTokenUpdatedEmail(false, user, c)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -92,7 +103,7 @@ func (r *Router) OTPTokenEnable(c *fiber.Ctx) error {
 			"username": username,
 			"err":      err,
 		}).Error("Failed to enable OTP token")
-		vars["message"] = "Failed to enable token"
+		vars["message"] = tr(c, "Failed to enable token")
 	}
 
 	return r.tokenList(c, vars)
@@ -113,9 +124,9 @@ func (r *Router) OTPTokenDisable(c *fiber.Ctx) error {
 		}).Error("Failed to enable OTP token")
 
 		if ierr, ok := err.(*ipa.IpaError); ok && ierr.Code == 4203 {
-			vars["message"] = "You can't disable your last active token while Two-Factor auth is enabled"
+			vars["message"] = tr(c, "You can't disable your last active token while Two-Factor auth is enabled")
 		} else {
-			vars["message"] = "Failed to disable token"
+			vars["message"] = tr(c, "Failed to disable token")
 		}
 	}
 
@@ -134,7 +145,7 @@ func (r *Router) OTPTokenVerify(c *fiber.Ctx) error {
 	key, err := otp.NewKeyFromURL(uri)
 	if err != nil || action == "cancel" {
 		client.RemoveOTPToken(uuid)
-		vars["message"] = "Failed to verify token."
+		vars["message"] = tr(c, "Failed to verify token.")
 		return r.tokenList(c, vars)
 	}
 
@@ -154,9 +165,20 @@ func (r *Router) OTPTokenVerify(c *fiber.Ctx) error {
 			"uuid":     uuid,
 			"username": user.Username,
 		}).Error("Failed to verify OTP token")
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid 6-digit code. Please try again.")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Invalid 6-digit code. Please try again."))
 	}
 
+	r.audit(c, &AuditEvent{
+		Action: AuditOTPTokenAdd,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"uuid": uuid,
+		},
+	})
+	r.webhooks.Emit(EventOTPTokenAdded, user.Username, RemoteIP(c), map[string]interface{}{
+		"uuid": uuid,
+	})
+
 	autoMFA := false
 	if viper.GetBool("accounts.require_mfa") {
 		tokens, _ := client.FetchOTPTokens(user.Username)
@@ -173,6 +195,16 @@ func (r *Router) OTPTokenVerify(c *fiber.Ctx) error {
 				autoMFA = true
 				user.AuthTypes = otpOnly
 				c.Locals(ContextKeyUser, user)
+				r.audit(c, &AuditEvent{
+					Action: AuditMFAEnable,
+					Target: user.Username,
+					Data: map[string]interface{}{
+						"automatic": true,
+					},
+				})
+				r.webhooks.Emit(EventMFAEnabled, user.Username, RemoteIP(c), map[string]interface{}{
+					"automatic": true,
+				})
 
 				err = r.emailer.SendMFAChangedEmail(true, user, c)
 				if err != nil {
@@ -2,7 +2,6 @@ package server
 
 import (
 	"errors"
-	"fmt"
 	"regexp"
 	"time"
 
@@ -13,6 +12,10 @@ import (
 	ipa "github.com/ubccr/goipa"
 )
 
+// passwordStrengthMaxInput is the maximum number of runes of each form value
+// used when estimating password strength
+const passwordStrengthMaxInput = 256
+
 var (
 	PasswordCheckLower  = regexp.MustCompile(`[a-z]`)
 	PasswordCheckUpper  = regexp.MustCompile(`[A-Z]`)
@@ -20,58 +23,13 @@ var (
 	PasswordCheckMarks  = regexp.MustCompile(`[^0-9a-zA-Z]`)
 )
 
-// Simple password checker to validate passwords before creating an account
+// Simple password checker to validate passwords using the password policy set
+// in the mokey config
 func checkPassword(pass string) error {
-	minLength := viper.GetInt("accounts.min_passwd_len")
-	minClasses := viper.GetInt("accounts.min_passwd_classes")
-
-	l := len([]rune(pass))
-	if l < minLength {
-		return fmt.Errorf("Password does not conform to policy. Min length: %d", minLength)
-	}
-
-	numCategories := 0
-
-	if PasswordCheckLower.MatchString(pass) {
-		numCategories++
-	}
-	if PasswordCheckUpper.MatchString(pass) {
-		numCategories++
-	}
-	if PasswordCheckNumber.MatchString(pass) {
-		numCategories++
-	}
-	if PasswordCheckMarks.MatchString(pass) {
-		numCategories++
-	}
-
-	repeated := 0
-	for i := 0; i < l; i++ {
-		count := 1
-		for j := i + 1; j < l; j++ {
-			if pass[i] != pass[j] {
-				break
-			}
-			count++
-		}
-
-		if count > repeated {
-			repeated = count
-		}
-	}
-
-	if repeated > 1 {
-		numCategories--
-	}
-
-	if numCategories < minClasses {
-		return fmt.Errorf("Password does not conform to policy. Try including both upper/lower case, numbers, and other characters")
-	}
-
-	return nil
+	return ConfigPasswordPolicy().Check(pass)
 }
 
-func validatePassword(password, passwordConfirm string) error {
+func validatePassword(password, passwordConfirm string, policy *PasswordPolicy) error {
 	if password == "" {
 		return errors.New("Please enter a new password")
 	}
@@ -84,14 +42,14 @@ func validatePassword(password, passwordConfirm string) error {
 		return errors.New("Password do not match. Please confirm your password.")
 	}
 
-	if err := checkPassword(password); err != nil {
+	if err := policy.Check(password); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func validatePasswordChange(passwordCurrent, password, passwordConfirm string) error {
+func validatePasswordChange(passwordCurrent, password, passwordConfirm string, policy *PasswordPolicy) error {
 	if passwordCurrent == "" {
 		return errors.New("Please enter you current password")
 	}
@@ -100,15 +58,68 @@ func validatePasswordChange(passwordCurrent, password, passwordConfirm string) e
 		return errors.New("Current password is the same as new password. Please set a different password.")
 	}
 
-	return validatePassword(password, passwordConfirm)
+	return validatePassword(password, passwordConfirm, policy)
+}
+
+// checkNewPassword checks the strength of a new password for user and
+// ensures it has not appeared in a breach
+func (r *Router) checkNewPassword(user *ipa.User, password string) error {
+	if err := checkPasswordStrength(password, user); err != nil {
+		return err
+	}
+
+	return r.checkBreachedPassword(user.Username, password)
+}
+
+// PasswordStrength renders the live password strength meter shown on all
+// password forms
+// truncateRunes returns at most max runes of s
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+
+	return s
+}
+
+func (r *Router) PasswordStrength(c *fiber.Ctx) error {
+	password := c.FormValue("newpassword")
+	if password == "" {
+		password = c.FormValue("password")
+	}
+
+	if password == "" {
+		return c.SendString("")
+	}
+
+	user := &ipa.User{
+		Username: truncateRunes(c.FormValue("username"), passwordStrengthMaxInput),
+		First:    truncateRunes(c.FormValue("first"), passwordStrengthMaxInput),
+		Last:     truncateRunes(c.FormValue("last"), passwordStrengthMaxInput),
+		Email:    truncateRunes(c.FormValue("email"), passwordStrengthMaxInput),
+	}
+	password = truncateRunes(password, passwordStrengthMaxInput)
+
+	strength := EstimatePasswordStrength(password, passwordUserInputs(user)...)
+	minScore := viper.GetInt("accounts.min_passwd_score")
+
+	return c.Render("password-strength.html", fiber.Map{
+		"strength":   strength,
+		"acceptable": strength.Score >= minScore,
+		"minScore":   minScore,
+	})
 }
 
 func (r *Router) PasswordChange(c *fiber.Ctx) error {
 	user := r.user(c)
 	client := r.userClient(c)
 
+	policy := r.pwpolicy.Get(user.Username)
+
 	vars := fiber.Map{
-		"user": user,
+		"user":   user,
+		"policy": policy,
 	}
 
 	if c.Method() == fiber.MethodGet {
@@ -121,17 +132,29 @@ func (r *Router) PasswordChange(c *fiber.Ctx) error {
 	otp := c.FormValue("otpcode")
 
 	if user.OTPOnly() && otp == "" {
-		vars["message"] = "Please enter the 6-digit OTP code from your mobile app"
+		vars["message"] = tr(c, "Please enter the 6-digit OTP code from your mobile app")
 		return c.Render("password.html", vars)
 	}
 
-	if err := validatePasswordChange(password, newpass, newpass2); err != nil {
-		vars["message"] = err.Error()
+	if err := validatePasswordChange(password, newpass, newpass2, policy); err != nil {
+		vars["message"] = tr(c, err.Error())
+		return c.Render("password.html", vars)
+	}
+
+	if err := r.checkNewPassword(user, newpass); err != nil {
+		vars["message"] = tr(c, err.Error())
 		return c.Render("password.html", vars)
 	}
 
 	err := client.ChangePassword(user.Username, password, newpass, otp)
 	if err != nil {
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordChange,
+			Outcome: AuditFailure,
+			Target:  user.Username,
+			Reason:  err.Error(),
+		})
+
 		if ierr, ok := err.(*ipa.IpaError); ok {
 			log.WithFields(log.Fields{
 				"username": user.Username,
@@ -144,9 +167,17 @@ func (r *Router) PasswordChange(c *fiber.Ctx) error {
 				"username": user.Username,
 				"error":    err.Error(),
 			}).Error("Failed to change password")
-			vars["message"] = "Fatal system error"
+			vars["message"] = tr(c, "Fatal system error")
 		}
 	} else {
+		r.audit(c, &AuditEvent{
+			Action: AuditPasswordChange,
+			Target: user.Username,
+		})
+		r.webhooks.Emit(EventPasswordChanged, user.Username, RemoteIP(c), map[string]interface{}{
+			"method": "change",
+		})
+
 		err = r.emailer.SendPasswordChangedEmail(user, c)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -174,7 +205,7 @@ func (r *Router) PasswordForgot(c *fiber.Ctx) error {
 	err := r.verifyCaptcha(c.FormValue("captcha_id"), c.FormValue("captcha_sol"))
 	if err != nil {
 		c.Append("HX-Trigger", "{\"reloadCaptcha\":\""+captcha.New()+"\"}")
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	username := c.FormValue("username")
@@ -183,6 +214,12 @@ func (r *Router) PasswordForgot(c *fiber.Ctx) error {
 		log.WithFields(log.Fields{
 			"username": username,
 		}).Warn("AUDIT Forgot password attempt for blocked username")
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordResetRequest,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "blocked",
+		})
 		return c.Render("password-forgot-success.html", fiber.Map{})
 	}
 
@@ -192,6 +229,12 @@ func (r *Router) PasswordForgot(c *fiber.Ctx) error {
 			"username": username,
 			"err":      err,
 		}).Warn("AUDIT Forgot password attempt for unknown username")
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordResetRequest,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "unknown username",
+		})
 		return c.Render("password-forgot-success.html", fiber.Map{})
 	}
 
@@ -199,6 +242,12 @@ func (r *Router) PasswordForgot(c *fiber.Ctx) error {
 		log.WithFields(log.Fields{
 			"username": username,
 		}).Warn("AUDIT Forgot password attempt for disabled/locked user")
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordResetRequest,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "locked",
+		})
 		return c.Render("password-forgot-success.html", fiber.Map{})
 	}
 
@@ -216,6 +265,11 @@ func (r *Router) PasswordForgot(c *fiber.Ctx) error {
 			"email":    user.Email,
 		}).Info("Password reset email sent successfully")
 		r.metrics.totalPasswordResetsSent.Inc()
+		r.webhooks.Emit(EventPasswordResetRequested, user.Username, RemoteIP(c), nil)
+		r.audit(c, &AuditEvent{
+			Action: AuditPasswordResetRequest,
+			Target: user.Username,
+		})
 	}
 
 	return c.Render("password-forgot-success.html", fiber.Map{})
@@ -243,13 +297,37 @@ func (r *Router) PasswordReset(c *fiber.Ctx) error {
 			"username": claims.Username,
 			"email":    claims.Email,
 		}).Warn("AUDIT Attempt to reset password for disabled/locked user")
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordReset,
+			Outcome: AuditFailure,
+			Target:  claims.Username,
+			Reason:  "locked",
+		})
+		return c.Status(fiber.StatusNotFound).SendString("")
+	}
+
+	// Reset links are only valid for the email address they were sent to
+	if user.Email != claims.Email {
+		log.WithFields(log.Fields{
+			"username": claims.Username,
+			"email":    claims.Email,
+		}).Warn("AUDIT Attempt to reset password with token for a different email address")
+		r.audit(c, &AuditEvent{
+			Action:  AuditPasswordReset,
+			Outcome: AuditFailure,
+			Target:  claims.Username,
+			Reason:  "email mismatch",
+		})
 		return c.Status(fiber.StatusNotFound).SendString("")
 	}
 
+	policy := r.pwpolicy.Get(user.Username)
+
 	if c.Method() == fiber.MethodGet {
 		vars := fiber.Map{
 			"claims": claims,
 			"user":   user,
+			"policy": policy,
 		}
 
 		return c.Render("password-reset.html", vars)
@@ -260,16 +338,20 @@ func (r *Router) PasswordReset(c *fiber.Ctx) error {
 	otp := c.FormValue("otpcode")
 
 	if user.OTPOnly() && otp == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please enter the 6-digit OTP code from your mobile app")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please enter the 6-digit OTP code from your mobile app"))
+	}
+
+	if err := validatePassword(password, passwordConfirm, policy); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
-	if err := validatePassword(password, passwordConfirm); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	if err := r.checkNewPassword(user, password); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	rand, err := r.adminClient.ResetPassword(user.Username)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("System error please contact administrator")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "System error please contact administrator"))
 	}
 
 	err = r.adminClient.SetPassword(user.Username, rand, password, otp)
@@ -280,23 +362,23 @@ func (r *Router) PasswordReset(c *fiber.Ctx) error {
 				"username": user.Username,
 				"error":    err,
 			}).Error("Password does not conform to policy")
-			return c.Status(fiber.StatusBadRequest).SendString("Your password is too weak. Please ensure your password includes a number and lower/upper case character")
+			return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Your password is too weak. Please ensure your password includes a number and lower/upper case character"))
 		case errors.Is(err, ipa.ErrInvalidPassword):
 			log.WithFields(log.Fields{
 				"username": user.Username,
 				"error":    err,
 			}).Error("invalid password from FreeIPA")
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid OTP code.")
+			return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Invalid OTP code."))
 		default:
 			log.WithFields(log.Fields{
 				"username": user.Username,
 				"error":    err,
 			}).Error("failed to set user password in FreeIPA")
-			return c.Status(fiber.StatusInternalServerError).SendString("System error please contact administrator")
+			return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "System error please contact administrator"))
 		}
 	}
 
-	r.storage.Set(TokenPasswordReset+TokenUsedPrefix+token, []byte("true"), time.Until(claims.Timestamp.Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second)))
+	MarkTokenUsed(token, claims, r.storage)
 
 	err = r.emailer.SendPasswordChangedEmail(user, c)
 	if err != nil {
@@ -311,6 +393,11 @@ func (r *Router) PasswordReset(c *fiber.Ctx) error {
 		"username": user.Username,
 	}).Info("AUDIT User password changed successfully")
 	r.metrics.totalPasswordResets.Inc()
+	r.webhooks.Emit(EventPasswordReset, user.Username, RemoteIP(c), nil)
+	r.audit(c, &AuditEvent{
+		Action: AuditPasswordReset,
+		Target: user.Username,
+	})
 
 	return c.Render("password-reset-success.html", fiber.Map{})
 }
@@ -352,11 +439,15 @@ func (r *Router) PasswordExpired(c *fiber.Ctx) error {
 	otp := c.FormValue("otp")
 
 	if user.OTPOnly() && otp == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please enter the 6-digit OTP code from your mobile app")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please enter the 6-digit OTP code from your mobile app"))
 	}
 
-	if err := validatePasswordChange(password, newpass, newpass2); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	if err := validatePasswordChange(password, newpass, newpass2, r.pwpolicy.Get(user.Username)); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	if err := r.checkNewPassword(user, newpass); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	err = r.adminClient.SetPassword(user.Username, password, newpass, otp)
@@ -386,7 +477,7 @@ func (r *Router) PasswordExpired(c *fiber.Ctx) error {
 			"username":         user.Username,
 			"ipa_client_error": err,
 		}).Error("Failed to login after expired password change")
-		return c.Status(fiber.StatusUnauthorized).SendString("Login failed")
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Login failed"))
 	}
 
 	_, err = client.Ping()
@@ -395,12 +486,14 @@ func (r *Router) PasswordExpired(c *fiber.Ctx) error {
 			"username":         user.Username,
 			"ipa_client_error": err,
 		}).Error("Failed to ping FreeIPA after expired password change")
-		return c.Status(fiber.StatusUnauthorized).SendString("Invalid credentials")
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
 	}
 
 	sess.Set(SessionKeyAuthenticated, true)
 	sess.Set(SessionKeyUsername, user.Username)
 	sess.Set(SessionKeySID, client.SessionID())
+	sess.Set(SessionKeyLanguage, r.sessionLanguage(user.Username))
+	sess.Set(SessionKeyLoginAt, time.Now().UnixNano())
 
 	if err := r.sessionSave(c, sess); err != nil {
 		return err
@@ -410,7 +503,50 @@ func (r *Router) PasswordExpired(c *fiber.Ctx) error {
 		"username": user.Username,
 	}).Info("AUDIT User logged in and changed expired password successfully")
 	r.metrics.totalPasswordResets.Inc()
+	r.webhooks.Emit(EventPasswordChanged, user.Username, RemoteIP(c), map[string]interface{}{
+		"method": "expired",
+	})
+	r.audit(c, &AuditEvent{
+		Action: AuditPasswordChange,
+		Actor:  user.Username,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"expired": true,
+		},
+	})
 
 	c.Set("HX-Redirect", "/")
 	return c.Status(fiber.StatusNoContent).SendString("")
 }
+
+// passwordExpiryDismissed returns true if the user dismissed the password
+// expiry banner for their current password in this session
+func (r *Router) passwordExpiryDismissed(c *fiber.Ctx, user *ipa.User) bool {
+	sess, err := r.session(c)
+	if err != nil {
+		return false
+	}
+
+	dismissed, ok := sess.Get(SessionKeyExpiryDismiss).(int64)
+
+	return ok && dismissed == user.PasswdExpire.Unix()
+}
+
+func (r *Router) PasswordExpiryDismiss(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	sess, err := r.session(c)
+	if err != nil {
+		return err
+	}
+
+	// Keyed on the expiration time so the banner is shown again if the
+	// password changes
+	sess.Set(SessionKeyExpiryDismiss, user.PasswdExpire.Unix())
+
+	if err := r.sessionSave(c, sess); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	StoragePrefixPGPKey = "pgpkey-"
+)
+
+// ErrEncryptionRequired is returned when an email must be encrypted but the
+// user has no OpenPGP key
+var ErrEncryptionRequired = errors.New("Encryption is required but user has no OpenPGP key")
+
+// PGPKeyRecord is an OpenPGP public key registered by a user. Emails listed
+// in email.pgp_templates are encrypted to this key.
+type PGPKeyRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	Identities  []string  `json:"identities"`
+	Armored     string    `json:"armored"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+// PGPKeyStore saves the OpenPGP public keys of users
+type PGPKeyStore interface {
+	// Get returns the key for username or nil if none
+	Get(username string) (*PGPKeyRecord, error)
+	Save(username string, rec *PGPKeyRecord) error
+	Delete(username string) error
+}
+
+// NewPGPKeyStore returns the store for OpenPGP keys. Keys are saved in the
+// FreeIPA attribute email.pgp_key_attribute if set, otherwise in mokey
+// storage. Returns nil if keys can not be saved, either because the FreeIPA
+// JSON-RPC client is not available or storage is not persistent.
+func NewPGPKeyStore(storage fiber.Storage, rpc *IPARPC) PGPKeyStore {
+	if attr := viper.GetString("email.pgp_key_attribute"); attr != "" {
+		if rpc == nil {
+			return nil
+		}
+		return &IPAPGPKeyStore{rpc: rpc, attr: attr}
+	}
+
+	if storage == nil || !PersistentStorage(storage) {
+		return nil
+	}
+
+	return &StoragePGPKeyStore{storage: storage}
+}
+
+// StoragePGPKeyStore saves OpenPGP keys in mokey storage
+type StoragePGPKeyStore struct {
+	storage fiber.Storage
+}
+
+func pgpKeyRecordKey(username string) string {
+	return StoragePrefixPGPKey + username
+}
+
+func (s *StoragePGPKeyStore) Get(username string) (*PGPKeyRecord, error) {
+	data, err := s.storage.Get(pgpKeyRecordKey(username))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var rec PGPKeyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func (s *StoragePGPKeyStore) Save(username string, rec *PGPKeyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Set(pgpKeyRecordKey(username), data, 0)
+}
+
+func (s *StoragePGPKeyStore) Delete(username string) error {
+	return s.storage.Delete(pgpKeyRecordKey(username))
+}
+
+// IPAPGPKeyStore saves ASCII armored OpenPGP keys in a FreeIPA user attribute
+type IPAPGPKeyStore struct {
+	rpc  *IPARPC
+	attr string
+}
+
+func (s *IPAPGPKeyStore) Get(username string) (*PGPKeyRecord, error) {
+	armored, err := s.rpc.PGPKey(username, s.attr)
+	if err != nil || armored == "" {
+		return nil, err
+	}
+
+	return ParsePGPPublicKey(armored)
+}
+
+func (s *IPAPGPKeyStore) Save(username string, rec *PGPKeyRecord) error {
+	return s.rpc.SetPGPKey(username, s.attr, rec.Armored)
+}
+
+func (s *IPAPGPKeyStore) Delete(username string) error {
+	return s.rpc.SetPGPKey(username, s.attr, "")
+}
+
+// ParsePGPPublicKey parses an ASCII armored OpenPGP public key. The key must
+// contain a single public key capable of encryption. Private keys are
+// rejected.
+func ParsePGPPublicKey(armored string) (*PGPKeyRecord, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(strings.TrimSpace(armored)))
+	if err != nil {
+		return nil, errors.New("Invalid OpenPGP public key")
+	}
+
+	if len(entities) != 1 {
+		return nil, errors.New("Please provide a single OpenPGP public key")
+	}
+
+	entity := entities[0]
+	if entity.PrivateKey != nil {
+		return nil, errors.New("Please provide your public key, not your private key")
+	}
+
+	// Make sure the key can be used to encrypt
+	if _, err := pgpEncrypt([]byte{}, entities); err != nil {
+		return nil, errors.New("OpenPGP key has no valid encryption subkey")
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := entity.Serialize(w); err != nil {
+		return nil, err
+	}
+	w.Close()
+
+	rec := &PGPKeyRecord{
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		Armored:     buf.String(),
+	}
+	for name := range entity.Identities {
+		rec.Identities = append(rec.Identities, name)
+	}
+
+	return rec, nil
+}
+
+// PGPEncryptionRequired returns true if user is a member of one of the
+// email.pgp_require_groups
+func PGPEncryptionRequired(user *ipa.User) bool {
+	for _, g := range viper.GetStringSlice("email.pgp_require_groups") {
+		if containsString(user.Groups, g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pgpEncrypt returns msg encrypted to keys and ASCII armored
+func pgpEncrypt(msg []byte, keys openpgp.EntityList) ([]byte, error) {
+	var buf bytes.Buffer
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := openpgp.Encrypt(aw, keys, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// pgpMIME encrypts the MIME entity with contentType and body to keys and
+// returns the content type and body of the PGP/MIME message (RFC 3156)
+func pgpMIME(contentType string, body []byte, keys openpgp.EntityList) (string, []byte, error) {
+	var entity bytes.Buffer
+	fmt.Fprintf(&entity, "%s\r\n\r\n", foldHeader("Content-Type", contentType))
+	entity.Write(body)
+
+	encrypted, err := pgpEncrypt(entity.Bytes(), keys)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	mp := multipart.NewWriter(&buf)
+
+	parts := []struct {
+		header textproto.MIMEHeader
+		body   []byte
+	}{
+		{
+			textproto.MIMEHeader{
+				"Content-Type":        []string{"application/pgp-encrypted"},
+				"Content-Description": []string{"PGP/MIME version identification"},
+			},
+			[]byte("Version: 1\r\n"),
+		},
+		{
+			textproto.MIMEHeader{
+				"Content-Type":        []string{`application/octet-stream; name="encrypted.asc"`},
+				"Content-Description": []string{"OpenPGP encrypted message"},
+				"Content-Disposition": []string{`inline; filename="encrypted.asc"`},
+			},
+			bytes.ReplaceAll(encrypted, []byte("\n"), []byte(crlf)),
+		},
+	}
+
+	for _, p := range parts {
+		w, err := mp.CreatePart(p.header)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if _, err := w.Write(p.body); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := mp.Close(); err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf(`multipart/encrypted; protocol="application/pgp-encrypted";%s boundary=%s`, crlf, mp.Boundary()), buf.Bytes(), nil
+}
+
+// encryptionKeys returns the OpenPGP keys to encrypt the email template tmpl
+// sent to user. Returns nil if the email should be sent unencrypted and
+// ErrEncryptionRequired if the user must have a key but has none.
+func (e *Emailer) encryptionKeys(user *ipa.User, tmpl string) (openpgp.EntityList, error) {
+	if !containsString(viper.GetStringSlice("email.pgp_templates"), tmpl) {
+		return nil, nil
+	}
+
+	var rec *PGPKeyRecord
+	if e.pgpKeys != nil && user.Username != "" {
+		var err error
+		rec, err = e.pgpKeys.Get(user.Username)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch OpenPGP key for user %s: %w", user.Username, err)
+		}
+	}
+
+	if rec == nil {
+		if PGPEncryptionRequired(user) {
+			return nil, ErrEncryptionRequired
+		}
+		return nil, nil
+	}
+
+	return rec.EntityList()
+}
+
+// EntityList returns the parsed key
+func (rec *PGPKeyRecord) EntityList() (openpgp.EntityList, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(rec.Armored))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OpenPGP key %s: %w", rec.Fingerprint, err)
+	}
+
+	return keys, nil
+}
+
+// PGPKey returns the armored OpenPGP public key stored in the FreeIPA
+// attribute attr for username
+func (c *IPARPC) PGPKey(username, attr string) (string, error) {
+	res, err := c.Call("user_show", []string{username}, ipa.Options{"all": true})
+	if err != nil {
+		return "", err
+	}
+
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(res.Data, &attrs); err != nil {
+		return "", err
+	}
+
+	return ipaAttrString(attrs, strings.ToLower(attr)), nil
+}
+
+// SetPGPKey sets the FreeIPA attribute attr for username to the armored
+// OpenPGP public key. An empty key removes the attribute.
+func (c *IPARPC) SetPGPKey(username, attr, armored string) error {
+	_, err := c.Call("user_mod", []string{username}, ipa.Options{
+		"setattr": []string{strings.ToLower(attr) + "=" + armored},
+	})
+	if ierr, ok := err.(*ipa.IpaError); ok && ierr.Code == 4202 {
+		// no modifications to be performed
+		return nil
+	}
+
+	return err
+}
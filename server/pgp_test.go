@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func newTestPGPEntity(t *testing.T, email string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("John Doe", "", email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entity
+}
+
+func armorTestPGPEntity(t *testing.T, entity *openpgp.Entity, private bool) string {
+	var buf bytes.Buffer
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+
+	w, err := armor.Encode(&buf, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if private {
+		err = entity.SerializePrivate(w, nil)
+	} else {
+		err = entity.Serialize(w)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	return buf.String()
+}
+
+func newTestPGPEmailer(t *testing.T) (*Emailer, *MemoryTransport) {
+	emailer, transport := newTestEmailer(t)
+	emailer.pgpKeys = &StoragePGPKeyStore{storage: emailer.storage}
+	return emailer, transport
+}
+
+// decryptTestMessage returns the decrypted body of a PGP/MIME message
+func decryptTestMessage(t *testing.T, data []byte, entity *openpgp.Entity) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		return "", err
+	}
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", err
+	}
+
+	block, err := armor.Decode(part)
+	if err != nil {
+		return "", err
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	decrypted, err := io.ReadAll(md.UnverifiedBody)
+	return string(decrypted), err
+}
+
+func TestParsePGPPublicKey(t *testing.T) {
+	assert := assert.New(t)
+	entity := newTestPGPEntity(t, "jdoe@example.com")
+
+	rec, err := ParsePGPPublicKey(armorTestPGPEntity(t, entity, false))
+	if assert.NoError(err) {
+		assert.Len(rec.Fingerprint, 40)
+		assert.Equal([]string{"John Doe <jdoe@example.com>"}, rec.Identities)
+		assert.Contains(rec.Armored, "BEGIN PGP PUBLIC KEY BLOCK")
+	}
+
+	_, err = ParsePGPPublicKey(armorTestPGPEntity(t, entity, true))
+	assert.Error(err)
+
+	_, err = ParsePGPPublicKey("ssh-ed25519 AAAA")
+	assert.Error(err)
+
+	// Multiple keys are rejected
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	newTestPGPEntity(t, "other@example.com").Serialize(w)
+	w.Close()
+	_, err = ParsePGPPublicKey(buf.String())
+	assert.Error(err)
+}
+
+func TestEmailPGPEncryption(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestPGPEmailer(t)
+
+	user := &ipa.User{
+		Username: "jdoe",
+		First:    "John",
+		Last:     "Doe",
+		Email:    "jdoe@example.com",
+	}
+
+	entity := newTestPGPEntity(t, user.Email)
+	rec, err := ParsePGPPublicKey(armorTestPGPEntity(t, entity, false))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(emailer.pgpKeys.Save(user.Username, rec))
+
+	if !assert.NoError(emailer.SendPasswordResetEmail(user, nil)) {
+		return
+	}
+
+	messages := transport.Messages()
+	if !assert.Len(messages, 1) {
+		return
+	}
+	assert.NotContains(string(messages[0].Data), "/auth/resetpw/")
+
+	msg, err := mail.ReadMessage(bytes.NewReader(messages[0].Data))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("[Example HPC] Please reset your password", msg.Header.Get("Subject"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("multipart/encrypted", mediaType)
+	assert.Equal("application/pgp-encrypted", params["protocol"])
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if assert.NoError(err) {
+		assert.Equal("application/pgp-encrypted", part.Header.Get("Content-Type"))
+		version, _ := io.ReadAll(part)
+		assert.Equal("Version: 1\r\n", string(version))
+	}
+
+	part, err = mr.NextPart()
+	if !assert.NoError(err) {
+		return
+	}
+
+	block, err := armor.Decode(part)
+	if !assert.NoError(err) {
+		return
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	decrypted, err := io.ReadAll(md.UnverifiedBody)
+	if assert.NoError(err) {
+		assert.True(strings.HasPrefix(string(decrypted), "Content-Type: multipart/alternative;"))
+		assert.Contains(string(decrypted), "/auth/resetpw/")
+	}
+
+	// Templates not in email.pgp_templates are not encrypted
+	transport.Reset()
+	if assert.NoError(emailer.SendMagicLinkEmail(user, nil)) {
+		m := parseTestMessage(t, transport.Messages()[0].Data)
+		assert.Contains(m.text, "/auth/magic/")
+	}
+
+	// Users without a key get unencrypted emails
+	transport.Reset()
+	assert.NoError(emailer.pgpKeys.Delete(user.Username))
+	if assert.NoError(emailer.SendPasswordChangedEmail(user, nil)) {
+		m := parseTestMessage(t, transport.Messages()[0].Data)
+		assert.Contains(m.text, "Password changed")
+	}
+}
+
+func TestEmailPGPRequired(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestPGPEmailer(t)
+
+	viper.Set("email.pgp_require_groups", []string{"admins"})
+	t.Cleanup(func() { viper.Set("email.pgp_require_groups", []string{}) })
+
+	user := &ipa.User{
+		Username: "jadmin",
+		First:    "Jane",
+		Last:     "Admin",
+		Email:    "jadmin@example.com",
+		Groups:   []string{"ipausers", "admins"},
+	}
+
+	assert.True(PGPEncryptionRequired(user))
+	assert.False(PGPEncryptionRequired(&ipa.User{Groups: []string{"ipausers"}}))
+
+	err := emailer.SendPasswordResetEmail(user, nil)
+	assert.True(errors.Is(err, ErrEncryptionRequired))
+	assert.Len(transport.Messages(), 0)
+
+	// Emails not in email.pgp_templates are still sent
+	assert.NoError(emailer.SendMagicLinkEmail(user, nil))
+	assert.Len(transport.Messages(), 1)
+
+	entity := newTestPGPEntity(t, user.Email)
+	rec, _ := ParsePGPPublicKey(armorTestPGPEntity(t, entity, false))
+	emailer.pgpKeys.Save(user.Username, rec)
+
+	emailer.storage.Delete(TokenPasswordReset + TokenIssuedPrefix + user.Username)
+	assert.NoError(emailer.SendPasswordResetEmail(user, nil))
+	assert.Len(transport.Messages(), 2)
+}
+
+func TestEmailPGPKeyUpdated(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestPGPEmailer(t)
+
+	user := &ipa.User{
+		Username: "jdoe",
+		First:    "John",
+		Last:     "Doe",
+		Email:    "jdoe@example.com",
+	}
+
+	owner := newTestPGPEntity(t, user.Email)
+	ownerRec, _ := ParsePGPPublicKey(armorTestPGPEntity(t, owner, false))
+	other := newTestPGPEntity(t, user.Email)
+	otherRec, _ := ParsePGPPublicKey(armorTestPGPEntity(t, other, false))
+
+	// Notice of a first key is not encrypted to the new key
+	assert.NoError(emailer.pgpKeys.Save(user.Username, ownerRec))
+	if assert.NoError(emailer.SendPGPKeyUpdatedEmail(true, user, nil, nil)) {
+		m := parseTestMessage(t, transport.Messages()[0].Data)
+		assert.Contains(m.text, "Encryption key added")
+	}
+
+	// Notice of a replaced key is encrypted to the previous key
+	transport.Reset()
+	assert.NoError(emailer.pgpKeys.Save(user.Username, otherRec))
+	if assert.NoError(emailer.SendPGPKeyUpdatedEmail(true, user, ownerRec, nil)) {
+		data := transport.Messages()[0].Data
+		body, err := decryptTestMessage(t, data, owner)
+		if assert.NoError(err) {
+			assert.Contains(body, "Content-Type: multipart/alternative;")
+		}
+
+		_, err = decryptTestMessage(t, data, other)
+		assert.Error(err)
+	}
+}
+
+func TestPGPKeyStore(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+
+	// Keys are not kept in non persistent storage
+	assert.Nil(NewPGPKeyStore(memory.New(), nil))
+
+	// FreeIPA attribute requires the JSON-RPC client
+	viper.Set("email.pgp_key_attribute", "pgpKey")
+	defer viper.Set("email.pgp_key_attribute", "")
+	assert.Nil(NewPGPKeyStore(memory.New(), nil))
+	assert.IsType(&IPAPGPKeyStore{}, NewPGPKeyStore(memory.New(), &IPARPC{}))
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	ipa "github.com/ubccr/goipa"
+)
+
+// pgpKeyVars sets the OpenPGP key template variables for the account page
+func (r *Router) pgpKeyVars(user *ipa.User, vars fiber.Map) {
+	vars["pgpEnabled"] = r.emailer.pgpKeys != nil
+	vars["pgpRequired"] = PGPEncryptionRequired(user)
+
+	if r.emailer.pgpKeys == nil {
+		return
+	}
+
+	rec, err := r.emailer.pgpKeys.Get(user.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Failed to fetch OpenPGP key")
+	}
+
+	vars["pgpKey"] = rec
+}
+
+func (r *Router) accountPage(c *fiber.Ctx, vars fiber.Map) error {
+	user := r.user(c)
+	vars["user"] = user
+	vars["preferredLanguage"] = r.preferredLanguage(c)
+	r.pgpKeyVars(user, vars)
+
+	return c.Render("account.html", vars)
+}
+
+func (r *Router) PGPKeyModal(c *fiber.Ctx) error {
+	vars := fiber.Map{
+		"user": r.user(c),
+	}
+	return c.Render("pgpkey-new.html", vars)
+}
+
+func (r *Router) PGPKeyAdd(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	armored := c.FormValue("key")
+	if armored == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide an OpenPGP public key"))
+	}
+
+	rec, err := ParsePGPPublicKey(armored)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Warn("Invalid OpenPGP key")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	previous, err := r.emailer.pgpKeys.Get(user.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Failed to fetch OpenPGP key")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Fatal system error"))
+	}
+
+	rec.AddedAt = time.Now()
+	if err := r.emailer.pgpKeys.Save(user.Username, rec); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Failed to save OpenPGP key")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Fatal system error"))
+	}
+
+	log.WithFields(log.Fields{
+		"username":    user.Username,
+		"fingerprint": rec.Fingerprint,
+		"ip":          RemoteIP(c),
+	}).Info("AUDIT User added OpenPGP key")
+	r.audit(c, &AuditEvent{
+		Action: AuditPGPKeyAdd,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"fingerprint": rec.Fingerprint,
+		},
+	})
+	r.webhooks.Emit(EventPGPKeyAdded, user.Username, RemoteIP(c), map[string]interface{}{
+		"fingerprint": rec.Fingerprint,
+	})
+
+	err = r.emailer.SendPGPKeyUpdatedEmail(true, user, previous, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": user.Username,
+		}).Error("Failed to send OpenPGP key added email")
+	}
+
+	return r.accountPage(c, fiber.Map{"success": true})
+}
+
+func (r *Router) PGPKeyRemove(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	rec, err := r.emailer.pgpKeys.Get(user.Username)
+	if err != nil || rec == nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "No OpenPGP key to remove"))
+	}
+
+	if PGPEncryptionRequired(user) {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Encrypted email is required for your account. Please replace your key instead of removing it"))
+	}
+
+	if err := r.emailer.pgpKeys.Delete(user.Username); err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Failed to remove OpenPGP key")
+		return c.Status(fiber.StatusInternalServerError).SendString(tr(c, "Fatal system error"))
+	}
+
+	log.WithFields(log.Fields{
+		"username":    user.Username,
+		"fingerprint": rec.Fingerprint,
+		"ip":          RemoteIP(c),
+	}).Info("AUDIT User removed OpenPGP key")
+	r.audit(c, &AuditEvent{
+		Action: AuditPGPKeyRemove,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"fingerprint": rec.Fingerprint,
+		},
+	})
+	r.webhooks.Emit(EventPGPKeyRemoved, user.Username, RemoteIP(c), map[string]interface{}{
+		"fingerprint": rec.Fingerprint,
+	})
+
+	err = r.emailer.SendPGPKeyUpdatedEmail(false, user, rec, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": user.Username,
+		}).Error("Failed to send OpenPGP key removed email")
+	}
+
+	return r.accountPage(c, fiber.Map{"success": true})
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	StoragePrefixPruneReminder = "prune-reminded-"
+)
+
+// ErrPruneStorage is returned when unverified accounts are pruned without
+// persistent storage. Sent reminders would be forgotten and users emailed
+// again on every run.
+var ErrPruneStorage = errors.New("Pruning unverified accounts requires a persistent storage driver. Please set storage.driver to sqlite3 or redis")
+
+// AccountPruner deletes accounts that never verified their email address.
+// The age of an unverified account is taken from the time the password was
+// set at signup (krbLastPwdChange) as unverified accounts are disabled and
+// can not change their password.
+type AccountPruner struct {
+	MaxAge      time.Duration
+	ReminderAge time.Duration
+	DryRun      bool
+
+	client   *ipa.Client
+	emailer  *Emailer
+	storage  fiber.Storage
+	audit    *AuditLogger
+	webhooks *Webhooks
+}
+
+// PruneResult lists the usernames acted on by a prune run
+type PruneResult struct {
+	Reminded []string
+	Deleted  []string
+}
+
+// NewAccountPruner returns a pruner for the accounts.unverified_* config.
+// Deletions are logged to audit and sent to webhooks if not nil.
+func NewAccountPruner(client *ipa.Client, emailer *Emailer, storage fiber.Storage, audit *AuditLogger, webhooks *Webhooks) *AccountPruner {
+	return &AccountPruner{
+		MaxAge:      time.Duration(viper.GetInt("accounts.unverified_max_age")) * 24 * time.Hour,
+		ReminderAge: time.Duration(viper.GetInt("accounts.unverified_reminder_age")) * 24 * time.Hour,
+		client:      client,
+		emailer:     emailer,
+		storage:     storage,
+		audit:       audit,
+		webhooks:    webhooks,
+	}
+}
+
+// Run sends reminders to and deletes unverified accounts
+func (p *AccountPruner) Run() (*PruneResult, error) {
+	if p.MaxAge <= 0 {
+		return nil, errors.New("max age for unverified accounts must be greater than 0")
+	}
+
+	users, err := p.client.UserFind(ipa.Options{"userclass": UserCategoryUnverified, "sizelimit": 0})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{}
+	now := time.Now()
+
+	for _, user := range users {
+		if user.Category != UserCategoryUnverified {
+			continue
+		}
+
+		if user.LastPasswdChange.IsZero() {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+			}).Warn("Unable to determine age of unverified account. Skipping")
+			continue
+		}
+
+		age := now.Sub(user.LastPasswdChange)
+		deleteAt := user.LastPasswdChange.Add(p.MaxAge)
+
+		switch {
+		case age >= p.MaxAge:
+			if err := p.delete(user, age); err != nil {
+				log.WithFields(log.Fields{
+					"username": user.Username,
+					"err":      err,
+				}).Error("Failed to delete unverified account")
+				continue
+			}
+			result.Deleted = append(result.Deleted, user.Username)
+		case p.ReminderAge > 0 && age >= p.ReminderAge:
+			sent, err := p.remind(user, deleteAt)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"username": user.Username,
+					"email":    user.Email,
+					"err":      err,
+				}).Error("Failed to send unverified account reminder email")
+				continue
+			}
+			if sent {
+				result.Reminded = append(result.Reminded, user.Username)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (p *AccountPruner) delete(user *ipa.User, age time.Duration) error {
+	if !p.DryRun {
+		if err := p.client.UserDelete(false, true, user.Username); err != nil {
+			return err
+		}
+
+		p.storage.Delete(StoragePrefixPruneReminder + user.Username)
+	}
+
+	log.WithFields(log.Fields{
+		"username": user.Username,
+		"email":    user.Email,
+		"created":  user.LastPasswdChange,
+		"age_days": int(age.Hours() / 24),
+		"dry_run":  p.DryRun,
+	}).Info("AUDIT Deleted unverified user account")
+
+	if !p.DryRun {
+		p.audit.Log(&AuditEvent{
+			Action: AuditAccountDelete,
+			Target: user.Username,
+			Reason: "unverified",
+			Data: map[string]interface{}{
+				"email":    user.Email,
+				"age_days": int(age.Hours() / 24),
+			},
+		})
+		p.webhooks.Emit(EventAccountDeleted, user.Username, "", map[string]interface{}{
+			"email":  user.Email,
+			"reason": "unverified",
+		})
+	}
+
+	return nil
+}
+
+func (p *AccountPruner) remind(user *ipa.User, deleteAt time.Time) (bool, error) {
+	reminded, err := p.storage.Get(StoragePrefixPruneReminder + user.Username)
+	if err != nil {
+		return false, err
+	}
+
+	if reminded != nil {
+		return false, nil
+	}
+
+	if !p.DryRun {
+		if err := p.emailer.SendAccountVerifyReminderEmail(user, deleteAt, nil); err != nil {
+			return false, err
+		}
+
+		p.storage.Set(StoragePrefixPruneReminder+user.Username, []byte("true"), time.Until(deleteAt.Add(24*time.Hour)))
+	}
+
+	log.WithFields(log.Fields{
+		"username":  user.Username,
+		"email":     user.Email,
+		"delete_at": deleteAt,
+		"dry_run":   p.DryRun,
+	}).Info("Sent unverified account reminder email")
+
+	return true, nil
+}
+
+// Schedule runs the pruner every interval until stop is closed
+func (p *AccountPruner) Schedule(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			result, err := p.Run()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("Failed to prune unverified accounts")
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"reminded": len(result.Reminded),
+				"deleted":  len(result.Deleted),
+			}).Info("Pruned unverified accounts")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+// testIPAServer is a fake FreeIPA JSON-RPC endpoint. handler returns the
+// result for each call.
+type testIPAServer struct {
+	mu      sync.Mutex
+	calls   []string
+	params  [][]interface{}
+	handler func(method string, params []interface{}) interface{}
+}
+
+func (s *testIPAServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string        `json:"method"`
+		Params []interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&call); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call.Method)
+	s.params = append(s.params, call.Params)
+	s.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     0,
+		"error":  nil,
+		"result": s.handler(call.Method, call.Params),
+	})
+}
+
+func (s *testIPAServer) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.calls...)
+}
+
+func newTestIPAClient(t *testing.T, handler func(method string, params []interface{}) interface{}) (*ipa.Client, *testIPAServer) {
+	fake := &testIPAServer{handler: handler}
+	ts := httptest.NewTLSServer(fake)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ipa.NewClientCustomHttp(u.Host, "EXAMPLE.COM", ts.Client()), fake
+}
+
+func testIPAUser(username string, category string, lastPasswdChange time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"uid":              []string{username},
+		"mail":             []string{username + "@example.com"},
+		"userclass":        []string{category},
+		"krblastpwdchange": []map[string]string{{"__datetime__": lastPasswdChange.UTC().Format(ipa.IpaDatetimeFormat)}},
+	}
+}
+
+func TestAccountPrunerRun(t *testing.T) {
+	assert := assert.New(t)
+	emailer, transport := newTestEmailer(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit := newTestAuditLogger(t, auditPath)
+
+	now := time.Now()
+	client, fake := newTestIPAClient(t, func(method string, params []interface{}) interface{} {
+		if method != "user_find" {
+			return map[string]interface{}{"result": map[string]interface{}{"failed": []string{}}}
+		}
+
+		return map[string]interface{}{
+			"count": 4,
+			"result": []interface{}{
+				testIPAUser("old", UserCategoryUnverified, now.Add(-40*24*time.Hour)),
+				testIPAUser("remind", UserCategoryUnverified, now.Add(-25*24*time.Hour)),
+				testIPAUser("new", UserCategoryUnverified, now.Add(-2*24*time.Hour)),
+				testIPAUser("verified", "", now.Add(-400*24*time.Hour)),
+			},
+		}
+	})
+
+	receiver := &webhookReceiver{received: make(chan struct{}, 10)}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	webhooks := newTestWebhooks(t, []map[string]interface{}{
+		{"url": ts.URL, "secret": "s3cret", "events": []string{"account.*"}},
+	})
+	stop := make(chan struct{})
+	webhooks.Start(stop)
+	defer func() {
+		close(stop)
+		webhooks.Wait()
+	}()
+
+	storage := memory.New()
+	pruner := NewAccountPruner(client, emailer, storage, audit, webhooks)
+	pruner.MaxAge = 30 * 24 * time.Hour
+	pruner.ReminderAge = 21 * 24 * time.Hour
+
+	result, err := pruner.Run()
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]string{"old"}, result.Deleted)
+	assert.Equal([]string{"remind"}, result.Reminded)
+	assert.Equal([]string{"user_find", "user_del"}, fake.Calls())
+	assert.Equal([]interface{}{"old"}, fake.params[1][0])
+
+	messages := transport.Messages()
+	if assert.Len(messages, 1) {
+		assert.Equal([]string{"remind@example.com"}, messages[0].To)
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if assert.NoError(err) {
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		var ev AuditEvent
+		if assert.Len(lines, 1) && assert.NoError(json.Unmarshal(lines[0], &ev)) {
+			assert.Equal(AuditAccountDelete, ev.Action)
+			assert.Equal("old", ev.Target)
+			assert.Equal("unverified", ev.Reason)
+		}
+	}
+
+	if assert.True(webhooks.Flush(5*time.Second)) && assert.Len(receiver.bodies, 1) {
+		var event WebhookEvent
+		if assert.NoError(json.Unmarshal(receiver.bodies[0], &event)) {
+			assert.Equal(EventAccountDeleted, event.Event)
+			assert.Equal("old", event.Username)
+			assert.Equal("unverified", event.Data["reason"])
+		}
+	}
+
+	// Reminders are only sent once
+	result, err = pruner.Run()
+	if assert.NoError(err) {
+		assert.Empty(result.Reminded)
+	}
+	assert.Len(transport.Messages(), 1)
+
+	// Dry runs do not delete or email
+	pruner.DryRun = true
+	assert.NoError(storage.Reset())
+	result, err = pruner.Run()
+	if assert.NoError(err) {
+		assert.Equal([]string{"old"}, result.Deleted)
+		assert.Equal([]string{"remind"}, result.Reminded)
+	}
+	assert.Len(transport.Messages(), 1)
+	assert.Equal([]string{"user_find", "user_del", "user_find", "user_del", "user_find"}, fake.Calls())
+}
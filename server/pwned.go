@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var ErrPasswordBreached = errors.New("This password has appeared in a data breach and can not be used. Please choose a different password")
+
+// BreachedPasswordChecker returns the number of times a password appears in a
+// corpus of breached passwords. Passwords are only ever passed to
+// implementations as SHA-1 hashes.
+type BreachedPasswordChecker interface {
+	Count(hash string) (int, error)
+}
+
+// NewBreachedPasswordChecker returns the breached password checker configured
+// in accounts.breached_password_corpus or accounts.breached_password_api_url.
+// A local corpus takes precedence. Returns nil if neither is configured.
+func NewBreachedPasswordChecker() (BreachedPasswordChecker, error) {
+	if path := viper.GetString("accounts.breached_password_corpus"); path != "" {
+		return NewCorpusChecker(path)
+	}
+
+	if url := viper.GetString("accounts.breached_password_api_url"); url != "" {
+		return NewRangeAPIChecker(url, time.Duration(viper.GetInt("accounts.breached_password_api_timeout"))*time.Second), nil
+	}
+
+	return nil, nil
+}
+
+// HashPassword returns the uppercase hex encoded SHA-1 hash of password as
+// used in HIBP style datasets
+func HashPassword(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// CorpusChecker searches a locally stored HIBP style SHA-1 dataset. The
+// corpus is either a single file of HASH:COUNT lines sorted by hash, or a
+// directory of range files named by 5 character hash prefix (e.g. 21BD1.txt)
+// containing SUFFIX:COUNT lines sorted by suffix, as produced by the
+// haveibeenpwned downloader. Files are binary searched on disk and never
+// loaded into memory.
+type CorpusChecker struct {
+	path  string
+	isDir bool
+}
+
+func NewCorpusChecker(path string) (*CorpusChecker, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CorpusChecker{path: path, isDir: info.IsDir()}, nil
+}
+
+func (cc *CorpusChecker) Count(hash string) (int, error) {
+	hash = strings.ToUpper(hash)
+	if len(hash) != 40 {
+		return 0, errors.New("invalid sha1 hash")
+	}
+
+	path, key := cc.path, hash
+	if cc.isDir {
+		path = filepath.Join(cc.path, hash[:5]+".txt")
+		key = hash[5:]
+
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			path = filepath.Join(cc.path, hash[:5])
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if cc.isDir && errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return searchSortedFile(f, info.Size(), key)
+}
+
+// searchSortedFile binary searches a file of KEY:COUNT lines sorted by KEY
+// and returns COUNT for the line matching key or 0 if not found.
+func searchSortedFile(r io.ReaderAt, size int64, key string) (int, error) {
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, line, err := readLineAt(r, mid, size)
+		if err != nil {
+			return 0, err
+		}
+
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		lineKey, count, _ := strings.Cut(line, ":")
+		switch cmp := strings.Compare(strings.ToUpper(lineKey), key); {
+		case cmp == 0:
+			n, err := strconv.Atoi(strings.TrimSpace(count))
+			if err != nil {
+				return 0, fmt.Errorf("invalid count in breached password corpus: %w", err)
+			}
+			return n, nil
+		case cmp < 0:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return 0, nil
+}
+
+// readLineAt returns the first line that begins at or after offset along with
+// its starting offset.
+func readLineAt(r io.ReaderAt, offset, size int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		// Skip to the start of the next line unless offset is already at one
+		start = offset - 1
+	}
+
+	br := bufio.NewReaderSize(io.NewSectionReader(r, start, size-start), 128)
+	if offset > 0 {
+		skipped, err := br.ReadSlice('\n')
+		if err != nil && err != io.EOF {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+		if err == io.EOF {
+			return size, "", nil
+		}
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+
+	return start, strings.TrimRight(line, "\r\n"), nil
+}
+
+// RangeAPIChecker uses the k-anonymity range API of pwnedpasswords.com (or a
+// compatible mirror). Only the first 5 characters of the hash are sent.
+type RangeAPIChecker struct {
+	url    string
+	client *http.Client
+}
+
+func NewRangeAPIChecker(url string, timeout time.Duration) *RangeAPIChecker {
+	return &RangeAPIChecker{
+		url:    strings.TrimSuffix(url, "/") + "/",
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (rc *RangeAPIChecker) Count(hash string) (int, error) {
+	hash = strings.ToUpper(hash)
+	if len(hash) != 40 {
+		return 0, errors.New("invalid sha1 hash")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rc.url+hash[:5], nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "mokey/"+Version)
+
+	res, err := rc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("range api returned http status: %d", res.StatusCode)
+	}
+
+	suffix := []byte(hash[5:])
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		lineKey, count, ok := bytes.Cut(bytes.TrimSpace(scanner.Bytes()), []byte(":"))
+		if !ok || !bytes.EqualFold(lineKey, suffix) {
+			continue
+		}
+
+		// Padding entries have a count of 0
+		return strconv.Atoi(string(count))
+	}
+
+	return 0, scanner.Err()
+}
+
+// checkBreachedPassword returns ErrPasswordBreached if password appears in the
+// configured breach corpus. Lookup failures are logged and the password is
+// allowed so an unavailable corpus does not block password changes.
+func (r *Router) checkBreachedPassword(username, password string) error {
+	if r.breachChecker == nil {
+		return nil
+	}
+
+	count, err := r.breachChecker.Count(HashPassword(password))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"err":      err,
+		}).Error("Failed to check password against breached password corpus")
+		return nil
+	}
+
+	if count > 0 && count >= viper.GetInt("accounts.breached_password_min_count") {
+		log.WithFields(log.Fields{
+			"username": username,
+		}).Warn("AUDIT Rejected breached password")
+		r.metrics.totalBreachedPasswords.Inc()
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
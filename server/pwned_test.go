@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreachedPasswordCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	breached := map[string]int{}
+	for i := 0; i < 500; i++ {
+		breached[fmt.Sprintf("password%d", i)] = i + 1
+	}
+
+	hashes := make([]string, 0, len(breached))
+	counts := map[string]int{}
+	for pass, count := range breached {
+		hash := HashPassword(pass)
+		hashes = append(hashes, hash)
+		counts[hash] = count
+	}
+	sort.Strings(hashes)
+
+	dir := t.TempDir()
+	rangeDir := filepath.Join(dir, "ranges")
+	if !assert.NoError(os.Mkdir(rangeDir, 0755)) {
+		return
+	}
+
+	var corpus strings.Builder
+	ranges := map[string]*strings.Builder{}
+	for _, hash := range hashes {
+		fmt.Fprintf(&corpus, "%s:%d\r\n", hash, counts[hash])
+
+		if _, ok := ranges[hash[:5]]; !ok {
+			ranges[hash[:5]] = &strings.Builder{}
+		}
+		fmt.Fprintf(ranges[hash[:5]], "%s:%d\n", hash[5:], counts[hash])
+	}
+
+	corpusFile := filepath.Join(dir, "pwned.txt")
+	if !assert.NoError(os.WriteFile(corpusFile, []byte(corpus.String()), 0644)) {
+		return
+	}
+	for prefix, b := range ranges {
+		if !assert.NoError(os.WriteFile(filepath.Join(rangeDir, prefix+".txt"), []byte(b.String()), 0644)) {
+			return
+		}
+	}
+
+	for _, path := range []string{corpusFile, rangeDir} {
+		checker, err := NewCorpusChecker(path)
+		if !assert.NoError(err) {
+			return
+		}
+
+		for pass, count := range breached {
+			n, err := checker.Count(HashPassword(pass))
+			if assert.NoError(err, pass) {
+				assert.Equal(count, n, pass)
+			}
+		}
+
+		for _, pass := range []string{"", "correct horse battery staple", "password500", "zzzzzz"} {
+			n, err := checker.Count(HashPassword(pass))
+			if assert.NoError(err, pass) {
+				assert.Equal(0, n, pass)
+			}
+		}
+	}
+}
+
+func TestBreachedPasswordRangeAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := HashPassword("password")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prefix := strings.TrimPrefix(req.URL.Path, "/range/")
+		if len(prefix) != 5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if prefix == hash[:5] {
+			fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n%s:9545824\r\n", hash[5:])
+		}
+		fmt.Fprint(w, "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:0\r\n")
+	}))
+	defer ts.Close()
+
+	checker := NewRangeAPIChecker(ts.URL+"/range", 0)
+
+	n, err := checker.Count(hash)
+	if assert.NoError(err) {
+		assert.Equal(9545824, n)
+	}
+
+	n, err = checker.Count(HashPassword("correct horse battery staple"))
+	if assert.NoError(err) {
+		assert.Equal(0, n)
+	}
+}
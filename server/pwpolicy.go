@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+// PasswordPolicy is the effective FreeIPA password policy for a user
+type PasswordPolicy struct {
+	Name        string
+	MinLength   int
+	MinClasses  int
+	History     int
+	MaxLifetime int // days
+	MinLifetime int // hours
+	MaxRepeat   int
+	MaxSequence int
+	DictCheck   bool
+	UserCheck   bool
+}
+
+// PasswordPolicyFetcher fetches the password policy for username. An empty
+// username returns the global policy.
+type PasswordPolicyFetcher func(username string) (*PasswordPolicy, error)
+
+// PasswordPolicyCache caches password policies fetched from FreeIPA
+type PasswordPolicyCache struct {
+	fetch PasswordPolicyFetcher
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	policies map[string]*cachedPasswordPolicy
+}
+
+type cachedPasswordPolicy struct {
+	policy  *PasswordPolicy
+	expires time.Time
+}
+
+// ConfigPasswordPolicy returns the password policy set in the mokey config
+// using accounts.min_passwd_len and accounts.min_passwd_classes
+func ConfigPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		Name:       "config",
+		MinLength:  viper.GetInt("accounts.min_passwd_len"),
+		MinClasses: viper.GetInt("accounts.min_passwd_classes"),
+	}
+}
+
+// NewPasswordPolicyCache returns a cache using fetch to load policies. If
+// fetch is nil the config policy is always used.
+func NewPasswordPolicyCache(fetch PasswordPolicyFetcher, ttl time.Duration) *PasswordPolicyCache {
+	return &PasswordPolicyCache{
+		fetch:    fetch,
+		ttl:      ttl,
+		policies: make(map[string]*cachedPasswordPolicy),
+	}
+}
+
+// Get returns the effective password policy for username. The minimum length
+// and classes are the stricter of the FreeIPA and config values. Falls back to
+// the config policy if the policy can not be fetched.
+func (pc *PasswordPolicyCache) Get(username string) *PasswordPolicy {
+	if pc == nil || pc.fetch == nil {
+		return ConfigPasswordPolicy()
+	}
+
+	pc.mu.Lock()
+	cached, ok := pc.policies[username]
+	pc.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.policy
+	}
+
+	policy, err := pc.fetch(username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"err":      err,
+		}).Error("Failed to fetch password policy from FreeIPA. Using config values")
+		return ConfigPasswordPolicy()
+	}
+
+	config := ConfigPasswordPolicy()
+	policy.MinLength = max(policy.MinLength, config.MinLength)
+	policy.MinClasses = max(policy.MinClasses, config.MinClasses)
+
+	pc.mu.Lock()
+	pc.policies[username] = &cachedPasswordPolicy{policy: policy, expires: time.Now().Add(pc.ttl)}
+	pc.mu.Unlock()
+
+	return policy
+}
+
+// PasswordPolicy fetches the effective password policy for username from
+// FreeIPA using pwpolicy_show
+func (c *IPARPC) PasswordPolicy(username string) (*PasswordPolicy, error) {
+	options := ipa.Options{"all": true}
+	if username != "" {
+		options["user"] = username
+	}
+
+	res, err := c.Call("pwpolicy_show", []string{}, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePasswordPolicy(res.Data)
+}
+
+func parsePasswordPolicy(raw []byte) (*PasswordPolicy, error) {
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(raw, &attrs); err != nil {
+		return nil, err
+	}
+
+	if len(attrs) == 0 {
+		return nil, errors.New("empty password policy")
+	}
+
+	p := &PasswordPolicy{
+		Name:        ipaAttrString(attrs, "cn"),
+		MinLength:   ipaAttrInt(attrs, "krbpwdminlength"),
+		MinClasses:  ipaAttrInt(attrs, "krbpwdmindiffchars"),
+		History:     ipaAttrInt(attrs, "krbpwdhistorylength"),
+		MaxLifetime: ipaAttrInt(attrs, "krbmaxpwdlife"),
+		MinLifetime: ipaAttrInt(attrs, "krbminpwdlife"),
+		MaxRepeat:   ipaAttrInt(attrs, "ipapwdmaxrepeat"),
+		MaxSequence: ipaAttrInt(attrs, "ipapwdmaxsequence"),
+		DictCheck:   ipaAttrBool(attrs, "ipapwddictcheck"),
+		UserCheck:   ipaAttrBool(attrs, "ipapwdusercheck"),
+	}
+
+	return p, nil
+}
+
+// ipaAttr returns the first value of a FreeIPA attribute. Attributes are
+// returned as single element arrays.
+func ipaAttr(attrs map[string]interface{}, name string) interface{} {
+	v, ok := attrs[name]
+	if !ok {
+		return nil
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		if len(list) == 0 {
+			return nil
+		}
+		return list[0]
+	}
+
+	return v
+}
+
+func ipaAttrString(attrs map[string]interface{}, name string) string {
+	switch v := ipaAttr(attrs, name).(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func ipaAttrInt(attrs map[string]interface{}, name string) int {
+	switch v := ipaAttr(attrs, name).(type) {
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+
+	return 0
+}
+
+func ipaAttrBool(attrs map[string]interface{}, name string) bool {
+	switch v := ipaAttr(attrs, name).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+
+	return false
+}
+
+// Check validates pass against the password policy. Checks that require
+// FreeIPA (history, dictionary, username) are left to FreeIPA.
+func (p *PasswordPolicy) Check(pass string) error {
+	runes := []rune(pass)
+	if len(runes) < p.MinLength {
+		return fmt.Errorf("Password does not conform to policy. Min length: %d", p.MinLength)
+	}
+
+	if p.MaxRepeat > 0 && maxRepeatedChars(runes) > p.MaxRepeat {
+		return fmt.Errorf("Password does not conform to policy. No more than %d repeated characters allowed", p.MaxRepeat)
+	}
+
+	if p.MaxSequence > 0 && maxSequenceLength(runes) > p.MaxSequence {
+		return fmt.Errorf("Password does not conform to policy. No sequences longer than %d characters allowed", p.MaxSequence)
+	}
+
+	numCategories := 0
+
+	if PasswordCheckLower.MatchString(pass) {
+		numCategories++
+	}
+	if PasswordCheckUpper.MatchString(pass) {
+		numCategories++
+	}
+	if PasswordCheckNumber.MatchString(pass) {
+		numCategories++
+	}
+	if PasswordCheckMarks.MatchString(pass) {
+		numCategories++
+	}
+
+	if maxRepeatedChars(runes) > 1 {
+		numCategories--
+	}
+
+	if numCategories < p.MinClasses {
+		return fmt.Errorf("Password does not conform to policy. Try including both upper/lower case, numbers, and other characters")
+	}
+
+	return nil
+}
+
+// Rules returns the password policy as human readable rules translated to lang
+func (p *PasswordPolicy) Rules(lang interface{}) []string {
+	rules := []string{T(lang, "At least %d characters long", p.MinLength)}
+
+	if p.MinClasses > 1 {
+		rules = append(rules, T(lang, "At least %d of: lowercase letters, uppercase letters, numbers, and special characters", p.MinClasses))
+	}
+	if minScore := viper.GetInt("accounts.min_passwd_score"); minScore > 0 {
+		rules = append(rules, T(lang, "Strength of at least %q", T(lang, (&PasswordStrength{Score: minScore}).Label())))
+	}
+
+	if p.MaxRepeat > 0 {
+		rules = append(rules, T(lang, "No more than %d repeated characters", p.MaxRepeat))
+	}
+	if p.MaxSequence > 0 {
+		rules = append(rules, T(lang, "No sequences longer than %d characters", p.MaxSequence))
+	}
+	if p.DictCheck {
+		rules = append(rules, T(lang, "Must not be based on a dictionary word"))
+	}
+	if p.UserCheck {
+		rules = append(rules, T(lang, "Must not contain your username"))
+	}
+	if p.History > 0 {
+		rules = append(rules, T(lang, "Must not match your last %d passwords", p.History))
+	}
+	if p.MinLifetime > 0 {
+		rules = append(rules, T(lang, "Can be changed at most once every %d hours", p.MinLifetime))
+	}
+	if p.MaxLifetime > 0 {
+		rules = append(rules, T(lang, "Expires after %d days", p.MaxLifetime))
+	}
+
+	return rules
+}
+
+func maxRepeatedChars(runes []rune) int {
+	longest := 0
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+		if j-i > longest {
+			longest = j - i
+		}
+		i = j
+	}
+
+	return longest
+}
+
+// maxSequenceLength returns the length of the longest run of monotonic
+// characters such as abcd or 4321
+func maxSequenceLength(runes []rune) int {
+	if len(runes) == 0 {
+		return 0
+	}
+
+	longest, length, lastDelta := 1, 1, 0
+	for i := 1; i < len(runes); i++ {
+		delta := int(runes[i]) - int(runes[i-1])
+		if (delta == 1 || delta == -1) && (length == 1 || delta == lastDelta) {
+			length++
+		} else if delta == 1 || delta == -1 {
+			length = 2
+		} else {
+			length = 1
+		}
+		lastDelta = delta
+
+		if length > longest {
+			longest = length
+		}
+	}
+
+	return longest
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicyParse(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := []byte(`{
+		"cn": ["admins"],
+		"krbmaxpwdlife": ["90"],
+		"krbminpwdlife": ["1"],
+		"krbpwdhistorylength": ["6"],
+		"krbpwdmindiffchars": ["3"],
+		"krbpwdminlength": ["12"],
+		"ipapwdmaxrepeat": ["2"],
+		"ipapwdmaxsequence": ["3"],
+		"ipapwddictcheck": [true],
+		"ipapwdusercheck": ["FALSE"],
+		"cospriority": ["1"]
+	}`)
+
+	policy, err := parsePasswordPolicy(raw)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(&PasswordPolicy{
+		Name:        "admins",
+		MinLength:   12,
+		MinClasses:  3,
+		History:     6,
+		MaxLifetime: 90,
+		MinLifetime: 1,
+		MaxRepeat:   2,
+		MaxSequence: 3,
+		DictCheck:   true,
+		UserCheck:   false,
+	}, policy)
+
+	assert.Contains(policy.Rules("en"), "At least 12 characters long")
+	assert.Contains(policy.Rules("en"), "Must not match your last 6 passwords")
+	assert.Contains(policy.Rules("en"), "Expires after 90 days")
+	assert.Contains(policy.Rules("fr"), "Ne doit pas correspondre à vos 6 derniers mots de passe")
+
+	_, err = parsePasswordPolicy([]byte(`{}`))
+	assert.Error(err)
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := &PasswordPolicy{MinLength: 10, MinClasses: 3, MaxRepeat: 2, MaxSequence: 3}
+
+	// Too short
+	assert.Error(policy.Check("aB3!"))
+	// Too many repeated characters
+	assert.Error(policy.Check("aaaB3!xyQ9"))
+	// Sequence too long
+	assert.Error(policy.Check("abcdQ3!xyR"))
+	assert.Error(policy.Check("4321Q!xyRz"))
+	// Not enough classes
+	assert.Error(policy.Check("qzmxnwbvty"))
+
+	// Good
+	assert.NoError(policy.Check("aB3!xQ9zk#"))
+
+	// Character classes are still enforced along with the strength score
+	viper.Set("accounts.min_passwd_score", 3)
+	defer viper.Set("accounts.min_passwd_score", 0)
+	assert.Error(policy.Check("qzmxnwbvty"))
+	assert.Contains(policy.Rules("en"), "At least 3 of: lowercase letters, uppercase letters, numbers, and special characters")
+	assert.Contains(policy.Rules("en"), `Strength of at least "Strong"`)
+}
+
+func TestPasswordPolicyCache(t *testing.T) {
+	viper.Set("accounts.min_passwd_len", 8)
+	viper.Set("accounts.min_passwd_classes", 2)
+
+	assert := assert.New(t)
+
+	calls := 0
+	fetch := func(username string) (*PasswordPolicy, error) {
+		calls++
+		if username == "broken" {
+			return nil, errors.New("ipa unavailable")
+		}
+		return &PasswordPolicy{Name: "global_policy", MinLength: 16}, nil
+	}
+
+	cache := NewPasswordPolicyCache(fetch, time.Minute)
+
+	assert.Equal(16, cache.Get("jdoe").MinLength)
+	assert.Equal(16, cache.Get("jdoe").MinLength)
+	assert.Equal(1, calls)
+
+	// Config values are enforced when stricter than FreeIPA
+	assert.Equal(2, cache.Get("jdoe").MinClasses)
+
+	// Falls back to config values
+	policy := cache.Get("broken")
+	assert.Equal("config", policy.Name)
+	assert.Equal(8, policy.MinLength)
+	assert.Equal(2, policy.MinClasses)
+
+	// Expired entries are fetched again
+	cache = NewPasswordPolicyCache(fetch, 0)
+	cache.Get("jdoe")
+	cache.Get("jdoe")
+	assert.Equal(4, calls)
+
+	// No fetcher uses config values
+	assert.Equal("config", NewPasswordPolicyCache(nil, time.Minute).Get("jdoe").Name)
+}
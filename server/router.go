@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	hydra "github.com/ory/hydra-client-go/client"
 	log "github.com/sirupsen/logrus"
@@ -18,7 +19,23 @@ type Router struct {
 	adminClient  *ipa.Client
 	sessionStore *session.Store
 	emailer      *Emailer
+	mailQueue    *MailQueue
+	webhooks     *Webhooks
+	auditLog     *AuditLogger
 	storage      fiber.Storage
+	emailFilter  *EmailDomainFilter
+
+	// Optional breached password corpus
+	breachChecker BreachedPasswordChecker
+
+	// FreeIPA JSON-RPC client for calls not provided by goipa
+	ipaRPC *IPARPC
+
+	// Password policies fetched from FreeIPA
+	pwpolicy *PasswordPolicyCache
+
+	// Optional ssh certificate authority
+	sshca *SSHCA
 
 	// Hydra consent app support
 	hydraClient          *hydra.OryHydra
@@ -33,15 +50,12 @@ func NewRouter(storage fiber.Storage) (*Router, error) {
 		storage: storage,
 	}
 
-	r.adminClient = ipa.NewDefaultClient()
-
-	err := r.adminClient.LoginWithKeytab(viper.GetString("site.keytab"), viper.GetString("site.ktuser"))
+	var err error
+	r.adminClient, err = NewAdminClient()
 	if err != nil {
 		return nil, err
 	}
 
-	r.adminClient.StickySession(false)
-
 	r.sessionStore = session.New(session.Config{
 		Storage:        storage,
 		Expiration:     time.Duration(viper.GetInt("server.session_idle_timeout")) * time.Second,
@@ -78,11 +92,169 @@ func NewRouter(storage fiber.Storage) (*Router, error) {
 		}
 	}
 
+	if err := validateUsernameGenerators(viper.GetStringMapString("accounts.allowed_domains")); err != nil {
+		return nil, err
+	}
+
+	r.emailFilter = NewEmailDomainFilter(
+		viper.GetString("accounts.email_domain_denylist"),
+		viper.GetBool("accounts.email_check_mx"),
+		time.Duration(viper.GetInt("accounts.email_check_mx_timeout"))*time.Second)
+	if err := r.emailFilter.Load(); err != nil {
+		return nil, err
+	}
+
+	r.ipaRPC, err = NewIPARPC(r.adminClient)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to create FreeIPA JSON-RPC client. Password policies will use config values and preferred languages are disabled")
+		r.ipaRPC = nil
+	} else {
+		r.emailer.UseIPARPC(r.ipaRPC)
+	}
+
+	if r.emailer.pgpKeys == nil {
+		log.Warn("OpenPGP keys require email.pgp_key_attribute or a persistent storage driver. Users will not be able to add OpenPGP keys")
+	}
+
+	var fetchPolicy PasswordPolicyFetcher
+	if viper.GetBool("accounts.fetch_pwpolicy") && r.ipaRPC != nil {
+		fetchPolicy = r.ipaRPC.PasswordPolicy
+	}
+	r.pwpolicy = NewPasswordPolicyCache(fetchPolicy, time.Duration(viper.GetInt("accounts.pwpolicy_cache_ttl"))*time.Second)
+
+	r.breachChecker, err = NewBreachedPasswordChecker()
+	if err != nil {
+		return nil, err
+	}
+
+	if viper.GetInt("sshkeys.max_lifetime") > 0 && !PersistentStorage(storage) {
+		return nil, ErrSSHKeyExpiryStorage
+	}
+
+	if viper.GetBool("sshca.enabled") {
+		if !PersistentStorage(storage) {
+			return nil, ErrSSHCAStorage
+		}
+
+		r.sshca, err = NewSSHCA(storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	r.metrics = NewMetrics()
 
+	if viper.GetBool("email.queue") {
+		if !PersistentStorage(storage) {
+			return nil, ErrMailQueueStorage
+		}
+		r.mailQueue = NewMailQueue(r.emailer.transport, storage)
+		r.mailQueue.metrics = r.metrics
+		r.emailer.transport = r.mailQueue
+	}
+
+	r.auditLog, err = NewAuditLogger()
+	if err != nil {
+		return nil, err
+	}
+
+	r.webhooks, err = NewWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	if r.webhooks != nil {
+		r.webhooks.metrics = r.metrics
+	}
+
 	return r, nil
 }
 
+// NewAdminClient returns a FreeIPA client logged in using the mokey keytab
+func NewAdminClient() (*ipa.Client, error) {
+	client := ipa.NewDefaultClient()
+
+	err := client.LoginWithKeytab(viper.GetString("site.keytab"), viper.GetString("site.ktuser"))
+	if err != nil {
+		return nil, err
+	}
+
+	client.StickySession(false)
+
+	return client, nil
+}
+
+// StartSchedulers starts any enabled background jobs. Jobs are stopped when
+// the app is shutdown.
+func (r *Router) StartSchedulers(app *fiber.App) {
+	stop := make(chan struct{})
+	app.Hooks().OnShutdown(func() error {
+		close(stop)
+		return nil
+	})
+
+	if r.mailQueue != nil {
+		log.WithFields(log.Fields{
+			"workers":      r.mailQueue.Workers,
+			"max_attempts": r.mailQueue.MaxAttempts,
+		}).Info("Starting email queue")
+		go r.mailQueue.Start(stop)
+	}
+
+	if r.webhooks != nil {
+		log.WithFields(log.Fields{
+			"endpoints":    len(r.webhooks.endpoints),
+			"workers":      r.webhooks.Workers,
+			"max_attempts": r.webhooks.MaxAttempts,
+		}).Info("Starting webhook dispatcher")
+		r.webhooks.Start(stop)
+	}
+
+	if interval := viper.GetInt("accounts.unverified_prune_interval"); interval > 0 {
+		pruner := NewAccountPruner(r.adminClient, r.emailer, r.storage, r.auditLog, r.webhooks)
+		if !PersistentStorage(r.storage) {
+			log.Error(ErrPruneStorage)
+		} else if pruner.MaxAge > 0 {
+			log.WithFields(log.Fields{
+				"interval_hours": interval,
+				"max_age":        pruner.MaxAge,
+			}).Info("Scheduling pruning of unverified accounts")
+			go pruner.Schedule(time.Duration(interval)*time.Hour, stop)
+		}
+	}
+
+	if interval := viper.GetInt("accounts.password_expiry_notify_interval"); interval > 0 {
+		if !PersistentStorage(r.storage) {
+			log.Error(ErrPasswordExpiryStorage)
+		} else if viper.GetString("email.base_url") == "" {
+			log.Error("Please set email.base_url to schedule password expiring emails")
+		} else {
+			notifier := NewPasswordExpiryNotifier(r.adminClient, r.emailer, r.storage)
+			log.WithFields(log.Fields{
+				"interval_hours": interval,
+				"thresholds":     notifier.Thresholds,
+			}).Info("Scheduling password expiring emails")
+			go notifier.Schedule(time.Duration(interval)*time.Hour, stop)
+		}
+	}
+
+	if interval := viper.GetInt("sshkeys.expire_interval"); interval > 0 {
+		if !PersistentStorage(r.storage) {
+			log.Error(ErrSSHKeyExpiryStorage)
+		} else if viper.GetInt("sshkeys.expiry_notify_days") > 0 && viper.GetString("email.base_url") == "" {
+			log.Error("Please set email.base_url to schedule ssh key expiration")
+		} else {
+			expirer := NewSSHKeyExpirer(r.adminClient, r.emailer, r.storage, r.auditLog, r.webhooks)
+			log.WithFields(log.Fields{
+				"interval_hours": interval,
+				"notify_days":    expirer.NotifyDays,
+			}).Info("Scheduling ssh key expiration")
+			go expirer.Schedule(time.Duration(interval)*time.Hour, stop)
+		}
+	}
+}
+
 func RemoteIP(c *fiber.Ctx) string {
 	ips := c.IPs()
 	if len(ips) > 0 {
@@ -93,25 +265,44 @@ func RemoteIP(c *fiber.Ctx) string {
 }
 
 func (r *Router) SetupRoutes(app *fiber.App) {
+	// SSH CA endpoints used by scripts and ssh servers. These are registered
+	// before the CSRF middleware as they do not use sessions.
+	if r.sshca != nil {
+		app.Get("/sshca/ca.pub", r.SSHCAPublicKey)
+		app.Get("/sshca/krl", r.SSHCAKRL)
+		app.Post("/api/sshcert", r.sshCertAPILimiter(), r.SSHCertAPI)
+	}
+
 	// CSRF tokens stored in sessions
 	app.Use(r.CSRF)
 
+	// Language used for templates, messages, and emails
+	app.Use(r.Localize)
+
 	app.Get("/", r.RequireLogin, r.Index)
 	app.Get("/account", r.RequireLogin, r.Index)
-	app.Get("/password", r.RequireLogin, r.Index)
-	app.Get("/security", r.RequireLogin, r.Index)
-	app.Get("/sshkey", r.RequireLogin, r.Index)
-	app.Get("/otp", r.RequireLogin, r.Index)
+	app.Get("/password", r.RequireLogin, r.RequirePassword, r.Index)
+	app.Get("/security", r.RequireLogin, r.RequirePassword, r.Index)
+	app.Get("/sshkey", r.RequireLogin, r.RequirePassword, r.Index)
+	app.Get("/otp", r.RequireLogin, r.RequirePassword, r.Index)
+	if ActivityEnabled() {
+		app.Get("/activity", r.RequireLogin, r.RequirePassword, r.Index)
+	}
 
 	// Account Create
 	app.Get("/signup", r.RequireNoLogin, r.AccountCreate)
 	app.Post("/signup", r.RequireNoLogin, r.AccountCreate)
+	app.Get("/signup/username-check", r.usernameCheckLimiter(), r.RequireNoLogin, r.RequireHTMX, r.UsernameCheck)
 
 	// Auth
 	app.Get("/auth/login", r.RequireNoLogin, r.Login)
 	app.Post("/auth/login", r.RequireNoLogin, r.CheckUser)
 	app.Post("/auth/authenticate", r.RequireNoLogin, r.Authenticate)
 	app.Post("/auth/expiredpw", r.RequireNoLogin, r.PasswordExpired)
+	app.Get("/auth/magic", r.RequireNoLogin, r.MagicLinkRequest)
+	app.Post("/auth/magic", r.RequireNoLogin, r.MagicLinkRequest)
+	app.Get("/auth/magic/:token", r.RequireNoLogin, r.MagicLinkLogin)
+	app.Post("/auth/magic/:token", r.RequireNoLogin, r.MagicLinkLogin)
 	app.Get("/auth/forgotpw", r.RequireNoLogin, r.PasswordForgot)
 	app.Post("/auth/forgotpw", r.RequireNoLogin, r.PasswordForgot)
 	app.Get("/auth/verify", r.RequireNoLogin, r.AccountVerifyResend)
@@ -120,36 +311,62 @@ func (r *Router) SetupRoutes(app *fiber.App) {
 	app.Post("/auth/resetpw/:token", r.PasswordReset)
 	app.Get("/auth/verify/:token", r.AccountVerify)
 	app.Post("/auth/verify/:token", r.AccountVerify)
+	app.Get("/auth/email/cancel/:token", r.AccountEmailCancel)
+	app.Post("/auth/email/cancel/:token", r.AccountEmailCancel)
+	app.Get("/auth/email/:token", r.AccountEmailConfirm)
+	app.Post("/auth/email/:token", r.AccountEmailConfirm)
 	app.Post("/auth/logout", r.Logout)
 	app.Get("/auth/captcha/:id.png", r.Captcha)
 
 	// Account Settings
 	app.Get("/account/settings", r.RequireLogin, r.RequireHTMX, r.AccountSettings)
 	app.Post("/account/settings", r.RequireLogin, r.RequireHTMX, r.AccountSettings)
+	app.Get("/account/email", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.AccountEmailModal)
+	app.Post("/account/email", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.AccountEmailChange)
+	if r.emailer.pgpKeys != nil {
+		app.Get("/account/pgpkey", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.PGPKeyModal)
+		app.Post("/account/pgpkey", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.PGPKeyAdd)
+		app.Post("/account/pgpkey/remove", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.PGPKeyRemove)
+	}
 
 	// Password
-	app.Get("/password/change", r.RequireLogin, r.RequireHTMX, r.PasswordChange)
-	app.Post("/password/change", r.RequireLogin, r.RequireHTMX, r.PasswordChange)
+	app.Get("/password/change", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.PasswordChange)
+	app.Post("/password/change", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.PasswordChange)
+	app.Post("/password/strength", r.passwordStrengthLimiter(), r.RequireHTMX, r.PasswordStrength)
+	app.Post("/password/expiry/dismiss", r.RequireLogin, r.RequireHTMX, r.PasswordExpiryDismiss)
 
 	// Security
-	app.Get("/security/settings", r.RequireLogin, r.RequireHTMX, r.SecurityList)
-	app.Post("/security/mfa/enable", r.RequireLogin, r.RequireHTMX, r.TwoFactorEnable)
-	app.Post("/security/mfa/disable", r.RequireLogin, r.RequireHTMX, r.TwoFactorDisable)
+	app.Get("/security/settings", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SecurityList)
+	app.Post("/security/mfa/enable", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.TwoFactorEnable)
+	app.Post("/security/mfa/disable", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.TwoFactorDisable)
 
 	// SSH Keys
-	app.Get("/sshkey/list", r.RequireLogin, r.RequireHTMX, r.SSHKeyList)
-	app.Get("/sshkey/modal", r.RequireLogin, r.RequireHTMX, r.SSHKeyModal)
-	app.Post("/sshkey/add", r.RequireLogin, r.RequireMFA, r.RequireHTMX, r.SSHKeyAdd)
-	app.Post("/sshkey/remove", r.RequireLogin, r.RequireMFA, r.RequireHTMX, r.SSHKeyRemove)
+	app.Get("/sshkey/list", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SSHKeyList)
+	app.Get("/sshkey/modal", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SSHKeyModal)
+	app.Post("/sshkey/add", r.RequireLogin, r.RequirePassword, r.RequireMFA, r.RequireHTMX, r.SSHKeyAdd)
+	app.Post("/sshkey/remove", r.RequireLogin, r.RequirePassword, r.RequireMFA, r.RequireHTMX, r.SSHKeyRemove)
+	app.Get("/sshkey/import", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SSHKeyImportModal)
+	app.Post("/sshkey/import/preview", r.RequireLogin, r.RequirePassword, r.RequireMFA, r.RequireHTMX, r.SSHKeyImportPreview)
+	app.Post("/sshkey/import", r.RequireLogin, r.RequirePassword, r.RequireMFA, r.RequireHTMX, r.SSHKeyImport)
+	if r.sshca != nil {
+		app.Get("/sshkey/cert", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SSHCertModal)
+		app.Post("/sshkey/cert", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.SSHCertSign)
+	}
 
 	// OTP Tokens
-	app.Get("/otptoken/list", r.RequireLogin, r.RequireHTMX, r.OTPTokenList)
-	app.Get("/otptoken/modal", r.RequireLogin, r.RequireHTMX, r.OTPTokenModal)
-	app.Post("/otptoken/add", r.RequireLogin, r.RequireHTMX, r.OTPTokenAdd)
-	app.Post("/otptoken/verify", r.RequireLogin, r.RequireHTMX, r.OTPTokenVerify)
-	app.Post("/otptoken/remove", r.RequireLogin, r.RequireHTMX, r.OTPTokenRemove)
-	app.Post("/otptoken/enable", r.RequireLogin, r.RequireHTMX, r.OTPTokenEnable)
-	app.Post("/otptoken/disable", r.RequireLogin, r.RequireHTMX, r.OTPTokenDisable)
+	app.Get("/otptoken/list", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenList)
+	app.Get("/otptoken/modal", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenModal)
+	app.Post("/otptoken/add", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenAdd)
+	app.Post("/otptoken/verify", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenVerify)
+	app.Post("/otptoken/remove", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenRemove)
+	app.Post("/otptoken/enable", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenEnable)
+	app.Post("/otptoken/disable", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.OTPTokenDisable)
+
+	// Account activity
+	if ActivityEnabled() {
+		app.Post("/activity/lockdown", r.RequireLogin, r.RequirePassword, r.RequireHTMX, r.ActivityLockdown)
+		app.Get("/auth/lockdown", r.RequireNoLogin, r.LockdownSuccess)
+	}
 
 	if viper.IsSet("site.logo") {
 		app.Get("/images/logo", r.Logo)
@@ -171,6 +388,66 @@ func (r *Router) SetupRoutes(app *fiber.App) {
 	}
 }
 
+// usernameCheckLimiter rate limits the username availability check separately
+// from the global limiter to prevent bulk username enumeration
+func (r *Router) usernameCheckLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:          viper.GetInt("accounts.username_check_rate_limit_max"),
+		Expiration:   time.Duration(viper.GetInt("accounts.username_check_rate_limit_expiration")) * time.Second,
+		Storage:      r.storage,
+		LimitReached: LimitReachedHandler,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			ips := c.IPs()
+			if len(ips) > 0 {
+				return "username-check-" + ips[0]
+			}
+
+			return "username-check-" + c.IP()
+		},
+	})
+}
+
+// passwordStrengthLimiter rate limits the password strength meter per client
+// IP as it does not require a login and estimating strength is CPU intensive
+func (r *Router) passwordStrengthLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:          viper.GetInt("accounts.password_strength_rate_limit_max"),
+		Expiration:   time.Duration(viper.GetInt("accounts.password_strength_rate_limit_expiration")) * time.Second,
+		Storage:      r.storage,
+		LimitReached: LimitReachedHandler,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			ips := c.IPs()
+			if len(ips) > 0 {
+				return "password-strength-" + ips[0]
+			}
+
+			return "password-strength-" + c.IP()
+		},
+	})
+}
+
+// sshCertAPILimiter rate limits failed logins to the ssh certificate api per
+// client IP and username to prevent password guessing as the api is not
+// covered by the global limiter
+func (r *Router) sshCertAPILimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:                    viper.GetInt("sshca.api_rate_limit_max"),
+		Expiration:             time.Duration(viper.GetInt("sshca.api_rate_limit_expiration")) * time.Second,
+		SkipSuccessfulRequests: true,
+		Storage:                r.storage,
+		LimitReached:           LimitReachedHandler,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			username, _, _ := basicAuth(c)
+			ips := c.IPs()
+			if len(ips) > 0 {
+				return "sshcert-api-" + ips[0] + "-" + username
+			}
+
+			return "sshcert-api-" + c.IP() + "-" + username
+		},
+	})
+}
+
 func (r *Router) userClient(c *fiber.Ctx) *ipa.Client {
 	return c.Locals(ContextKeyIPAClient).(*ipa.Client)
 }
@@ -192,12 +469,21 @@ func (r *Router) Index(c *fiber.Ctx) error {
 	}
 
 	vars := fiber.Map{
-		"user": user,
-		"path": path,
+		"user":            user,
+		"path":            path,
+		"activityEnabled": ActivityEnabled(),
+	}
+
+	if c.Locals(ContextKeyMagicLink) == nil && passwordExpiresSoon(user, time.Now()) && !r.passwordExpiryDismissed(c, user) {
+		vars["passwordExpiring"] = user.PasswdExpire
 	}
 
-	if path == "sshkey" {
+	if path == "account" {
+		vars["preferredLanguage"] = r.preferredLanguage(c)
+		r.pgpKeyVars(user, vars)
+	} else if path == "sshkey" {
 		vars["keys"] = user.SSHAuthKeys
+		vars["keyRecords"] = sshKeyRecords(r.storage, user)
 	} else if path == "otp" {
 		username := r.username(c)
 		client := r.userClient(c)
@@ -208,6 +494,16 @@ func (r *Router) Index(c *fiber.Ctx) error {
 		}
 
 		vars["otptokens"] = tokens
+	} else if path == "activity" {
+		records, err := GetActivity(r.storage, user.Username)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Failed to fetch account activity")
+		}
+
+		vars["activity"] = records
 	}
 
 	return c.Render("index.html", vars)
@@ -24,7 +24,13 @@ func (r *Router) TwoFactorDisable(c *fiber.Ctx) error {
 			"username": user.Username,
 			"err":      err,
 		}).Error("Failed to disable Two-Factor auth")
-		vars["message"] = "Failed to disable Two-Factor authentication"
+		vars["message"] = tr(c, "Failed to disable Two-Factor authentication")
+	} else {
+		r.audit(c, &AuditEvent{
+			Action: AuditMFADisable,
+			Target: user.Username,
+		})
+		r.webhooks.Emit(EventMFADisabled, user.Username, RemoteIP(c), nil)
 	}
 
 	user.AuthTypes = nil
@@ -52,12 +58,12 @@ func (r *Router) TwoFactorEnable(c *fiber.Ctx) error {
 			"username": user.Username,
 			"err":      err,
 		}).Error("Failed to check otp tokens")
-		vars["message"] = "Failed to enable Two-Factor authentication"
+		vars["message"] = tr(c, "Failed to enable Two-Factor authentication")
 		return r.securityList(c, vars)
 	}
 
 	if len(tokens) == 0 {
-		vars["message"] = "You must add an OTP token first before enabling Two-Factor authentication"
+		vars["message"] = tr(c, "You must add an OTP token first before enabling Two-Factor authentication")
 		return r.securityList(c, vars)
 	}
 
@@ -68,7 +74,13 @@ func (r *Router) TwoFactorEnable(c *fiber.Ctx) error {
 			"username": user.Username,
 			"err":      err,
 		}).Error("Failed to enable Two-Factor auth")
-		vars["message"] = "Failed to enable Two-Factor authentication"
+		vars["message"] = tr(c, "Failed to enable Two-Factor authentication")
+	} else {
+		r.audit(c, &AuditEvent{
+			Action: AuditMFAEnable,
+			Target: user.Username,
+		})
+		r.webhooks.Emit(EventMFAEnabled, user.Username, RemoteIP(c), nil)
 	}
 
 	user.AuthTypes = otpOnly
@@ -40,20 +40,88 @@ type Server struct {
 func SetDefaults() {
 	viper.SetDefault("site.name", "Acme Widgets")
 	viper.SetDefault("site.ktuser", "mokeyapp")
+	viper.SetDefault("site.default_language", "en")
 	viper.SetDefault("accounts.hide_invalid_username_error", false)
 	viper.SetDefault("accounts.default_homedir", "/home")
 	viper.SetDefault("accounts.default_shell", "/bin/bash")
 	viper.SetDefault("accounts.min_passwd_len", 8)
 	viper.SetDefault("accounts.min_passwd_classes", 2)
+	viper.SetDefault("accounts.min_passwd_score", 0)
+	viper.SetDefault("accounts.fetch_pwpolicy", true)
+	viper.SetDefault("accounts.pwpolicy_cache_ttl", 300)
 	viper.SetDefault("accounts.otp_hash_algorithm", "sha1")
 	viper.SetDefault("accounts.username_from_email", false)
 	viper.SetDefault("accounts.require_mfa", false)
 	viper.SetDefault("accounts.require_admin_verify", false)
+	viper.SetDefault("accounts.email_check_mx", false)
+	viper.SetDefault("accounts.email_check_mx_timeout", 5)
+	viper.SetDefault("accounts.username_check_rate_limit_max", 30)
+	viper.SetDefault("accounts.username_check_rate_limit_expiration", 300)
+	viper.SetDefault("accounts.password_strength_rate_limit_max", 60)
+	viper.SetDefault("accounts.password_strength_rate_limit_expiration", 60)
+	viper.SetDefault("accounts.unverified_max_age", 0)
+	viper.SetDefault("accounts.unverified_reminder_age", 0)
+	viper.SetDefault("accounts.unverified_prune_interval", 0)
+	viper.SetDefault("accounts.password_expiry_thresholds", []int{14, 7, 1})
+	viper.SetDefault("accounts.password_expiry_notify_interval", 0)
+	viper.SetDefault("accounts.password_expiry_warn_days", 14)
+	viper.SetDefault("accounts.force_password_change", false)
+	viper.SetDefault("accounts.magic_link_login", false)
+	viper.SetDefault("accounts.magic_link_max_age", 600)
+	viper.SetDefault("sshkeys.allowed_types", []string{
+		"ssh-rsa",
+		"ecdsa-sha2-nistp256",
+		"ecdsa-sha2-nistp384",
+		"ecdsa-sha2-nistp521",
+		"ssh-ed25519",
+		"sk-ecdsa-sha2-nistp256@openssh.com",
+		"sk-ssh-ed25519@openssh.com",
+	})
+	viper.SetDefault("sshkeys.min_rsa_bits", 3072)
+	viper.SetDefault("sshkeys.require_security_key", false)
+	viper.SetDefault("sshkeys.max_keys", 0)
+	viper.SetDefault("sshkeys.allowed_options", []string{"from", "no-agent-forwarding", "no-port-forwarding", "no-pty", "no-user-rc", "no-x11-forwarding", "restrict"})
+	viper.SetDefault("sshkeys.max_title_length", 100)
+	viper.SetDefault("sshkeys.max_lifetime", 0)
+	viper.SetDefault("sshkeys.expiry_notify_days", 7)
+	viper.SetDefault("sshkeys.expire_interval", 0)
+	viper.SetDefault("sshca.enabled", false)
+	viper.SetDefault("sshca.validity", 28800)
+	viper.SetDefault("sshca.require_mfa", true)
+	viper.SetDefault("sshca.api_rate_limit_max", 5)
+	viper.SetDefault("sshca.api_rate_limit_expiration", 900)
+	viper.SetDefault("sshca.extensions", []string{"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"})
+	viper.SetDefault("accounts.breached_password_min_count", 1)
+	viper.SetDefault("accounts.breached_password_api_timeout", 5)
 	viper.SetDefault("email.token_max_age", 3600)
+	viper.SetDefault("email.transport", "smtp")
+	viper.SetDefault("email.sendmail_path", "/usr/sbin/sendmail")
+	viper.SetDefault("email.queue", false)
+	viper.SetDefault("email.queue_workers", 2)
+	viper.SetDefault("email.queue_max_attempts", 8)
+	viper.SetDefault("email.queue_retry_delay", 30)
+	viper.SetDefault("email.queue_max_retry_delay", 3600)
 	viper.SetDefault("email.smtp_host", "localhost")
 	viper.SetDefault("email.smtp_port", 25)
 	viper.SetDefault("email.smtp_tls", "off")
 	viper.SetDefault("email.from", "support@example.com")
+	viper.SetDefault("email.pgp_templates", []string{"password-reset", "account-updated"})
+	viper.SetDefault("email.dkim_headers", []string{"From", "To", "Subject", "Date", "Message-ID", "Mime-Version", "Content-Type"})
+	viper.SetDefault("accounts.activity_retention", 90)
+	viper.SetDefault("accounts.activity_max_events", 200)
+	viper.SetDefault("accounts.lockdown_window", 7)
+	viper.SetDefault("audit.max_size", 100)
+	viper.SetDefault("audit.max_backups", 10)
+	viper.SetDefault("audit.syslog_network", "unixgram")
+	viper.SetDefault("audit.syslog_address", "/dev/log")
+	viper.SetDefault("audit.syslog_facility", "authpriv")
+	viper.SetDefault("audit.syslog_tag", "mokey")
+	viper.SetDefault("webhooks.workers", 2)
+	viper.SetDefault("webhooks.max_attempts", 6)
+	viper.SetDefault("webhooks.retry_delay", 10)
+	viper.SetDefault("webhooks.max_retry_delay", 600)
+	viper.SetDefault("webhooks.timeout", 10)
+	viper.SetDefault("webhooks.queue_size", 1000)
 	viper.SetDefault("server.secure_cookies", true)
 	viper.SetDefault("server.session_idle_timeout", 900)
 	viper.SetDefault("server.listen", "0.0.0.0:8866")
@@ -100,7 +168,8 @@ func recoverInvalidStorage() {
 	}
 }
 
-func newStorage() fiber.Storage {
+// NewStorage returns the fiber.Storage configured by storage.driver
+func NewStorage() fiber.Storage {
 	var storage fiber.Storage
 
 	if viper.IsSet("storage.sqlite3.dbpath") && viper.GetString("storage.driver") == "memory" {
@@ -112,7 +181,7 @@ func newStorage() fiber.Storage {
 	case "sqlite3":
 		storage = sqlite3.New(sqlite3.Config{
 			Database: viper.GetString("storage.sqlite3.dbpath"),
-			Table:    "mokey_data",
+			Table:    storageTable,
 		})
 	case "redis":
 		storage = redis.New(redis.Config{
@@ -133,7 +202,7 @@ func newFiber() (*fiber.App, error) {
 		log.Fatal(err)
 	}
 
-	storage := newStorage()
+	storage := NewStorage()
 	if storage == nil {
 		return nil, errors.New("Failed to open mokey storage database")
 	}
@@ -192,6 +261,7 @@ func newFiber() (*fiber.App, error) {
 	}
 
 	router.SetupRoutes(app)
+	router.StartSchedulers(app)
 
 	assetsFS := getAssetsFS()
 	app.Use("/static", filesystem.New(filesystem.Config{
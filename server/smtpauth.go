@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	SMTPAuthNone    = "none"
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+	SMTPAuthXOAUTH2 = "xoauth2"
+)
+
+// configSecret returns the value of key or, if key is not set, the contents of
+// the file at key_file. Values can also be set in the environment, for example
+// MOKEY_EMAIL_SMTP_PASSWORD.
+func configSecret(key string) (string, error) {
+	if value := viper.GetString(key); value != "" {
+		return value, nil
+	}
+
+	path := viper.GetString(key + "_file")
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s_file: %w", key, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// configureSMTPAuth sets the auth mechanism and credentials of t from the
+// email.smtp_* config
+func configureSMTPAuth(t *SMTPTransport) error {
+	username := viper.GetString("email.smtp_username")
+	password, err := configSecret("email.smtp_password")
+	if err != nil {
+		return err
+	}
+
+	t.Auth = strings.ToLower(viper.GetString("email.smtp_auth"))
+	if t.Auth == "" {
+		// Backwards compatible default: use PLAIN if credentials are set
+		t.Auth = SMTPAuthNone
+		if username != "" && password != "" {
+			t.Auth = SMTPAuthPlain
+		}
+	}
+
+	switch t.Auth {
+	case SMTPAuthNone:
+		return nil
+	case SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5:
+		if username == "" || password == "" {
+			return fmt.Errorf("Please set email.smtp_username and email.smtp_password to use smtp auth %s", t.Auth)
+		}
+		t.Username = username
+		t.Password = password
+		return nil
+	case SMTPAuthXOAUTH2:
+		if username == "" {
+			return errors.New("Please set email.smtp_username to use smtp auth xoauth2")
+		}
+		t.Username = username
+
+		tokenSource, err := newSMTPTokenSource()
+		if err != nil {
+			return err
+		}
+		t.TokenSource = tokenSource
+		return nil
+	}
+
+	return fmt.Errorf("Invalid config value for email.smtp_auth: %s", t.Auth)
+}
+
+// newSMTPTokenSource returns an OAuth2 client credentials token source. Tokens
+// are cached and only fetched again when they expire.
+func newSMTPTokenSource() (oauth2.TokenSource, error) {
+	secret, err := configSecret("email.smtp_oauth2_client_secret")
+	if err != nil {
+		return nil, err
+	}
+
+	config := &clientcredentials.Config{
+		ClientID:     viper.GetString("email.smtp_oauth2_client_id"),
+		ClientSecret: secret,
+		TokenURL:     viper.GetString("email.smtp_oauth2_token_url"),
+		Scopes:       viper.GetStringSlice("email.smtp_oauth2_scopes"),
+	}
+
+	if config.ClientID == "" || config.ClientSecret == "" || config.TokenURL == "" {
+		return nil, errors.New("Please set email.smtp_oauth2_client_id, email.smtp_oauth2_client_secret, and email.smtp_oauth2_token_url to use smtp auth xoauth2")
+	}
+
+	return config.TokenSource(context.Background()), nil
+}
+
+// smtpAuth returns the smtp.Auth for the configured mechanism or nil if no
+// auth is required
+func (t *SMTPTransport) smtpAuth() (smtp.Auth, error) {
+	switch t.Auth {
+	case "", SMTPAuthNone:
+		return nil, nil
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", t.Username, t.Password, t.Host), nil
+	case SMTPAuthLogin:
+		return &loginAuth{username: t.Username, password: t.Password, host: t.Host}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(t.Username, t.Password), nil
+	case SMTPAuthXOAUTH2:
+		if t.TokenSource == nil {
+			return nil, errors.New("No oauth2 token source configured for smtp auth xoauth2")
+		}
+
+		token, err := t.TokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch oauth2 token for smtp: %w", err)
+		}
+
+		return &xoauth2Auth{username: t.Username, token: token.AccessToken, host: t.Host}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid smtp auth mechanism: %s", t.Auth)
+}
+
+// requireTLS returns an error if credentials would be sent in the clear. As
+// with smtp.PlainAuth connections to localhost are allowed.
+func requireTLS(server *smtp.ServerInfo, host string) error {
+	if server.TLS || server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1" {
+		if server.Name != host {
+			return errors.New("wrong host name")
+		}
+		return nil
+	}
+
+	return errors.New("unencrypted connection")
+}
+
+// loginAuth implements the non-standard but widely used LOGIN mechanism
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server, a.host); err != nil {
+		return "", nil, err
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+
+	return nil, fmt.Errorf("unexpected LOGIN challenge from server: %q", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Microsoft 365 and Gmail
+type xoauth2Auth struct {
+	username string
+	token    string
+	host     string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server, a.host); err != nil {
+		return "", nil, err
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// Server sent a JSON error. Reply with an empty response so the server
+		// returns the final error status
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
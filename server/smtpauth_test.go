@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testSMTPUser     = "mokey@example.com"
+	testSMTPPassword = "s3cret"
+	testSMTPToken    = "test-access-token"
+)
+
+// fakeSMTPServer is a minimal SMTP server supporting the PLAIN, LOGIN,
+// CRAM-MD5, and XOAUTH2 auth mechanisms
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	authed   []string
+	messages []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTPServer{listener: l}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) transport(auth string) *SMTPTransport {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &SMTPTransport{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		TLS:      "off",
+		Auth:     auth,
+		Username: testSMTPUser,
+		Password: testSMTPPassword,
+	}
+}
+
+func (s *fakeSMTPServer) Authed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.authed...)
+}
+
+func (s *fakeSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+	decode := func(s string) string {
+		data, _ := base64.StdEncoding.DecodeString(s)
+		return string(data)
+	}
+
+	reply("220 localhost fake smtp")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			var ok bool
+			switch mech {
+			case "PLAIN":
+				ok = decode(initial) == "\x00"+testSMTPUser+"\x00"+testSMTPPassword
+			case "LOGIN":
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := readLine()
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := readLine()
+				ok = decode(user) == testSMTPUser && decode(pass) == testSMTPPassword
+			case "CRAM-MD5":
+				challenge := "<1234.5678@localhost>"
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+				resp, _ := readLine()
+				mac := hmac.New(md5.New, []byte(testSMTPPassword))
+				mac.Write([]byte(challenge))
+				ok = decode(resp) == testSMTPUser+" "+hex.EncodeToString(mac.Sum(nil))
+			case "XOAUTH2":
+				ok = decode(initial) == "user="+testSMTPUser+"\x01auth=Bearer "+testSMTPToken+"\x01\x01"
+				if !ok {
+					reply("334 %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+					readLine()
+				}
+			}
+
+			if !ok {
+				reply("535 5.7.8 Authentication credentials invalid")
+				continue
+			}
+
+			s.mu.Lock()
+			s.authed = append(s.authed, mech)
+			s.mu.Unlock()
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 OK")
+		case "DATA":
+			reply("354 Start mail input")
+			var msg strings.Builder
+			for {
+				l, ok := readLine()
+				if !ok || l == "." {
+					break
+				}
+				msg.WriteString(l + "\r\n")
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 OK queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPAuthMechanisms(t *testing.T) {
+	server := newFakeSMTPServer(t)
+
+	tests := []struct {
+		auth string
+		mech string
+	}{
+		{SMTPAuthNone, ""},
+		{SMTPAuthPlain, "PLAIN"},
+		{SMTPAuthLogin, "LOGIN"},
+		{SMTPAuthCRAMMD5, "CRAM-MD5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			assert := assert.New(t)
+			before := len(server.Authed())
+
+			transport := server.transport(tt.auth)
+			err := transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("Subject: "+tt.auth+"\r\n\r\nhello\r\n"))
+			if !assert.NoError(err) {
+				return
+			}
+
+			authed := server.Authed()
+			if tt.mech == "" {
+				assert.Len(authed, before)
+			} else if assert.Len(authed, before+1) {
+				assert.Equal(tt.mech, authed[before])
+			}
+
+			messages := server.Messages()
+			assert.Contains(messages[len(messages)-1], "Subject: "+tt.auth)
+		})
+	}
+
+	t.Run("bad password", func(t *testing.T) {
+		for _, auth := range []string{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5} {
+			transport := server.transport(auth)
+			transport.Password = "wrong"
+			assert.Error(t, transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello\r\n")), auth)
+		}
+	})
+}
+
+func TestSMTPAuthXOAUTH2(t *testing.T) {
+	assert := assert.New(t)
+	server := newFakeSMTPServer(t)
+
+	var requests int32
+	expiresIn := 3600
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		id, secret, _ := r.BasicAuth()
+		if id != "mokey-client" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"%s","token_type":"Bearer","expires_in":%d}`, testSMTPToken, expiresIn)
+	}))
+	defer tokenServer.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("client-secret\n"), 0600)
+
+	viper.Set("email.smtp_auth", "xoauth2")
+	viper.Set("email.smtp_username", testSMTPUser)
+	viper.Set("email.smtp_oauth2_client_id", "mokey-client")
+	viper.Set("email.smtp_oauth2_client_secret_file", secretFile)
+	viper.Set("email.smtp_oauth2_token_url", tokenServer.URL)
+	t.Cleanup(func() {
+		viper.Set("email.smtp_auth", "")
+		viper.Set("email.smtp_username", "")
+		viper.Set("email.smtp_oauth2_client_id", "")
+		viper.Set("email.smtp_oauth2_client_secret_file", "")
+		viper.Set("email.smtp_oauth2_token_url", "")
+	})
+
+	transport := server.transport("")
+	if !assert.NoError(configureSMTPAuth(transport)) {
+		return
+	}
+	assert.Equal(SMTPAuthXOAUTH2, transport.Auth)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello\r\n")))
+	}
+	assert.Equal([]string{"XOAUTH2", "XOAUTH2"}, server.Authed())
+
+	// Token is cached between sends
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	// Expired tokens are refreshed
+	expiresIn = 1
+	transport = server.transport("")
+	if assert.NoError(configureSMTPAuth(transport)) {
+		for i := 0; i < 2; i++ {
+			assert.NoError(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello\r\n")))
+		}
+		assert.Equal(int32(3), atomic.LoadInt32(&requests))
+	}
+
+	// Invalid token is rejected by the server
+	transport.TokenSource = nil
+	assert.Error(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello\r\n")))
+	transport.Auth = SMTPAuthXOAUTH2
+	transport.TokenSource = staticTokenSource("bogus")
+	assert.Error(transport.Send("support@example.com", []string{"jdoe@example.com"}, []byte("hello\r\n")))
+}
+
+func TestConfigureSMTPAuth(t *testing.T) {
+	assert := assert.New(t)
+	t.Cleanup(func() {
+		viper.Set("email.smtp_auth", "")
+		viper.Set("email.smtp_username", "")
+		viper.Set("email.smtp_password", "")
+		viper.Set("email.smtp_password_file", "")
+	})
+
+	transport := &SMTPTransport{}
+	assert.NoError(configureSMTPAuth(transport))
+	assert.Equal(SMTPAuthNone, transport.Auth)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(passwordFile, []byte(testSMTPPassword+"\n"), 0600)
+	viper.Set("email.smtp_username", testSMTPUser)
+	viper.Set("email.smtp_password_file", passwordFile)
+	transport = &SMTPTransport{}
+	assert.NoError(configureSMTPAuth(transport))
+	assert.Equal(SMTPAuthPlain, transport.Auth)
+	assert.Equal(testSMTPPassword, transport.Password)
+
+	t.Setenv("MOKEY_EMAIL_SMTP_PASSWORD", "from-env")
+	viper.SetEnvPrefix("mokey")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.BindEnv("email.smtp_password")
+	viper.Set("email.smtp_auth", "LOGIN")
+	transport = &SMTPTransport{}
+	assert.NoError(configureSMTPAuth(transport))
+	assert.Equal(SMTPAuthLogin, transport.Auth)
+	assert.Equal("from-env", transport.Password)
+
+	viper.Set("email.smtp_auth", "gssapi")
+	assert.Error(configureSMTPAuth(&SMTPTransport{}))
+
+	viper.Set("email.smtp_auth", "xoauth2")
+	assert.Error(configureSMTPAuth(&SMTPTransport{}))
+
+	viper.Set("email.smtp_auth", "cram-md5")
+	viper.Set("email.smtp_password_file", filepath.Join(t.TempDir(), "missing"))
+	os.Unsetenv("MOKEY_EMAIL_SMTP_PASSWORD")
+	assert.Error(configureSMTPAuth(&SMTPTransport{}))
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: string(s)}, nil
+}
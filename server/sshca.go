@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	StoragePrefixSSHCA   = "sshca-"
+	storageKeySSHSerial  = StoragePrefixSSHCA + "serial"
+	storageKeySSHRevoked = StoragePrefixSSHCA + "revoked"
+	storagePrefixSSHUser = StoragePrefixSSHCA + "user-"
+	storageKeySSHLock    = StoragePrefixSSHCA + "lock"
+
+	sshcaLockTTL  = 30 * time.Second
+	sshcaLockWait = 10 * time.Second
+
+	// OpenSSH KRL format. See PROTOCOL.krl in the OpenSSH source
+	krlMagic                 = 0x5353484b524c0a00
+	krlFormatVersion         = 1
+	krlSectionCertificates   = 1
+	krlSectionCertSerialList = 0x20
+	krlSectionCertKeyID      = 0x23
+)
+
+// ErrSSHCAStorage is returned when the ssh CA is used without persistent
+// storage. Serials would restart at 1 and revocations would be lost.
+var ErrSSHCAStorage = errors.New("The ssh certificate authority requires a persistent storage driver. Please set storage.driver to sqlite3 or redis")
+
+// SSHCA issues short lived OpenSSH user certificates signed by the CA key
+// configured in sshca.ca_key
+type SSHCA struct {
+	Validity        time.Duration
+	GroupPrincipals map[string]string
+	Extensions      []string
+
+	signer  ssh.Signer
+	storage fiber.Storage
+}
+
+// SSHCertRecord is an issued certificate. Records are kept per user so all of
+// a users certificates can be revoked.
+type SSHCertRecord struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	Fingerprint string    `json:"fingerprint"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+// SSHRevocations lists revoked certificates included in the KRL
+type SSHRevocations struct {
+	Version uint64   `json:"version"`
+	Serials []uint64 `json:"serials"`
+	KeyIDs  []string `json:"key_ids"`
+}
+
+func NewSSHCA(storage fiber.Storage) (*SSHCA, error) {
+	pem, err := os.ReadFile(viper.GetString("sshca.ca_key"))
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if pass := viper.GetString("sshca.ca_key_passphrase"); pass != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(pass))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse ssh CA key: %w", err)
+	}
+
+	return &SSHCA{
+		Validity:        time.Duration(viper.GetInt("sshca.validity")) * time.Second,
+		GroupPrincipals: viper.GetStringMapString("sshca.group_principals"),
+		Extensions:      viper.GetStringSlice("sshca.extensions"),
+		signer:          signer,
+		storage:         storage,
+	}, nil
+}
+
+// PublicKey returns the CA public key. Servers trust certificates signed by
+// this key using TrustedUserCAKeys.
+func (ca *SSHCA) PublicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+// Principals returns the principals for user. The username is always the
+// first principal followed by any principals mapped from the users groups.
+func (ca *SSHCA) Principals(user *ipa.User) []string {
+	principals := []string{user.Username}
+	seen := map[string]bool{user.Username: true}
+
+	groups := make([]string, 0, len(ca.GroupPrincipals))
+	for g := range ca.GroupPrincipals {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	for _, g := range groups {
+		p := ca.GroupPrincipals[g]
+		if p == "" || seen[p] || !user.HasGroup(g) {
+			continue
+		}
+		seen[p] = true
+		principals = append(principals, p)
+	}
+
+	return principals
+}
+
+// Sign issues a user certificate for pubKey
+func (ca *SSHCA) Sign(user *ipa.User, pubKey ssh.PublicKey) (*ssh.Certificate, error) {
+	serial, err := ca.nextSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	extensions := make(map[string]string, len(ca.Extensions))
+	for _, e := range ca.Extensions {
+		extensions[e] = ""
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pubKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s-%d", user.Username, serial),
+		ValidPrincipals: ca.Principals(user),
+		// Allow for clock skew between mokey and ssh servers
+		ValidAfter:  uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(ca.Validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, err
+	}
+
+	err = ca.addUserCert(user.Username, &SSHCertRecord{
+		Serial:      cert.Serial,
+		KeyID:       cert.KeyId,
+		Principals:  cert.ValidPrincipals,
+		Fingerprint: ssh.FingerprintSHA256(pubKey),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// lock acquires the CA lock shared by all mokey processes using storage
+func (ca *SSHCA) lock() (func(), error) {
+	return LockStorage(ca.storage, storageKeySSHLock, sshcaLockTTL, sshcaLockWait)
+}
+
+func (ca *SSHCA) nextSerial() (uint64, error) {
+	unlock, err := ca.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	data, err := ca.storage.Get(storageKeySSHSerial)
+	if err != nil {
+		return 0, err
+	}
+
+	var serial uint64
+	if data != nil {
+		serial, err = strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	serial++
+
+	if err := ca.storage.Set(storageKeySSHSerial, []byte(strconv.FormatUint(serial, 10)), 0); err != nil {
+		return 0, err
+	}
+
+	return serial, nil
+}
+
+// UserCerts returns the unexpired certificates issued to username
+func (ca *SSHCA) UserCerts(username string) ([]*SSHCertRecord, error) {
+	data, err := ca.storage.Get(storagePrefixSSHUser + username)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var records []*SSHCertRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	valid := make([]*SSHCertRecord, 0, len(records))
+	for _, rec := range records {
+		if now.Before(rec.ValidBefore) {
+			valid = append(valid, rec)
+		}
+	}
+
+	return valid, nil
+}
+
+func (ca *SSHCA) addUserCert(username string, rec *SSHCertRecord) error {
+	unlock, err := ca.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := ca.UserCerts(username)
+	if err != nil {
+		return err
+	}
+
+	records = append(records, rec)
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	return ca.storage.Set(storagePrefixSSHUser+username, data, time.Until(rec.ValidBefore))
+}
+
+// Revocations returns the revoked certificates
+func (ca *SSHCA) Revocations() (*SSHRevocations, error) {
+	data, err := ca.storage.Get(storageKeySSHRevoked)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := &SSHRevocations{}
+	if data == nil {
+		return revoked, nil
+	}
+
+	if err := json.Unmarshal(data, revoked); err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
+
+// Revoke adds certificate serials and key IDs to the KRL
+func (ca *SSHCA) Revoke(serials []uint64, keyIDs []string) error {
+	unlock, err := ca.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	revoked, err := ca.Revocations()
+	if err != nil {
+		return err
+	}
+
+	revoked.Version++
+	revoked.Serials = append(revoked.Serials, serials...)
+	revoked.KeyIDs = append(revoked.KeyIDs, keyIDs...)
+
+	data, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+
+	return ca.storage.Set(storageKeySSHRevoked, data, 0)
+}
+
+// RevokeUser revokes all unexpired certificates issued to username and
+// returns the revoked serials
+func (ca *SSHCA) RevokeUser(username string) ([]uint64, error) {
+	records, err := ca.UserCerts(username)
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make([]uint64, 0, len(records))
+	for _, rec := range records {
+		serials = append(serials, rec.Serial)
+	}
+
+	if len(serials) == 0 {
+		return serials, nil
+	}
+
+	return serials, ca.Revoke(serials, nil)
+}
+
+// KRL returns the revoked certificates as an OpenSSH Key Revocation List
+// suitable for RevokedKeys in sshd_config
+func (ca *SSHCA) KRL() ([]byte, error) {
+	revoked, err := ca.Revocations()
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalKRL(ca.PublicKey(), revoked, time.Now())
+}
+
+func marshalKRL(caKey ssh.PublicKey, revoked *SSHRevocations, generated time.Time) ([]byte, error) {
+	var certs bytes.Buffer
+	writeKRLString(&certs, caKey.Marshal())
+	writeKRLString(&certs, nil)
+
+	if len(revoked.Serials) > 0 {
+		serials := append([]uint64{}, revoked.Serials...)
+		sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+		var list bytes.Buffer
+		for i, s := range serials {
+			if i > 0 && s == serials[i-1] {
+				continue
+			}
+			binary.Write(&list, binary.BigEndian, s)
+		}
+		certs.WriteByte(krlSectionCertSerialList)
+		writeKRLString(&certs, list.Bytes())
+	}
+
+	if len(revoked.KeyIDs) > 0 {
+		var ids bytes.Buffer
+		for _, id := range revoked.KeyIDs {
+			writeKRLString(&ids, []byte(id))
+		}
+		certs.WriteByte(krlSectionCertKeyID)
+		writeKRLString(&certs, ids.Bytes())
+	}
+
+	var krl bytes.Buffer
+	binary.Write(&krl, binary.BigEndian, uint64(krlMagic))
+	binary.Write(&krl, binary.BigEndian, uint32(krlFormatVersion))
+	binary.Write(&krl, binary.BigEndian, revoked.Version)
+	binary.Write(&krl, binary.BigEndian, uint64(generated.Unix()))
+	binary.Write(&krl, binary.BigEndian, uint64(0)) // flags
+	writeKRLString(&krl, nil)                       // reserved
+	writeKRLString(&krl, []byte("mokey"))           // comment
+
+	krl.WriteByte(krlSectionCertificates)
+	writeKRLString(&krl, certs.Bytes())
+
+	return krl.Bytes(), nil
+}
+
+func writeKRLString(buf *bytes.Buffer, s []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.Write(s)
+}
+
+// ParseSSHPublicKey parses a single public key in authorized_keys format
+func ParseSSHPublicKey(key string) (ssh.PublicKey, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil, errors.New("Invalid ssh public key")
+	}
+
+	if _, ok := pubKey.(*ssh.Certificate); ok {
+		return nil, errors.New("Please provide a public key not a certificate")
+	}
+
+	return pubKey, nil
+}
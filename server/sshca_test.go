@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/gofiber/storage/sqlite3/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSSHCA(t *testing.T) *SSHCA {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SSHCA{
+		Validity:        time.Hour,
+		GroupPrincipals: map[string]string{"admins": "root", "hpc": "hpcuser", "staff": "jdoe"},
+		Extensions:      []string{"permit-pty"},
+		signer:          signer,
+		storage:         memory.New(),
+	}
+}
+
+func TestSSHCAPrincipals(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestSSHCA(t)
+
+	user := &ipa.User{Username: "jdoe"}
+	assert.Equal([]string{"jdoe"}, ca.Principals(user))
+
+	user.Groups = []string{"staff", "hpc", "admins"}
+	assert.Equal([]string{"jdoe", "root", "hpcuser"}, ca.Principals(user))
+}
+
+func TestSSHCASign(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestSSHCA(t)
+
+	user := &ipa.User{Username: "jdoe", Groups: []string{"hpc"}}
+	key := parseTestKey(t, testKeyED25519)
+
+	cert, err := ca.Sign(user, key.PublicKey)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(uint64(1), cert.Serial)
+	assert.Equal("jdoe-1", cert.KeyId)
+	assert.Equal(uint32(ssh.UserCert), cert.CertType)
+	assert.Equal([]string{"jdoe", "hpcuser"}, cert.ValidPrincipals)
+	assert.Contains(cert.Permissions.Extensions, "permit-pty")
+	assert.InDelta(time.Now().Add(time.Hour).Unix(), int64(cert.ValidBefore), 5)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	assert.NoError(checker.CheckCert("jdoe", cert))
+	assert.Error(checker.CheckCert("root", cert))
+
+	cert, err = ca.Sign(user, key.PublicKey)
+	if assert.NoError(err) {
+		assert.Equal(uint64(2), cert.Serial)
+	}
+
+	records, err := ca.UserCerts("jdoe")
+	if assert.NoError(err) && assert.Len(records, 2) {
+		assert.Equal(key.Fingerprint, records[0].Fingerprint)
+	}
+
+	revoked, err := ca.RevokeUser("jdoe")
+	if assert.NoError(err) {
+		assert.Equal([]uint64{1, 2}, revoked)
+	}
+}
+
+func TestSSHCAKRL(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestSSHCA(t)
+
+	assert.NoError(ca.Revoke([]uint64{7, 3, 7}, []string{"jdoe-5"}))
+
+	krl, err := ca.KRL()
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(uint64(krlMagic), binary.BigEndian.Uint64(krl[0:8]))
+	assert.Equal(uint32(krlFormatVersion), binary.BigEndian.Uint32(krl[8:12]))
+	assert.Equal(uint64(1), binary.BigEndian.Uint64(krl[12:20]))
+
+	// Serials are sorted and de-duplicated
+	var serials bytes.Buffer
+	binary.Write(&serials, binary.BigEndian, uint64(3))
+	binary.Write(&serials, binary.BigEndian, uint64(7))
+	assert.True(bytes.Contains(krl, serials.Bytes()))
+	assert.True(bytes.Contains(krl, []byte("jdoe-5")))
+	assert.True(bytes.Contains(krl, ca.PublicKey().Marshal()))
+}
+
+func TestSSHCAShared(t *testing.T) {
+	assert := assert.New(t)
+	storage := sqlite3.New(sqlite3.Config{
+		Database: filepath.Join(t.TempDir(), "mokey.db"),
+		Table:    storageTable,
+	})
+	defer storage.Close()
+
+	// The server and the sshca command sharing storage
+	ca1 := newTestSSHCA(t)
+	ca1.storage = storage
+	ca2 := &SSHCA{signer: ca1.signer, storage: storage, Validity: time.Hour}
+
+	user := &ipa.User{Username: "jdoe"}
+	key := parseTestKey(t, testKeyED25519)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := ca1.Sign(user, key.PublicKey)
+			assert.NoError(err)
+		}()
+		go func(serial uint64) {
+			defer wg.Done()
+			assert.NoError(ca2.Revoke([]uint64{1000 + serial}, nil))
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	certs, err := ca2.UserCerts("jdoe")
+	assert.NoError(err)
+	serials := make(map[uint64]bool)
+	for _, c := range certs {
+		serials[c.Serial] = true
+	}
+	assert.Len(serials, 10)
+
+	revoked, err := ca1.Revocations()
+	if assert.NoError(err) {
+		assert.Len(revoked.Serials, 10)
+		assert.Equal(uint64(10), revoked.Version)
+	}
+}
+
+func TestParseSSHPublicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseSSHPublicKey(testKeyED25519)
+	assert.NoError(err)
+
+	_, err = ParseSSHPublicKey("not a key")
+	assert.Error(err)
+
+	ca := newTestSSHCA(t)
+	cert, err := ca.Sign(&ipa.User{Username: "jdoe"}, parseTestKey(t, testKeyED25519).PublicKey)
+	if assert.NoError(err) {
+		_, err = ParseSSHPublicKey(string(ssh.MarshalAuthorizedKey(cert)))
+		assert.Error(err)
+	}
+}
+
+func TestSSHCertAPILimiter(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+	viper.Set("sshca.api_rate_limit_max", 2)
+	defer viper.Set("sshca.api_rate_limit_max", 5)
+
+	r := &Router{storage: memory.New()}
+	app := fiber.New()
+	app.Post("/api/sshcert", r.sshCertAPILimiter(), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	})
+
+	request := func(username string) int {
+		req := httptest.NewRequest(fiber.MethodPost, "/api/sshcert", nil)
+		req.SetBasicAuth(username, "password")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	assert.Equal(fiber.StatusUnauthorized, request("jdoe"))
+	assert.Equal(fiber.StatusUnauthorized, request("jdoe"))
+	assert.Equal(fiber.StatusTooManyRequests, request("jdoe"))
+
+	// Limits are per username
+	assert.Equal(fiber.StatusUnauthorized, request("mjones"))
+}
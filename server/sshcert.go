@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshCertAllowed returns an error message if user can not be issued ssh
+// certificates
+func sshCertAllowed(user *ipa.User) string {
+	if viper.GetBool("sshca.require_mfa") && !user.OTPOnly() {
+		return "You must enable Two-Factor Authentication before requesting SSH certificates"
+	}
+
+	return ""
+}
+
+// signSSHCert validates key and issues a certificate for user
+func (r *Router) signSSHCert(c *fiber.Ctx, user *ipa.User, key string) (*ssh.Certificate, error) {
+	pubKey, err := ParseSSHPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := NewSSHKeyPolicy().CheckPublicKey(pubKey); err != nil {
+		log.WithFields(log.Fields{
+			"username":    user.Username,
+			"type":        pubKey.Type(),
+			"fingerprint": ssh.FingerprintSHA256(pubKey),
+			"err":         err,
+		}).Warn("AUDIT Rejected ssh certificate request for key not allowed by policy")
+		r.audit(c, &AuditEvent{
+			Action:  AuditSSHCertIssue,
+			Outcome: AuditFailure,
+			Actor:   user.Username,
+			Target:  user.Username,
+			Reason:  err.Error(),
+			Data: map[string]interface{}{
+				"fingerprint": ssh.FingerprintSHA256(pubKey),
+			},
+		})
+		return nil, err
+	}
+
+	cert, err := r.sshca.Sign(user, pubKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": user.Username,
+			"err":      err,
+		}).Error("Failed to sign ssh certificate")
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"username":     user.Username,
+		"ip":           RemoteIP(c),
+		"serial":       cert.Serial,
+		"key_id":       cert.KeyId,
+		"principals":   strings.Join(cert.ValidPrincipals, ","),
+		"fingerprint":  ssh.FingerprintSHA256(pubKey),
+		"valid_before": time.Unix(int64(cert.ValidBefore), 0),
+	}).Info("AUDIT Issued ssh certificate")
+	r.metrics.totalSSHCertsIssued.Inc()
+	r.audit(c, &AuditEvent{
+		Action: AuditSSHCertIssue,
+		Actor:  user.Username,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"serial":      cert.Serial,
+			"key_id":      cert.KeyId,
+			"principals":  cert.ValidPrincipals,
+			"fingerprint": ssh.FingerprintSHA256(pubKey),
+		},
+	})
+	r.webhooks.Emit(EventSSHCertIssued, user.Username, RemoteIP(c), map[string]interface{}{
+		"serial":       cert.Serial,
+		"key_id":       cert.KeyId,
+		"principals":   cert.ValidPrincipals,
+		"fingerprint":  ssh.FingerprintSHA256(pubKey),
+		"valid_before": time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	})
+
+	return cert, nil
+}
+
+func (r *Router) SSHCertModal(c *fiber.Ctx) error {
+	vars := fiber.Map{
+		"policy":   NewSSHKeyPolicy(),
+		"validity": humanize.RelTime(time.Time{}, time.Time{}.Add(r.sshca.Validity), "", ""),
+	}
+	return c.Render("sshcert-new.html", vars)
+}
+
+func (r *Router) SSHCertSign(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	if msg := sshCertAllowed(user); msg != "" {
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, msg))
+	}
+
+	key := c.FormValue("key")
+	if key == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide an ssh public key"))
+	}
+
+	cert, err := r.signSSHCert(c, user, key)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	vars := fiber.Map{
+		"cert":        strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+		"keyID":       cert.KeyId,
+		"principals":  cert.ValidPrincipals,
+		"validBefore": time.Unix(int64(cert.ValidBefore), 0),
+	}
+	return c.Render("sshcert-issued.html", vars)
+}
+
+// SSHCertAPI issues a certificate for the public key in the request body.
+// Users authenticate using HTTP Basic auth with their password followed by
+// their OTP.
+func (r *Router) SSHCertAPI(c *fiber.Ctx) error {
+	username, password, ok := basicAuth(c)
+	if !ok || username == "" || password == "" {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="mokey"`)
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Please provide your username and password followed by your OTP"))
+	}
+
+	if isBlocked(username) {
+		log.WithFields(log.Fields{
+			"username": username,
+		}).Warn("AUDIT User account is blocked from requesting ssh certificates")
+		r.audit(c, &AuditEvent{
+			Action:  AuditSSHCertIssue,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "blocked",
+		})
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
+	}
+
+	client := ipa.NewDefaultClient()
+	if err := client.RemoteLogin(username, password); err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"ip":       RemoteIP(c),
+			"err":      err,
+		}).Error("AUDIT Failed ssh certificate api login attempt")
+		r.metrics.totalFailedLogins.Inc()
+		r.audit(c, &AuditEvent{
+			Action:  AuditSSHCertIssue,
+			Outcome: AuditFailure,
+			Target:  username,
+			Reason:  "invalid credentials",
+		})
+		return c.Status(fiber.StatusUnauthorized).SendString(tr(c, "Invalid credentials"))
+	}
+
+	user, err := client.UserShow(username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+			"err":      err,
+		}).Error("Failed to fetch user info from FreeIPA")
+		return c.Status(fiber.StatusInternalServerError).SendString("")
+	}
+
+	if msg := sshCertAllowed(user); msg != "" {
+		return c.Status(fiber.StatusForbidden).SendString(tr(c, msg))
+	}
+
+	cert, err := r.signSSHCert(c, user, string(c.Body()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Send(ssh.MarshalAuthorizedKey(cert))
+}
+
+// SSHCAPublicKey returns the CA public key for TrustedUserCAKeys
+func (r *Router) SSHCAPublicKey(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Send(ssh.MarshalAuthorizedKey(r.sshca.PublicKey()))
+}
+
+// SSHCAKRL returns the Key Revocation List for RevokedKeys
+func (r *Router) SSHCAKRL(c *fiber.Ctx) error {
+	krl, err := r.sshca.KRL()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to generate ssh KRL")
+		return c.Status(fiber.StatusInternalServerError).SendString("")
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="mokey.krl"`)
+	return c.Send(krl)
+}
+
+func basicAuth(c *fiber.Ctx) (string, string, bool) {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if len(auth) <= 6 || !strings.EqualFold(auth[:6], "basic ") {
+		return "", "", false
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(auth[6:])
+	if err != nil {
+		return "", "", false
+	}
+
+	username, password, ok := strings.Cut(string(raw), ":")
+	return username, password, ok
+}
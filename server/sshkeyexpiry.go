@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	StoragePrefixSSHKey = "sshkey-"
+)
+
+// ErrSSHKeyExpiryStorage is returned when ssh key expiration is used without
+// persistent storage. Keys without a record never expire so records written
+// by the server must survive restarts and be visible to "mokey sshkeys
+// expire".
+var ErrSSHKeyExpiryStorage = errors.New("SSH key expiration requires a persistent storage driver. Please set storage.driver to sqlite3 or redis")
+
+// SSHKeyRecord tracks when an ssh key was added through mokey and when it
+// expires. FreeIPA does not store either so they are kept in mokey storage
+// keyed on username and key fingerprint.
+type SSHKeyRecord struct {
+	AddedAt   time.Time `json:"added_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Notified  bool      `json:"notified"`
+}
+
+// Expired returns true if the key has an expiration time that has passed
+func (k *SSHKeyRecord) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+func sshKeyRecordKey(username, fingerprint string) string {
+	return fmt.Sprintf("%s%s-%s", StoragePrefixSSHKey, username, fingerprint)
+}
+
+// NewSSHKeyRecord returns a record for a key added now using the
+// sshkeys.max_lifetime config
+func NewSSHKeyRecord(now time.Time) *SSHKeyRecord {
+	rec := &SSHKeyRecord{AddedAt: now}
+	if days := viper.GetInt("sshkeys.max_lifetime"); days > 0 {
+		rec.ExpiresAt = now.Add(time.Duration(days) * 24 * time.Hour)
+	}
+
+	return rec
+}
+
+// GetSSHKeyRecord returns the record for the key with fingerprint or nil if
+// the key was not added through mokey
+func GetSSHKeyRecord(storage fiber.Storage, username, fingerprint string) (*SSHKeyRecord, error) {
+	data, err := storage.Get(sshKeyRecordKey(username, fingerprint))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var rec SSHKeyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func SaveSSHKeyRecord(storage fiber.Storage, username, fingerprint string, rec *SSHKeyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	// Records without an expiration are kept forever
+	var ttl time.Duration
+	if !rec.ExpiresAt.IsZero() {
+		ttl = time.Until(rec.ExpiresAt.Add(30 * 24 * time.Hour))
+	}
+
+	return storage.Set(sshKeyRecordKey(username, fingerprint), data, ttl)
+}
+
+func DeleteSSHKeyRecord(storage fiber.Storage, username, fingerprint string) error {
+	return storage.Delete(sshKeyRecordKey(username, fingerprint))
+}
+
+// sshKeyRecords returns the records for all of the users ssh keys keyed on
+// fingerprint
+func sshKeyRecords(storage fiber.Storage, user *ipa.User) map[string]*SSHKeyRecord {
+	records := make(map[string]*SSHKeyRecord)
+	for _, key := range user.SSHAuthKeys {
+		rec, err := GetSSHKeyRecord(storage, user.Username, key.Fingerprint)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username":    user.Username,
+				"fingerprint": key.Fingerprint,
+				"err":         err,
+			}).Error("Failed to fetch ssh key record from storage")
+			continue
+		}
+
+		if rec != nil {
+			records[key.Fingerprint] = rec
+		}
+	}
+
+	return records
+}
+
+// SSHKeyExpirer removes expired ssh keys from FreeIPA and emails users before
+// their keys expire
+type SSHKeyExpirer struct {
+	NotifyDays int
+	DryRun     bool
+
+	client   *ipa.Client
+	emailer  *Emailer
+	storage  fiber.Storage
+	audit    *AuditLogger
+	webhooks *Webhooks
+}
+
+// ExpireResult lists the keys removed and users emailed by an expire run.
+// Entries are formatted username:fingerprint
+type ExpireResult struct {
+	Removed  []string
+	Notified []string
+}
+
+// NewSSHKeyExpirer returns an expirer for the sshkeys config. Removed keys
+// are logged to audit and sent to webhooks if not nil.
+func NewSSHKeyExpirer(client *ipa.Client, emailer *Emailer, storage fiber.Storage, audit *AuditLogger, webhooks *Webhooks) *SSHKeyExpirer {
+	return &SSHKeyExpirer{
+		NotifyDays: viper.GetInt("sshkeys.expiry_notify_days"),
+		client:     client,
+		emailer:    emailer,
+		storage:    storage,
+		audit:      audit,
+		webhooks:   webhooks,
+	}
+}
+
+// Run removes expired keys and sends expiring key reminders
+func (e *SSHKeyExpirer) Run() (*ExpireResult, error) {
+	users, err := e.client.UserFind(ipa.Options{"sizelimit": 0})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ExpireResult{}
+	now := time.Now()
+
+	for _, user := range users {
+		if len(user.SSHAuthKeys) == 0 {
+			continue
+		}
+
+		removed := e.expireUser(user, sshKeyRecords(e.storage, user), now, result)
+		if len(removed) == 0 {
+			continue
+		}
+
+		if e.DryRun {
+			for _, fp := range removed {
+				result.Removed = append(result.Removed, user.Username+":"+fp)
+			}
+			continue
+		}
+
+		for _, fp := range removed {
+			user.RemoveSSHAuthorizedKey(fp)
+		}
+
+		if _, err := e.client.UserMod(user); err != nil {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"err":      err,
+			}).Error("Failed to remove expired ssh keys from FreeIPA")
+			continue
+		}
+
+		for _, fp := range removed {
+			DeleteSSHKeyRecord(e.storage, user.Username, fp)
+
+			log.WithFields(log.Fields{
+				"username":    user.Username,
+				"fingerprint": fp,
+			}).Warn("AUDIT Removed expired ssh key")
+			e.audit.Log(&AuditEvent{
+				Action: AuditSSHKeyExpire,
+				Target: user.Username,
+				Data: map[string]interface{}{
+					"fingerprint": fp,
+				},
+			})
+			e.webhooks.Emit(EventSSHKeyRemoved, user.Username, "", map[string]interface{}{
+				"fingerprint": fp,
+				"reason":      "expired",
+			})
+			result.Removed = append(result.Removed, user.Username+":"+fp)
+		}
+
+		if user.Email != "" {
+			if err := e.emailer.SendSSHKeyUpdatedEmail(false, user, nil); err != nil {
+				log.WithFields(log.Fields{
+					"username": user.Username,
+					"err":      err,
+				}).Error("Failed to send sshkey removed email")
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// expireUser returns the fingerprints of the users expired keys and sends
+// reminders for keys expiring soon
+func (e *SSHKeyExpirer) expireUser(user *ipa.User, records map[string]*SSHKeyRecord, now time.Time, result *ExpireResult) []string {
+	removed := make([]string, 0)
+
+	for _, key := range user.SSHAuthKeys {
+		rec, ok := records[key.Fingerprint]
+		if !ok || rec.ExpiresAt.IsZero() {
+			continue
+		}
+
+		if rec.Expired(now) {
+			removed = append(removed, key.Fingerprint)
+			continue
+		}
+
+		if e.NotifyDays <= 0 || rec.Notified || user.Email == "" || rec.ExpiresAt.Sub(now) > time.Duration(e.NotifyDays)*24*time.Hour {
+			continue
+		}
+
+		if !e.DryRun {
+			if err := e.emailer.SendSSHKeyExpiringEmail(user, key, rec, nil); err != nil {
+				log.WithFields(log.Fields{
+					"username":    user.Username,
+					"fingerprint": key.Fingerprint,
+					"err":         err,
+				}).Error("Failed to send ssh key expiring email")
+				continue
+			}
+
+			rec.Notified = true
+			if err := SaveSSHKeyRecord(e.storage, user.Username, key.Fingerprint, rec); err != nil {
+				log.WithFields(log.Fields{
+					"username":    user.Username,
+					"fingerprint": key.Fingerprint,
+					"err":         err,
+				}).Error("Failed to save ssh key record")
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"username":    user.Username,
+			"fingerprint": key.Fingerprint,
+			"expire_at":   rec.ExpiresAt,
+			"dry_run":     e.DryRun,
+		}).Info("Sent ssh key expiring email")
+		result.Notified = append(result.Notified, user.Username+":"+key.Fingerprint)
+	}
+
+	return removed
+}
+
+// Schedule runs the expirer every interval until stop is closed
+func (e *SSHKeyExpirer) Schedule(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			result, err := e.Run()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("Failed to expire ssh keys")
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"removed":  len(result.Removed),
+				"notified": len(result.Notified),
+			}).Info("Expired ssh keys")
+		}
+	}
+}
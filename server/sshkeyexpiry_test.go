@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestSSHKeyRecord(t *testing.T) {
+	assert := assert.New(t)
+	storage := memory.New()
+	now := time.Now()
+
+	viper.Set("sshkeys.max_lifetime", 0)
+	rec := NewSSHKeyRecord(now)
+	assert.True(rec.ExpiresAt.IsZero())
+	assert.False(rec.Expired(now.Add(1000 * 24 * time.Hour)))
+
+	viper.Set("sshkeys.max_lifetime", 90)
+	defer viper.Set("sshkeys.max_lifetime", 0)
+
+	rec = NewSSHKeyRecord(now)
+	assert.Equal(now.Add(90*24*time.Hour), rec.ExpiresAt)
+	assert.False(rec.Expired(now))
+	assert.True(rec.Expired(now.Add(91 * 24 * time.Hour)))
+
+	if !assert.NoError(SaveSSHKeyRecord(storage, "jdoe", "SHA256:abc", rec)) {
+		return
+	}
+
+	saved, err := GetSSHKeyRecord(storage, "jdoe", "SHA256:abc")
+	if assert.NoError(err) && assert.NotNil(saved) {
+		assert.True(rec.ExpiresAt.Equal(saved.ExpiresAt))
+	}
+
+	assert.NoError(DeleteSSHKeyRecord(storage, "jdoe", "SHA256:abc"))
+	saved, err = GetSSHKeyRecord(storage, "jdoe", "SHA256:abc")
+	assert.NoError(err)
+	assert.Nil(saved)
+}
+
+func TestSSHKeyExpireUser(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	expired := parseTestKey(t, testKeyED25519)
+	expiring := parseTestKey(t, testKeyECDSA)
+	forever := parseTestKey(t, testKeyRSA3072)
+	untracked := parseTestKey(t, testKeyED25519SK)
+
+	user := &ipa.User{
+		Username:    "jdoe",
+		Email:       "jdoe@example.com",
+		SSHAuthKeys: []*ipa.SSHAuthorizedKey{expired, expiring, forever, untracked},
+	}
+
+	records := map[string]*SSHKeyRecord{
+		expired.Fingerprint:  {AddedAt: now.Add(-100 * 24 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		expiring.Fingerprint: {AddedAt: now.Add(-85 * 24 * time.Hour), ExpiresAt: now.Add(5 * 24 * time.Hour)},
+		forever.Fingerprint:  {AddedAt: now.Add(-85 * 24 * time.Hour)},
+	}
+
+	e := &SSHKeyExpirer{NotifyDays: 7, DryRun: true}
+	result := &ExpireResult{}
+
+	removed := e.expireUser(user, records, now, result)
+	assert.Equal([]string{expired.Fingerprint}, removed)
+	assert.Equal([]string{"jdoe:" + expiring.Fingerprint}, result.Notified)
+
+	// Already notified
+	records[expiring.Fingerprint].Notified = true
+	result = &ExpireResult{}
+	e.expireUser(user, records, now, result)
+	assert.Empty(result.Notified)
+}
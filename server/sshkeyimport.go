@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	// Max size of an authorized_keys file that can be imported
+	maxSSHKeyImportSize = 64 * 1024
+)
+
+// SSHKeyImportLine is the result of parsing a single line of an imported
+// authorized_keys file
+type SSHKeyImportLine struct {
+	Line int
+	Key  *ipa.SSHAuthorizedKey
+	Err  error
+}
+
+// Accepted returns true if the key on this line will be imported
+func (l *SSHKeyImportLine) Accepted() bool {
+	return l.Err == nil
+}
+
+// ParseAuthorizedKeys parses an authorized_keys file and validates each key
+// against the policy. Keys are checked against the users existing keys and
+// the keys accepted on previous lines so duplicates and the max keys limit
+// are handled across the whole file. Blank lines and comments are skipped.
+func (p *SSHKeyPolicy) ParseAuthorizedKeys(user *ipa.User, data string) []*SSHKeyImportLine {
+	// Work on a copy so the users keys are not modified
+	check := &ipa.User{
+		Username:    user.Username,
+		SSHAuthKeys: append([]*ipa.SSHAuthorizedKey{}, user.SSHAuthKeys...),
+	}
+
+	lines := make([]*SSHKeyImportLine, 0)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 16*1024), maxSSHKeyImportSize)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		line := &SSHKeyImportLine{Line: n}
+		lines = append(lines, line)
+
+		key, err := ipa.NewSSHAuthorizedKey(text)
+		if err != nil {
+			line.Err = errors.New("Invalid ssh key")
+			continue
+		}
+
+		key.Comment = p.sanitizeComment(key.Comment)
+		line.Key = key
+
+		if err := p.Check(check, key); err != nil {
+			line.Err = err
+			continue
+		}
+
+		check.AddSSHAuthorizedKey(key)
+	}
+
+	return lines
+}
+
+// importData returns the authorized_keys data from an uploaded file or the
+// pasted keys form field
+func importData(c *fiber.Ctx) (string, error) {
+	if fh, err := c.FormFile("file"); err == nil {
+		if fh.Size > maxSSHKeyImportSize {
+			return "", errors.New("File is too large")
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, maxSSHKeyImportSize))
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	}
+
+	data := c.FormValue("keys")
+	if len(data) > maxSSHKeyImportSize {
+		return "", errors.New("Too many ssh keys")
+	}
+
+	return data, nil
+}
+
+func (r *Router) SSHKeyImportModal(c *fiber.Ctx) error {
+	vars := fiber.Map{
+		"policy": NewSSHKeyPolicy(),
+	}
+	return c.Render("sshkey-import.html", vars)
+}
+
+func (r *Router) SSHKeyImportPreview(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	data, err := importData(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	if strings.TrimSpace(data) == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide an authorized_keys file"))
+	}
+
+	lines := NewSSHKeyPolicy().ParseAuthorizedKeys(user, data)
+
+	accepted := 0
+	for _, l := range lines {
+		if l.Accepted() {
+			accepted++
+		}
+	}
+
+	vars := fiber.Map{
+		"lines":    lines,
+		"accepted": accepted,
+		"data":     data,
+	}
+	return c.Render("sshkey-import-preview.html", vars)
+}
+
+func (r *Router) SSHKeyImport(c *fiber.Ctx) error {
+	user := r.user(c)
+
+	data, err := importData(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
+	}
+
+	keys := make([]*ipa.SSHAuthorizedKey, 0)
+	for _, l := range NewSSHKeyPolicy().ParseAuthorizedKeys(user, data) {
+		if !l.Accepted() {
+			log.WithFields(log.Fields{
+				"username": user.Username,
+				"line":     l.Line,
+				"err":      l.Err,
+			}).Info("Skipping ssh key rejected during import")
+			continue
+		}
+
+		keys = append(keys, l.Key)
+	}
+
+	if len(keys) == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "No ssh keys to import"))
+	}
+
+	for _, key := range keys {
+		user.AddSSHAuthorizedKey(key)
+	}
+
+	user, err = r.adminClient.UserMod(user)
+	if err != nil {
+		return err
+	}
+
+	c.Locals(ContextKeyUser, user)
+
+	now := time.Now()
+	for _, key := range keys {
+		rec := NewSSHKeyRecord(now)
+		if err := SaveSSHKeyRecord(r.storage, user.Username, key.Fingerprint, rec); err != nil {
+			log.WithFields(log.Fields{
+				"err":         err,
+				"username":    user.Username,
+				"fingerprint": key.Fingerprint,
+			}).Error("Failed to save ssh key record")
+		}
+
+		log.WithFields(log.Fields{
+			"username":    user.Username,
+			"fingerprint": key.Fingerprint,
+			"expire_at":   rec.ExpiresAt,
+		}).Info("AUDIT User imported ssh key")
+		r.audit(c, &AuditEvent{
+			Action: AuditSSHKeyAdd,
+			Target: user.Username,
+			Data: map[string]interface{}{
+				"fingerprint": key.Fingerprint,
+				"type":        key.PublicKey.Type(),
+				"imported":    true,
+			},
+		})
+		r.webhooks.Emit(EventSSHKeyAdded, user.Username, RemoteIP(c), map[string]interface{}{
+			"fingerprint": key.Fingerprint,
+			"type":        key.PublicKey.Type(),
+			"imported":    true,
+		})
+	}
+
+	err = r.emailer.SendSSHKeysImportedEmail(user, keys, c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"username": user.Username,
+		}).Error("Failed to send sshkey imported email")
+	}
+
+	return r.SSHKeyList(c)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestSSHKeyParseAuthorizedKeys(t *testing.T) {
+	SetDefaults()
+	assert := assert.New(t)
+
+	policy := NewSSHKeyPolicy()
+	user := &ipa.User{
+		Username:    "jdoe",
+		SSHAuthKeys: []*ipa.SSHAuthorizedKey{parseTestKey(t, testKeyECDSA)},
+	}
+
+	data := strings.Join([]string{
+		"# old cluster keys",
+		testKeyED25519 + " laptop",
+		"",
+		testKeyDSA + " old",
+		"not a key",
+		testKeyED25519 + " laptop again",
+		testKeyECDSA + " existing",
+		`command="/bin/sh" ` + testKeyRSA3072,
+		"no-pty " + testKeyED25519SK + " yubikey",
+	}, "\n")
+
+	lines := policy.ParseAuthorizedKeys(user, data)
+	if !assert.Len(lines, 7) {
+		return
+	}
+
+	assert.Equal(2, lines[0].Line)
+	assert.True(lines[0].Accepted())
+	assert.Equal("laptop", lines[0].Key.Comment)
+
+	assert.Equal(4, lines[1].Line)
+	assert.False(lines[1].Accepted())
+	assert.NotNil(lines[1].Key)
+
+	assert.False(lines[2].Accepted())
+	assert.Nil(lines[2].Key)
+
+	// Duplicates within the file and of existing keys are rejected
+	assert.False(lines[3].Accepted())
+	assert.False(lines[4].Accepted())
+
+	assert.False(lines[5].Accepted())
+	assert.True(lines[6].Accepted())
+
+	// Users keys are not modified
+	assert.Len(user.SSHAuthKeys, 1)
+
+	policy.MaxKeys = 2
+	lines = policy.ParseAuthorizedKeys(user, testKeyED25519+"\n"+testKeyRSA3072)
+	if assert.Len(lines, 2) {
+		assert.True(lines[0].Accepted())
+		assert.False(lines[1].Accepted())
+	}
+}
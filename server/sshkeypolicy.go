@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKeyPolicy restricts the ssh public keys users can add to their account
+type SSHKeyPolicy struct {
+	AllowedTypes       []string
+	MinRSABits         int
+	RequireSecurityKey bool
+	MaxKeys            int
+	AllowedOptions     []string
+	MaxTitleLength     int
+}
+
+// NewSSHKeyPolicy returns the ssh key policy set in the [sshkeys] section of
+// the mokey config
+func NewSSHKeyPolicy() *SSHKeyPolicy {
+	return &SSHKeyPolicy{
+		AllowedTypes:       viper.GetStringSlice("sshkeys.allowed_types"),
+		MinRSABits:         viper.GetInt("sshkeys.min_rsa_bits"),
+		RequireSecurityKey: viper.GetBool("sshkeys.require_security_key"),
+		MaxKeys:            viper.GetInt("sshkeys.max_keys"),
+		AllowedOptions:     viper.GetStringSlice("sshkeys.allowed_options"),
+		MaxTitleLength:     viper.GetInt("sshkeys.max_title_length"),
+	}
+}
+
+// isSecurityKeyType returns true if keyType is a FIDO/U2F hardware backed key
+func isSecurityKeyType(keyType string) bool {
+	return keyType == ssh.KeyAlgoSKECDSA256 || keyType == ssh.KeyAlgoSKED25519
+}
+
+// sshKeyTypeName returns a short human readable name for keyType
+func sshKeyTypeName(keyType string) string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	case ssh.KeyAlgoDSA:
+		return "DSA"
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoSKED25519:
+		return "ED25519-SK"
+	case ssh.KeyAlgoSKECDSA256:
+		return "ECDSA-SK"
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA"
+	}
+
+	return keyType
+}
+
+// Types returns the key types accepted by the policy
+func (p *SSHKeyPolicy) Types() []string {
+	if !p.RequireSecurityKey {
+		return p.AllowedTypes
+	}
+
+	types := make([]string, 0, len(p.AllowedTypes))
+	for _, t := range p.AllowedTypes {
+		if isSecurityKeyType(t) {
+			types = append(types, t)
+		}
+	}
+
+	return types
+}
+
+// Check validates a new key for user against the policy
+func (p *SSHKeyPolicy) Check(user *ipa.User, key *ipa.SSHAuthorizedKey) error {
+	if err := p.CheckPublicKey(key.PublicKey); err != nil {
+		return err
+	}
+
+	for _, opt := range key.Options {
+		name := strings.ToLower(strings.SplitN(opt, "=", 2)[0])
+		if !p.optionAllowed(name) {
+			return fmt.Errorf("The authorized_keys option %q is not allowed", name)
+		}
+	}
+
+	for _, k := range user.SSHAuthKeys {
+		if k.Fingerprint == key.Fingerprint {
+			return fmt.Errorf("This ssh key has already been added to your account")
+		}
+	}
+
+	if p.MaxKeys > 0 && len(user.SSHAuthKeys) >= p.MaxKeys {
+		return fmt.Errorf("You have reached the maximum of %d ssh keys. Please remove a key before adding a new one", p.MaxKeys)
+	}
+
+	return nil
+}
+
+// CheckPublicKey validates the key type and size against the policy
+func (p *SSHKeyPolicy) CheckPublicKey(pubKey ssh.PublicKey) error {
+	keyType := pubKey.Type()
+
+	allowed := false
+	for _, t := range p.Types() {
+		if keyType == t {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		if p.RequireSecurityKey && !isSecurityKeyType(keyType) {
+			return fmt.Errorf("%s keys are not allowed. Please use a hardware security key (ecdsa-sk or ed25519-sk)", sshKeyTypeName(keyType))
+		}
+		return fmt.Errorf("%s keys are not allowed. Allowed key types: %s", sshKeyTypeName(keyType), strings.Join(p.Types(), ", "))
+	}
+
+	if keyType == ssh.KeyAlgoRSA && p.MinRSABits > 0 {
+		if cpk, ok := pubKey.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+				return fmt.Errorf("RSA key is too small (%d bits). RSA keys must be at least %d bits", rsaKey.N.BitLen(), p.MinRSABits)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *SSHKeyPolicy) optionAllowed(name string) bool {
+	for _, o := range p.AllowedOptions {
+		if strings.ToLower(o) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SanitizeTitle removes control characters and collapses whitespace in a
+// key title. Returns an error if the title is longer than the policy allows.
+func (p *SSHKeyPolicy) SanitizeTitle(title string) (string, error) {
+	title = cleanSSHKeyTitle(title)
+
+	if p.MaxTitleLength > 0 && len([]rune(title)) > p.MaxTitleLength {
+		return "", fmt.Errorf("Title is too long. Maximum of %d characters allowed", p.MaxTitleLength)
+	}
+
+	return title, nil
+}
+
+// sanitizeComment cleans up the comment included with a key, truncating it
+// to the max title length
+func (p *SSHKeyPolicy) sanitizeComment(comment string) string {
+	comment = cleanSSHKeyTitle(comment)
+
+	if runes := []rune(comment); p.MaxTitleLength > 0 && len(runes) > p.MaxTitleLength {
+		comment = string(runes[:p.MaxTitleLength])
+	}
+
+	return comment
+}
+
+func cleanSSHKeyTitle(title string) string {
+	return strings.Join(strings.FieldsFunc(title, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+const (
+	testKeyDSA       = "ssh-dss AAAAB3NzaC1kc3MAAACBAO/7HhESrGCPo1VjOqaC3YMB3OkIHEFIkqikqgkWRpdu7CGvS5ta6VCWIokIwtCVd/mx2x/C7P/f7/eW/WlZSHoSAXb9n/jIL++tj/Av50PeKbOMj64ApS86GczUmHXWamZSinZzaW4qu9sjHiQFLWB5W5aXpsFyk5iMpv7oIfRjAAAAFQDZrfW79PDQ0t8p7DnO+ud5PGKzzQAAAIAMDdzSzZlCMXPHPgAWRrsvpWKA81M6jI0ZyRAgLOPUPRYLZIA+rBNZdz5k+1Kn7jAPMrqq2lUmhjumsc6CivlgTQ3ReWeFjMQWRWAuVKxy5T0i0x4OIn7mYuAvNISPggsempV4xWFNUF7WdS3lx1yi65sDsmuRY2eu9qcizlaD/QAAAIBXq51mKdoGRZCr3cF3lpanFAh6Cua1hkc6DrHXK9N27wj72+P7NolLYEjfwBNRDJoMU+rg+RDBE7C0PLSFwchM+nMLouBYjpCrC5aAjjsnrOTGNndtQBA28KgzESbKlVcJ4ufitKGHQ0cGGrHcrhKTVUAAfXhiVqqL5uJ/3zTsQA=="
+	testKeyRSA2048   = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDOSIqzCeEIK0Ov+sRZLOFZI7NCEGUCFnKd6lDk/nbhwEg0IP2wNqcZuXzeiL5YlYdj/leGzNP3+FdqPsNw5/OUm+bTEV0iDoFDvTZ5J7gOAfFpf+r15ek+nVgL5g1/PNSijG/hVIezneS8zRTzT4036Ac4gC/i099mVWxqP/8Y8XVZoTkSsYgP2lttaCr1VncJzV4OYGuOZS2TaL+0gvWXXSgWWC7rT5cGJTQT4rL65veK/iyZJZKf90RA8gqXyqjp9TM2fOqMKSviAZxNBzUrxi1FLG/EsDqS9/gYGQ6oymcig0u7jiX/tDwjYD1LdujvWWPXCqguUo/eafxVdkdz"
+	testKeyRSA3072   = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC+10SVqK49Y+SQItoH7K8ZKOme/Y/qqzNCHmyhe5nuTMSp2MNM8NnYYw0tRT+41vIXsqK3qywhBObag+Teo0YyxqFkWmWRwJGY03Zd6zLWSsmZkwvoLB+b1rTcKis3MkiTTdvNil5SOfcVj9VuejCUnfTaFdgp98yYdt/8JJfsKiA3fqM7qhhebu9qFniGm6097SsF8bo7wvzsn3fjyLyaHnG/TtfUn7SCX0qlr2WjWK0x6uuFUs85n4sbFA3NhG3YFIvl3JfbBwA31FGSQMRS15KbRDIjv9zzHzKMN7dbmLS5z/35ix1WP5/CZA5PXO+JwuU2Qj3HHOYki0AsIOcnYjZJEPdRQnuAe1DDrTtZg8S9dq9mI1+8pAoiFqdzGNsV5QYu0nlBIFJMIAyvaa6rh6vuITnDUbRBgQwOkh2uzbhC4he9nbtRo3wdw7YoThpxtFCfdIHCEzv2yneGYUCrNMcoLX3WNg04zOMVRen1ko6DBu5mDFl/t+6WBFNo7js="
+	testKeyED25519   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUD26fdAMHjeCxmt9z/7MITMnj7rtIl+gkHtKTrK9ul"
+	testKeyECDSA     = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLESL+oxmF+jg0wnhMPzAmcOJz+qZtmpfI6uv1lGQaECgRK8eD1Fhxp2QOIoATdqmqbRKuWVtmy5+G11etM2Lrw="
+	testKeyED25519SK = "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIH/p4sWSIaET87houDtQ7FbS6JWHZ/DwUhqzyYa81ibVAAAABHNzaDo="
+)
+
+func parseTestKey(t *testing.T, key string) *ipa.SSHAuthorizedKey {
+	k, err := ipa.NewSSHAuthorizedKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSSHKeyPolicyCheck(t *testing.T) {
+	SetDefaults()
+	assert := assert.New(t)
+
+	policy := NewSSHKeyPolicy()
+	user := &ipa.User{Username: "jdoe"}
+
+	assert.Error(policy.Check(user, parseTestKey(t, testKeyDSA)))
+	assert.Error(policy.Check(user, parseTestKey(t, testKeyRSA2048)))
+	assert.NoError(policy.Check(user, parseTestKey(t, testKeyRSA3072)))
+	assert.NoError(policy.Check(user, parseTestKey(t, testKeyED25519)))
+	assert.NoError(policy.Check(user, parseTestKey(t, testKeyECDSA)))
+	assert.NoError(policy.Check(user, parseTestKey(t, testKeyED25519SK)))
+
+	// Options
+	assert.NoError(policy.Check(user, parseTestKey(t, `from="10.0.0.0/8",no-pty `+testKeyED25519)))
+	assert.Error(policy.Check(user, parseTestKey(t, `command="/bin/sh" `+testKeyED25519)))
+
+	// Duplicates
+	user.SSHAuthKeys = []*ipa.SSHAuthorizedKey{parseTestKey(t, testKeyED25519+" laptop")}
+	assert.Error(policy.Check(user, parseTestKey(t, testKeyED25519+" desktop")))
+
+	// Max keys
+	policy.MaxKeys = 1
+	assert.Error(policy.Check(user, parseTestKey(t, testKeyECDSA)))
+	policy.MaxKeys = 0
+
+	// Security keys only
+	policy.RequireSecurityKey = true
+	assert.Equal([]string{"sk-ecdsa-sha2-nistp256@openssh.com", "sk-ssh-ed25519@openssh.com"}, policy.Types())
+	assert.Error(policy.Check(user, parseTestKey(t, testKeyECDSA)))
+	assert.NoError(policy.Check(user, parseTestKey(t, testKeyED25519SK)))
+}
+
+func TestSSHKeyPolicyTitle(t *testing.T) {
+	viper.Set("sshkeys.max_title_length", 10)
+	defer viper.Set("sshkeys.max_title_length", 100)
+
+	assert := assert.New(t)
+	policy := NewSSHKeyPolicy()
+
+	title, err := policy.SanitizeTitle("  my\tlaptop\n\x00 ")
+	if assert.NoError(err) {
+		assert.Equal("my laptop", title)
+	}
+
+	_, err = policy.SanitizeTitle("my very long laptop title")
+	assert.Error(err)
+
+	assert.Equal("jdoe@examp", policy.sanitizeComment("jdoe@example.com\r\n"))
+}
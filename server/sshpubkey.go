@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	log "github.com/sirupsen/logrus"
 	ipa "github.com/ubccr/goipa"
@@ -9,13 +11,16 @@ import (
 func (r *Router) SSHKeyList(c *fiber.Ctx) error {
 	user := r.user(c)
 	vars := fiber.Map{
-		"user": user,
+		"user":       user,
+		"keyRecords": sshKeyRecords(r.storage, user),
 	}
 	return c.Render("sshkey-list.html", vars)
 }
 
 func (r *Router) SSHKeyModal(c *fiber.Ctx) error {
-	vars := fiber.Map{}
+	vars := fiber.Map{
+		"policy": NewSSHKeyPolicy(),
+	}
 	return c.Render("sshkey-new.html", vars)
 }
 
@@ -26,7 +31,7 @@ func (r *Router) SSHKeyAdd(c *fiber.Ctx) error {
 	key := c.FormValue("key")
 
 	if key == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Please provide an ssh key")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Please provide an ssh key"))
 	}
 
 	authKey, err := ipa.NewSSHAuthorizedKey(key)
@@ -35,12 +40,39 @@ func (r *Router) SSHKeyAdd(c *fiber.Ctx) error {
 			"username": user.Username,
 			"err":      err,
 		}).Error("Failed to add new ssh key")
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid ssh key")
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, "Invalid ssh key"))
+	}
+
+	policy := NewSSHKeyPolicy()
+
+	title, err = policy.SanitizeTitle(title)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	if title != "" {
-		// TODO validate title
 		authKey.Comment = title
+	} else {
+		authKey.Comment = policy.sanitizeComment(authKey.Comment)
+	}
+
+	if err := policy.Check(user, authKey); err != nil {
+		log.WithFields(log.Fields{
+			"username":    user.Username,
+			"type":        authKey.PublicKey.Type(),
+			"fingerprint": authKey.Fingerprint,
+			"err":         err,
+		}).Warn("AUDIT Rejected ssh key not allowed by policy")
+		r.audit(c, &AuditEvent{
+			Action:  AuditSSHKeyAdd,
+			Outcome: AuditFailure,
+			Target:  user.Username,
+			Reason:  err.Error(),
+			Data: map[string]interface{}{
+				"fingerprint": authKey.Fingerprint,
+			},
+		})
+		return c.Status(fiber.StatusBadRequest).SendString(tr(c, err.Error()))
 	}
 
 	user.AddSSHAuthorizedKey(authKey)
@@ -52,6 +84,33 @@ func (r *Router) SSHKeyAdd(c *fiber.Ctx) error {
 
 	c.Locals(ContextKeyUser, user)
 
+	rec := NewSSHKeyRecord(time.Now())
+	if err := SaveSSHKeyRecord(r.storage, user.Username, authKey.Fingerprint, rec); err != nil {
+		log.WithFields(log.Fields{
+			"err":         err,
+			"username":    user.Username,
+			"fingerprint": authKey.Fingerprint,
+		}).Error("Failed to save ssh key record")
+	}
+
+	log.WithFields(log.Fields{
+		"username":    user.Username,
+		"fingerprint": authKey.Fingerprint,
+		"expire_at":   rec.ExpiresAt,
+	}).Info("AUDIT User added ssh key")
+	r.audit(c, &AuditEvent{
+		Action: AuditSSHKeyAdd,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"fingerprint": authKey.Fingerprint,
+			"type":        authKey.PublicKey.Type(),
+		},
+	})
+	r.webhooks.Emit(EventSSHKeyAdded, user.Username, RemoteIP(c), map[string]interface{}{
+		"fingerprint": authKey.Fingerprint,
+		"type":        authKey.PublicKey.Type(),
+	})
+
 	err = r.emailer.SendSSHKeyUpdatedEmail(true, user, c)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -77,6 +136,18 @@ func (r *Router) SSHKeyRemove(c *fiber.Ctx) error {
 
 	c.Locals(ContextKeyUser, user)
 
+	DeleteSSHKeyRecord(r.storage, user.Username, fp)
+	r.audit(c, &AuditEvent{
+		Action: AuditSSHKeyRemove,
+		Target: user.Username,
+		Data: map[string]interface{}{
+			"fingerprint": fp,
+		},
+	})
+	r.webhooks.Emit(EventSSHKeyRemoved, user.Username, RemoteIP(c), map[string]interface{}{
+		"fingerprint": fp,
+	})
+
 	err = r.emailer.SendSSHKeyUpdatedEmail(false, user, c)
 	if err != nil {
 		log.WithFields(log.Fields{
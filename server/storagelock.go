@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/gofiber/storage/redis/v3"
+	"github.com/gofiber/storage/sqlite3/v2"
+)
+
+const (
+	storageTable = "mokey_data"
+
+	// Lock retry interval
+	storageLockPoll = 20 * time.Millisecond
+)
+
+var ErrStorageLockTimeout = errors.New("timed out waiting for storage lock")
+
+// redisUnlockScript deletes the lock only if it is still held by the caller
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// localLocks are used for storage drivers that are only shared within a
+// single process
+var localLocks sync.Map
+
+// PersistentStorage returns true if storage is saved across restarts and
+// shared between mokey processes
+func PersistentStorage(storage fiber.Storage) bool {
+	_, ok := storage.(*memory.Storage)
+	return !ok
+}
+
+// LockStorage acquires the exclusive lock key shared by all mokey processes
+// using storage, waiting up to wait. The lock is released automatically
+// after ttl in case the holder dies. Returns a function that releases the
+// lock.
+func LockStorage(storage fiber.Storage, key string, ttl, wait time.Duration) (func(), error) {
+	switch s := storage.(type) {
+	case *redis.Storage, *sqlite3.Storage:
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return nil, err
+		}
+		value := hex.EncodeToString(token)
+
+		deadline := time.Now().Add(wait)
+		for {
+			ok, err := tryLockStorage(s, key, value, ttl)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to acquire storage lock %s: %w", key, err)
+			}
+			if ok {
+				return func() { unlockStorage(s, key, value) }, nil
+			}
+			if time.Now().After(deadline) {
+				return nil, ErrStorageLockTimeout
+			}
+			time.Sleep(storageLockPoll)
+		}
+	}
+
+	mu, _ := localLocks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock, nil
+}
+
+func tryLockStorage(storage fiber.Storage, key, value string, ttl time.Duration) (bool, error) {
+	switch s := storage.(type) {
+	case *redis.Storage:
+		return s.Conn().SetNX(context.Background(), key, value, ttl).Result()
+	case *sqlite3.Storage:
+		// Insert the lock unless an unexpired lock exists
+		now := time.Now()
+		res, err := s.Conn().Exec(fmt.Sprintf(`INSERT INTO %s (k, v, e) VALUES (?, ?, ?)
+			ON CONFLICT(k) DO UPDATE SET v = excluded.v, e = excluded.e
+			WHERE %s.e != 0 AND %s.e <= ?`, storageTable, storageTable, storageTable),
+			key, []byte(value), now.Add(ttl).Unix(), now.Unix())
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+
+	return false, errors.New("storage driver does not support locking")
+}
+
+func unlockStorage(storage fiber.Storage, key, value string) {
+	switch s := storage.(type) {
+	case *redis.Storage:
+		s.Conn().Eval(context.Background(), redisUnlockScript, []string{key}, value)
+	case *sqlite3.Storage:
+		s.Conn().Exec(fmt.Sprintf(`DELETE FROM %s WHERE k = ? AND v = ?`, storageTable), key, []byte(value))
+	}
+}
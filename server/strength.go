@@ -0,0 +1,1021 @@
+package server
+
+import (
+	"embed"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/viper"
+	ipa "github.com/ubccr/goipa"
+)
+
+// Password strength estimation based on the zxcvbn algorithm from Dropbox.
+// A password is split into the sequence of patterns (dictionary words,
+// keyboard walks, sequences, repeats, dates) that would take an attacker the
+// fewest guesses to find, and the total number of guesses is mapped to a score
+// from 0 (too guessable) to 4 (very unguessable).
+
+//go:embed dictionaries/*.txt
+var dictionaryFiles embed.FS
+
+const (
+	strengthMaxLength      = 100
+	strengthMinTokenLength = 3
+
+	// Minimum guesses for a match sequence to grow by one. Penalizes splitting
+	// a password into many small matches.
+	strengthMinSequenceGuesses = 10000
+
+	patternDictionary = "dictionary"
+	patternSpatial    = "spatial"
+	patternSequence   = "sequence"
+	patternRepeat     = "repeat"
+	patternDate       = "date"
+	patternYear       = "year"
+	patternBruteforce = "bruteforce"
+
+	dictionaryPasswords  = "passwords"
+	dictionaryWords      = "words"
+	dictionaryNames      = "names"
+	dictionaryUserInputs = "user_inputs"
+)
+
+var (
+	dateSeparatorRegx = regexp.MustCompile(`^(\d{1,4})([\s/\\_.-])(\d{1,2})([\s/\\_.-])(\d{1,4})$`)
+	digitsRegx        = regexp.MustCompile(`^\d{4,8}$`)
+	yearRegx          = regexp.MustCompile(`^(19|20)\d\d$`)
+
+	// Possible day/month/year splits of a date without separators by length
+	dateSplits = map[int][][2]int{
+		5: {{1, 3}, {2, 3}},
+		6: {{1, 2}, {2, 4}, {4, 5}},
+		7: {{1, 3}, {2, 3}, {4, 5}, {4, 6}},
+		8: {{2, 4}, {4, 6}},
+	}
+
+	l33tTable = map[rune][]rune{
+		'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '{': {'c'}, '[': {'c'},
+		'<': {'c'}, '3': {'e'}, '6': {'g'}, '9': {'g'}, '1': {'i', 'l'},
+		'!': {'i'}, '|': {'i', 'l'}, '7': {'l', 't'}, '0': {'o'}, '$': {'s'},
+		'5': {'s'}, '+': {'t'}, '%': {'x'}, '2': {'z'},
+	}
+
+	rankedDictionaries = loadRankedDictionaries()
+	keyboardGraphs     = []*keyboardGraph{qwertyGraph(), keypadGraph()}
+)
+
+// PasswordStrength is the estimated strength of a password along with
+// feedback to help users choose a stronger password
+type PasswordStrength struct {
+	Score       int
+	Guesses     float64
+	Warning     string
+	Suggestions []string
+}
+
+// Label returns a human readable description of the score
+func (s *PasswordStrength) Label() string {
+	return [...]string{"Very weak", "Weak", "Fair", "Strong", "Very strong"}[s.Score]
+}
+
+// Percent returns the score as a percentage for display in a meter
+func (s *PasswordStrength) Percent() int {
+	return (s.Score + 1) * 20
+}
+
+type rankedDictionary struct {
+	name  string
+	ranks map[string]int
+}
+
+type strengthMatch struct {
+	pattern string
+	i, j    int
+	token   string
+	guesses float64
+
+	dictionary string
+	rank       int
+	reversed   bool
+	sub        map[rune]rune
+
+	graph   *keyboardGraph
+	turns   int
+	shifted int
+
+	ascending bool
+
+	baseToken    string
+	baseGuesses  float64
+	repeatCount  int
+	year         int
+	hasSeparator bool
+}
+
+type keyboardGraph struct {
+	name              string
+	adjacent          map[rune]map[rune]int
+	shifted           map[rune]bool
+	startingPositions float64
+	averageDegree     float64
+}
+
+type keyPosition struct {
+	x, y float64
+	keys string
+}
+
+func loadRankedDictionaries() []*rankedDictionary {
+	dicts := make([]*rankedDictionary, 0, 3)
+	for _, name := range []string{dictionaryPasswords, dictionaryWords, dictionaryNames} {
+		data, err := dictionaryFiles.ReadFile("dictionaries/" + name + ".txt")
+		if err != nil {
+			panic(err)
+		}
+
+		dicts = append(dicts, newRankedDictionary(name, strings.Fields(string(data))))
+	}
+
+	return dicts
+}
+
+func newRankedDictionary(name string, words []string) *rankedDictionary {
+	d := &rankedDictionary{name: name, ranks: make(map[string]int)}
+	for _, w := range words {
+		w = strings.ToLower(w)
+		if _, ok := d.ranks[w]; !ok && w != "" {
+			d.ranks[w] = len(d.ranks) + 1
+		}
+	}
+
+	return d
+}
+
+// newKeyboardGraph builds the adjacency graph for a keyboard layout. Keys in
+// the same row are adjacent when 1 key apart and keys in neighbouring rows
+// when their centers are within maxOffset keys horizontally.
+func newKeyboardGraph(name string, positions []keyPosition, maxOffset float64) *keyboardGraph {
+	g := &keyboardGraph{
+		name:     name,
+		adjacent: make(map[rune]map[rune]int),
+		shifted:  make(map[rune]bool),
+	}
+
+	degree := 0
+	for _, p := range positions {
+		for idx, c := range p.keys {
+			g.adjacent[c] = make(map[rune]int)
+			if idx > 0 {
+				g.shifted[c] = true
+			}
+		}
+
+		for _, n := range positions {
+			dx, dy := n.x-p.x, n.y-p.y
+			if (dx == 0 && dy == 0) || math.Abs(dy) > 1 {
+				continue
+			}
+			if (dy == 0 && math.Abs(dx) > 1) || (dy != 0 && math.Abs(dx) > maxOffset) {
+				continue
+			}
+
+			sx := 0
+			if dx > 0 {
+				sx = 1
+			} else if dx < 0 {
+				sx = -1
+			}
+			direction := int(dy+1)*3 + sx + 1
+
+			degree++
+			for _, c := range p.keys {
+				for _, nc := range n.keys {
+					g.adjacent[c][nc] = direction
+				}
+			}
+		}
+	}
+
+	g.startingPositions = float64(len(positions))
+	g.averageDegree = float64(degree) / float64(len(positions))
+
+	return g
+}
+
+func qwertyGraph() *keyboardGraph {
+	rows := []struct {
+		offset float64
+		keys   string
+	}{
+		{0, "`~ 1! 2@ 3# 4$ 5% 6^ 7& 8* 9( 0) -_ =+"},
+		{1.5, "qQ wW eE rR tT yY uU iI oO pP [{ ]} \\|"},
+		{1.75, "aA sS dD fF gG hH jJ kK lL ;: '\""},
+		{2.25, "zZ xX cC vV bB nN mM ,< .> /?"},
+	}
+
+	positions := make([]keyPosition, 0)
+	for y, row := range rows {
+		for x, keys := range strings.Fields(row.keys) {
+			positions = append(positions, keyPosition{x: float64(x) + row.offset, y: float64(y), keys: keys})
+		}
+	}
+
+	return newKeyboardGraph("qwerty", positions, 0.75)
+}
+
+func keypadGraph() *keyboardGraph {
+	rows := []string{
+		" / * -",
+		"7 8 9 +",
+		"4 5 6",
+		"1 2 3",
+		" 0 .",
+	}
+
+	positions := make([]keyPosition, 0)
+	for y, row := range rows {
+		for x, key := range strings.Split(row, " ") {
+			if key != "" {
+				positions = append(positions, keyPosition{x: float64(x), y: float64(y), keys: key})
+			}
+		}
+	}
+
+	return newKeyboardGraph("keypad", positions, 1)
+}
+
+// EstimatePasswordStrength estimates the strength of password. Any
+// userInputs such as the users name or email address are treated as the most
+// common dictionary words.
+func EstimatePasswordStrength(password string, userInputs ...string) *PasswordStrength {
+	runes := []rune(password)
+	if len(runes) > strengthMaxLength {
+		runes = runes[:strengthMaxLength]
+	}
+
+	words := make([]string, 0, len(userInputs))
+	for _, in := range userInputs {
+		if len([]rune(in)) >= strengthMinTokenLength {
+			words = append(words, in)
+		}
+	}
+
+	dicts := append([]*rankedDictionary{newRankedDictionary(dictionaryUserInputs, words)}, rankedDictionaries...)
+
+	guesses, sequence := mostGuessableSequence(runes, dicts)
+
+	strength := &PasswordStrength{
+		Score:   guessesToScore(guesses),
+		Guesses: guesses,
+	}
+	strength.Warning, strength.Suggestions = strengthFeedback(strength.Score, sequence)
+
+	return strength
+}
+
+func guessesToScore(guesses float64) int {
+	const delta = 5
+
+	switch {
+	case guesses < 1e3+delta:
+		return 0
+	case guesses < 1e6+delta:
+		return 1
+	case guesses < 1e8+delta:
+		return 2
+	case guesses < 1e10+delta:
+		return 3
+	}
+
+	return 4
+}
+
+func findMatches(password []rune, dicts []*rankedDictionary) []*strengthMatch {
+	matches := dictionaryMatches(password, dicts)
+	matches = append(matches, reverseDictionaryMatches(password, dicts)...)
+	matches = append(matches, l33tMatches(password, dicts)...)
+	matches = append(matches, spatialMatches(password)...)
+	matches = append(matches, sequenceMatches(password)...)
+	matches = append(matches, repeatMatches(password, dicts)...)
+	matches = append(matches, dateMatches(password)...)
+
+	return matches
+}
+
+// mostGuessableSequence finds the sequence of non-overlapping matches
+// covering password that minimizes the total number of guesses. Gaps between
+// matches are filled with bruteforce matches.
+func mostGuessableSequence(password []rune, dicts []*rankedDictionary) (float64, []*strengthMatch) {
+	n := len(password)
+	if n == 0 {
+		return 1, nil
+	}
+
+	type state struct {
+		product float64
+		guesses float64
+		seq     []*strengthMatch
+	}
+
+	// best[k][l] is the best sequence of length l ending at position k
+	best := make([][]*state, n)
+	for k := range best {
+		best[k] = make([]*state, n+1)
+	}
+
+	byEnd := make([][]*strengthMatch, n)
+	for _, m := range findMatches(password, dicts) {
+		m.guesses = matchGuesses(m, n)
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	update := func(m *strengthMatch, l int, prev *state) {
+		product := m.guesses
+		seq := []*strengthMatch{m}
+		if prev != nil {
+			product *= prev.product
+			seq = append(append(make([]*strengthMatch, 0, l), prev.seq...), m)
+		}
+
+		guesses := factorial(l)*product + math.Pow(strengthMinSequenceGuesses, float64(l-1))
+		for cl := 1; cl <= l; cl++ {
+			if s := best[m.j][cl]; s != nil && s.guesses <= guesses {
+				return
+			}
+		}
+
+		best[m.j][l] = &state{product: product, guesses: guesses, seq: seq}
+	}
+
+	bruteforce := func(i, j int) *strengthMatch {
+		m := &strengthMatch{pattern: patternBruteforce, i: i, j: j, token: string(password[i : j+1])}
+		m.guesses = matchGuesses(m, n)
+		return m
+	}
+
+	for k := 0; k < n; k++ {
+		for _, m := range byEnd[k] {
+			if m.i == 0 {
+				update(m, 1, nil)
+				continue
+			}
+
+			for l, s := range best[m.i-1] {
+				if s != nil {
+					update(m, l+1, s)
+				}
+			}
+		}
+
+		update(bruteforce(0, k), 1, nil)
+		for i := 1; i <= k; i++ {
+			m := bruteforce(i, k)
+			for l, s := range best[i-1] {
+				// Adjacent bruteforce matches are never better than one
+				if s != nil && s.seq[len(s.seq)-1].pattern != patternBruteforce {
+					update(m, l+1, s)
+				}
+			}
+		}
+	}
+
+	var result *state
+	for _, s := range best[n-1] {
+		if s != nil && (result == nil || s.guesses < result.guesses) {
+			result = s
+		}
+	}
+
+	return result.guesses, result.seq
+}
+
+func dictionaryMatches(password []rune, dicts []*rankedDictionary) []*strengthMatch {
+	lower := make([]rune, len(password))
+	for i, r := range password {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	matches := make([]*strengthMatch, 0)
+	for i := range lower {
+		for j := i + strengthMinTokenLength - 1; j < len(lower); j++ {
+			word := string(lower[i : j+1])
+			for _, d := range dicts {
+				if rank, ok := d.ranks[word]; ok {
+					matches = append(matches, &strengthMatch{
+						pattern:    patternDictionary,
+						i:          i,
+						j:          j,
+						token:      string(password[i : j+1]),
+						dictionary: d.name,
+						rank:       rank,
+					})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+func reverseDictionaryMatches(password []rune, dicts []*rankedDictionary) []*strengthMatch {
+	n := len(password)
+	reversed := make([]rune, n)
+	for i, r := range password {
+		reversed[n-1-i] = r
+	}
+
+	matches := dictionaryMatches(reversed, dicts)
+	for _, m := range matches {
+		m.i, m.j = n-1-m.j, n-1-m.i
+		m.token = string(password[m.i : m.j+1])
+		m.reversed = true
+	}
+
+	return matches
+}
+
+// l33tSubstitutions returns the possible mappings of l33t characters found in
+// password back to letters
+func l33tSubstitutions(password []rune) []map[rune]rune {
+	subs := []map[rune]rune{{}}
+	seen := make(map[rune]bool)
+	for _, r := range password {
+		letters, ok := l33tTable[r]
+		if !ok || seen[r] {
+			continue
+		}
+		seen[r] = true
+
+		next := make([]map[rune]rune, 0, len(subs)*len(letters))
+		for _, sub := range subs {
+			for _, l := range letters {
+				s := make(map[rune]rune, len(sub)+1)
+				for k, v := range sub {
+					s[k] = v
+				}
+				s[r] = l
+				next = append(next, s)
+			}
+		}
+
+		// Bound the work done for passwords full of l33t characters
+		if len(next) > 32 {
+			next = next[:32]
+		}
+		subs = next
+	}
+
+	if len(seen) == 0 {
+		return nil
+	}
+
+	return subs
+}
+
+func l33tMatches(password []rune, dicts []*rankedDictionary) []*strengthMatch {
+	matches := make([]*strengthMatch, 0)
+	for _, sub := range l33tSubstitutions(password) {
+		translated := make([]rune, len(password))
+		for i, r := range password {
+			if l, ok := sub[r]; ok {
+				translated[i] = l
+			} else {
+				translated[i] = r
+			}
+		}
+
+		for _, m := range dictionaryMatches(translated, dicts) {
+			token := password[m.i : m.j+1]
+			used := make(map[rune]rune)
+			for _, r := range token {
+				if l, ok := sub[r]; ok {
+					used[r] = l
+				}
+			}
+
+			if len(used) == 0 {
+				continue
+			}
+
+			m.token = string(token)
+			m.sub = used
+			matches = append(matches, m)
+		}
+	}
+
+	return matches
+}
+
+func spatialMatches(password []rune) []*strengthMatch {
+	matches := make([]*strengthMatch, 0)
+	for _, g := range keyboardGraphs {
+		i := 0
+		for i < len(password)-1 {
+			j := i + 1
+			lastDirection := -1
+			turns := 0
+			shifted := 0
+			if g.shifted[password[i]] {
+				shifted++
+			}
+
+			for j < len(password) {
+				direction, ok := g.adjacent[password[j-1]][password[j]]
+				if !ok {
+					break
+				}
+
+				if g.shifted[password[j]] {
+					shifted++
+				}
+				if direction != lastDirection {
+					turns++
+					lastDirection = direction
+				}
+				j++
+			}
+
+			if j-i > 2 {
+				matches = append(matches, &strengthMatch{
+					pattern: patternSpatial,
+					i:       i,
+					j:       j - 1,
+					token:   string(password[i:j]),
+					graph:   g,
+					turns:   turns,
+					shifted: shifted,
+				})
+			}
+
+			i = j
+		}
+	}
+
+	return matches
+}
+
+func sequenceMatches(password []rune) []*strengthMatch {
+	matches := make([]*strengthMatch, 0)
+	if len(password) < 3 {
+		return matches
+	}
+
+	emit := func(i, j, delta int) {
+		if j-i < 2 || delta == 0 || delta > 5 || delta < -5 {
+			return
+		}
+
+		matches = append(matches, &strengthMatch{
+			pattern:   patternSequence,
+			i:         i,
+			j:         j,
+			token:     string(password[i : j+1]),
+			ascending: delta > 0,
+		})
+	}
+
+	i := 0
+	lastDelta := int(password[1]) - int(password[0])
+	for k := 2; k < len(password); k++ {
+		delta := int(password[k]) - int(password[k-1])
+		if delta == lastDelta {
+			continue
+		}
+
+		emit(i, k-1, lastDelta)
+		i = k - 1
+		lastDelta = delta
+	}
+	emit(i, len(password)-1, lastDelta)
+
+	return matches
+}
+
+func repeatMatches(password []rune, dicts []*rankedDictionary) []*strengthMatch {
+	matches := make([]*strengthMatch, 0)
+	n := len(password)
+
+	for i := 0; i < n; {
+		bestLength, bestBase, bestCount := 0, 0, 0
+		for b := 1; i+2*b <= n; b++ {
+			base := string(password[i : i+b])
+			count := 1
+			for i+(count+1)*b <= n && string(password[i+count*b:i+(count+1)*b]) == base {
+				count++
+			}
+
+			if count >= 2 && b*count > bestLength {
+				bestLength, bestBase, bestCount = b*count, b, count
+			}
+		}
+
+		if bestLength == 0 {
+			i++
+			continue
+		}
+
+		base := password[i : i+bestBase]
+		baseGuesses, _ := mostGuessableSequence(base, dicts)
+		matches = append(matches, &strengthMatch{
+			pattern:     patternRepeat,
+			i:           i,
+			j:           i + bestLength - 1,
+			token:       string(password[i : i+bestLength]),
+			baseToken:   string(base),
+			baseGuesses: baseGuesses,
+			repeatCount: bestCount,
+		})
+
+		i += bestLength
+	}
+
+	return matches
+}
+
+func dateMatches(password []rune) []*strengthMatch {
+	matches := make([]*strengthMatch, 0)
+	ref := time.Now().Year()
+
+	for i := range password {
+		for j := i + 3; j < len(password) && j < i+10; j++ {
+			token := string(password[i : j+1])
+
+			if yearRegx.MatchString(token) {
+				year, _ := strconv.Atoi(token)
+				matches = append(matches, &strengthMatch{pattern: patternYear, i: i, j: j, token: token, year: year})
+			}
+
+			year, ok := 0, false
+			separator := false
+			if digitsRegx.MatchString(token) {
+				for _, split := range dateSplits[len(token)] {
+					if y, valid := parseDate(token[:split[0]], token[split[0]:split[1]], token[split[1]:]); valid {
+						if !ok || absInt(y-ref) < absInt(year-ref) {
+							year, ok = y, true
+						}
+					}
+				}
+			} else if parts := dateSeparatorRegx.FindStringSubmatch(token); parts != nil && parts[2] == parts[4] {
+				year, ok = parseDate(parts[1], parts[3], parts[5])
+				separator = true
+			}
+
+			if ok {
+				matches = append(matches, &strengthMatch{
+					pattern:      patternDate,
+					i:            i,
+					j:            j,
+					token:        token,
+					year:         year,
+					hasSeparator: separator,
+				})
+			}
+		}
+	}
+
+	return matches
+}
+
+// parseDate checks whether the parts form a valid date with the year either
+// first or last and returns the year
+func parseDate(a, b, c string) (int, bool) {
+	for _, order := range [][3]string{{c, a, b}, {a, b, c}} {
+		year, ok := parseYear(order[0])
+		if !ok {
+			continue
+		}
+
+		x, _ := strconv.Atoi(order[1])
+		y, _ := strconv.Atoi(order[2])
+		if (x >= 1 && x <= 31 && y >= 1 && y <= 12) || (x >= 1 && x <= 12 && y >= 1 && y <= 31) {
+			return year, true
+		}
+	}
+
+	return 0, false
+}
+
+func parseYear(s string) (int, bool) {
+	year, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+
+	switch len(s) {
+	case 2:
+		if year < 50 {
+			return 2000 + year, true
+		}
+		return 1900 + year, true
+	case 4:
+		return year, year >= 1000 && year <= 2050
+	}
+
+	return 0, false
+}
+
+// matchGuesses estimates the number of guesses needed to find match m in a
+// password of length n
+func matchGuesses(m *strengthMatch, n int) float64 {
+	length := m.j - m.i + 1
+
+	minGuesses := 1.0
+	if length < n {
+		if length == 1 {
+			minGuesses = 11
+		} else {
+			minGuesses = 51
+		}
+	}
+
+	var guesses float64
+	switch m.pattern {
+	case patternBruteforce:
+		guesses = math.Pow(10, float64(length))
+	case patternDictionary:
+		guesses = float64(m.rank) * uppercaseVariations(m.token) * l33tVariations(m)
+		if m.reversed {
+			guesses *= 2
+		}
+	case patternSpatial:
+		guesses = spatialGuesses(m)
+	case patternSequence:
+		first := []rune(m.token)[0]
+		base := 26.0
+		switch {
+		case strings.ContainsRune("aAzZ019", first):
+			base = 4
+		case unicode.IsDigit(first):
+			base = 10
+		}
+		if !m.ascending {
+			base *= 2
+		}
+		guesses = base * float64(length)
+	case patternRepeat:
+		guesses = m.baseGuesses * float64(m.repeatCount)
+	case patternYear:
+		guesses = yearSpace(m.year)
+	case patternDate:
+		guesses = yearSpace(m.year) * 365
+		if m.hasSeparator {
+			guesses *= 4
+		}
+	}
+
+	return math.Max(guesses, minGuesses)
+}
+
+func yearSpace(year int) float64 {
+	return math.Max(float64(absInt(year-time.Now().Year())), 20)
+}
+
+func uppercaseVariations(token string) float64 {
+	runes := []rune(token)
+	upper, lower := 0, 0
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+
+	if upper == 0 {
+		return 1
+	}
+
+	// All upper, first letter upper, or last letter upper
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(runes[0]) || unicode.IsUpper(runes[len(runes)-1]))) {
+		return 2
+	}
+
+	return sumBinomials(upper, lower)
+}
+
+func l33tVariations(m *strengthMatch) float64 {
+	variations := 1.0
+	lower := []rune(strings.ToLower(m.token))
+	for sub, letter := range m.sub {
+		subbed, unsubbed := 0, 0
+		for _, r := range lower {
+			if r == sub {
+				subbed++
+			} else if r == letter {
+				unsubbed++
+			}
+		}
+
+		if subbed == 0 || unsubbed == 0 {
+			variations *= 2
+		} else {
+			variations *= sumBinomials(subbed, unsubbed)
+		}
+	}
+
+	return variations
+}
+
+func spatialGuesses(m *strengthMatch) float64 {
+	s, d := m.graph.startingPositions, m.graph.averageDegree
+	length := len([]rune(m.token))
+
+	guesses := 0.0
+	for i := 2; i <= length; i++ {
+		for j := 1; j <= m.turns && j <= i-1; j++ {
+			guesses += binomial(i-1, j-1) * s * math.Pow(d, float64(j))
+		}
+	}
+
+	if m.shifted > 0 {
+		unshifted := length - m.shifted
+		if unshifted == 0 {
+			guesses *= 2
+		} else {
+			guesses *= sumBinomials(m.shifted, unshifted)
+		}
+	}
+
+	return guesses
+}
+
+// sumBinomials returns the number of ways to choose between 1 and min(a, b)
+// items from a+b
+func sumBinomials(a, b int) float64 {
+	sum := 0.0
+	for i := 1; i <= a && i <= b; i++ {
+		sum += binomial(a+b, i)
+	}
+
+	return sum
+}
+
+func binomial(n, k int) float64 {
+	if k > n {
+		return 0
+	}
+
+	r := 1.0
+	for d := 1; d <= k; d++ {
+		r *= float64(n)
+		r /= float64(d)
+		n--
+	}
+
+	return r
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+
+	return f
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+func strengthFeedback(score int, sequence []*strengthMatch) (string, []string) {
+	if len(sequence) == 0 {
+		return "", []string{
+			"Use a few words, avoid common phrases",
+			"No need for symbols, digits, or uppercase letters",
+		}
+	}
+
+	if score > 2 {
+		return "", nil
+	}
+
+	longest := sequence[0]
+	for _, m := range sequence[1:] {
+		if len(m.token) > len(longest.token) {
+			longest = m
+		}
+	}
+
+	suggestions := []string{"Add another word or two. Uncommon words are better."}
+	warning := ""
+
+	switch longest.pattern {
+	case patternDictionary:
+		sole := len(sequence) == 1
+		switch longest.dictionary {
+		case dictionaryPasswords:
+			switch {
+			case sole && !longest.reversed && longest.sub == nil && longest.rank <= 10:
+				warning = "This is a top-10 common password"
+			case sole && !longest.reversed && longest.sub == nil && longest.rank <= 100:
+				warning = "This is a top-100 common password"
+			case sole:
+				warning = "This is a very common password"
+			case longest.guesses <= 1e4:
+				warning = "This is similar to a commonly used password"
+			}
+		case dictionaryWords:
+			if sole {
+				warning = "A word by itself is easy to guess"
+			}
+		case dictionaryNames:
+			if sole {
+				warning = "Names and surnames by themselves are easy to guess"
+			} else {
+				warning = "Common names and surnames are easy to guess"
+			}
+		case dictionaryUserInputs:
+			warning = "Avoid using your name, username or email address in your password"
+		}
+
+		token := []rune(longest.token)
+		if unicode.IsUpper(token[0]) {
+			suggestions = append(suggestions, "Capitalization doesn't help very much")
+		} else if strings.ToUpper(longest.token) == longest.token && strings.ToLower(longest.token) != longest.token {
+			suggestions = append(suggestions, "All-uppercase is almost as easy to guess as all-lowercase")
+		}
+		if longest.reversed && len(token) >= 4 {
+			suggestions = append(suggestions, "Reversed words aren't much harder to guess")
+		}
+		if longest.sub != nil {
+			suggestions = append(suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much")
+		}
+	case patternSpatial:
+		if longest.turns == 1 {
+			warning = "Straight rows of keys are easy to guess"
+		} else {
+			warning = "Short keyboard patterns are easy to guess"
+		}
+		suggestions = append(suggestions, "Use a longer keyboard pattern with more turns")
+	case patternRepeat:
+		if len([]rune(longest.baseToken)) == 1 {
+			warning = `Repeats like "aaa" are easy to guess`
+		} else {
+			warning = `Repeats like "abcabcabc" are only slightly harder to guess than "abc"`
+		}
+		suggestions = append(suggestions, "Avoid repeated words and characters")
+	case patternSequence:
+		warning = "Sequences like abc or 6543 are easy to guess"
+		suggestions = append(suggestions, "Avoid sequences")
+	case patternYear:
+		warning = "Recent years are easy to guess"
+		suggestions = append(suggestions, "Avoid recent years", "Avoid years that are associated with you")
+	case patternDate:
+		warning = "Dates are often easy to guess"
+		suggestions = append(suggestions, "Avoid dates and years that are associated with you")
+	}
+
+	return warning, suggestions
+}
+
+// passwordUserInputs returns the words associated with user that should be
+// penalized when used in a password
+func passwordUserInputs(user *ipa.User) []string {
+	inputs := []string{user.Username, user.First, user.Last, user.Email}
+
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	}
+
+	inputs = append(inputs, split(user.Username)...)
+	inputs = append(inputs, split(user.Email)...)
+	inputs = append(inputs, split(viper.GetString("site.name"))...)
+
+	return inputs
+}
+
+// checkPasswordStrength returns an error if the estimated strength of password
+// is below accounts.min_passwd_score
+func checkPasswordStrength(password string, user *ipa.User) error {
+	minScore := viper.GetInt("accounts.min_passwd_score")
+	if minScore <= 0 {
+		return nil
+	}
+
+	strength := EstimatePasswordStrength(password, passwordUserInputs(user)...)
+	if strength.Score >= minScore {
+		return nil
+	}
+
+	msg := "Password is too easy to guess."
+	if strength.Warning != "" {
+		msg += " " + strength.Warning + "."
+	}
+	if len(strength.Suggestions) > 0 {
+		msg += " " + strength.Suggestions[len(strength.Suggestions)-1]
+	}
+
+	return errors.New(msg)
+}
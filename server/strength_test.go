@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	ipa "github.com/ubccr/goipa"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	assert := assert.New(t)
+
+	weakTests := []string{
+		"password",
+		"Password1",
+		"P@ssw0rd",
+		"qwertyuiop",
+		"zxcvbnm,./",
+		"abcdefghijk",
+		"aaaaaaaaaaaa",
+		"12/31/1999",
+		"19991231",
+		"drowssap",
+		"jennifer1990",
+	}
+
+	for _, pass := range weakTests {
+		strength := EstimatePasswordStrength(pass)
+		assert.LessOrEqual(strength.Score, 1, pass)
+		assert.NotEmpty(strength.Warning, pass)
+		assert.NotEmpty(strength.Suggestions, pass)
+	}
+
+	strongTests := []string{
+		"correct horse battery staple",
+		"purple monkey dishwasher lantern",
+		"rWibMFACxAUGZmxhVncy",
+		"Ba9ZyWABu99[BK#6MBgbH88Tofv)vs$",
+	}
+
+	for _, pass := range strongTests {
+		strength := EstimatePasswordStrength(pass)
+		assert.GreaterOrEqual(strength.Score, 3, pass)
+		assert.Empty(strength.Warning, pass)
+	}
+
+	strength := EstimatePasswordStrength("")
+	assert.Equal(0, strength.Score)
+	assert.NotEmpty(strength.Suggestions)
+
+	// Users own name and email are penalized
+	user := &ipa.User{
+		Username: "jxdoe",
+		First:    "Jxane",
+		Last:     "Dxoeson",
+		Email:    "jxdoe@univ.example.edu",
+	}
+
+	generic := EstimatePasswordStrength("Dxoeson2")
+	personal := EstimatePasswordStrength("Dxoeson2", passwordUserInputs(user)...)
+	assert.Less(personal.Guesses, generic.Guesses)
+	assert.Less(personal.Score, generic.Score)
+	assert.Equal("Avoid using your name, username or email address in your password", personal.Warning)
+}
+
+func TestPasswordStrengthCheck(t *testing.T) {
+	viper.Set("accounts.min_passwd_len", 8)
+	viper.Set("accounts.min_passwd_classes", 3)
+	viper.Set("accounts.min_passwd_score", 3)
+	defer viper.Set("accounts.min_passwd_score", 0)
+
+	assert := assert.New(t)
+	user := &ipa.User{Username: "jdoe", First: "Jane", Last: "Doe", Email: "jdoe@example.edu"}
+
+	// Character classes are enforced along with the strength score as
+	// FreeIPA also enforces them
+	assert.Error(checkPassword("correct horse battery staple"))
+	assert.NoError(checkPassword("Correct horse battery staple 9"))
+	assert.NoError(checkPasswordStrength("Correct horse battery staple 9", user))
+
+	// Predictable passwords are rejected even if they have enough classes
+	assert.Error(checkPasswordStrength("Password1!", user))
+	assert.Error(checkPasswordStrength("Jdoe2024!", user))
+
+	// Minimum length is still enforced
+	assert.Error(checkPassword("a8#Kq"))
+}
+
+func TestPasswordStrengthLimits(t *testing.T) {
+	assert := assert.New(t)
+	SetDefaults()
+	viper.Set("accounts.password_strength_rate_limit_max", 2)
+	defer viper.Set("accounts.password_strength_rate_limit_max", 60)
+
+	assert.Equal("abc", truncateRunes("abc", 5))
+	assert.Equal("ééé", truncateRunes("éééé", 3))
+
+	r := &Router{storage: memory.New()}
+	app := fiber.New()
+	app.Post("/password/strength", r.passwordStrengthLimiter(), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	request := func() int {
+		res, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/password/strength", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	assert.Equal(fiber.StatusOK, request())
+	assert.Equal(fiber.StatusOK, request())
+	assert.Equal(fiber.StatusTooManyRequests, request())
+}
@@ -24,6 +24,9 @@ var funcMap = template.FuncMap{
 	"ConfigValueBool":   ConfigValueBool,
 	"AllowedDomains":    AllowedDomains,
 	"BreakNewlines":     BreakNewlines,
+	"Now":               time.Now,
+	"T":                 T,
+	"Languages":         Languages,
 }
 
 type TemplateRenderer struct {
@@ -31,6 +34,9 @@ type TemplateRenderer struct {
 }
 
 func NewTemplateRenderer() (*TemplateRenderer, error) {
+	if err := LoadTranslations(); err != nil {
+		return nil, err
+	}
 
 	tmpl := template.New("")
 	tmpl.Funcs(funcMap)
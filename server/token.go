@@ -17,7 +17,12 @@ import (
 	"github.com/spf13/viper"
 )
 
+var ErrTokenAlreadyIssued = errors.New("token already issued")
+
+// Token is the payload of the tokens emailed to users. Type is the token
+// prefix it was issued for so a token can only be used for its purpose.
 type Token struct {
+	Type      string    `json:"type"`
 	Username  string    `json:"username"`
 	Email     string    `json:"email"`
 	Timestamp time.Time `json:"-"`
@@ -50,10 +55,11 @@ func GenerateSecretString(n int) (string, error) {
 func NewToken(username, email, prefix string, storage fiber.Storage) (string, error) {
 	tokenIssued, err := storage.Get(prefix + TokenIssuedPrefix + username)
 	if tokenIssued != nil {
-		return "", errors.New("token already issued")
+		return "", ErrTokenAlreadyIssued
 	}
 
 	claims := &Token{
+		Type:     prefix,
 		Username: username,
 		Email:    email,
 	}
@@ -84,7 +90,7 @@ func NewToken(username, email, prefix string, storage fiber.Storage) (string, er
 }
 
 func ParseToken(token, prefix string, storage fiber.Storage) (*Token, error) {
-	tokenUsed, err := storage.Get(prefix + TokenUsedPrefix + token)
+	tokenUsed, err := storage.Get(TokenUsedPrefix + token)
 	if tokenUsed != nil {
 		return nil, errors.New("token already used")
 	}
@@ -114,7 +120,17 @@ func ParseToken(token, prefix string, storage fiber.Storage) (*Token, error) {
 		return nil, err
 	}
 
+	if tk.Type != prefix {
+		return nil, errors.New("Invalid token type")
+	}
+
 	tk.Timestamp = brancaToken.Timestamp()
 
 	return &tk, nil
 }
+
+// MarkTokenUsed records token as used until it expires. Used tokens are
+// rejected by ParseToken regardless of type.
+func MarkTokenUsed(token string, claims *Token, storage fiber.Storage) error {
+	return storage.Set(TokenUsedPrefix+token, []byte("true"), time.Until(claims.Timestamp.Add(time.Duration(viper.GetInt("email.token_max_age"))*time.Second)))
+}
@@ -40,6 +40,17 @@ func TestToken(t *testing.T) {
 	_, err = NewToken(uid, email, TokenPasswordReset, storage)
 	assert.Error(err)
 
+	// Tokens are only valid for the type they were issued for
+	_, err = ParseToken(token, TokenMagicLink, storage)
+	assert.Error(err)
+	_, err = ParseToken(token, TokenAccountVerify, storage)
+	assert.Error(err)
+
+	// Used tokens are rejected for every type
+	assert.NoError(MarkTokenUsed(token, claims, storage))
+	_, err = ParseToken(token, TokenPasswordReset, storage)
+	assert.Error(err)
+
 	time.Sleep(time.Second * 4)
 
 	viper.Set("email.token_max_age", uint32(1))
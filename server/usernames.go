@@ -1,16 +1,26 @@
 package server
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	ttemplate "text/template"
 
 	valid "github.com/asaskevich/govalidator"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/ubccr/goipa"
 )
 
+const (
+	maxUsernameLength = 32
+	maxUsernameSuffix = 99
+)
+
 var (
 	ErrDomainNotAllowed = errors.New("Email domain not allowed")
 	ErrInvalidUsername  = errors.New("Username is invalid. May only include letters, numbers, _, -, .")
@@ -19,42 +29,231 @@ var (
 	rxUsername   = regexp.MustCompile("[^a-zA-Z0-9_.-]")
 )
 
-func defaultUsernameGenerator(username string) string {
-	return rxUsername.ReplaceAllString(username, "")
+// UsernameParts are the name components available to username generators.
+// First and Last are taken from a FirstName.LastName style email address when
+// possible and otherwise fall back to the name provided by the user.
+type UsernameParts struct {
+	Local  string
+	Domain string
+	First  string
+	Last   string
+}
+
+// UsernameGenerator generates a username from the parts of a users name and
+// email address
+type UsernameGenerator func(p *UsernameParts) (string, error)
+
+var usernameGenerators = map[string]UsernameGenerator{
+	"default":    defaultUsernameGenerator,
+	"flast":      flastUsernameGenerator,
+	"firstlast":  firstlastUsernameGenerator,
+	"first.last": firstDotLastUsernameGenerator,
+	"lastf":      lastfUsernameGenerator,
+}
+
+// RegisterUsernameGenerator adds a named username generator strategy which
+// can then be used in accounts.allowed_domains
+func RegisterUsernameGenerator(name string, g UsernameGenerator) {
+	usernameGenerators[name] = g
+}
+
+func newUsernameParts(user *ipa.User) *UsernameParts {
+	p := &UsernameParts{
+		First: user.First,
+		Last:  user.Last,
+	}
+
+	if at := strings.LastIndex(user.Email, "@"); at != -1 {
+		p.Local, p.Domain = user.Email[:at], strings.ToLower(user.Email[at+1:])
+	}
+
+	if dot := strings.Index(p.Local, "."); dot != -1 {
+		p.First, p.Last = p.Local[:dot], p.Local[dot+1:]
+	} else if p.First == "" && p.Last == "" {
+		p.Last = p.Local
+	}
+
+	return p
+}
+
+func defaultUsernameGenerator(p *UsernameParts) (string, error) {
+	return p.Local, nil
+}
+
+func flastUsernameGenerator(p *UsernameParts) (string, error) {
+	if p.First == "" {
+		return p.Last, nil
+	}
+
+	return string([]rune(p.First)[0]) + p.Last, nil
+}
+
+func firstlastUsernameGenerator(p *UsernameParts) (string, error) {
+	return p.First + p.Last, nil
+}
+
+func firstDotLastUsernameGenerator(p *UsernameParts) (string, error) {
+	if p.First == "" || p.Last == "" {
+		return p.First + p.Last, nil
+	}
+
+	return p.First + "." + p.Last, nil
+}
+
+func lastfUsernameGenerator(p *UsernameParts) (string, error) {
+	if p.First == "" {
+		return p.Last, nil
+	}
+
+	return p.Last + string([]rune(p.First)[0]), nil
 }
 
-func flastUsernameGenerator(username string) string {
-	dot := strings.Index(username, ".")
-	first, last := username[:dot], username[dot+1:]
-	username = last
-	if first != "" {
-		username = string(first[0]) + last
+// templateUsernameGenerator returns a generator using a Go text/template.
+// Name parts are available as the functions first, last, local, and domain
+// which can be piped to lower, upper, and trunc. For example:
+//
+//	{{first|lower|trunc 1}}{{last|lower|trunc 7}}
+func templateUsernameGenerator(text string) (UsernameGenerator, error) {
+	var parts *UsernameParts
+	funcs := ttemplate.FuncMap{
+		"first":  func() string { return parts.First },
+		"last":   func() string { return parts.Last },
+		"local":  func() string { return parts.Local },
+		"domain": func() string { return parts.Domain },
+		"lower":  strings.ToLower,
+		"upper":  strings.ToUpper,
+		"trunc": func(n int, s string) string {
+			r := []rune(s)
+			if n < 0 || n >= len(r) {
+				return s
+			}
+			return string(r[:n])
+		},
+	}
+
+	tmpl, err := ttemplate.New("username").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
 	}
-	return rxUsername.ReplaceAllString(username, "")
+
+	var mu sync.Mutex
+	return func(p *UsernameParts) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		parts = p
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, nil); err != nil {
+			return "", err
+		}
+
+		return buf.String(), nil
+	}, nil
+}
+
+// lookupUsernameGenerator returns the generator registered with name. Names
+// containing "{{" are parsed as a username template.
+func lookupUsernameGenerator(name string) (UsernameGenerator, error) {
+	if name == "" {
+		name = "default"
+	}
+
+	if strings.Contains(name, "{{") {
+		return templateUsernameGenerator(name)
+	}
+
+	g, ok := usernameGenerators[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown username generator: %s", name)
+	}
+
+	return g, nil
+}
+
+// validateUsernameGenerators ensures all generators configured in
+// allowedDomains exist
+func validateUsernameGenerators(allowedDomains map[string]string) error {
+	for domain, name := range allowedDomains {
+		if _, err := lookupUsernameGenerator(name); err != nil {
+			return fmt.Errorf("Invalid username generator for domain %s: %w", domain, err)
+		}
+	}
+
+	return nil
+}
+
+func generateUsername(user *ipa.User, name string) (string, error) {
+	g, err := lookupUsernameGenerator(name)
+	if err != nil {
+		return "", err
+	}
+
+	username, err := g(newUsernameParts(user))
+	if err != nil {
+		return "", err
+	}
+
+	return rxUsername.ReplaceAllString(username, ""), nil
 }
 
 func generateUsernameFromEmail(user *ipa.User, allowedDomains map[string]string) error {
 	at := strings.LastIndex(user.Email, "@")
-	username, domain := user.Email[:at], strings.ToLower(user.Email[at+1:])
+	if at == -1 {
+		return errors.New("Please provide a valid email address")
+	}
+	domain := strings.ToLower(user.Email[at+1:])
 
-	if len(allowedDomains) == 0 {
-		user.Username = defaultUsernameGenerator(username)
-	} else {
+	name := "default"
+	if len(allowedDomains) > 0 {
 		if _, ok := allowedDomains[domain]; !ok {
 			return fmt.Errorf("%w: %s", ErrDomainNotAllowed, domain)
 		}
 
-		switch allowedDomains[domain] {
-		case "flast":
-			user.Username = flastUsernameGenerator(username)
-		default:
-			user.Username = defaultUsernameGenerator(username)
-		}
+		name = allowedDomains[domain]
+	}
+
+	username, err := generateUsername(user, name)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"email":     user.Email,
+			"generator": name,
+			"err":       err,
+		}).Error("Failed to generate username from email")
+		return errors.New("Failed to generate username from email address. Please contact the administrator")
+	}
+
+	if username == "" {
+		return errors.New("Failed to generate username from email address")
 	}
 
+	user.Username = username
+
 	return nil
 }
 
+// uniqueUsername returns username if it does not exist otherwise appends the
+// lowest number resulting in a username that does not exist.
+func uniqueUsername(username string, exists func(string) bool) (string, error) {
+	if !exists(username) {
+		return username, nil
+	}
+
+	for i := 1; i <= maxUsernameSuffix; i++ {
+		suffix := strconv.Itoa(i)
+		base := username
+		if len(base)+len(suffix) > maxUsernameLength {
+			base = base[:maxUsernameLength-len(suffix)]
+		}
+
+		candidate := base + suffix
+		if !exists(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("Username already exists: %s", username)
+}
+
 func validateEmail(user *ipa.User, allowedDomains map[string]string) error {
 	if !valid.IsEmail(user.Email) {
 		return errors.New("Please provide a valid email address")
@@ -72,6 +271,77 @@ func validateEmail(user *ipa.User, allowedDomains map[string]string) error {
 	return nil
 }
 
+// checkUsername validates username against the site username rules
+func checkUsername(username string) error {
+	if !usernameRegx.MatchString(username) {
+		return fmt.Errorf("%w: %s", ErrInvalidUsername, username)
+	}
+
+	if valid.IsNumeric(username) {
+		return errors.New("Username must include at least one letter")
+	}
+
+	if isBlocked(username) {
+		return errors.New("Username not allowed. Please try different username or contact the administrator")
+	}
+
+	return nil
+}
+
+// suggestUsernames returns up to max available usernames built from the
+// users name, email address, and numbered variants of the requested username.
+// The exists function is used to check whether a username is already taken.
+func suggestUsernames(user *ipa.User, exists func(string) bool, max int) []string {
+	candidates := make([]string, 0)
+
+	if user.First != "" && user.Last != "" {
+		for _, name := range []string{"flast", "first.last", "firstlast", "lastf"} {
+			u := &ipa.User{First: user.First, Last: user.Last}
+			if username, err := generateUsername(u, name); err == nil {
+				candidates = append(candidates, strings.ToLower(username))
+			}
+		}
+	}
+
+	if strings.Contains(user.Email, "@") {
+		if username, err := generateUsername(user, "default"); err == nil {
+			candidates = append(candidates, strings.ToLower(username))
+		}
+	}
+
+	base := strings.ToLower(user.Username)
+	if base == "" && len(candidates) > 0 {
+		base = candidates[0]
+	}
+
+	if base != "" {
+		for i := 1; i <= max*2; i++ {
+			candidates = append(candidates, fmt.Sprintf("%s%d", base, i))
+		}
+	}
+
+	seen := map[string]bool{base: true}
+	suggestions := make([]string, 0, max)
+	for _, c := range candidates {
+		if len(suggestions) >= max {
+			break
+		}
+
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		if checkUsername(c) != nil || exists(c) {
+			continue
+		}
+
+		suggestions = append(suggestions, c)
+	}
+
+	return suggestions
+}
+
 func validateUsername(user *ipa.User) error {
 	allowedDomains := viper.GetStringMapString("accounts.allowed_domains")
 
@@ -85,16 +355,8 @@ func validateUsername(user *ipa.User) error {
 		}
 	}
 
-	if !usernameRegx.MatchString(user.Username) {
-		return fmt.Errorf("%w: %s", ErrInvalidUsername, user.Username)
-	}
-
-	if valid.IsNumeric(user.Username) {
-		return errors.New("Username must include at least one letter")
-	}
-
-	if isBlocked(user.Username) {
-		return errors.New("Username not allowed. Please try different username or contact the administrator")
+	if err := checkUsername(user.Username); err != nil {
+		return err
 	}
 
 	user.Username = strings.ToLower(user.Username)
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,6 +14,10 @@ func TestUsernameFromEmail(t *testing.T) {
 	allowedDomains := map[string]string{
 		"example.edu": "default",
 		"example.com": "flast",
+		"example.org": "firstlast",
+		"example.net": "first.last",
+		"example.gov": "lastf",
+		"example.io":  "{{first|lower|trunc 1}}{{last|lower|trunc 7}}",
 	}
 
 	type testUsername struct {
@@ -29,6 +34,12 @@ func TestUsernameFromEmail(t *testing.T) {
 		testUsername{"user+test@example.edu", "usertest"},
 		testUsername{"first.last@example.com", "flast"},
 		testUsername{".last@example.com", "last"},
+		testUsername{"user@example.com", "user"},
+		testUsername{"first.last@example.org", "firstlast"},
+		testUsername{"first.last@example.net", "first.last"},
+		testUsername{"first.last@example.gov", "lastf"},
+		testUsername{"John.Richardson@example.io", "jrichard"},
+		testUsername{"j.doe@example.io", "jdoe"},
 	}
 
 	for _, utest := range goodTests {
@@ -42,6 +53,7 @@ func TestUsernameFromEmail(t *testing.T) {
 	badTests := []testUsername{
 		testUsername{"user@invalidemail.edu", ""},
 		testUsername{"@example.edu", ""},
+		testUsername{"@example.io", ""},
 	}
 
 	for _, utest := range badTests {
@@ -51,3 +63,97 @@ func TestUsernameFromEmail(t *testing.T) {
 	}
 
 }
+
+func TestSuggestUsernames(t *testing.T) {
+	assert := assert.New(t)
+
+	taken := map[string]bool{
+		"jdoe":  true,
+		"jdoe1": true,
+	}
+	exists := func(username string) bool {
+		return taken[username]
+	}
+
+	user := &ipa.User{Username: "jdoe", First: "John", Last: "Doe", Email: "johnny@example.edu"}
+	suggestions := suggestUsernames(user, exists, 5)
+	assert.Equal([]string{"john.doe", "johndoe", "doej", "johnny", "jdoe2"}, suggestions)
+
+	for _, s := range suggestions {
+		assert.False(taken[s])
+	}
+
+	user = &ipa.User{Username: "JDoe"}
+	assert.Equal([]string{"jdoe2", "jdoe3"}, suggestUsernames(user, exists, 2))
+}
+
+func TestUsernameGenerators(t *testing.T) {
+	assert := assert.New(t)
+
+	user := &ipa.User{Email: "jsmith@example.edu", First: "Jane", Last: "Smith-Jones"}
+
+	tests := map[string]string{
+		"default":    "jsmith",
+		"flast":      "JSmith-Jones",
+		"firstlast":  "JaneSmith-Jones",
+		"first.last": "Jane.Smith-Jones",
+		"lastf":      "Smith-JonesJ",
+		"{{last|lower|trunc 5}}{{first|upper|trunc 2}}": "smithJA",
+		"{{local}}-{{domain}}":                          "jsmith-example.edu",
+	}
+
+	for name, result := range tests {
+		username, err := generateUsername(user, name)
+		if assert.NoError(err, name) {
+			assert.Equal(result, username, name)
+		}
+	}
+
+	_, err := generateUsername(user, "unknown")
+	assert.Error(err)
+
+	assert.NoError(validateUsernameGenerators(map[string]string{"example.edu": "lastf"}))
+	assert.Error(validateUsernameGenerators(map[string]string{"example.edu": "bogus"}))
+	assert.Error(validateUsernameGenerators(map[string]string{"example.edu": "{{first"}))
+
+	RegisterUsernameGenerator("upper", func(p *UsernameParts) (string, error) {
+		return strings.ToUpper(p.Local), nil
+	})
+	username, err := generateUsername(user, "upper")
+	if assert.NoError(err) {
+		assert.Equal("JSMITH", username)
+	}
+}
+
+func TestUniqueUsername(t *testing.T) {
+	assert := assert.New(t)
+
+	taken := map[string]bool{
+		"jdoe":                             true,
+		"jdoe1":                            true,
+		"jdoe2":                            true,
+		"abcdefghijklmnopqrstuvwxyz012345": true,
+	}
+	exists := func(username string) bool {
+		return taken[username]
+	}
+
+	username, err := uniqueUsername("jsmith", exists)
+	if assert.NoError(err) {
+		assert.Equal("jsmith", username)
+	}
+
+	username, err = uniqueUsername("jdoe", exists)
+	if assert.NoError(err) {
+		assert.Equal("jdoe3", username)
+	}
+
+	// Suffix must not exceed max username length
+	username, err = uniqueUsername("abcdefghijklmnopqrstuvwxyz012345", exists)
+	if assert.NoError(err) {
+		assert.Equal("abcdefghijklmnopqrstuvwxyz012341", username)
+	}
+
+	_, err = uniqueUsername("jdoe", func(string) bool { return true })
+	assert.Error(err)
+}
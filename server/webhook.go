@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Webhook event types
+const (
+	EventAccountCreated         = "account.created"
+	EventAccountVerified        = "account.verified"
+	EventAccountDeleted         = "account.deleted"
+	EventEmailChanged           = "account.email_changed"
+	EventLogin                  = "login.succeeded"
+	EventPasswordChanged        = "password.changed"
+	EventPasswordResetRequested = "password.reset_requested"
+	EventPasswordReset          = "password.reset"
+	EventMFAEnabled             = "mfa.enabled"
+	EventMFADisabled            = "mfa.disabled"
+	EventOTPTokenAdded          = "otptoken.added"
+	EventOTPTokenRemoved        = "otptoken.removed"
+	EventSSHKeyAdded            = "sshkey.added"
+	EventSSHKeyRemoved          = "sshkey.removed"
+	EventSSHCertIssued          = "sshcert.issued"
+	EventPGPKeyAdded            = "pgpkey.added"
+	EventPGPKeyRemoved          = "pgpkey.removed"
+	EventAccountLockdown        = "account.lockdown"
+
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the request
+	// body keyed with the endpoint secret, prefixed with "sha256="
+	WebhookSignatureHeader = "X-Mokey-Signature"
+	WebhookEventHeader     = "X-Mokey-Event"
+	WebhookDeliveryHeader  = "X-Mokey-Delivery"
+)
+
+// WebhookEndpoint is a URL that receives webhook events. Events is a list of
+// event types or patterns such as "sshkey.*". An empty list receives all
+// events.
+type WebhookEndpoint struct {
+	URL        string   `mapstructure:"url"`
+	Secret     string   `mapstructure:"secret"`
+	SecretFile string   `mapstructure:"secret_file"`
+	Events     []string `mapstructure:"events"`
+}
+
+// Matches returns true if the endpoint subscribes to event
+func (e *WebhookEndpoint) Matches(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+
+	for _, pattern := range e.Events {
+		if ok, _ := path.Match(pattern, event); ok || pattern == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookEvent is the JSON payload posted to webhook endpoints
+type WebhookEvent struct {
+	ID        string                 `json:"id"`
+	Event     string                 `json:"event"`
+	Timestamp time.Time              `json:"timestamp"`
+	Username  string                 `json:"username"`
+	IP        string                 `json:"ip,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type webhookDelivery struct {
+	endpoint *WebhookEndpoint
+	event    *WebhookEvent
+	body     []byte
+	attempts int
+	delay    time.Duration
+}
+
+// Webhooks posts account lifecycle events to the configured endpoints.
+// Events are delivered asynchronously by worker goroutines. Failed deliveries
+// are put back on the queue after an exponential backoff delay so an
+// unreachable endpoint does not hold up the workers. A nil *Webhooks discards
+// all events.
+type Webhooks struct {
+	Workers       int
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	endpoints []*WebhookEndpoint
+	client    *http.Client
+	metrics   *Metrics
+	queue     chan *webhookDelivery
+	wg        sync.WaitGroup
+	pending   sync.WaitGroup
+}
+
+// NewWebhooks returns a webhook dispatcher for the webhooks.endpoints config.
+// Returns nil if no endpoints are configured.
+func NewWebhooks() (*Webhooks, error) {
+	var endpoints []*WebhookEndpoint
+	if err := viper.UnmarshalKey("webhooks.endpoints", &endpoints); err != nil {
+		return nil, fmt.Errorf("Invalid config value for webhooks.endpoints: %w", err)
+	}
+
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+
+	for _, e := range endpoints {
+		if e.URL == "" {
+			return nil, errors.New("Please set the url for all webhooks.endpoints")
+		}
+
+		if e.Secret == "" && e.SecretFile != "" {
+			data, err := os.ReadFile(e.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read webhook secret_file: %w", err)
+			}
+			e.Secret = strings.TrimSpace(string(data))
+		}
+
+		if e.Secret == "" {
+			return nil, fmt.Errorf("Please set a secret for webhook endpoint %s", e.URL)
+		}
+	}
+
+	return &Webhooks{
+		Workers:       viper.GetInt("webhooks.workers"),
+		MaxAttempts:   viper.GetInt("webhooks.max_attempts"),
+		RetryDelay:    time.Duration(viper.GetInt("webhooks.retry_delay")) * time.Second,
+		MaxRetryDelay: time.Duration(viper.GetInt("webhooks.max_retry_delay")) * time.Second,
+		endpoints:     endpoints,
+		client:        &http.Client{Timeout: time.Duration(viper.GetInt("webhooks.timeout")) * time.Second},
+		queue:         make(chan *webhookDelivery, viper.GetInt("webhooks.queue_size")),
+	}, nil
+}
+
+// Emit queues event for delivery to all endpoints subscribed to it. Emit
+// never blocks; events are dropped if the queue is full.
+func (w *Webhooks) Emit(event, username, ip string, data map[string]interface{}) {
+	if w == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.WithFields(log.Fields{
+			"event": event,
+			"err":   err,
+		}).Error("Failed to generate webhook event id")
+		return
+	}
+
+	payload := &WebhookEvent{
+		ID:        hex.EncodeToString(id),
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Username:  username,
+		IP:        ip,
+		Data:      data,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event": event,
+			"err":   err,
+		}).Error("Failed to encode webhook event")
+		return
+	}
+
+	for _, e := range w.endpoints {
+		if !e.Matches(event) {
+			continue
+		}
+
+		w.pending.Add(1)
+		select {
+		case w.queue <- &webhookDelivery{endpoint: e, event: payload, body: body}:
+		default:
+			w.pending.Done()
+			if w.metrics != nil {
+				w.metrics.totalWebhookFailures.Inc()
+			}
+			log.WithFields(log.Fields{
+				"event": event,
+				"id":    payload.ID,
+				"url":   e.URL,
+			}).Error("Webhook queue is full, dropping event")
+		}
+	}
+}
+
+// Start runs the delivery workers until stop is closed
+func (w *Webhooks) Start(stop <-chan struct{}) {
+	workers := w.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case d := <-w.queue:
+					w.deliver(d, stop)
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until all workers have stopped
+func (w *Webhooks) Wait() {
+	w.wg.Wait()
+}
+
+// Flush waits up to timeout for all emitted events to be delivered or given
+// up on. Returns false on timeout. Used by commands that exit after emitting
+// events.
+func (w *Webhooks) Flush(timeout time.Duration) bool {
+	if w == nil {
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// deliver posts the event to the endpoint. Failed deliveries are scheduled
+// for retry with exponential backoff until MaxAttempts is reached or stop is
+// closed.
+func (w *Webhooks) deliver(d *webhookDelivery, stop <-chan struct{}) {
+	d.attempts++
+	err := w.post(d)
+	if err == nil {
+		log.WithFields(log.Fields{
+			"event":    d.event.Event,
+			"id":       d.event.ID,
+			"url":      d.endpoint.URL,
+			"attempts": d.attempts,
+		}).Debug("Delivered webhook")
+		w.pending.Done()
+		return
+	}
+
+	if w.metrics != nil {
+		w.metrics.totalWebhookFailures.Inc()
+	}
+
+	if w.MaxAttempts > 0 && d.attempts >= w.MaxAttempts {
+		log.WithFields(log.Fields{
+			"event":    d.event.Event,
+			"id":       d.event.ID,
+			"url":      d.endpoint.URL,
+			"attempts": d.attempts,
+			"err":      err,
+		}).Error("Failed to deliver webhook, giving up")
+		w.pending.Done()
+		return
+	}
+
+	if d.delay == 0 {
+		d.delay = w.RetryDelay
+	} else {
+		d.delay *= 2
+	}
+	if w.MaxRetryDelay > 0 && d.delay > w.MaxRetryDelay {
+		d.delay = w.MaxRetryDelay
+	}
+
+	log.WithFields(log.Fields{
+		"event":    d.event.Event,
+		"id":       d.event.ID,
+		"url":      d.endpoint.URL,
+		"attempts": d.attempts,
+		"retry_in": d.delay,
+		"err":      err,
+	}).Warn("Failed to deliver webhook, will retry")
+
+	w.retry(d, stop)
+}
+
+// retry puts d back on the queue after its backoff delay
+func (w *Webhooks) retry(d *webhookDelivery, stop <-chan struct{}) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		timer := time.NewTimer(d.delay)
+		defer timer.Stop()
+
+		select {
+		case <-stop:
+			w.pending.Done()
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-stop:
+			w.pending.Done()
+		case w.queue <- d:
+		default:
+			w.pending.Done()
+			if w.metrics != nil {
+				w.metrics.totalWebhookFailures.Inc()
+			}
+			log.WithFields(log.Fields{
+				"event": d.event.Event,
+				"id":    d.event.ID,
+				"url":   d.endpoint.URL,
+			}).Error("Webhook queue is full, dropping retry")
+		}
+	}()
+}
+
+func (w *Webhooks) post(d *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.endpoint.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mokey-webhook")
+	req.Header.Set(WebhookEventHeader, d.event.Event)
+	req.Header.Set(WebhookDeliveryHeader, d.event.ID)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(d.endpoint.Secret, d.body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook endpoint returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of body keyed with
+// secret. Receivers should compare it to the X-Mokey-Signature header using a
+// constant time comparison.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	body, _ := io.ReadAll(req.Body)
+	h.requests = append(h.requests, req)
+	h.bodies = append(h.bodies, body)
+
+	if h.fail > 0 {
+		h.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	h.received <- struct{}{}
+}
+
+func newTestWebhooks(t *testing.T, endpoints []map[string]interface{}) *Webhooks {
+	SetDefaults()
+	viper.Set("webhooks.endpoints", endpoints)
+	t.Cleanup(func() { viper.Set("webhooks.endpoints", nil) })
+
+	w, err := NewWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func TestWebhookEndpointMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &WebhookEndpoint{}
+	assert.True(e.Matches(EventLogin))
+
+	e.Events = []string{"sshkey.*", EventMFAEnabled}
+	assert.True(e.Matches(EventSSHKeyAdded))
+	assert.True(e.Matches(EventSSHKeyRemoved))
+	assert.True(e.Matches(EventMFAEnabled))
+	assert.False(e.Matches(EventMFADisabled))
+	assert.False(e.Matches(EventSSHCertIssued))
+}
+
+func TestWebhooksConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newTestWebhooks(t, nil))
+
+	viper.Set("webhooks.endpoints", []map[string]interface{}{{"url": "https://hooks.example.com"}})
+	_, err := NewWebhooks()
+	assert.Error(err)
+
+	viper.Set("webhooks.endpoints", []map[string]interface{}{{"secret": "s3cret"}})
+	_, err = NewWebhooks()
+	assert.Error(err)
+	viper.Set("webhooks.endpoints", nil)
+}
+
+func TestWebhooksDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &webhookReceiver{fail: 2, received: make(chan struct{}, 10)}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	w := newTestWebhooks(t, []map[string]interface{}{
+		{"url": ts.URL, "secret": "s3cret", "events": []string{"password.*"}},
+	})
+	w.RetryDelay = time.Millisecond
+
+	stop := make(chan struct{})
+	w.Start(stop)
+	defer func() {
+		close(stop)
+		w.Wait()
+	}()
+
+	// Not subscribed
+	w.Emit(EventSSHKeyAdded, "jdoe", "10.0.0.1", nil)
+	w.Emit(EventPasswordChanged, "jdoe", "10.0.0.1", map[string]interface{}{"method": "change"})
+
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	// Two failed attempts then success
+	if !assert.Len(receiver.requests, 3) {
+		return
+	}
+
+	req := receiver.requests[2]
+	body := receiver.bodies[2]
+	assert.Equal("application/json", req.Header.Get("Content-Type"))
+	assert.Equal(EventPasswordChanged, req.Header.Get(WebhookEventHeader))
+	assert.Equal("sha256="+WebhookSignature("s3cret", body), req.Header.Get(WebhookSignatureHeader))
+	assert.Equal(receiver.requests[0].Header.Get(WebhookDeliveryHeader), req.Header.Get(WebhookDeliveryHeader))
+
+	var event WebhookEvent
+	if assert.NoError(json.Unmarshal(body, &event)) {
+		assert.Equal(EventPasswordChanged, event.Event)
+		assert.Equal("jdoe", event.Username)
+		assert.Equal("10.0.0.1", event.IP)
+		assert.Equal("change", event.Data["method"])
+		assert.Equal(req.Header.Get(WebhookDeliveryHeader), event.ID)
+	}
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	receiver := &webhookReceiver{fail: 100, received: make(chan struct{}, 10)}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	w := newTestWebhooks(t, []map[string]interface{}{
+		{"url": ts.URL, "secret": "s3cret"},
+	})
+	w.RetryDelay = time.Millisecond
+	w.MaxAttempts = 3
+
+	stop := make(chan struct{})
+	w.Start(stop)
+
+	w.Emit(EventLogin, "jdoe", "", nil)
+
+	requests := func() int {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.requests)
+	}
+
+	assert.Eventually(t, func() bool { return requests() == 3 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3, requests())
+
+	close(stop)
+	w.Wait()
+}
+
+func TestWebhooksRetryDoesNotBlock(t *testing.T) {
+	down := &webhookReceiver{fail: 100, received: make(chan struct{}, 10)}
+	tsDown := httptest.NewServer(down)
+	defer tsDown.Close()
+
+	up := &webhookReceiver{received: make(chan struct{}, 10)}
+	tsUp := httptest.NewServer(up)
+	defer tsUp.Close()
+
+	w := newTestWebhooks(t, []map[string]interface{}{
+		{"url": tsDown.URL, "secret": "s3cret"},
+		{"url": tsUp.URL, "secret": "s3cret"},
+	})
+	w.Workers = 1
+	w.RetryDelay = time.Hour
+
+	stop := make(chan struct{})
+	w.Start(stop)
+	defer func() {
+		close(stop)
+		w.Wait()
+	}()
+
+	// The failing endpoint waiting to retry does not hold up the worker
+	w.Emit(EventLogin, "jdoe", "", nil)
+	w.Emit(EventLogin, "mjones", "", nil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-up.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for webhook")
+		}
+	}
+}
+
+func TestWebhooksNil(t *testing.T) {
+	var w *Webhooks
+	assert.NotPanics(t, func() {
+		w.Emit(EventLogin, "jdoe", "", nil)
+	})
+}
+
+func TestWebhooksFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &webhookReceiver{fail: 1, received: make(chan struct{}, 10)}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	w := newTestWebhooks(t, []map[string]interface{}{
+		{"url": ts.URL, "secret": "s3cret"},
+	})
+	w.RetryDelay = time.Millisecond
+
+	stop := make(chan struct{})
+	w.Start(stop)
+	defer func() {
+		close(stop)
+		w.Wait()
+	}()
+
+	w.Emit(EventAccountDeleted, "jdoe", "", nil)
+	w.Emit(EventSSHKeyRemoved, "jdoe", "", nil)
+
+	// Waits for the retried delivery
+	assert.True(w.Flush(5 * time.Second))
+	assert.Len(receiver.received, 2)
+
+	// Nothing pending
+	assert.True(w.Flush(time.Millisecond))
+
+	var nilWebhooks *Webhooks
+	assert.True(nilWebhooks.Flush(time.Millisecond))
+}